@@ -80,6 +80,11 @@ type Frame struct {
 	Payload   []byte // 媒体数据载荷
 }
 
+// Size 帧载荷长度
+func (frame *Frame) Size() int {
+	return len(frame.Payload)
+}
+
 // FrameWriter 包装 WriteFrame 方法的接口
 type FrameWriter interface {
 	WriteFrame(frame *Frame) error
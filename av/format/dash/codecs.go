@@ -0,0 +1,75 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"fmt"
+	"math/bits"
+	"strings"
+
+	"github.com/cnotch/ipchub/av/codec"
+	"github.com/cnotch/ipchub/av/codec/aac"
+	"github.com/cnotch/ipchub/av/codec/hevc"
+)
+
+// 视频的 RFC 6381 codecs 参数
+func videoCodecs(video *codec.VideoMeta) string {
+	switch video.Codec {
+	case "H264":
+		if len(video.Sps) < 4 {
+			return "avc1"
+		}
+		// avc1.<profile_idc><constraint_flags><level_idc>
+		return fmt.Sprintf("avc1.%02X%02X%02X", video.Sps[1], video.Sps[2], video.Sps[3])
+	case "H265":
+		var sps hevc.H265RawSPS
+		if err := sps.Decode(video.Sps); err != nil {
+			return "hvc1"
+		}
+		return hevcCodecs(&sps.Profile_tier_level)
+	}
+	return ""
+}
+
+// ISO/IEC 14496-15 E.3:
+// hvc1.<profile_space><profile_idc>.<compatibility_flags>.<tier><level_idc>.<constraint_flags>
+func hevcCodecs(ptl *hevc.H265RawProfileTierLevel) string {
+	var b strings.Builder
+	b.WriteString("hvc1.")
+	if ptl.General_profile_space > 0 {
+		b.WriteByte('A' + ptl.General_profile_space - 1)
+	}
+	// 兼容标志按相反的位序输出
+	fmt.Fprintf(&b, "%d.%X.", ptl.General_profile_idc,
+		bits.Reverse32(ptl.GeneralProfileCompatibilityFlags))
+	tier := byte('L')
+	if ptl.General_tier_flag > 0 {
+		tier = 'H'
+	}
+	fmt.Fprintf(&b, "%c%d", tier, ptl.General_level_idc)
+
+	// 6 字节约束标志，省略末尾为 0 的字节
+	var constraints [6]byte
+	n := 0
+	for i := range constraints {
+		constraints[i] = byte(ptl.GeneralConstraintIndicatorFlags >> uint(40-8*i))
+		if constraints[i] != 0 {
+			n = i + 1
+		}
+	}
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, ".%X", constraints[i])
+	}
+	return b.String()
+}
+
+// 音频的 RFC 6381 codecs 参数
+func audioCodecs(audio *codec.AudioMeta) string {
+	var asc aac.AudioSpecificConfig
+	if err := asc.Decode(audio.Sps); err != nil || asc.ObjectType == 0 {
+		return "mp4a.40.2" // AAC-LC
+	}
+	return fmt.Sprintf("mp4a.40.%d", asc.ObjectType)
+}
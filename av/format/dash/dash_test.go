@@ -0,0 +1,112 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/cnotch/ipchub/av/codec"
+	"github.com/cnotch/ipchub/av/format/fmp4"
+	"github.com/cnotch/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func testMeta() (codec.VideoMeta, codec.AudioMeta) {
+	sps, _ := base64.StdEncoding.DecodeString("Z2QAH6zZQFAFuhAAAAMAEAAAAwPI8YMZYA==")
+	video := codec.VideoMeta{Codec: "H264", Width: 1280, Height: 720,
+		Sps: sps, Pps: []byte{0x68, 0xef, 0xbc, 0xb0}}
+	audio := codec.AudioMeta{Codec: "AAC", SampleRate: 44100, Channels: 2, Sps: []byte{0x12, 0x10}}
+	return video, audio
+}
+
+func TestCodecs(t *testing.T) {
+	video, audio := testMeta()
+	assert.Equal(t, "avc1.64001F", videoCodecs(&video))
+	assert.Equal(t, "mp4a.40.2", audioCodecs(&audio))
+
+	sps, _ := base64.StdEncoding.DecodeString("QgEBAWAAAAMAkAAAAwAAAwBdoAKAgC0WWVmkkyuAQAAA+kAAF3AC")
+	assert.Equal(t, "hvc1.1.6.L93.90", videoCodecs(&codec.VideoMeta{Codec: "H265", Sps: sps}))
+}
+
+func TestMpd(t *testing.T) {
+	video, audio := testMeta()
+	mpd := NewMpd("/live/test", &video, &audio)
+	sg := NewSegmentGenerator(mpd, 1, xlog.L())
+	defer mpd.Close()
+	defer sg.Close()
+
+	_, err := mpd.WaitMpd("", 10*time.Millisecond)
+	assert.Equal(t, ErrMpdTimeout, err)
+
+	assert.NoError(t, sg.WriteInitSegment(nil))
+	fragmentDuration := int64(time.Second / 2)
+	for i := 0; i < 11; i++ {
+		fragment := &fmp4.Fragment{
+			SequenceNumber: uint32(i + 1),
+			Independent:    i%2 == 0,
+			Dts:            int64(i) * fragmentDuration,
+			Duration:       fragmentDuration,
+			Video: &fmp4.TrackFragment{
+				TrackID:             fmp4.VideoTrackID,
+				BaseMediaDecodeTime: uint64(i * 45000),
+				Samples:             []fmp4.Sample{{Duration: 45000, Key: i%2 == 0, Data: []byte{byte(i)}}},
+			},
+		}
+		if i >= 4 { // 音频从第 3 个片段开始
+			fragment.Audio = &fmp4.TrackFragment{
+				TrackID:             fmp4.AudioTrackID,
+				BaseMediaDecodeTime: uint64(i * 22050),
+				Samples:             []fmp4.Sample{{Duration: 22050, Key: true, Data: []byte{0xaa}}},
+			}
+		}
+		assert.NoError(t, sg.WriteFragment(fragment))
+	}
+
+	// 已完成 5 个片段，保留最新的 3 个
+	cont, err := mpd.WaitMpd("abc", time.Second)
+	if !assert.NoError(t, err) {
+		return
+	}
+	s := string(cont)
+	assert.Contains(t, s, `type="dynamic"`)
+	assert.Contains(t, s, `timeShiftBufferDepth="PT3.000S"`)
+	assert.Contains(t, s, `<Representation id="video" codecs="avc1.64001F" width="1280" height="720"`)
+	assert.Contains(t, s, `<SegmentTemplate timescale="90000" initialization="/streams/live/test/init.m4v?token=abc" media="/streams/live/test/$Number$.m4v?token=abc" startNumber="3">`)
+	assert.Contains(t, s, `<S t="180000" d="90000"/>`)
+	assert.Contains(t, s, `<S t="360000" d="90000"/>`)
+	assert.NotContains(t, s, `<S t="90000" d="90000"/>`)
+	assert.Contains(t, s, `<Representation id="audio" codecs="mp4a.40.2" audioSamplingRate="44100"`)
+	assert.Contains(t, s, `<SegmentTemplate timescale="44100" initialization="/streams/live/test/init.m4a?token=abc" media="/streams/live/test/$Number$.m4a?token=abc" startNumber="3">`)
+	assert.Contains(t, s, `<S t="88200" d="44100"/>`)
+
+	// 片段
+	_, _, err = mpd.Segment(codec.MediaTypeVideo, 2)
+	assert.Error(t, err)
+	reader, _, err := mpd.Segment(codec.MediaTypeVideo, 5)
+	if assert.NoError(t, err) {
+		data, _ := ioutil.ReadAll(reader)
+		assert.Equal(t, byte(9), data[len(data)-1])
+	}
+	reader, _, err = mpd.Segment(codec.MediaTypeAudio, 5)
+	if assert.NoError(t, err) {
+		data, _ := ioutil.ReadAll(reader)
+		assert.Equal(t, byte(0xaa), data[len(data)-1])
+	}
+
+	// 初始化片段
+	_, size, err := mpd.InitSegment(codec.MediaTypeVideo)
+	assert.NoError(t, err)
+	assert.True(t, size > 0)
+	_, size, err = mpd.InitSegment(codec.MediaTypeAudio)
+	assert.NoError(t, err)
+	assert.True(t, size > 0)
+
+	mpd.Close()
+	_, err = mpd.WaitMpd("", time.Second)
+	assert.Equal(t, ErrMpdClosed, err)
+}
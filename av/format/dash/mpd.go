@@ -0,0 +1,295 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cnotch/ipchub/av/codec"
+)
+
+const dashRemainSegments = 3
+
+// 错误定义
+var (
+	// ErrMpdTimeout 等待 MPD 可用超时
+	ErrMpdTimeout = errors.New("wait for mpd timeout")
+	// ErrMpdClosed MPD 已关闭
+	ErrMpdClosed = errors.New("mpd is closed")
+)
+
+// 一个表示(Representation)在片段中的数据
+type track struct {
+	t    uint64 // 片段起始时间，单位为轨道的时间刻度
+	d    uint64 // 片段时长，单位为轨道的时间刻度
+	data []byte // moof+mdat 序列
+}
+
+// 视频和音频分别输出片段，二者使用相同的片段编号
+type segment struct {
+	number   int     // $Number$
+	duration float64 // 秒
+	video    track
+	audio    track // 没有音频时 data 为空
+}
+
+// Mpd the dynamic MPEG-DASH manifest and fmp4 segments.
+// 视频、音频分属不同的自适应集(AdaptationSet)，
+// 使用 SegmentTemplate+SegmentTimeline 的 $Number$ 寻址
+type Mpd struct {
+	path  string
+	video *codec.VideoMeta
+	audio *codec.AudioMeta
+
+	l                     sync.RWMutex
+	segments              []*segment
+	closed                bool
+	updated               chan struct{} // MPD 更新时关闭，用于等待 MPD 可用
+	availabilityStartTime time.Time
+	videoInit             []byte
+	audioInit             []byte
+
+	// last http access time
+	lastAccessTime int64
+}
+
+// NewMpd .
+func NewMpd(path string, video *codec.VideoMeta, audio *codec.AudioMeta) *Mpd {
+	return &Mpd{
+		path:           path,
+		video:          video,
+		audio:          audio,
+		updated:        make(chan struct{}),
+		lastAccessTime: time.Now().UnixNano(),
+	}
+}
+
+var mpdPool = sync.Pool{
+	New: func() interface{} {
+		return bytes.NewBuffer(make([]byte, 0, 2048))
+	},
+}
+
+// WaitMpd 阻塞直到 MPD 可用，然后获取 MPD
+func (mpd *Mpd) WaitMpd(token string, timeout time.Duration) ([]byte, error) {
+	atomic.StoreInt64(&mpd.lastAccessTime, time.Now().UnixNano())
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		mpd.l.RLock()
+		if mpd.closed {
+			mpd.l.RUnlock()
+			return nil, ErrMpdClosed
+		}
+		if len(mpd.segments) >= dashRemainSegments {
+			cont := mpd.mpd(token)
+			mpd.l.RUnlock()
+			return cont, nil
+		}
+		updated := mpd.updated
+		mpd.l.RUnlock()
+
+		select {
+		case <-updated:
+		case <-deadline.C:
+			return nil, ErrMpdTimeout
+		}
+	}
+}
+
+func (mpd *Mpd) hasAudio() bool {
+	return mpd.audio != nil && mpd.audio.Codec == "AAC" && mpd.audio.SampleRate > 0
+}
+
+func (mpd *Mpd) mpd(token string) []byte {
+	w := mpdPool.Get().(*bytes.Buffer)
+	w.Reset()
+	defer mpdPool.Put(w)
+
+	segments := mpd.segments
+	var maxDuration, depth float64
+	for _, seg := range segments {
+		if seg.duration > maxDuration {
+			maxDuration = seg.duration
+		}
+		depth += seg.duration
+	}
+
+	// 描述部分
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" profiles="urn:mpeg:dash:profile:isoff-live:2011" type="dynamic"`+
+		` availabilityStartTime="%s" publishTime="%s" minimumUpdatePeriod="PT%.3fS" minBufferTime="PT%.3fS"`+
+		` timeShiftBufferDepth="PT%.3fS" suggestedPresentationDelay="PT%.3fS">
+  <Period id="0" start="PT0S">
+`,
+		formatTime(mpd.availabilityStartTime), formatTime(time.Now()),
+		segments[len(segments)-1].duration, maxDuration, depth, 2*maxDuration)
+
+	// 视频
+	fmt.Fprintf(w, `    <AdaptationSet id="0" contentType="video" mimeType="video/mp4" segmentAlignment="true" startWithSAP="1">
+      <Representation id="video" codecs="%s" width="%d" height="%d" bandwidth="%d">
+`,
+		videoCodecs(mpd.video), mpd.video.Width, mpd.video.Height,
+		bandwidth(segments, func(seg *segment) *track { return &seg.video }))
+	mpd.writeSegmentTemplate(w, "m4v", 90000, segments, token,
+		func(seg *segment) *track { return &seg.video })
+	fmt.Fprint(w, "      </Representation>\n    </AdaptationSet>\n")
+
+	// 音频，只包含最新的连续有音频数据的片段
+	i := len(segments)
+	for i > 0 && len(segments[i-1].audio.data) > 0 {
+		i--
+	}
+	if mpd.hasAudio() && i < len(segments) {
+		audioSegments := segments[i:]
+		fmt.Fprintf(w, `    <AdaptationSet id="1" contentType="audio" mimeType="audio/mp4" segmentAlignment="true" startWithSAP="1">
+      <Representation id="audio" codecs="%s" audioSamplingRate="%d" bandwidth="%d">
+        <AudioChannelConfiguration schemeIdUri="urn:mpeg:dash:23003:3:audio_channel_configuration:2011" value="%d"/>
+`,
+			audioCodecs(mpd.audio), mpd.audio.SampleRate,
+			bandwidth(audioSegments, func(seg *segment) *track { return &seg.audio }),
+			mpd.audio.Channels)
+		mpd.writeSegmentTemplate(w, "m4a", mpd.audio.SampleRate, audioSegments, token,
+			func(seg *segment) *track { return &seg.audio })
+		fmt.Fprint(w, "      </Representation>\n    </AdaptationSet>\n")
+	}
+
+	fmt.Fprint(w, "  </Period>\n</MPD>\n")
+	return append([]byte(nil), w.Bytes()...)
+}
+
+func (mpd *Mpd) writeSegmentTemplate(w io.Writer, ext string, timescale int,
+	segments []*segment, token string, trackOf func(*segment) *track) {
+	prefix := "/streams" + mpd.path + "/"
+	fmt.Fprintf(w, `        <SegmentTemplate timescale="%d" initialization="%s" media="%s" startNumber="%d">
+          <SegmentTimeline>
+`,
+		timescale, withToken(prefix+"init."+ext, token),
+		withToken(prefix+"$Number$."+ext, token), segments[0].number)
+	for _, seg := range segments {
+		t := trackOf(seg)
+		fmt.Fprintf(w, "            <S t=\"%d\" d=\"%d\"/>\n", t.t, t.d)
+	}
+	fmt.Fprint(w, "          </SegmentTimeline>\n        </SegmentTemplate>\n")
+}
+
+// 根据片段大小估算码率
+func bandwidth(segments []*segment, trackOf func(*segment) *track) int {
+	var size int
+	var duration float64
+	for _, seg := range segments {
+		size += len(trackOf(seg).data)
+		duration += seg.duration
+	}
+	if duration <= 0 {
+		return 0
+	}
+	return int(float64(size*8) / duration)
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+func withToken(uri string, token string) string {
+	if len(token) > 0 {
+		return uri + "?token=" + token
+	}
+	return uri
+}
+
+// InitSegment 获取视频或音频的初始化片段
+func (mpd *Mpd) InitSegment(mediaType codec.MediaType) (io.Reader, int, error) {
+	atomic.StoreInt64(&mpd.lastAccessTime, time.Now().UnixNano())
+	mpd.l.RLock()
+	defer mpd.l.RUnlock()
+
+	init := mpd.videoInit
+	if mediaType == codec.MediaTypeAudio {
+		init = mpd.audioInit
+	}
+	if len(init) == 0 {
+		return nil, 0, errors.New("Not found init segment")
+	}
+	return bytes.NewReader(init), len(init), nil
+}
+
+// Segment 获取编号为 number 的视频或音频片段
+func (mpd *Mpd) Segment(mediaType codec.MediaType, number int) (io.Reader, int, error) {
+	atomic.StoreInt64(&mpd.lastAccessTime, time.Now().UnixNano())
+	mpd.l.RLock()
+	defer mpd.l.RUnlock()
+
+	for _, seg := range mpd.segments {
+		if seg.number == number {
+			data := seg.video.data
+			if mediaType == codec.MediaTypeAudio {
+				data = seg.audio.data
+			}
+			if len(data) == 0 {
+				break
+			}
+			return bytes.NewReader(data), len(data), nil
+		}
+	}
+	return nil, 0, errors.New("Not found segment")
+}
+
+// LastAccessTime 最后dash访问时间
+func (mpd *Mpd) LastAccessTime() time.Time {
+	lastAccessTime := atomic.LoadInt64(&mpd.lastAccessTime)
+	return time.Unix(0, lastAccessTime)
+}
+
+// Close .
+func (mpd *Mpd) Close() error {
+	mpd.l.Lock()
+	defer mpd.l.Unlock()
+	mpd.segments = nil
+	mpd.closed = true
+	mpd.notify()
+	return nil
+}
+
+func (mpd *Mpd) setInitSegment(videoInit, audioInit []byte) {
+	mpd.l.Lock()
+	defer mpd.l.Unlock()
+	mpd.videoInit = videoInit
+	mpd.audioInit = audioInit
+}
+
+func (mpd *Mpd) setAvailabilityStartTime(t time.Time) {
+	mpd.l.Lock()
+	defer mpd.l.Unlock()
+	mpd.availabilityStartTime = t
+}
+
+func (mpd *Mpd) addSegment(seg *segment) {
+	mpd.l.Lock()
+	defer mpd.l.Unlock()
+	mpd.segments = append(mpd.segments, seg)
+	if len(mpd.segments) > dashRemainSegments {
+		n := len(mpd.segments) - dashRemainSegments
+		for i := 0; i < n; i++ {
+			mpd.segments[i] = nil
+		}
+		copy(mpd.segments, mpd.segments[n:])
+		mpd.segments = mpd.segments[:dashRemainSegments]
+	}
+	mpd.notify()
+}
+
+// 通知等待 MPD 可用的请求
+func (mpd *Mpd) notify() {
+	close(mpd.updated)
+	mpd.updated = make(chan struct{})
+}
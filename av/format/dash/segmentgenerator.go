@@ -0,0 +1,95 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"time"
+
+	"github.com/cnotch/ipchub/av/format/fmp4"
+	"github.com/cnotch/xlog"
+)
+
+// SegmentGenerator generate the MPEG-DASH segments from fmp4.Fragment.
+// 片段只在以关键帧开始的 fmp4.Fragment 处切分，
+// 视频和音频轨道分别输出各自的片段
+type SegmentGenerator struct {
+	mpd             *Mpd
+	segmentDuration int // 每个片段长度(秒)
+
+	number  int      // 片段编号
+	current *segment // current segment
+
+	logger *xlog.Logger
+}
+
+// NewSegmentGenerator .
+func NewSegmentGenerator(mpd *Mpd, segmentDuration int, logger *xlog.Logger) *SegmentGenerator {
+	return &SegmentGenerator{
+		mpd:             mpd,
+		segmentDuration: segmentDuration,
+		logger:          logger,
+	}
+}
+
+// WriteInitSegment implements fmp4.FragmentWriter
+// DASH 的视频和音频分属不同的自适应集，需要各自的初始化片段
+func (sg *SegmentGenerator) WriteInitSegment(init []byte) (err error) {
+	var videoInit, audioInit []byte
+	if videoInit, err = fmp4.MarshalInitSegment(sg.mpd.video, nil); err != nil {
+		return
+	}
+	if sg.mpd.hasAudio() {
+		if audioInit, err = fmp4.MarshalInitSegment(nil, sg.mpd.audio); err != nil {
+			return
+		}
+	}
+	sg.mpd.setInitSegment(videoInit, audioInit)
+	return
+}
+
+// WriteFragment implements fmp4.FragmentWriter
+func (sg *SegmentGenerator) WriteFragment(fragment *fmp4.Fragment) error {
+	if sg.current != nil && fragment.Independent &&
+		sg.current.duration >= float64(sg.segmentDuration) {
+		sg.mpd.addSegment(sg.current)
+		sg.current = nil
+	}
+
+	if sg.current == nil {
+		if !fragment.Independent {
+			return nil // 片段必须从关键帧开始
+		}
+		if sg.number == 0 {
+			// 片段的时间线从 availabilityStartTime 开始
+			sg.mpd.setAvailabilityStartTime(time.Now().Add(-time.Duration(fragment.Dts)))
+		}
+		sg.number++
+		sg.current = &segment{
+			number: sg.number,
+			video:  track{t: fragment.Video.BaseMediaDecodeTime},
+		}
+	}
+
+	curr := sg.current
+	curr.video.data = append(curr.video.data,
+		fmp4.MarshalFragment(fragment.SequenceNumber, fragment.Video)...)
+	curr.video.d += fragment.Video.Duration()
+	if fragment.Audio != nil && sg.mpd.hasAudio() {
+		if len(curr.audio.data) == 0 {
+			curr.audio.t = fragment.Audio.BaseMediaDecodeTime
+		}
+		curr.audio.data = append(curr.audio.data,
+			fmp4.MarshalFragment(fragment.SequenceNumber, fragment.Audio)...)
+		curr.audio.d += fragment.Audio.Duration()
+	}
+	curr.duration += float64(fragment.Duration) / float64(time.Second)
+	return nil
+}
+
+// Close .
+func (sg *SegmentGenerator) Close() error {
+	sg.current = nil
+	return nil
+}
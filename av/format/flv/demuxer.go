@@ -0,0 +1,285 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package flv
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cnotch/ipchub/av/codec"
+	"github.com/cnotch/ipchub/av/codec/aac"
+	"github.com/cnotch/ipchub/av/codec/h264"
+	"github.com/cnotch/ipchub/av/codec/hevc"
+	"github.com/cnotch/ipchub/av/format/amf"
+)
+
+// Demuxer flv.Tag 解封装器，输出 codec.Frame(H264/H265[+AAC])
+//
+// 元数据从 onMetaData 和序列头中提取，并写入构造时传入的 videoMeta 和 audioMeta；
+// 视频 Tag 中的多个 NALU 会被拆分成多个 codec.Frame。
+// 与 Muxer 不同，Demuxer 在调用者的 routine 中同步处理。
+type Demuxer struct {
+	videoMeta *codec.VideoMeta
+	audioMeta *codec.AudioMeta
+	fw        codec.FrameWriter
+}
+
+var _ TagWriter = &Demuxer{}
+
+// NewDemuxer 创建 flv.Tag 解封装器
+func NewDemuxer(videoMeta *codec.VideoMeta, audioMeta *codec.AudioMeta, fw codec.FrameWriter) *Demuxer {
+	return &Demuxer{
+		videoMeta: videoMeta,
+		audioMeta: audioMeta,
+		fw:        fw,
+	}
+}
+
+// WriteFlvTag .
+func (demuxer *Demuxer) WriteFlvTag(tag *Tag) error {
+	switch tag.TagType {
+	case TagTypeVideo:
+		return demuxer.demuxVideo(tag)
+	case TagTypeAudio:
+		return demuxer.demuxAudio(tag)
+	case TagTypeAmf0Data:
+		return demuxer.demuxMetadata(tag)
+	}
+	return nil
+}
+
+// VideoMetadataIsReady 视频元数据是否已经就绪
+func (demuxer *Demuxer) VideoMetadataIsReady() bool {
+	switch demuxer.videoMeta.Codec {
+	case "H264":
+		return h264.MetadataIsReady(demuxer.videoMeta)
+	case "H265":
+		return hevc.MetadataIsReady(demuxer.videoMeta)
+	}
+	return false
+}
+
+// AudioMetadataIsReady 音频元数据是否已经就绪
+func (demuxer *Demuxer) AudioMetadataIsReady() bool {
+	if demuxer.audioMeta.Codec == "AAC" {
+		return aac.MetadataIsReady(demuxer.audioMeta)
+	}
+	return false
+}
+
+func (demuxer *Demuxer) demuxMetadata(tag *Tag) error {
+	data := tag.Data
+	var scriptData ScriptData
+	if err := scriptData.Unmarshal(data); err != nil {
+		return err
+	}
+
+	// RTMP 推流时格式为: @setDataFrame onMetaData EcmaArray
+	if scriptData.Name == ScriptSetDataFrame {
+		data = data[3+len(scriptData.Name):]
+		if err := scriptData.Unmarshal(data); err != nil {
+			return err
+		}
+	}
+
+	if scriptData.Name != ScriptOnMetaData {
+		return nil
+	}
+
+	switch v := scriptData.Value.(type) {
+	case amf.EcmaArray:
+		demuxer.applyMetadata(v)
+	case amf.Object:
+		demuxer.applyMetadata(v)
+	}
+	return nil
+}
+
+func (demuxer *Demuxer) applyMetadata(props []amf.ObjectProperty) {
+	number := func(name string) float64 {
+		if v, ok := amf.PropertyValue(props, name); ok {
+			if f, ok := v.(float64); ok {
+				return f
+			}
+		}
+		return 0
+	}
+
+	if demuxer.videoMeta.Codec == "" {
+		demuxer.videoMeta.Codec = CodecIDName(int32(number(MetaDataVideoCodecID)))
+	}
+	if demuxer.videoMeta.FrameRate == 0 {
+		demuxer.videoMeta.FrameRate = number(MetaDataFrameRate)
+	}
+	if demuxer.videoMeta.DataRate == 0 {
+		demuxer.videoMeta.DataRate = number(MetaDataVideoDataRate)
+	}
+	if demuxer.audioMeta.Codec == "" && int(number(MetaDataAudioCodecID)) == SoundFormatAAC {
+		demuxer.audioMeta.Codec = "AAC"
+	}
+	if demuxer.audioMeta.DataRate == 0 {
+		demuxer.audioMeta.DataRate = number(MetaDataAudioDateRate)
+	}
+}
+
+func (demuxer *Demuxer) demuxVideo(tag *Tag) error {
+	var videoData VideoData
+	if err := videoData.Unmarshal(tag.Data); err != nil {
+		return err
+	}
+
+	codecName := CodecIDName(int32(videoData.CodecID))
+	if codecName != "H264" && codecName != "H265" {
+		return fmt.Errorf("flv demuxer unsupport video codec type:%s", codecName)
+	}
+	meta := demuxer.videoMeta
+	if meta.Codec == "" {
+		meta.Codec = codecName
+	} else if meta.Codec != codecName {
+		return fmt.Errorf("flv demuxer: video codec changed from %s to %s", meta.Codec, codecName)
+	}
+
+	switch videoData.H2645PacketType {
+	case H2645PacketTypeSequenceHeader:
+		return demuxer.demuxVideoSequenceHeader(videoData.Body)
+	case H2645PacketTypeNALU:
+		break
+	default:
+		return nil
+	}
+
+	dts := int64(tag.Timestamp) * int64(time.Millisecond)
+	pts := dts + int64(videoData.CompositionTime)*int64(time.Millisecond)
+
+	// 跳过 FrameType,CodecID,H2645PacketType,CompositionTime
+	nalus := tag.Data[5:]
+	for len(nalus) >= 4 {
+		size := int(binary.BigEndian.Uint32(nalus))
+		nalus = nalus[4:]
+		if size > len(nalus) {
+			return errors.New("flv demuxer: insufficient nalu data")
+		}
+		nalu := nalus[:size]
+		nalus = nalus[size:]
+		if size == 0 {
+			continue
+		}
+
+		if !demuxer.acceptNalu(nalu) {
+			continue
+		}
+
+		frame := &codec.Frame{
+			MediaType: codec.MediaTypeVideo,
+			Dts:       dts,
+			Pts:       pts,
+			Payload:   nalu,
+		}
+		if err := demuxer.fw.WriteFrame(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 提取 nalu 中的参数集，并过滤掉 AUD 等无需转发的 nalu
+func (demuxer *Demuxer) acceptNalu(nalu []byte) bool {
+	meta := demuxer.videoMeta
+	if meta.Codec == "H264" {
+		switch nalu[0] & h264.NalTypeBitmask {
+		case h264.NalSps:
+			if len(meta.Sps) == 0 {
+				meta.Sps = nalu
+			}
+		case h264.NalPps:
+			if len(meta.Pps) == 0 {
+				meta.Pps = nalu
+			}
+		case h264.NalAud, h264.NalFillerData:
+			return false
+		}
+		return true
+	}
+
+	switch (nalu[0] >> 1) & 0x3f {
+	case hevc.NalVps:
+		if len(meta.Vps) == 0 {
+			meta.Vps = nalu
+		}
+	case hevc.NalSps:
+		if len(meta.Sps) == 0 {
+			meta.Sps = nalu
+		}
+	case hevc.NalPps:
+		if len(meta.Pps) == 0 {
+			meta.Pps = nalu
+		}
+	case hevc.NalAud:
+		return false
+	}
+	return true
+}
+
+func (demuxer *Demuxer) demuxVideoSequenceHeader(body []byte) error {
+	meta := demuxer.videoMeta
+	if meta.Codec == "H264" {
+		var record AVCDecoderConfigurationRecord
+		if err := record.Unmarshal(body); err != nil {
+			return err
+		}
+		meta.Sps = record.SPS
+		meta.Pps = record.PPS
+	} else {
+		var record HEVCDecoderConfigurationRecord
+		if err := record.Unmarshal(body); err != nil {
+			return err
+		}
+		meta.Vps = record.VPS
+		meta.Sps = record.SPS
+		meta.Pps = record.PPS
+	}
+
+	// 序列头变化，重新解析宽高等信息
+	meta.Width = 0
+	meta.Height = 0
+	demuxer.VideoMetadataIsReady()
+	return nil
+}
+
+func (demuxer *Demuxer) demuxAudio(tag *Tag) error {
+	var audioData AudioData
+	if err := audioData.Unmarshal(tag.Data); err != nil {
+		return err
+	}
+
+	// 仅支持 AAC，其他音频格式被忽略
+	if audioData.SoundFormat != SoundFormatAAC {
+		return nil
+	}
+
+	meta := demuxer.audioMeta
+	meta.Codec = "AAC"
+	if audioData.AACPacketType == AACPacketTypeSequenceHeader {
+		meta.Sps = audioData.Body
+		meta.SampleRate = 0
+		demuxer.AudioMetadataIsReady()
+		return nil
+	}
+
+	if len(audioData.Body) == 0 || !demuxer.AudioMetadataIsReady() {
+		return nil
+	}
+
+	pts := int64(tag.Timestamp) * int64(time.Millisecond)
+	frame := &codec.Frame{
+		MediaType: codec.MediaTypeAudio,
+		Dts:       pts,
+		Pts:       pts,
+		Payload:   audioData.Body,
+	}
+	return demuxer.fw.WriteFrame(frame)
+}
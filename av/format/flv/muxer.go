@@ -5,6 +5,7 @@
 package flv
 
 import (
+	"errors"
 	"fmt"
 	"runtime/debug"
 	"time"
@@ -48,16 +49,18 @@ func NewMuxer(videoMeta *codec.VideoMeta, audioMeta *codec.AudioMeta, tagWriter
 		audioMeta: audioMeta,
 		vp:        emptyPacketizer{},
 		ap:        emptyPacketizer{},
-		typeFlags: byte(TypeFlagsVideo),
 		tagWriter: tagWriter,
 		closed:    false,
 		logger:    logger,
 	}
 	switch videoMeta.Codec {
 	case "H264":
+		muxer.typeFlags |= TypeFlagsVideo
 		muxer.vp = NewH264Packetizer(videoMeta, tagWriter)
 	case "H265":
+		muxer.typeFlags |= TypeFlagsVideo
 		muxer.vp = NewH265Packetizer(videoMeta, tagWriter)
+	case "": // 只有音频
 	default:
 		return nil, fmt.Errorf("flv muxer unsupport video codec type:%s", videoMeta.Codec)
 	}
@@ -66,6 +69,9 @@ func NewMuxer(videoMeta *codec.VideoMeta, audioMeta *codec.AudioMeta, tagWriter
 		muxer.typeFlags |= TypeFlagsAudio
 		muxer.ap = NewAacPacketizer(audioMeta, tagWriter)
 	}
+	if muxer.typeFlags == 0 {
+		return nil, errors.New("flv muxer: no video or audio")
+	}
 
 	go muxer.process()
 	return muxer, nil
@@ -176,31 +182,33 @@ func (muxer *Muxer) muxMetadataTag() error {
 				Value: muxer.audioMeta.Channels > 1})
 	}
 
-	vcodecID := CodecIDAVC
-	if muxer.videoMeta.Codec == "H265" {
-		vcodecID = CodecIDHEVC
-	}
+	if muxer.typeFlags&TypeFlagsVideo > 0 {
+		vcodecID := CodecIDAVC
+		if muxer.videoMeta.Codec == "H265" {
+			vcodecID = CodecIDHEVC
+		}
 
-	properties = append(properties,
-		amf.ObjectProperty{
-			Name:  MetaDataVideoCodecID,
-			Value: vcodecID})
-	properties = append(properties,
-		amf.ObjectProperty{
-			Name:  MetaDataVideoDataRate,
-			Value: muxer.videoMeta.DataRate})
-	properties = append(properties,
-		amf.ObjectProperty{
-			Name:  MetaDataFrameRate,
-			Value: muxer.videoMeta.FrameRate})
-	properties = append(properties,
-		amf.ObjectProperty{
-			Name:  MetaDataWidth,
-			Value: muxer.videoMeta.Width})
-	properties = append(properties,
-		amf.ObjectProperty{
-			Name:  MetaDataHeight,
-			Value: muxer.videoMeta.Height})
+		properties = append(properties,
+			amf.ObjectProperty{
+				Name:  MetaDataVideoCodecID,
+				Value: vcodecID})
+		properties = append(properties,
+			amf.ObjectProperty{
+				Name:  MetaDataVideoDataRate,
+				Value: muxer.videoMeta.DataRate})
+		properties = append(properties,
+			amf.ObjectProperty{
+				Name:  MetaDataFrameRate,
+				Value: muxer.videoMeta.FrameRate})
+		properties = append(properties,
+			amf.ObjectProperty{
+				Name:  MetaDataWidth,
+				Value: muxer.videoMeta.Width})
+		properties = append(properties,
+			amf.ObjectProperty{
+				Name:  MetaDataHeight,
+				Value: muxer.videoMeta.Height})
+	}
 
 	scriptData := ScriptData{
 		Name:  ScriptOnMetaData,
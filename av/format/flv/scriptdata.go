@@ -12,7 +12,8 @@ import (
 
 // 数据名称常量，如元数据
 const (
-	ScriptOnMetaData = "onMetaData"
+	ScriptOnMetaData   = "onMetaData"
+	ScriptSetDataFrame = "@setDataFrame"
 )
 
 // MetaData 常见属性名
@@ -0,0 +1,67 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fmp4
+
+import (
+	"encoding/binary"
+)
+
+// boxWriter ISO BMFF box 序列化辅助
+type boxWriter struct {
+	buf []byte
+}
+
+// startBox 写入 box 头，返回 box 起始位置，用于 endBox 回填 size
+func (w *boxWriter) startBox(boxType string) int {
+	offset := len(w.buf)
+	w.buf = append(w.buf, 0, 0, 0, 0, boxType[0], boxType[1], boxType[2], boxType[3])
+	return offset
+}
+
+// startFullBox 写入 FullBox 头
+func (w *boxWriter) startFullBox(boxType string, version byte, flags uint32) int {
+	offset := w.startBox(boxType)
+	w.u32(uint32(version)<<24 | flags&0xffffff)
+	return offset
+}
+
+// endBox 回填 box 的 size
+func (w *boxWriter) endBox(offset int) {
+	binary.BigEndian.PutUint32(w.buf[offset:], uint32(len(w.buf)-offset))
+}
+
+func (w *boxWriter) u8(v byte) {
+	w.buf = append(w.buf, v)
+}
+
+func (w *boxWriter) u16(v uint16) {
+	w.buf = append(w.buf, byte(v>>8), byte(v))
+}
+
+func (w *boxWriter) u32(v uint32) {
+	w.buf = append(w.buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (w *boxWriter) u64(v uint64) {
+	w.u32(uint32(v >> 32))
+	w.u32(uint32(v))
+}
+
+func (w *boxWriter) bytes(p []byte) {
+	w.buf = append(w.buf, p...)
+}
+
+func (w *boxWriter) zeros(n int) {
+	for i := 0; i < n; i++ {
+		w.buf = append(w.buf, 0)
+	}
+}
+
+// matrix 单位变换矩阵
+func (w *boxWriter) matrix() {
+	for _, v := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		w.u32(v)
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fmp4
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/cnotch/ipchub/av/codec"
+	"github.com/cnotch/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+// 容器 box 的子 box 起始偏移
+var containerOffsets = map[string]int{
+	"moov": 8, "trak": 8, "mdia": 8, "minf": 8, "stbl": 8, "mvex": 8,
+	"moof": 8, "traf": 8, "stsd": 16, "avc1": 86, "hvc1": 86, "mp4a": 36,
+}
+
+// findBox 按路径查找 box，返回 box 的全部数据
+func findBox(data []byte, path ...string) []byte {
+	for len(data) >= 8 {
+		size := int(binary.BigEndian.Uint32(data))
+		if size < 8 || size > len(data) {
+			return nil
+		}
+		if string(data[4:8]) == path[0] {
+			box := data[:size]
+			if len(path) == 1 {
+				return box
+			}
+			return findBox(box[containerOffsets[path[0]]:], path[1:]...)
+		}
+		data = data[size:]
+	}
+	return nil
+}
+
+func testMeta() (codec.VideoMeta, codec.AudioMeta) {
+	sps, _ := base64.StdEncoding.DecodeString("Z2QAH6zZQFAFuhAAAAMAEAAAAwPI8YMZYA==")
+	video := codec.VideoMeta{Codec: "H264", Sps: sps, Pps: []byte{0x68, 0xef, 0xbc, 0xb0}}
+	audio := codec.AudioMeta{Codec: "AAC", SampleRate: 44100, Channels: 2, Sps: []byte{0x12, 0x10}}
+	return video, audio
+}
+
+func TestMarshalInitSegment(t *testing.T) {
+	video, audio := testMeta()
+	video.Width, video.Height = 1280, 720
+	init, err := MarshalInitSegment(&video, &audio)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NotNil(t, findBox(init, "ftyp"))
+	avcC := findBox(init, "moov", "trak", "mdia", "minf", "stbl", "stsd", "avc1", "avcC")
+	if assert.NotNil(t, avcC) {
+		assert.Equal(t, byte(1), avcC[8])      // configurationVersion
+		assert.Equal(t, video.Sps[1], avcC[9]) // AVCProfileIndication
+	}
+	assert.NotNil(t, findBox(init, "moov", "mvex", "trex"))
+
+	// 第二个 trak 是音频
+	moov := findBox(init, "moov")
+	trak := findBox(moov[8:], "trak")
+	esds := findBox(moov[bytes.Index(moov, trak)+len(trak):], "trak", "mdia", "minf", "stbl", "stsd", "mp4a", "esds")
+	if assert.NotNil(t, esds) {
+		assert.Equal(t, audio.Sps, esds[len(esds)-3-len(audio.Sps):len(esds)-3])
+	}
+
+	_, err = MarshalInitSegment(&codec.VideoMeta{Codec: "VP8"}, &audio)
+	assert.Error(t, err)
+
+	// 只包含音频轨道
+	init, err = MarshalInitSegment(nil, &audio)
+	if assert.NoError(t, err) {
+		assert.NotNil(t, findBox(init, "moov", "trak", "mdia", "minf", "stbl", "stsd", "mp4a", "esds"))
+		assert.Nil(t, findBox(init, "moov", "trak", "mdia", "minf", "stbl", "stsd", "avc1"))
+	}
+	_, err = MarshalInitSegment(nil, &codec.AudioMeta{Codec: "G711"})
+	assert.Error(t, err)
+}
+
+func TestMarshalFragment(t *testing.T) {
+	video := &TrackFragment{
+		TrackID:             VideoTrackID,
+		BaseMediaDecodeTime: 9000,
+		Samples: []Sample{
+			{Duration: 3600, Key: true, Data: []byte{0, 0, 0, 2, 0x65, 1}},
+			{Duration: 3600, CompositionTimeOffset: -3600, Data: []byte{0, 0, 0, 1, 0x41}},
+		},
+	}
+	audio := &TrackFragment{
+		TrackID: AudioTrackID,
+		Samples: []Sample{{Duration: 1024, Key: true, Data: []byte{0xaa, 0xbb}}},
+	}
+
+	data := MarshalFragment(3, video, audio)
+	mfhd := findBox(data, "moof", "mfhd")
+	if assert.NotNil(t, mfhd) {
+		assert.Equal(t, uint32(3), binary.BigEndian.Uint32(mfhd[12:]))
+	}
+	tfdt := findBox(data, "moof", "traf", "tfdt")
+	if assert.NotNil(t, tfdt) {
+		assert.Equal(t, uint64(9000), binary.BigEndian.Uint64(tfdt[12:]))
+	}
+
+	// data_offset 指向 mdat 中的样本数据
+	moof := findBox(data, "moof")
+	traf := findBox(moof[8:], "traf")
+	videoTrun := findBox(traf[8:], "trun")
+	audioTrun := findBox(moof[bytes.Index(moof, traf)+len(traf):], "traf", "trun")
+	if assert.NotNil(t, videoTrun) && assert.NotNil(t, audioTrun) {
+		offset := binary.BigEndian.Uint32(videoTrun[16:])
+		assert.Equal(t, video.Samples[0].Data, data[offset:offset+6])
+		assert.Equal(t, int32(-3600), int32(binary.BigEndian.Uint32(videoTrun[20+16+12:])))
+		offset = binary.BigEndian.Uint32(audioTrun[16:])
+		assert.Equal(t, audio.Samples[0].Data, data[offset:offset+2])
+	}
+}
+
+type fragmentWriter struct {
+	init      []byte
+	fragments []*Fragment
+}
+
+func (w *fragmentWriter) WriteInitSegment(init []byte) error {
+	w.init = init
+	return nil
+}
+
+func (w *fragmentWriter) WriteFragment(fragment *Fragment) error {
+	w.fragments = append(w.fragments, fragment)
+	return nil
+}
+
+func TestMuxer(t *testing.T) {
+	video, audio := testMeta()
+	w := &fragmentWriter{}
+	muxer := &Muxer{
+		logger:   xlog.L(),
+		video:    &video,
+		audio:    &audio,
+		hasAudio: true,
+		fw:       w,
+	}
+
+	frameDuration := int64(time.Second) / 25
+	frames := []*codec.Frame{
+		{MediaType: codec.MediaTypeVideo, Payload: []byte{0x41, 1}}, // 第一个关键帧之前，丢弃
+		{MediaType: codec.MediaTypeVideo, Dts: frameDuration, Payload: video.Sps},
+		{MediaType: codec.MediaTypeVideo, Dts: frameDuration, Payload: video.Pps},
+		{MediaType: codec.MediaTypeVideo, Dts: frameDuration, Payload: []byte{0x65, 1}},
+		{MediaType: codec.MediaTypeAudio, Dts: frameDuration, Payload: []byte{0xaa}},
+		{MediaType: codec.MediaTypeVideo, Dts: 2 * frameDuration, Payload: []byte{0x41, 2}},
+		{MediaType: codec.MediaTypeVideo, Dts: 3 * frameDuration, Payload: []byte{0x65, 3}},
+		{MediaType: codec.MediaTypeVideo, Dts: 4 * frameDuration, Payload: []byte{0x41, 4}},
+	}
+	for _, frame := range frames {
+		var err error
+		if frame.MediaType == codec.MediaTypeVideo {
+			err = muxer.muxVideo(frame)
+		} else {
+			err = muxer.muxAudio(frame)
+		}
+		assert.NoError(t, err)
+	}
+
+	assert.NotNil(t, findBox(w.init, "moov"))
+	if !assert.Len(t, w.fragments, 1) {
+		return
+	}
+	fragment := w.fragments[0]
+	assert.Equal(t, frameDuration, fragment.Dts)
+	assert.Equal(t, 2*frameDuration, fragment.Duration)
+
+	trun := findBox(fragment.Data, "moof", "traf", "trun")
+	if assert.NotNil(t, trun) {
+		assert.Equal(t, uint32(2), binary.BigEndian.Uint32(trun[12:])) // sample_count
+		assert.Equal(t, uint32(3600), binary.BigEndian.Uint32(trun[20:]))
+		assert.Equal(t, uint32(sampleFlagsSync), binary.BigEndian.Uint32(trun[28:]))
+	}
+	mdat := findBox(fragment.Data, "mdat")
+	assert.Equal(t, []byte{0, 0, 0, 2, 0x65, 1, 0, 0, 0, 2, 0x41, 2, 0xaa}, mdat[8:])
+}
+
+func TestMuxerFragmentDuration(t *testing.T) {
+	video, audio := testMeta()
+	w := &fragmentWriter{}
+	frameDuration := int64(time.Second) / 25
+	muxer := &Muxer{
+		logger:           xlog.L(),
+		video:            &video,
+		audio:            &audio,
+		fw:               w,
+		fragmentDuration: 2 * frameDuration,
+	}
+
+	nals := [][]byte{{0x65, 0}, {0x41, 1}, {0x41, 2}, {0x41, 3}, {0x41, 4}, {0x41, 5}}
+	for i, nal := range nals {
+		assert.NoError(t, muxer.muxVideo(&codec.Frame{
+			MediaType: codec.MediaTypeVideo,
+			Dts:       int64(i) * frameDuration,
+			Payload:   nal,
+		}))
+	}
+
+	// 每个片段最多 2 帧，只有第一个片段从关键帧开始
+	if assert.Len(t, w.fragments, 2) {
+		assert.True(t, w.fragments[0].Independent)
+		assert.False(t, w.fragments[1].Independent)
+		assert.Equal(t, 2*frameDuration, w.fragments[1].Dts)
+		assert.Equal(t, 2*frameDuration, w.fragments[1].Duration)
+	}
+}
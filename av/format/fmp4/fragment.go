@@ -0,0 +1,111 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fmp4
+
+import (
+	"encoding/binary"
+)
+
+// sample_flags
+const (
+	sampleFlagsSync    = 0x02000000 // sample_depends_on=2
+	sampleFlagsNonSync = 0x01010000 // sample_depends_on=1, sample_is_non_sync_sample=1
+)
+
+// Sample 片段中的一个样本
+type Sample struct {
+	Duration              uint32 // 时长，单位为轨道的时间刻度
+	CompositionTimeOffset int32  // PTS - DTS，单位为轨道的时间刻度
+	Key                   bool   // 是否同步样本(关键帧)
+	Data                  []byte // 样本数据，视频为 4 字节长度前缀的 NAL 序列
+}
+
+// TrackFragment 一个轨道的片段
+type TrackFragment struct {
+	TrackID             uint32
+	BaseMediaDecodeTime uint64 // 第一个样本的 DTS，单位为轨道的时间刻度
+	Samples             []Sample
+}
+
+// Duration 轨道片段的时长，单位为轨道的时间刻度
+func (traf *TrackFragment) Duration() uint64 {
+	var duration uint64
+	for i := range traf.Samples {
+		duration += uint64(traf.Samples[i].Duration)
+	}
+	return duration
+}
+
+// Size 轨道片段样本数据的大小
+func (traf *TrackFragment) Size() int {
+	size := 0
+	for i := range traf.Samples {
+		size += len(traf.Samples[i].Data)
+	}
+	return size
+}
+
+// MarshalFragment 将轨道片段序列化为 moof+mdat；
+// mdat 中样本数据按轨道顺序存放
+func MarshalFragment(sequenceNumber uint32, trafs ...*TrackFragment) []byte {
+	size := 0
+	for _, traf := range trafs {
+		size += traf.Size()
+	}
+
+	w := &boxWriter{buf: make([]byte, 0, size+1024)}
+	moof := w.startBox("moof")
+	mfhd := w.startFullBox("mfhd", 0, 0)
+	w.u32(sequenceNumber)
+	w.endBox(mfhd)
+
+	dataOffsets := make([]int, 0, len(trafs))
+	for _, traf := range trafs {
+		trafBox := w.startBox("traf")
+		tfhd := w.startFullBox("tfhd", 0, 0x020000) // default-base-is-moof
+		w.u32(traf.TrackID)
+		w.endBox(tfhd)
+
+		tfdt := w.startFullBox("tfdt", 1, 0)
+		w.u64(traf.BaseMediaDecodeTime)
+		w.endBox(tfdt)
+
+		// data-offset, sample-duration, sample-size, sample-flags, sample-composition-time-offset
+		trun := w.startFullBox("trun", 1, 0x000f01)
+		w.u32(uint32(len(traf.Samples)))
+		dataOffsets = append(dataOffsets, len(w.buf))
+		w.u32(0) // data_offset, 稍后回填
+		for i := range traf.Samples {
+			sample := &traf.Samples[i]
+			w.u32(sample.Duration)
+			w.u32(uint32(len(sample.Data)))
+			if sample.Key {
+				w.u32(sampleFlagsSync)
+			} else {
+				w.u32(sampleFlagsNonSync)
+			}
+			w.u32(uint32(sample.CompositionTimeOffset))
+		}
+		w.endBox(trun)
+		w.endBox(trafBox)
+	}
+	w.endBox(moof)
+
+	// 回填各轨道样本数据相对 moof 的偏移
+	offset := len(w.buf) - moof + 8
+	for i, traf := range trafs {
+		binary.BigEndian.PutUint32(w.buf[dataOffsets[i]:], uint32(offset))
+		offset += traf.Size()
+	}
+
+	mdat := w.startBox("mdat")
+	for _, traf := range trafs {
+		for i := range traf.Samples {
+			w.bytes(traf.Samples[i].Data)
+		}
+	}
+	w.endBox(mdat)
+	return w.buf
+}
@@ -0,0 +1,279 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fmp4
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/cnotch/ipchub/av/codec"
+	"github.com/cnotch/ipchub/av/format/flv"
+)
+
+// 轨道 ID
+const (
+	VideoTrackID = 1
+	AudioTrackID = 2
+)
+
+// 视频轨道的时间刻度
+const videoTimescale = 90000
+
+// MarshalInitSegment 根据音视频元数据生成初始化片段(ftyp+moov)；
+// 视频支持 H264/H265，音频支持 AAC，其他音频编码忽略；
+// video 为 nil 时生成只包含音频轨道的初始化片段，如 DASH 的音频自适应集
+func MarshalInitSegment(video *codec.VideoMeta, audio *codec.AudioMeta) ([]byte, error) {
+	var record []byte
+	var err error
+	if video != nil {
+		switch video.Codec {
+		case "H264":
+			record, err = flv.NewAVCDecoderConfigurationRecord(video.Sps, video.Pps).Marshal()
+		case "H265":
+			record, err = flv.NewHEVCDecoderConfigurationRecord(video.Vps, video.Sps, video.Pps).Marshal()
+		default:
+			return nil, fmt.Errorf("fmp4 unsupport video codec type:%s", video.Codec)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	hasAudio := audio != nil && audio.Codec == "AAC"
+	if video == nil && !hasAudio {
+		return nil, errors.New("fmp4 init segment requires video or audio track")
+	}
+
+	w := &boxWriter{buf: make([]byte, 0, 1024)}
+
+	// ftyp
+	ftyp := w.startBox("ftyp")
+	w.bytes([]byte("iso5"))
+	w.u32(512)
+	w.bytes([]byte("iso5iso6mp41"))
+	w.endBox(ftyp)
+
+	moov := w.startBox("moov")
+	writeMvhd(w, AudioTrackID+1)
+	if video != nil {
+		writeVideoTrak(w, video, record)
+	}
+	if hasAudio {
+		writeAudioTrak(w, audio)
+	}
+
+	// mvex
+	mvex := w.startBox("mvex")
+	if video != nil {
+		writeTrex(w, VideoTrackID)
+	}
+	if hasAudio {
+		writeTrex(w, AudioTrackID)
+	}
+	w.endBox(mvex)
+	w.endBox(moov)
+	return w.buf, nil
+}
+
+func writeMvhd(w *boxWriter, nextTrackID uint32) {
+	mvhd := w.startFullBox("mvhd", 0, 0)
+	w.u32(0)          // creation_time
+	w.u32(0)          // modification_time
+	w.u32(1000)       // timescale
+	w.u32(0)          // duration
+	w.u32(0x00010000) // rate
+	w.u16(0x0100)     // volume
+	w.zeros(10)       // reserved
+	w.matrix()
+	w.zeros(24) // pre_defined
+	w.u32(nextTrackID)
+	w.endBox(mvhd)
+}
+
+func writeTkhd(w *boxWriter, trackID uint32, volume uint16, width, height int) {
+	// flags: track_enabled | track_in_movie
+	tkhd := w.startFullBox("tkhd", 0, 0x000003)
+	w.u32(0)       // creation_time
+	w.u32(0)       // modification_time
+	w.u32(trackID) // track_ID
+	w.u32(0)       // reserved
+	w.u32(0)       // duration
+	w.zeros(8)     // reserved
+	w.u16(0)       // layer
+	w.u16(0)       // alternate_group
+	w.u16(volume)  // volume
+	w.u16(0)       // reserved
+	w.matrix()
+	w.u32(uint32(width) << 16)
+	w.u32(uint32(height) << 16)
+	w.endBox(tkhd)
+}
+
+func writeMdhd(w *boxWriter, timescale uint32) {
+	mdhd := w.startFullBox("mdhd", 0, 0)
+	w.u32(0) // creation_time
+	w.u32(0) // modification_time
+	w.u32(timescale)
+	w.u32(0)      // duration
+	w.u16(0x55c4) // language: und
+	w.u16(0)      // pre_defined
+	w.endBox(mdhd)
+}
+
+func writeHdlr(w *boxWriter, handlerType, name string) {
+	hdlr := w.startFullBox("hdlr", 0, 0)
+	w.u32(0) // pre_defined
+	w.bytes([]byte(handlerType))
+	w.zeros(12) // reserved
+	w.bytes([]byte(name))
+	w.u8(0)
+	w.endBox(hdlr)
+}
+
+// dinf 和空的样本表
+func writeDinfAndStbl(w *boxWriter, writeStsd func()) {
+	dinf := w.startBox("dinf")
+	dref := w.startFullBox("dref", 0, 0)
+	w.u32(1) // entry_count
+	url := w.startFullBox("url ", 0, 0x000001)
+	w.endBox(url)
+	w.endBox(dref)
+	w.endBox(dinf)
+
+	stbl := w.startBox("stbl")
+	stsd := w.startFullBox("stsd", 0, 0)
+	w.u32(1) // entry_count
+	writeStsd()
+	w.endBox(stsd)
+	for _, boxType := range []string{"stts", "stsc", "stco"} {
+		box := w.startFullBox(boxType, 0, 0)
+		w.u32(0) // entry_count
+		w.endBox(box)
+	}
+	stsz := w.startFullBox("stsz", 0, 0)
+	w.u32(0) // sample_size
+	w.u32(0) // sample_count
+	w.endBox(stsz)
+	w.endBox(stbl)
+}
+
+func writeVideoTrak(w *boxWriter, video *codec.VideoMeta, record []byte) {
+	trak := w.startBox("trak")
+	writeTkhd(w, VideoTrackID, 0, video.Width, video.Height)
+
+	mdia := w.startBox("mdia")
+	writeMdhd(w, videoTimescale)
+	writeHdlr(w, "vide", "VideoHandler")
+
+	minf := w.startBox("minf")
+	vmhd := w.startFullBox("vmhd", 0, 0x000001)
+	w.zeros(8) // graphicsmode + opcolor
+	w.endBox(vmhd)
+
+	writeDinfAndStbl(w, func() {
+		entryType, recordType := "avc1", "avcC"
+		if video.Codec == "H265" {
+			entryType, recordType = "hvc1", "hvcC"
+		}
+
+		entry := w.startBox(entryType)
+		w.zeros(6)  // reserved
+		w.u16(1)    // data_reference_index
+		w.zeros(16) // pre_defined + reserved
+		w.u16(uint16(video.Width))
+		w.u16(uint16(video.Height))
+		w.u32(0x00480000) // horizresolution 72 dpi
+		w.u32(0x00480000) // vertresolution 72 dpi
+		w.u32(0)          // reserved
+		w.u16(1)          // frame_count
+		w.zeros(32)       // compressorname
+		w.u16(0x0018)     // depth
+		w.u16(0xffff)     // pre_defined = -1
+
+		config := w.startBox(recordType)
+		w.bytes(record)
+		w.endBox(config)
+		w.endBox(entry)
+	})
+	w.endBox(minf)
+	w.endBox(mdia)
+	w.endBox(trak)
+}
+
+func writeAudioTrak(w *boxWriter, audio *codec.AudioMeta) {
+	trak := w.startBox("trak")
+	writeTkhd(w, AudioTrackID, 0x0100, 0, 0)
+
+	mdia := w.startBox("mdia")
+	writeMdhd(w, uint32(audio.SampleRate))
+	writeHdlr(w, "soun", "SoundHandler")
+
+	minf := w.startBox("minf")
+	smhd := w.startFullBox("smhd", 0, 0)
+	w.u32(0) // balance + reserved
+	w.endBox(smhd)
+
+	writeDinfAndStbl(w, func() {
+		channels := audio.Channels
+		if channels == 0 {
+			channels = 2
+		}
+
+		entry := w.startBox("mp4a")
+		w.zeros(6) // reserved
+		w.u16(1)   // data_reference_index
+		w.zeros(8) // reserved
+		w.u16(uint16(channels))
+		w.u16(16) // samplesize
+		w.u32(0)  // pre_defined + reserved
+		w.u32(uint32(audio.SampleRate) << 16)
+		writeEsds(w, audio.Sps)
+		w.endBox(entry)
+	})
+	w.endBox(minf)
+	w.endBox(mdia)
+	w.endBox(trak)
+}
+
+// esds 包含 ES_Descriptor，详见 ISO/IEC 14496-1
+func writeEsds(w *boxWriter, asc []byte) {
+	esds := w.startFullBox("esds", 0, 0)
+
+	// ES_Descriptor
+	w.u8(0x03)
+	w.u8(byte(3 + 2 + 13 + 2 + len(asc) + 3))
+	w.u16(AudioTrackID) // ES_ID
+	w.u8(0)             // flags
+
+	// DecoderConfigDescriptor
+	w.u8(0x04)
+	w.u8(byte(13 + 2 + len(asc)))
+	w.u8(0x40) // objectTypeIndication: Audio ISO/IEC 14496-3
+	w.u8(0x15) // streamType: AudioStream, upStream=0, reserved=1
+	w.zeros(3) // bufferSizeDB
+	w.u32(0)   // maxBitrate
+	w.u32(0)   // avgBitrate
+
+	// DecoderSpecificInfo
+	w.u8(0x05)
+	w.u8(byte(len(asc)))
+	w.bytes(asc)
+
+	// SLConfigDescriptor
+	w.u8(0x06)
+	w.u8(1)
+	w.u8(0x02)
+	w.endBox(esds)
+}
+
+func writeTrex(w *boxWriter, trackID uint32) {
+	trex := w.startFullBox("trex", 0, 0)
+	w.u32(trackID)
+	w.u32(1) // default_sample_description_index
+	w.u32(0) // default_sample_duration
+	w.u32(0) // default_sample_size
+	w.u32(0) // default_sample_flags
+	w.endBox(trex)
+}
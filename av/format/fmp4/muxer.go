@@ -0,0 +1,350 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fmp4
+
+import (
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/cnotch/ipchub/av/codec"
+	"github.com/cnotch/ipchub/av/codec/h264"
+	"github.com/cnotch/ipchub/av/codec/hevc"
+	"github.com/cnotch/queue"
+	"github.com/cnotch/xlog"
+)
+
+// AAC 每帧的采样数
+const aacSamplesPerFrame = 1024
+
+// Fragment moof+mdat 片段
+type Fragment struct {
+	SequenceNumber uint32
+	Independent    bool   // 是否以关键帧开始
+	Dts            int64  // 片段起始 DTS，单位为 ns
+	Duration       int64  // 片段时长，单位为 ns
+	Data           []byte // moof+mdat
+	Video          *TrackFragment
+	Audio          *TrackFragment // 没有音频时为 nil
+}
+
+// FragmentWriter 包装 WriteInitSegment 和 WriteFragment 方法的接口
+type FragmentWriter interface {
+	// WriteInitSegment 在第一个片段之前调用
+	WriteInitSegment(init []byte) error
+	WriteFragment(fragment *Fragment) error
+}
+
+type multiFragmentWriter struct {
+	writers []FragmentWriter
+}
+
+// MultiFragmentWriter 创建一个将片段写入所有 writers 的 FragmentWriter
+func MultiFragmentWriter(writers ...FragmentWriter) FragmentWriter {
+	return &multiFragmentWriter{writers: writers}
+}
+
+func (mw *multiFragmentWriter) WriteInitSegment(init []byte) (err error) {
+	for _, w := range mw.writers {
+		if err2 := w.WriteInitSegment(init); err2 != nil {
+			err = err2
+		}
+	}
+	return
+}
+
+func (mw *multiFragmentWriter) WriteFragment(fragment *Fragment) (err error) {
+	for _, w := range mw.writers {
+		if err2 := w.WriteFragment(fragment); err2 != nil {
+			err = err2
+		}
+	}
+	return
+}
+
+// 未转换时间刻度的样本
+type pendingSample struct {
+	dts  int64
+	pts  int64
+	key  bool
+	data []byte
+}
+
+// Muxer fmp4 muxer from av.Frame(H264/H265[+AAC])；
+// 片段在视频关键帧或超过片段最大时长时切分
+type Muxer struct {
+	recvQueue *queue.SyncQueue
+	closed    bool
+	logger    *xlog.Logger // 日志对象
+
+	video    *codec.VideoMeta
+	audio    *codec.AudioMeta
+	hasAudio bool
+	fw       FragmentWriter
+
+	fragmentDuration int64 // 片段最大时长，单位为 ns，0 表示只在关键帧切分
+	started          bool  // 是否已收到第一个关键帧
+	inited           bool
+	sequenceNumber   uint32
+	au               *pendingSample // 正在合并的视频访问单元
+	videoSamples     []*pendingSample
+	audioSamples     []*pendingSample
+}
+
+// NewMuxer .
+// fragmentDuration 为片段最大时长，如 LL-HLS 的部分片段时长；为 0 时每个 GOP 一个片段
+func NewMuxer(videoMeta *codec.VideoMeta, audioMeta *codec.AudioMeta, fragmentDuration time.Duration, fw FragmentWriter, logger *xlog.Logger) (*Muxer, error) {
+	switch videoMeta.Codec {
+	case "H264", "H265":
+	default:
+		return nil, fmt.Errorf("fmp4 muxer unsupport video codec type:%s", videoMeta.Codec)
+	}
+
+	muxer := &Muxer{
+		recvQueue:        queue.NewSyncQueue(),
+		closed:           false,
+		logger:           logger,
+		video:            videoMeta,
+		audio:            audioMeta,
+		hasAudio:         audioMeta.Codec == "AAC" && audioMeta.SampleRate > 0,
+		fw:               fw,
+		fragmentDuration: int64(fragmentDuration),
+	}
+
+	go muxer.process()
+	return muxer, nil
+}
+
+// WriteFrame .
+func (muxer *Muxer) WriteFrame(frame *codec.Frame) error {
+	muxer.recvQueue.Push(frame)
+	return nil
+}
+
+// Close .
+func (muxer *Muxer) Close() error {
+	if muxer.closed {
+		return nil
+	}
+
+	muxer.closed = true
+	muxer.recvQueue.Signal()
+	return nil
+}
+
+func (muxer *Muxer) process() {
+	defer func() {
+		defer func() { // 避免 handler 再 panic
+			recover()
+		}()
+
+		if r := recover(); r != nil {
+			muxer.logger.Errorf("fmp4 muxer routine panic；r = %v \n %s", r, debug.Stack())
+		}
+
+		// 尽早通知GC，回收内存
+		muxer.recvQueue.Reset()
+	}()
+
+	for !muxer.closed {
+		f := muxer.recvQueue.Pop()
+		if f == nil {
+			if !muxer.closed {
+				muxer.logger.Warn("fmp4muxer: receive nil frame")
+			}
+			continue
+		}
+
+		frame := f.(*codec.Frame)
+		if len(frame.Payload) == 0 {
+			continue
+		}
+
+		var err error
+		switch frame.MediaType {
+		case codec.MediaTypeVideo:
+			err = muxer.muxVideo(frame)
+		case codec.MediaTypeAudio:
+			err = muxer.muxAudio(frame)
+		default:
+		}
+		if err != nil {
+			muxer.logger.Errorf("fmp4muxer: mux %s error - %s", frame.MediaType.String(), err.Error())
+		}
+	}
+}
+
+// 同一 DTS 的 NAL 合并成一个访问单元
+func (muxer *Muxer) muxVideo(frame *codec.Frame) (err error) {
+	skip, key := muxer.classifyNal(frame.Payload)
+	if skip {
+		return
+	}
+
+	if muxer.au != nil && muxer.au.dts != frame.Dts {
+		au := muxer.au
+		muxer.au = nil
+		if err = muxer.addVideoSample(au); err != nil {
+			return
+		}
+	}
+
+	if muxer.au == nil {
+		muxer.au = &pendingSample{dts: frame.Dts, pts: frame.Pts}
+	}
+	size := len(frame.Payload)
+	muxer.au.data = append(muxer.au.data, byte(size>>24), byte(size>>16), byte(size>>8), byte(size))
+	muxer.au.data = append(muxer.au.data, frame.Payload...)
+	muxer.au.key = muxer.au.key || key
+	return
+}
+
+// 参数集在初始化片段中，AUD 等不需要写入样本
+func (muxer *Muxer) classifyNal(nal []byte) (skip, key bool) {
+	if muxer.video.Codec == "H265" {
+		nalType := hevc.NulType(nal[0])
+		skip = (nalType >= hevc.NalVps && nalType <= hevc.NalAud) || nalType == hevc.NalFdNut
+		key = nalType >= hevc.NalBlaWLp && nalType <= hevc.NalIrapVcl23
+		return
+	}
+
+	nalType := h264.NulType(nal[0])
+	skip = nalType == h264.NalSps || nalType == h264.NalPps ||
+		nalType == h264.NalAud || nalType == h264.NalFillerData
+	key = nalType == h264.NalIdrSlice
+	return
+}
+
+func (muxer *Muxer) addVideoSample(sample *pendingSample) (err error) {
+	if !muxer.started && !sample.key {
+		return // 等待第一个关键帧
+	}
+	muxer.started = true
+
+	if len(muxer.videoSamples) > 0 && (sample.key || muxer.isFragmentOverflow(sample.dts)) {
+		if err = muxer.flush(sample.dts); err != nil {
+			return
+		}
+	}
+	muxer.videoSamples = append(muxer.videoSamples, sample)
+	return
+}
+
+// 写入 dts 的样本后片段是否会超过最大时长
+func (muxer *Muxer) isFragmentOverflow(dts int64) bool {
+	if muxer.fragmentDuration <= 0 {
+		return false
+	}
+
+	interval := dts - muxer.videoSamples[len(muxer.videoSamples)-1].dts
+	if interval < 0 {
+		interval = 0
+	}
+	return dts+interval-muxer.videoSamples[0].dts > muxer.fragmentDuration
+}
+
+func (muxer *Muxer) muxAudio(frame *codec.Frame) error {
+	if !muxer.hasAudio {
+		return nil
+	}
+	if !muxer.started && (muxer.au == nil || !muxer.au.key) {
+		return nil // 片段从视频关键帧开始
+	}
+
+	muxer.audioSamples = append(muxer.audioSamples, &pendingSample{
+		dts:  frame.Dts,
+		pts:  frame.Dts,
+		key:  true,
+		data: frame.Payload,
+	})
+	return nil
+}
+
+// 输出已缓存样本组成的片段，nextDts 为下一个关键帧的 DTS
+func (muxer *Muxer) flush(nextDts int64) (err error) {
+	videoSamples := muxer.videoSamples
+	audioSamples := muxer.audioSamples
+	muxer.videoSamples = nil
+	muxer.audioSamples = nil
+
+	if !muxer.inited {
+		if !muxer.metadataIsReady() {
+			muxer.logger.Warn("fmp4muxer: video metadata is not ready, drop fragment")
+			return
+		}
+
+		var init []byte
+		if init, err = MarshalInitSegment(muxer.video, muxer.audio); err != nil {
+			return
+		}
+		if err = muxer.fw.WriteInitSegment(init); err != nil {
+			return
+		}
+		muxer.inited = true
+	}
+
+	muxer.sequenceNumber++
+	fragment := &Fragment{
+		SequenceNumber: muxer.sequenceNumber,
+		Independent:    videoSamples[0].key,
+		Dts:            videoSamples[0].dts,
+		Duration:       nextDts - videoSamples[0].dts,
+		Video: newTrackFragment(VideoTrackID, videoTimescale,
+			videoSamples, toTimescale(nextDts, videoTimescale)),
+	}
+	if len(audioSamples) > 0 {
+		timescale := uint32(muxer.audio.SampleRate)
+		last := toTimescale(audioSamples[len(audioSamples)-1].dts, timescale)
+		fragment.Audio = newTrackFragment(AudioTrackID, timescale,
+			audioSamples, last+aacSamplesPerFrame)
+		fragment.Data = MarshalFragment(fragment.SequenceNumber, fragment.Video, fragment.Audio)
+	} else {
+		fragment.Data = MarshalFragment(fragment.SequenceNumber, fragment.Video)
+	}
+	return muxer.fw.WriteFragment(fragment)
+}
+
+func (muxer *Muxer) metadataIsReady() bool {
+	if muxer.video.Codec == "H265" {
+		return hevc.MetadataIsReady(muxer.video)
+	}
+	return h264.MetadataIsReady(muxer.video)
+}
+
+// 转换样本的时间刻度，endDts 为最后一个样本的结束时间
+func newTrackFragment(trackID, timescale uint32, samples []*pendingSample, endDts int64) *TrackFragment {
+	traf := &TrackFragment{
+		TrackID: trackID,
+		Samples: make([]Sample, len(samples)),
+	}
+
+	dts := toTimescale(samples[0].dts, timescale)
+	traf.BaseMediaDecodeTime = uint64(dts)
+	for i, sample := range samples {
+		nextDts := endDts
+		if i+1 < len(samples) {
+			nextDts = toTimescale(samples[i+1].dts, timescale)
+		}
+		duration := nextDts - dts
+		if duration < 0 {
+			duration = 0
+		}
+
+		traf.Samples[i] = Sample{
+			Duration:              uint32(duration),
+			CompositionTimeOffset: int32(toTimescale(sample.pts, timescale) - dts),
+			Key:                   sample.key,
+			Data:                  sample.data,
+		}
+		dts = nextDts
+	}
+	return traf
+}
+
+// 将 ns 转换为指定时间刻度，避免溢出
+func toTimescale(ns int64, timescale uint32) int64 {
+	second := int64(time.Second)
+	return ns/second*int64(timescale) + ns%second*int64(timescale)/second
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package hls
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/cnotch/ipchub/av/format/fmp4"
+	"github.com/cnotch/ipchub/utils/murmur"
+	"github.com/cnotch/xlog"
+)
+
+// Fmp4SegmentGenerator generate the HLS fmp4(CMAF) segment.
+// 片段只在以关键帧开始的 fmp4.Fragment 处切分；
+// 启用 LL-HLS 时，每个 fmp4.Fragment 作为一个部分片段
+type Fmp4SegmentGenerator struct {
+	playlist    *Playlist // 播放列表
+	path        string    // 流路径
+	hlsFragment int       // 每个片段长度
+
+	memory      bool   // 使用内存存储缓存到硬盘
+	segmentPath string // 缓存文件路径
+
+	sequenceNo       int      // 片段序号
+	current          *segment // current segment
+	isSequenceHeader bool     // 下一个打开的片段是否是第一个片段
+
+	logger *xlog.Logger
+}
+
+// NewFmp4SegmentGenerator .
+func NewFmp4SegmentGenerator(playlist *Playlist, path string, hlsFragment int, segmentPath string, logger *xlog.Logger) *Fmp4SegmentGenerator {
+	return &Fmp4SegmentGenerator{
+		playlist:         playlist,
+		path:             path,
+		hlsFragment:      hlsFragment,
+		memory:           segmentPath == "",
+		segmentPath:      segmentPath,
+		isSequenceHeader: true,
+		logger:           logger,
+	}
+}
+
+// WriteInitSegment implements fmp4.FragmentWriter
+func (sg *Fmp4SegmentGenerator) WriteInitSegment(init []byte) error {
+	sg.playlist.setInitSegment("/streams"+sg.path+"/init.mp4", init)
+	return nil
+}
+
+// WriteFragment implements fmp4.FragmentWriter
+func (sg *Fmp4SegmentGenerator) WriteFragment(fragment *fmp4.Fragment) (err error) {
+	// 转换成 90000Hz，与 ts 片段一致
+	startPts := fragment.Dts / int64(time.Microsecond) * 90 / 1000
+	endPts := (fragment.Dts + fragment.Duration) / int64(time.Microsecond) * 90 / 1000
+
+	if sg.current != nil && fragment.Independent &&
+		sg.current.duration >= float64(sg.hlsFragment) {
+		if err = sg.segmentClose(); err != nil {
+			return
+		}
+	}
+
+	if sg.current == nil {
+		if err = sg.segmentOpen(startPts); err != nil {
+			return
+		}
+	}
+
+	if _, err = sg.current.file.Write(fragment.Data); err != nil {
+		return
+	}
+	sg.current.updateDuration(endPts)
+
+	if sg.playlist.partTarget > 0 {
+		sg.playlist.addPart(sg.current, &part{
+			duration:    float64(fragment.Duration) / float64(time.Second),
+			independent: fragment.Independent,
+			data:        fragment.Data,
+		})
+	}
+	return
+}
+
+// open a new segment, a new m4s file
+func (sg *Fmp4SegmentGenerator) segmentOpen(segmentStartPts int64) (err error) {
+	sg.sequenceNo++
+	curr := newSegment(sg.memory)
+	curr.sequenceNo = sg.sequenceNo
+	curr.segmentStartPts = segmentStartPts
+	curr.uri = "/streams" + sg.path + "/" + strconv.Itoa(sg.sequenceNo) + ".m4s"
+
+	fileName := fmt.Sprintf("%d_%d.m4s", murmur.OfString(sg.path), curr.sequenceNo)
+	if err = curr.file.open(filepath.Join(sg.segmentPath, fileName)); err != nil {
+		sg.sequenceNo--
+		return
+	}
+
+	// when close the first segement, it will write a discontinuity to m3u8 file.
+	curr.isSequenceHeader = sg.isSequenceHeader
+	sg.isSequenceHeader = false
+	sg.current = curr
+	return
+}
+
+// close segment(m4s)
+func (sg *Fmp4SegmentGenerator) segmentClose() (err error) {
+	curr := sg.current
+	sg.current = nil
+	curr.file.close()
+	if curr.duration*1000 < hlsSegmentMinDurationMs {
+		curr.file.delete()
+		if !sg.playlist.dropSegment(curr) {
+			// reuse current segment index
+			sg.sequenceNo--
+		}
+	} else {
+		sg.playlist.addSegment(curr)
+	}
+	return
+}
+
+// Close .
+func (sg *Fmp4SegmentGenerator) Close() error {
+	if nil == sg.current {
+		return nil
+	}
+
+	curr := sg.current
+	sg.current = nil
+	curr.file.close()
+	curr.file.delete()
+	return nil
+}
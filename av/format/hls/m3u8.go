@@ -0,0 +1,149 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package hls
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ErrM3u8Illegal 不是有效的 m3u8 播放列表
+var ErrM3u8Illegal = errors.New("m3u8 playlist illegal")
+
+// Variant 主播放列表中的一个码流(EXT-X-STREAM-INF)
+type Variant struct {
+	URI        string
+	Bandwidth  int
+	Codecs     string
+	Resolution string
+}
+
+// MediaSegment 媒体播放列表中的片段
+type MediaSegment struct {
+	URI           string
+	Sequence      int
+	Duration      float64 // 秒
+	Discontinuity bool    // 片段之前有 EXT-X-DISCONTINUITY
+	Gap           bool    // 片段缺失(EXT-X-GAP)，不能下载
+}
+
+// M3u8 解析后的播放列表；Variants 不为空时为主播放列表
+type M3u8 struct {
+	Variants       []Variant
+	TargetDuration float64 // 秒
+	MediaSequence  int
+	EndList        bool
+	Encrypted      bool   // EXT-X-KEY 的 METHOD 不为 NONE
+	MapURI         string // EXT-X-MAP 的初始化段，fmp4 片段时存在
+	Segments       []MediaSegment
+}
+
+// IsMaster 是否为主播放列表
+func (m *M3u8) IsMaster() bool {
+	return len(m.Variants) > 0
+}
+
+// ParseM3u8 解析 m3u8 播放列表，忽略不支持的标签
+func ParseM3u8(r io.Reader) (*M3u8, error) {
+	scanner := bufio.NewScanner(r)
+	if !scanner.Scan() || strings.TrimSpace(scanner.Text()) != "#EXTM3U" {
+		return nil, ErrM3u8Illegal
+	}
+
+	m := &M3u8{}
+	var variant *Variant
+	var segment MediaSegment
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if !strings.HasPrefix(line, "#") { // URI
+			if variant != nil {
+				variant.URI = line
+				m.Variants = append(m.Variants, *variant)
+				variant = nil
+				continue
+			}
+			segment.URI = line
+			segment.Sequence = m.MediaSequence + len(m.Segments)
+			m.Segments = append(m.Segments, segment)
+			segment = MediaSegment{}
+			continue
+		}
+
+		tag, value := line, ""
+		if i := strings.IndexByte(line, ':'); i > 0 {
+			tag, value = line[:i], line[i+1:]
+		}
+		switch tag {
+		case "#EXT-X-STREAM-INF":
+			attrs := parseAttributes(value)
+			bandwidth, _ := strconv.Atoi(attrs["BANDWIDTH"])
+			variant = &Variant{
+				Bandwidth:  bandwidth,
+				Codecs:     attrs["CODECS"],
+				Resolution: attrs["RESOLUTION"],
+			}
+		case "#EXT-X-TARGETDURATION":
+			m.TargetDuration, _ = strconv.ParseFloat(value, 64)
+		case "#EXT-X-MEDIA-SEQUENCE":
+			m.MediaSequence, _ = strconv.Atoi(value)
+		case "#EXT-X-ENDLIST":
+			m.EndList = true
+		case "#EXT-X-KEY":
+			m.Encrypted = parseAttributes(value)["METHOD"] != "NONE"
+		case "#EXT-X-MAP":
+			m.MapURI = parseAttributes(value)["URI"]
+		case "#EXT-X-DISCONTINUITY":
+			segment.Discontinuity = true
+		case "#EXT-X-GAP":
+			segment.Gap = true
+		case "#EXTINF":
+			if i := strings.IndexByte(value, ','); i >= 0 {
+				value = value[:i]
+			}
+			segment.Duration, _ = strconv.ParseFloat(value, 64)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// 解析属性列表，如 BANDWIDTH=1280000,CODECS="avc1.4d401f,mp4a.40.2"
+func parseAttributes(s string) map[string]string {
+	attrs := make(map[string]string)
+	for s != "" {
+		i := strings.IndexByte(s, '=')
+		if i < 0 {
+			break
+		}
+		name := strings.TrimSpace(s[:i])
+		s = s[i+1:]
+
+		var value string
+		if strings.HasPrefix(s, "\"") {
+			end := strings.IndexByte(s[1:], '"')
+			if end < 0 {
+				value, s = s[1:], ""
+			} else {
+				value, s = s[1:end+1], s[end+2:]
+			}
+			s = strings.TrimPrefix(s, ",")
+		} else if end := strings.IndexByte(s, ','); end >= 0 {
+			value, s = s[:end], s[end+1:]
+		} else {
+			value, s = s, ""
+		}
+		attrs[name] = value
+	}
+	return attrs
+}
@@ -18,11 +18,34 @@ import (
 
 const hlsRemainSegments = 3
 
+// LL-HLS 保留部分片段的最新片段数
+const hlsRemainPartSegments = 2
+
+// 错误定义
+var (
+	// ErrPlaylistTimeout 等待播放列表更新超时
+	ErrPlaylistTimeout = errors.New("wait for playlist update timeout")
+	// ErrPlaylistClosed 播放列表已关闭
+	ErrPlaylistClosed = errors.New("playlist is closed")
+	// ErrBlockingRequest 阻塞请求的片段序号超出范围
+	ErrBlockingRequest = errors.New("the _HLS_msn is out of range")
+)
+
 // Playlist the HLS playlist(m3u8 and ts files).
 type Playlist struct {
 	// m3u8 segments
 	l        sync.RWMutex
 	segments []*segment
+	closed   bool
+
+	// LL-HLS
+	partTarget float64       // 部分片段目标时长(秒)，0 表示不启用
+	pending    *segment      // 正在生成部分片段的片段
+	updated    chan struct{} // 播放列表更新时关闭，用于阻塞请求
+
+	// fmp4 init segment(EXT-X-MAP)
+	initURI     string
+	initSegment []byte
 
 	// last http access time
 	lastAccessTime int64
@@ -30,10 +53,17 @@ type Playlist struct {
 
 // NewPlaylist .
 func NewPlaylist() *Playlist {
+	return NewLowLatencyPlaylist(0)
+}
+
+// NewLowLatencyPlaylist 创建 LL-HLS 播放列表，partTarget 为部分片段的目标时长；
+// partTarget 为 0 时不生成部分片段
+func NewLowLatencyPlaylist(partTarget time.Duration) *Playlist {
 	return &Playlist{
+		partTarget:     partTarget.Seconds(),
+		updated:        make(chan struct{}),
 		lastAccessTime: time.Now().UnixNano(),
 	}
-
 }
 
 var m3u8Pool = sync.Pool{
@@ -45,18 +75,77 @@ var m3u8Pool = sync.Pool{
 // M3u8 获取 m3u8 播放列表
 func (pl *Playlist) M3u8(token string) ([]byte, error) {
 	atomic.StoreInt64(&pl.lastAccessTime, time.Now().UnixNano())
-	w := m3u8Pool.Get().(*bytes.Buffer)
-	w.Reset()
-	defer m3u8Pool.Put(w)
-
 	pl.l.RLock()
 	defer pl.l.RUnlock()
-	segments := pl.segments
+	return pl.m3u8(token)
+}
+
+// WaitM3u8 阻塞直到播放列表包含片段 msn 的部分片段 part，然后获取 m3u8 播放列表；
+// msn < 0 时只等待播放列表可用，part < 0 时等待完整的片段 msn
+func (pl *Playlist) WaitM3u8(token string, msn, part int, timeout time.Duration) ([]byte, error) {
+	atomic.StoreInt64(&pl.lastAccessTime, time.Now().UnixNano())
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		pl.l.RLock()
+		ready, err := pl.ready(msn, part)
+		if ready {
+			cont, err := pl.m3u8(token)
+			pl.l.RUnlock()
+			return cont, err
+		}
+		updated := pl.updated
+		pl.l.RUnlock()
+
+		if err != nil {
+			return nil, err
+		}
+
+		select {
+		case <-updated:
+		case <-deadline.C:
+			return nil, ErrPlaylistTimeout
+		}
+	}
+}
+
+// 播放列表是否已包含指定的片段
+func (pl *Playlist) ready(msn, part int) (bool, error) {
+	if pl.closed {
+		return false, ErrPlaylistClosed
+	}
+	if len(pl.segments) < hlsRemainSegments {
+		return false, nil
+	}
+	if msn < 0 {
+		return true, nil
+	}
+
+	last := pl.segments[len(pl.segments)-1].sequenceNo
+	if msn <= last {
+		return true, nil
+	}
+	if msn > last+2 {
+		return false, ErrBlockingRequest
+	}
+	if part < 0 || pl.pending == nil {
+		return false, nil
+	}
+	return pl.pending.sequenceNo > msn ||
+		(pl.pending.sequenceNo == msn && len(pl.pending.parts) > part), nil
+}
 
+func (pl *Playlist) m3u8(token string) ([]byte, error) {
+	segments := pl.segments
 	if len(segments) < hlsRemainSegments {
 		return nil, errors.New("playlist is not enough,maybe the HLS stream just started")
 	}
 
+	w := m3u8Pool.Get().(*bytes.Buffer)
+	w.Reset()
+	defer m3u8Pool.Put(w)
+
 	seq := segments[0].sequenceNo
 	var maxDuration float64
 	for _, seg := range segments {
@@ -65,10 +154,26 @@ func (pl *Playlist) M3u8(token string) ([]byte, error) {
 		}
 	}
 	duration := int32(maxDuration + 1)
+	version := 3
+	if pl.partTarget > 0 {
+		version = 9 // LL-HLS
+	} else if len(pl.initURI) > 0 {
+		version = 7 // EXT-X-MAP 用于非 I-frame 播放列表需要版本 6 以上
+	}
 	// 描述部分
 	fmt.Fprintf(w,
-		"#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-ALLOW-CACHE:NO\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:%d\n\n",
-		duration, seq)
+		"#EXTM3U\n#EXT-X-VERSION:%d\n#EXT-X-ALLOW-CACHE:NO\n#EXT-X-TARGETDURATION:%d\n",
+		version, duration)
+	if pl.partTarget > 0 {
+		fmt.Fprintf(w,
+			"#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n#EXT-X-PART-INF:PART-TARGET=%.3f\n",
+			3*pl.partTarget, pl.partTarget)
+	}
+	fmt.Fprintf(w, "#EXT-X-MEDIA-SEQUENCE:%d\n", seq)
+	if len(pl.initURI) > 0 {
+		fmt.Fprintf(w, "#EXT-X-MAP:URI=\"%s\"\n", withToken(pl.initURI, token))
+	}
+	fmt.Fprint(w, "\n")
 
 	// 列表部分
 	for _, seg := range segments {
@@ -77,18 +182,41 @@ func (pl *Playlist) M3u8(token string) ([]byte, error) {
 			fmt.Fprint(w, "#EXT-X-DISCONTINUITY\n")
 		}
 
-		if len(token) > 0 {
-			fmt.Fprintf(w, "#EXTINF:%.3f,\n%s?token=%s\n",
-				seg.duration,
-				seg.uri, token)
-		} else {
-			fmt.Fprintf(w, "#EXTINF:%.3f,\n%s\n",
-				seg.duration,
-				seg.uri)
+		writeParts(w, seg, token)
+		if seg.gap {
+			fmt.Fprint(w, "#EXT-X-GAP\n")
 		}
+		fmt.Fprintf(w, "#EXTINF:%.3f,\n%s\n",
+			seg.duration,
+			withToken(seg.uri, token))
+	}
+
+	// 正在生成的片段，提示客户端预加载下一个部分片段
+	if pl.pending != nil {
+		writeParts(w, pl.pending, token)
+		fmt.Fprintf(w, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"%s\"\n",
+			withToken(pl.pending.partURI(len(pl.pending.parts)), token))
 	}
 
-	return w.Bytes(), nil
+	return append([]byte(nil), w.Bytes()...), nil
+}
+
+func writeParts(w io.Writer, seg *segment, token string) {
+	for i, p := range seg.parts {
+		fmt.Fprintf(w, "#EXT-X-PART:DURATION=%.3f,URI=\"%s\"",
+			p.duration, withToken(seg.partURI(i), token))
+		if p.independent {
+			fmt.Fprint(w, ",INDEPENDENT=YES")
+		}
+		fmt.Fprint(w, "\n")
+	}
+}
+
+func withToken(uri string, token string) string {
+	if len(token) > 0 {
+		return uri + "?token=" + token
+	}
+	return uri
 }
 
 // Segment 获取 segment
@@ -98,13 +226,85 @@ func (pl *Playlist) Segment(seq int) (io.Reader, int, error) {
 	defer pl.l.RUnlock()
 
 	for _, seg := range pl.segments {
-		if seg.sequenceNo == seq {
+		if seg.sequenceNo == seq && !seg.gap {
 			return seg.file.get()
 		}
 	}
 	return nil, 0, errors.New("Not found TSFile")
 }
 
+// Part 获取 LL-HLS 部分片段；
+// 预加载提示的部分片段尚未生成时，阻塞到生成或超时
+func (pl *Playlist) Part(seq, index int) (io.Reader, int, error) {
+	atomic.StoreInt64(&pl.lastAccessTime, time.Now().UnixNano())
+	deadline := time.NewTimer(time.Duration(3 * pl.partTarget * float64(time.Second)))
+	defer deadline.Stop()
+
+	for {
+		pl.l.RLock()
+		p, wait := pl.findPart(seq, index)
+		updated := pl.updated
+		pl.l.RUnlock()
+
+		if p != nil {
+			return bytes.NewReader(p.data), len(p.data), nil
+		}
+		if !wait {
+			return nil, 0, errors.New("Not found part")
+		}
+
+		select {
+		case <-updated:
+		case <-deadline.C:
+			return nil, 0, ErrPlaylistTimeout
+		}
+	}
+}
+
+// 查找部分片段，未找到时返回是否需要等待它生成
+func (pl *Playlist) findPart(seq, index int) (p *part, wait bool) {
+	if pl.closed || pl.partTarget <= 0 {
+		return
+	}
+
+	if pl.pending != nil && pl.pending.sequenceNo == seq {
+		if index < len(pl.pending.parts) {
+			return pl.pending.parts[index], false
+		}
+		return nil, true
+	}
+
+	for _, seg := range pl.segments {
+		if seg.sequenceNo == seq {
+			if index < len(seg.parts) {
+				return seg.parts[index], false
+			}
+			return
+		}
+	}
+
+	// 下一个片段
+	var last int
+	if pl.pending != nil {
+		last = pl.pending.sequenceNo
+	} else if len(pl.segments) > 0 {
+		last = pl.segments[len(pl.segments)-1].sequenceNo
+	}
+	return nil, seq == last+1
+}
+
+// InitSegment 获取 fmp4 的初始化片段
+func (pl *Playlist) InitSegment() (io.Reader, int, error) {
+	atomic.StoreInt64(&pl.lastAccessTime, time.Now().UnixNano())
+	pl.l.RLock()
+	defer pl.l.RUnlock()
+
+	if len(pl.initSegment) == 0 {
+		return nil, 0, errors.New("Not found init segment")
+	}
+	return bytes.NewReader(pl.initSegment), len(pl.initSegment), nil
+}
+
 // LastAccessTime 最后hls访问时间
 func (pl *Playlist) LastAccessTime() time.Time {
 	lastAccessTime := atomic.LoadInt64(&pl.lastAccessTime)
@@ -116,29 +316,87 @@ func (pl *Playlist) Close() error {
 	pl.l.Lock()
 	defer pl.l.Unlock()
 	pl.clearSegments(0)
+	pl.pending = nil
+	pl.closed = true
+	pl.notify()
 
 	return nil
 }
 
+func (pl *Playlist) setInitSegment(uri string, data []byte) {
+	pl.l.Lock()
+	defer pl.l.Unlock()
+	pl.initURI = uri
+	pl.initSegment = data
+}
+
 func (pl *Playlist) addSegment(seg *segment) {
 	pl.l.Lock()
 	defer pl.l.Unlock()
 	pl.segments = append(pl.segments, seg)
+	if pl.pending == seg {
+		pl.pending = nil
+	}
+
+	pl.clearSegments(hlsRemainSegments)
+
+	// 只有最新的片段保留部分片段
+	for i := 0; i < len(pl.segments)-hlsRemainPartSegments; i++ {
+		pl.segments[i].parts = nil
+	}
+	pl.notify()
+}
 
+// 片段太短被丢弃时，清除正在生成的部分片段；
+// 已发布过部分片段时，片段作为 EXT-X-GAP 保留在播放列表中，返回 true，
+// 调用者不能再使用它的序号
+func (pl *Playlist) dropSegment(seg *segment) bool {
+	pl.l.Lock()
+	defer pl.l.Unlock()
+	if pl.pending == seg {
+		pl.pending = nil
+		pl.notify()
+	}
+	if len(seg.parts) == 0 {
+		return false
+	}
+
+	seg.gap = true
+	seg.parts = nil
+	pl.segments = append(pl.segments, seg)
 	pl.clearSegments(hlsRemainSegments)
+	pl.notify()
+	return true
+}
+
+func (pl *Playlist) addPart(seg *segment, p *part) {
+	pl.l.Lock()
+	defer pl.l.Unlock()
+	seg.parts = append(seg.parts, p)
+	pl.pending = seg
+	pl.notify()
+}
+
+// 通知等待播放列表更新的请求
+func (pl *Playlist) notify() {
+	close(pl.updated)
+	pl.updated = make(chan struct{})
 }
 
 func (pl *Playlist) clearSegments(remain int) {
 	if len(pl.segments) > remain {
 		for i := 0; i < len(pl.segments)-remain; i++ {
-			if err := pl.segments[i].file.delete(); err != nil {
-				// 延时异步删除
-				file := pl.segments[i].file
-				duration := time.Duration(pl.segments[i].duration * float64(time.Second))
-				uri := pl.segments[i].uri
-				scheduler.AfterFunc(duration, func() {
-					file.delete()
-				}, "delete "+uri)
+			// 作为 EXT-X-GAP 的片段在丢弃时已经删除
+			if seg := pl.segments[i]; !seg.gap {
+				if err := seg.file.delete(); err != nil {
+					// 延时异步删除
+					file := seg.file
+					duration := time.Duration(seg.duration * float64(time.Second))
+					uri := seg.uri
+					scheduler.AfterFunc(duration, func() {
+						file.delete()
+					}, "delete "+uri)
+				}
 			}
 			pl.segments[i] = nil
 		}
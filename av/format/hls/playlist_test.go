@@ -0,0 +1,181 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package hls
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cnotch/ipchub/av/format/fmp4"
+	"github.com/cnotch/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLowLatencyPlaylist(t *testing.T) {
+	pl := NewLowLatencyPlaylist(100 * time.Millisecond)
+	sg := NewFmp4SegmentGenerator(pl, "/live/test", 1, "", xlog.L())
+	defer pl.Close()
+	defer sg.Close()
+
+	// 等待播放列表可用
+	ready := make(chan error, 1)
+	go func() {
+		_, err := pl.WaitM3u8("", -1, -1, time.Second)
+		ready <- err
+	}()
+
+	sg.WriteInitSegment([]byte("init"))
+	fragmentDuration := int64(time.Second / 2)
+	writeFragment := func(i int) {
+		err := sg.WriteFragment(&fmp4.Fragment{
+			SequenceNumber: uint32(i + 1),
+			Independent:    i%2 == 0,
+			Dts:            int64(i) * fragmentDuration,
+			Duration:       fragmentDuration,
+			Data:           []byte{byte(i)},
+		})
+		assert.NoError(t, err)
+	}
+
+	// 每个片段包含 2 个部分片段，前 3 个片段完成，第 4 个片段正在生成
+	for i := 0; i < 7; i++ {
+		writeFragment(i)
+	}
+	assert.NoError(t, <-ready)
+
+	cont, err := pl.M3u8("abc")
+	if !assert.NoError(t, err) {
+		return
+	}
+	m3u8 := string(cont)
+	assert.Contains(t, m3u8, "#EXT-X-VERSION:9\n")
+	assert.Contains(t, m3u8, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=0.300\n")
+	assert.Contains(t, m3u8, "#EXT-X-PART-INF:PART-TARGET=0.100\n")
+	assert.Contains(t, m3u8, "#EXT-X-MAP:URI=\"/streams/live/test/init.mp4?token=abc\"\n")
+	assert.NotContains(t, m3u8, "/streams/live/test/1.0.m4s") // 旧片段不保留部分片段
+	assert.Contains(t, m3u8, "#EXT-X-PART:DURATION=0.500,URI=\"/streams/live/test/3.0.m4s?token=abc\",INDEPENDENT=YES\n")
+	assert.Contains(t, m3u8, "#EXT-X-PART:DURATION=0.500,URI=\"/streams/live/test/3.1.m4s?token=abc\"\n")
+	assert.Contains(t, m3u8, "#EXTINF:1.000,\n/streams/live/test/3.m4s?token=abc\n")
+	assert.True(t, strings.HasSuffix(m3u8,
+		"#EXT-X-PART:DURATION=0.500,URI=\"/streams/live/test/4.0.m4s?token=abc\",INDEPENDENT=YES\n"+
+			"#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"/streams/live/test/4.1.m4s?token=abc\"\n"))
+
+	// 阻塞请求
+	_, err = pl.WaitM3u8("", 4, 1, 50*time.Millisecond)
+	assert.Equal(t, ErrPlaylistTimeout, err)
+	_, err = pl.WaitM3u8("", 7, -1, time.Second)
+	assert.Equal(t, ErrBlockingRequest, err)
+
+	blocked := make(chan string, 1)
+	go func() {
+		cont, err := pl.WaitM3u8("", 4, 1, time.Second)
+		assert.NoError(t, err)
+		blocked <- string(cont)
+	}()
+	part := make(chan []byte, 1)
+	go func() {
+		reader, _, err := pl.Part(4, 1)
+		if assert.NoError(t, err) {
+			data, _ := ioutil.ReadAll(reader)
+			part <- data
+		}
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	writeFragment(7)
+	assert.Contains(t, <-blocked, "/streams/live/test/4.1.m4s\"\n")
+	assert.Equal(t, []byte{7}, <-part)
+
+	// 不存在的部分片段
+	_, _, err = pl.Part(1, 0)
+	assert.Error(t, err)
+	_, _, err = pl.Part(4, 2)
+	assert.Equal(t, ErrPlaylistTimeout, err)
+}
+
+// 已发布部分片段的短片段被丢弃时作为 EXT-X-GAP 保留，序号不被重用
+func TestDropSegmentGap(t *testing.T) {
+	pl := NewLowLatencyPlaylist(50 * time.Millisecond)
+	sg := NewFmp4SegmentGenerator(pl, "/live/gap", 0, "", xlog.L())
+	defer pl.Close()
+	defer sg.Close()
+
+	sg.WriteInitSegment([]byte("init"))
+	// 每个关键帧开始一个片段，第 2 个片段只有 50 毫秒
+	var dts int64
+	for i, d := range []time.Duration{200, 50, 200, 200, 200} {
+		sg.WriteFragment(&fmp4.Fragment{
+			SequenceNumber: uint32(i + 1),
+			Independent:    true,
+			Dts:            dts,
+			Duration:       int64(d * time.Millisecond),
+			Data:           []byte{byte(i)},
+		})
+		dts += int64(d * time.Millisecond)
+	}
+
+	cont, err := pl.M3u8("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	m3u8 := string(cont)
+	assert.Contains(t, m3u8, "#EXT-X-MEDIA-SEQUENCE:2\n")
+	assert.Contains(t, m3u8, "#EXT-X-GAP\n#EXTINF:0.050,\n/streams/live/gap/2.m4s\n")
+	assert.NotContains(t, m3u8, "/streams/live/gap/2.0.m4s")
+	assert.Contains(t, m3u8, "#EXTINF:0.200,\n/streams/live/gap/3.m4s\n")
+	assert.Contains(t, m3u8, "#EXTINF:0.200,\n/streams/live/gap/4.m4s\n")
+	assert.Contains(t, m3u8, "/streams/live/gap/5.0.m4s")
+
+	_, _, err = pl.Segment(2)
+	assert.Error(t, err)
+	_, _, err = pl.Segment(3)
+	assert.NoError(t, err)
+
+	m, err := ParseM3u8(strings.NewReader(m3u8))
+	if assert.NoError(t, err) && assert.Len(t, m.Segments, 3) {
+		assert.True(t, m.Segments[0].Gap)
+		assert.False(t, m.Segments[1].Gap)
+	}
+}
+
+func TestParseM3u8(t *testing.T) {
+	master := `#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=1280000,CODECS="avc1.4d401f,mp4a.40.2",RESOLUTION=1280x720
+high/index.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=640000,RESOLUTION=640x360
+low/index.m3u8
+`
+	m, err := ParseM3u8(strings.NewReader(master))
+	if assert.NoError(t, err) && assert.True(t, m.IsMaster()) {
+		assert.Equal(t, []Variant{
+			{URI: "high/index.m3u8", Bandwidth: 1280000, Codecs: "avc1.4d401f,mp4a.40.2", Resolution: "1280x720"},
+			{URI: "low/index.m3u8", Bandwidth: 640000, Resolution: "640x360"},
+		}, m.Variants)
+	}
+
+	media := "#EXTM3U\r\n#EXT-X-VERSION:3\r\n#EXT-X-TARGETDURATION:4\r\n#EXT-X-MEDIA-SEQUENCE:10\r\n" +
+		"#EXTINF:4.000,\r\n10.ts\r\n#EXT-X-DISCONTINUITY\r\n#EXTINF:3.5,title\r\n11.ts?token=1\r\n#EXT-X-ENDLIST\r\n"
+	m, err = ParseM3u8(strings.NewReader(media))
+	if assert.NoError(t, err) && assert.False(t, m.IsMaster()) {
+		assert.Equal(t, 4.0, m.TargetDuration)
+		assert.True(t, m.EndList)
+		assert.False(t, m.Encrypted)
+		assert.Equal(t, []MediaSegment{
+			{URI: "10.ts", Sequence: 10, Duration: 4},
+			{URI: "11.ts?token=1", Sequence: 11, Duration: 3.5, Discontinuity: true},
+		}, m.Segments)
+	}
+
+	m, err = ParseM3u8(strings.NewReader("#EXTM3U\n#EXT-X-KEY:METHOD=AES-128,URI=\"key\"\n#EXT-X-MAP:URI=\"init.mp4\"\n"))
+	if assert.NoError(t, err) {
+		assert.True(t, m.Encrypted)
+		assert.Equal(t, "init.mp4", m.MapURI)
+	}
+
+	_, err = ParseM3u8(strings.NewReader("<html></html>"))
+	assert.Equal(t, ErrM3u8Illegal, err)
+}
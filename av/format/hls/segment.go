@@ -6,6 +6,15 @@
 
 package hls
 
+import (
+	"bytes"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/cnotch/ipchub/av/format/mpegts"
+)
+
 // the wrapper of m3u8 segment from specification:
 // 3.3.2.  EXTINF
 // The EXTINF tag specifies the duration of a media segment.
@@ -20,10 +29,37 @@ type segment struct {
 	// fullPath string
 	// the file to write ts.
 	file segmentFile
+	// the ts writer of file, nil for fmp4 segment.
+	tsWriter mpegts.FrameWriter
 	// current segment start pts for m3u8
 	segmentStartPts int64
 	// whether current segement is sequence header.
 	isSequenceHeader bool
+	// whether the segment was dropped after its partial segments were published,
+	// it is listed with EXT-X-GAP.
+	gap bool
+
+	// LL-HLS partial segments, only retained for the latest segments.
+	parts []*part
+	// the pending partial segment data, nil when LL-HLS disabled.
+	partBuff *bytes.Buffer
+	// the pending partial segment start pts, -1 before the first frame.
+	partStartPts int64
+	// whether the pending partial segment starts with a key frame.
+	partIndependent bool
+	// whether a video frame has been written to the pending partial segment.
+	partHasVideo bool
+}
+
+// the LL-HLS partial segment from specification:
+// 4.4.4.9.  EXT-X-PART
+type part struct {
+	// duration in seconds.
+	duration float64
+	// whether the partial segment contains an independent frame.
+	independent bool
+	// the partial segment data.
+	data []byte
 }
 
 func newSegment(memory bool) *segment {
@@ -36,6 +72,50 @@ func newSegment(memory bool) *segment {
 	return seg
 }
 
+// enable LL-HLS partial segments.
+func (seg *segment) enableParts() {
+	seg.partBuff = &bytes.Buffer{}
+	seg.partStartPts = -1
+}
+
+// Write writes to the segment file, and to the pending partial segment when LL-HLS enabled.
+func (seg *segment) Write(p []byte) (n int, err error) {
+	if n, err = seg.file.Write(p); err != nil {
+		return
+	}
+	if seg.partBuff != nil {
+		seg.partBuff.Write(p)
+	}
+	return
+}
+
+// close the pending partial segment, return nil when it is empty.
+func (seg *segment) closePart(endPts int64) *part {
+	if seg.partBuff == nil || seg.partBuff.Len() == 0 || seg.partStartPts < 0 {
+		return nil
+	}
+
+	p := &part{
+		independent: seg.partIndependent,
+		data:        append([]byte(nil), seg.partBuff.Bytes()...),
+	}
+	if endPts > seg.partStartPts {
+		p.duration = float64(endPts-seg.partStartPts) / 90000.0
+	}
+
+	seg.partBuff.Reset()
+	seg.partStartPts = endPts
+	seg.partIndependent = false
+	seg.partHasVideo = false
+	return p
+}
+
+// the uri of the partial segment, for example: /streams/live/1.2.ts
+func (seg *segment) partURI(index int) string {
+	ext := path.Ext(seg.uri)
+	return strings.TrimSuffix(seg.uri, ext) + "." + strconv.Itoa(index) + ext
+}
+
 func (seg *segment) updateDuration(currentFramePts int64) {
 
 	// we use video/audio to update segment duration,
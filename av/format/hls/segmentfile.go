@@ -13,14 +13,12 @@ import (
 	"io"
 	"os"
 	"sync"
-
-	"github.com/cnotch/ipchub/av/format/mpegts"
 )
 
 type segmentFile interface {
+	io.Writer
 	open(path string) error
 	close() error
-	writeFrame(frame *mpegts.Frame) error
 	get() (io.Reader, int, error)
 	delete() error
 }
@@ -33,7 +31,6 @@ var segmentPool = sync.Pool{
 
 type memorySegmentFile struct {
 	file *bytes.Buffer
-	w    mpegts.FrameWriter
 }
 
 func newMemorySegmentFile() segmentFile {
@@ -43,16 +40,14 @@ func newMemorySegmentFile() segmentFile {
 func (mf *memorySegmentFile) open(path string) (err error) {
 	mf.file = segmentPool.Get().(*bytes.Buffer)
 	mf.file.Reset()
-	mf.w, err = mpegts.NewWriter(mf.file)
 	return
 }
 
-func (mf *memorySegmentFile) writeFrame(frame *mpegts.Frame) (err error) {
-	return mf.w.WriteMpegtsFrame(frame)
+func (mf *memorySegmentFile) Write(p []byte) (n int, err error) {
+	return mf.file.Write(p)
 }
 
 func (mf *memorySegmentFile) close() (err error) {
-	mf.w = nil
 	return
 }
 
@@ -73,7 +68,6 @@ type persistentSegmentFile struct {
 	path string
 	file *os.File
 	buff *bufio.Writer
-	w    mpegts.FrameWriter
 }
 
 func newPersistentSegmentFile() segmentFile {
@@ -88,12 +82,11 @@ func (pf *persistentSegmentFile) open(path string) (err error) {
 	}
 
 	pf.buff = bufio.NewWriterSize(pf.file, 64*1024)
-	pf.w, err = mpegts.NewWriter(pf.buff)
 	return
 }
 
-func (pf *persistentSegmentFile) writeFrame(frame *mpegts.Frame) (err error) {
-	return pf.w.WriteMpegtsFrame(frame)
+func (pf *persistentSegmentFile) Write(p []byte) (n int, err error) {
+	return pf.buff.Write(p)
 }
 
 func (pf *persistentSegmentFile) close() (err error) {
@@ -107,7 +100,6 @@ func (pf *persistentSegmentFile) close() (err error) {
 	// after close, rest the file write to nil
 	pf.file = nil
 	pf.buff = nil
-	pf.w = nil
 	return nil
 }
 
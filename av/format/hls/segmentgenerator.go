@@ -9,8 +9,10 @@ package hls
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"path/filepath"
 	"strconv"
+	"sync/atomic"
 
 	"github.com/cnotch/ipchub/av/format/mpegts"
 	"github.com/cnotch/ipchub/utils/murmur"
@@ -23,6 +25,17 @@ const hlsSegmentMinDurationMs = 100
 // in ms, for HLS aac flush the audio
 const hlsAacDelay = 100
 
+// SegmentArchiver 归档完成的 TS 片段，如用于录像回放
+type SegmentArchiver interface {
+	// ArchiveSegment 在片段完成时调用，discontinuity 表示片段与之前的片段不连续
+	ArchiveSegment(data io.Reader, size int, duration float64, discontinuity bool) error
+}
+
+// 包装归档者以便存储到 atomic.Value
+type archiverHolder struct {
+	archiver SegmentArchiver
+}
+
 // SegmentGenerator generate the HLS ts segment.
 type SegmentGenerator struct {
 	playlist    *Playlist // 播放列表
@@ -32,9 +45,14 @@ type SegmentGenerator struct {
 	memory      bool   // 使用内存存储缓存到硬盘
 	segmentPath string // 缓存文件路径
 
+	videoStreamType byte // 视频的 mpegts stream_type
+
 	sequenceNo int      // 片段序号
 	current    *segment //current segment
 
+	partTarget   int64 // LL-HLS 部分片段目标时长，单位 1/90000 秒
+	lastVideoPts int64 // 最后一个视频帧的 pts，用于估计帧间隔
+
 	logger *xlog.Logger
 
 	audioRate   int
@@ -42,20 +60,24 @@ type SegmentGenerator struct {
 	afCacheBuff bytes.Buffer
 	// time jitter for aac
 	aacJitter *hlsAacJitter
+
+	archiver atomic.Value // archiverHolder
 }
 
 // NewSegmentGenerator .
-func NewSegmentGenerator(playlist *Playlist, path string, hlsFragment int, segmentPath string, audioRate int, logger *xlog.Logger) (*SegmentGenerator, error) {
+func NewSegmentGenerator(playlist *Playlist, path string, hlsFragment int, segmentPath string, videoStreamType byte, audioRate int, logger *xlog.Logger) (*SegmentGenerator, error) {
 	sg := &SegmentGenerator{
-		playlist:    playlist,
-		path:        path,
-		hlsFragment: hlsFragment,
-		memory:      segmentPath == "",
-		segmentPath: segmentPath,
-		logger:      logger,
-		sequenceNo:  0,
-		audioRate:   audioRate,
-		aacJitter:   newHlsAacJitter(),
+		playlist:        playlist,
+		path:            path,
+		hlsFragment:     hlsFragment,
+		memory:          segmentPath == "",
+		segmentPath:     segmentPath,
+		videoStreamType: videoStreamType,
+		logger:          logger,
+		sequenceNo:      0,
+		audioRate:       audioRate,
+		aacJitter:       newHlsAacJitter(),
+		partTarget:      int64(playlist.partTarget * 90000),
 	}
 
 	if err := sg.segmentOpen(0); err != nil {
@@ -88,6 +110,13 @@ func (sg *SegmentGenerator) segmentOpen(segmentStartDts int64) (err error) {
 	if err = curr.file.open(tsFilePath); err != nil {
 		return
 	}
+	if sg.partTarget > 0 {
+		curr.enableParts()
+	}
+	if curr.tsWriter, err = mpegts.NewWriter(curr, sg.videoStreamType); err != nil {
+		curr.file.delete()
+		return
+	}
 
 	sg.current = curr
 	return
@@ -139,7 +168,10 @@ func (sg *SegmentGenerator) WriteMpegtsFrame(frame *mpegts.Frame) (err error) {
 		if err = sg.reapSegment(frame.Pts); err != nil {
 			return
 		}
+	} else if sg.isPartOverflow(frame.Pts) {
+		sg.reapPart(frame.Pts)
 	}
+	sg.lastVideoPts = frame.Pts
 
 	// flush video when got one
 	if err = sg.flushFrame(frame); err != nil {
@@ -161,8 +193,19 @@ func (sg *SegmentGenerator) flushAudioCache() (err error) {
 }
 
 func (sg *SegmentGenerator) flushFrame(frame *mpegts.Frame) (err error) {
+	curr := sg.current
+	if curr.partBuff != nil {
+		if curr.partStartPts < 0 {
+			curr.partStartPts = frame.Pts
+		}
+		if !frame.IsAudio() && !curr.partHasVideo {
+			curr.partHasVideo = true
+			curr.partIndependent = frame.IsKeyFrame()
+		}
+	}
+
 	sg.current.updateDuration(frame.Pts)
-	if err = sg.current.file.writeFrame(frame); err != nil {
+	if err = sg.current.tsWriter.WriteMpegtsFrame(frame); err != nil {
 		return
 	}
 	return
@@ -178,15 +221,69 @@ func (sg *SegmentGenerator) segmentClose() (err error) {
 	sg.current = nil
 	curr.file.close()
 	if curr.duration*1000 < hlsSegmentMinDurationMs {
-		// reuse current segment index
-		sg.sequenceNo--
 		curr.file.delete()
+		if !sg.playlist.dropSegment(curr) {
+			// reuse current segment index
+			sg.sequenceNo--
+		}
 	} else {
+		// the last partial segment
+		if p := curr.closePart(curr.segmentStartPts + int64(curr.duration*90000)); p != nil {
+			sg.playlist.addPart(curr, p)
+		}
+		// 加入播放列表前归档，避免片段被移出播放列表时删除
+		sg.archiveSegment(curr)
 		sg.playlist.addSegment(curr)
 	}
 	return
 }
 
+// SetArchiver 设置完成片段的归档者，a 为 nil 时停止归档
+func (sg *SegmentGenerator) SetArchiver(a SegmentArchiver) {
+	sg.archiver.Store(archiverHolder{a})
+}
+
+func (sg *SegmentGenerator) archiveSegment(seg *segment) {
+	holder, _ := sg.archiver.Load().(archiverHolder)
+	if holder.archiver == nil {
+		return
+	}
+
+	reader, size, err := seg.file.get()
+	if err != nil {
+		sg.logger.Errorf("hls: archive segment %s failed; %s", seg.uri, err.Error())
+		return
+	}
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+	if err = holder.archiver.ArchiveSegment(reader, size, seg.duration, seg.isSequenceHeader); err != nil {
+		sg.logger.Errorf("hls: archive segment %s failed; %s", seg.uri, err.Error())
+	}
+}
+
+// whether the pending partial segment will exceed the part target duration
+// after writing the video frame.
+func (sg *SegmentGenerator) isPartOverflow(pts int64) bool {
+	curr := sg.current
+	if curr.partBuff == nil || curr.partStartPts < 0 || !curr.partHasVideo {
+		return false
+	}
+
+	interval := pts - sg.lastVideoPts
+	if interval < 0 {
+		interval = 0
+	}
+	return pts+interval-curr.partStartPts > sg.partTarget
+}
+
+// close the pending partial segment and publish it to playlist.
+func (sg *SegmentGenerator) reapPart(endPts int64) {
+	if p := sg.current.closePart(endPts); p != nil {
+		sg.playlist.addPart(sg.current, p)
+	}
+}
+
 // reopen the sg for a new hls segment,
 // close current segment, open a new segment,
 // then write the key frame to the new segment.
@@ -0,0 +1,44 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package hls
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"time"
+)
+
+// VodSegment VOD 播放列表中的片段
+type VodSegment struct {
+	URI           string
+	Duration      float64   // 时长，单位秒
+	Start         time.Time // 片段开始的时间，用于 EXT-X-PROGRAM-DATE-TIME
+	Discontinuity bool      // 是否与前一个片段不连续
+}
+
+// VodM3u8 生成 EXT-X-PLAYLIST-TYPE:VOD 的播放列表
+func VodM3u8(segments []VodSegment) []byte {
+	var maxDuration float64
+	for i := range segments {
+		maxDuration = math.Max(maxDuration, segments[i].Duration)
+	}
+
+	w := &bytes.Buffer{}
+	fmt.Fprintf(w,
+		"#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:0\n\n",
+		int(math.Ceil(maxDuration)))
+
+	for i := range segments {
+		seg := &segments[i]
+		if seg.Discontinuity && i > 0 {
+			fmt.Fprint(w, "#EXT-X-DISCONTINUITY\n")
+		}
+		fmt.Fprintf(w, "#EXT-X-PROGRAM-DATE-TIME:%s\n#EXTINF:%.3f,\n%s\n",
+			seg.Start.Format("2006-01-02T15:04:05.000Z07:00"), seg.Duration, seg.URI)
+	}
+	fmt.Fprint(w, "#EXT-X-ENDLIST\n")
+	return w.Bytes()
+}
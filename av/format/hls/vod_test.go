@@ -0,0 +1,29 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package hls
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVodM3u8(t *testing.T) {
+	start := time.Date(2020, 5, 1, 8, 0, 0, 0, time.UTC)
+	cont := VodM3u8([]VodSegment{
+		{URI: "/streams/live/cam1.ts?seg=1", Duration: 2, Start: start, Discontinuity: true},
+		{URI: "/streams/live/cam1.ts?seg=2", Duration: 2.5, Start: start.Add(2 * time.Second)},
+		{URI: "/streams/live/cam1.ts?seg=3", Duration: 2, Start: start.Add(time.Minute), Discontinuity: true},
+	})
+
+	expected := "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-TARGETDURATION:3\n#EXT-X-MEDIA-SEQUENCE:0\n\n" +
+		"#EXT-X-PROGRAM-DATE-TIME:2020-05-01T08:00:00.000Z\n#EXTINF:2.000,\n/streams/live/cam1.ts?seg=1\n" +
+		"#EXT-X-PROGRAM-DATE-TIME:2020-05-01T08:00:02.000Z\n#EXTINF:2.500,\n/streams/live/cam1.ts?seg=2\n" +
+		"#EXT-X-DISCONTINUITY\n" +
+		"#EXT-X-PROGRAM-DATE-TIME:2020-05-01T08:01:00.000Z\n#EXTINF:2.000,\n/streams/live/cam1.ts?seg=3\n" +
+		"#EXT-X-ENDLIST\n"
+	assert.Equal(t, expected, string(cont))
+}
@@ -0,0 +1,578 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mpegts
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"github.com/cnotch/ipchub/av/codec"
+	"github.com/cnotch/ipchub/av/codec/aac"
+	"github.com/cnotch/ipchub/av/codec/h264"
+	"github.com/cnotch/ipchub/av/codec/hevc"
+)
+
+// ts 包大小
+const tsPacketSize = 188
+
+// PAT 的 PID
+const patPid = 0
+
+// 33 位时间戳的回绕周期
+const tsWrapPeriod = int64(1) << 33
+
+// ts 包格式错误
+var errPacketIllegal = errors.New("mpegts demuxer: ts packet illegal")
+
+// Demuxer mpegts 解封装器，输出 codec.Frame(H264/H265[+AAC])
+//
+// 从 PAT、PMT 获取第一个节目的音视频 PID 和编码，重组 PES 后输出 codec.Frame；
+// 元数据从 PMT、码流中的参数集和 ADTS 头中提取，并写入构造时传入的 videoMeta 和 audioMeta。
+// 视频 PES 中的多个 NALU 会被拆分成多个 codec.Frame，时间戳从第一个 PES 开始计算。
+// 与 Muxer 不同，Demuxer 在调用者的 routine 中同步处理。
+type Demuxer struct {
+	videoMeta *codec.VideoMeta
+	audioMeta *codec.AudioMeta
+	fw        codec.FrameWriter
+
+	pending    [tsPacketSize]byte // 不完整的 ts 包
+	pendingLen int
+	pmtPid     int
+	video      pesStream
+	audio      pesStream
+	baseTs     int64 // 第一个 PES 的 DTS，-1 表示未开始
+	offset     int64 // 不连续后输出时间戳的偏移(ns)
+	lastDts    int64 // 已输出的最大 DTS(ns)
+	lastDelta  int64 // 最近一次 DTS 的增量(ns)
+}
+
+// PES 重组状态
+type pesStream struct {
+	pid       int // 0 表示节目中没有该媒体
+	started   bool
+	lost      bool // 重组中出现丢包，丢弃当前 PES
+	cc        byte
+	pts       int64
+	dts       int64
+	size      int // PES 载荷长度，0 表示不确定
+	buf       bytes.Buffer
+	lastTs    int64 // 上一个 33 位时间戳，用于处理回绕
+	hasLastTs bool
+	wrapCount int64
+}
+
+// NewDemuxer 创建 mpegts 解封装器
+func NewDemuxer(videoMeta *codec.VideoMeta, audioMeta *codec.AudioMeta, fw codec.FrameWriter) *Demuxer {
+	return &Demuxer{
+		videoMeta: videoMeta,
+		audioMeta: audioMeta,
+		fw:        fw,
+		pmtPid:    -1,
+		baseTs:    -1,
+	}
+}
+
+// VideoMetadataIsReady 视频元数据是否已经就绪
+func (demuxer *Demuxer) VideoMetadataIsReady() bool {
+	switch demuxer.videoMeta.Codec {
+	case "H264":
+		return h264.MetadataIsReady(demuxer.videoMeta)
+	case "H265":
+		return hevc.MetadataIsReady(demuxer.videoMeta)
+	}
+	return false
+}
+
+// AudioMetadataIsReady 音频元数据是否已经就绪
+func (demuxer *Demuxer) AudioMetadataIsReady() bool {
+	if demuxer.audioMeta.Codec == "AAC" {
+		return aac.MetadataIsReady(demuxer.audioMeta)
+	}
+	return false
+}
+
+// ProgramIsReady 是否已经从 PMT 获取节目的音视频信息
+func (demuxer *Demuxer) ProgramIsReady() bool {
+	return demuxer.video.pid != 0 || demuxer.audio.pid != 0
+}
+
+// Write 写入 ts 流数据，数据可以不按 ts 包对齐；实现 io.Writer 接口
+func (demuxer *Demuxer) Write(p []byte) (n int, err error) {
+	n = len(p)
+
+	// 补齐上次不完整的 ts 包
+	if demuxer.pendingLen > 0 {
+		m := copy(demuxer.pending[demuxer.pendingLen:], p)
+		demuxer.pendingLen += m
+		p = p[m:]
+		if demuxer.pendingLen < tsPacketSize {
+			return
+		}
+		demuxer.pendingLen = 0
+		if err = demuxer.writePacket(demuxer.pending[:]); err != nil {
+			return
+		}
+	}
+
+	for len(p) > 0 {
+		// 查找同步字节
+		if p[0] != 0x47 {
+			i := bytes.IndexByte(p, 0x47)
+			if i < 0 {
+				return
+			}
+			p = p[i:]
+		}
+
+		if len(p) < tsPacketSize {
+			demuxer.pendingLen = copy(demuxer.pending[:], p)
+			return
+		}
+
+		if err = demuxer.writePacket(p[:tsPacketSize]); err != nil {
+			return
+		}
+		p = p[tsPacketSize:]
+	}
+	return
+}
+
+// Flush 输出缓存中最后一个 PES，用于流结束时
+func (demuxer *Demuxer) Flush() error {
+	if err := demuxer.flushPes(&demuxer.video); err != nil {
+		return err
+	}
+	return demuxer.flushPes(&demuxer.audio)
+}
+
+// Discontinue 处理流的不连续(如 HLS 的 EXT-X-DISCONTINUITY 或片段丢失)；
+// 输出缓存的 PES 后重新开始重组，之后的时间戳接续在已输出的帧之后
+func (demuxer *Demuxer) Discontinue() error {
+	err := demuxer.Flush()
+	demuxer.pendingLen = 0
+	demuxer.video.reset()
+	demuxer.audio.reset()
+	if demuxer.baseTs >= 0 {
+		demuxer.baseTs = -1
+		demuxer.offset = demuxer.lastDts + demuxer.lastDelta
+	}
+	return err
+}
+
+func (pes *pesStream) reset() {
+	pes.started = false
+	pes.lost = false
+	pes.buf.Reset()
+	pes.hasLastTs = false
+	pes.wrapCount = 0
+}
+
+func (demuxer *Demuxer) writePacket(pkt []byte) error {
+	pusi := pkt[1]&0x40 != 0
+	pid := int(pkt[1]&0x1f)<<8 | int(pkt[2])
+	afc := (pkt[3] >> 4) & 0x03
+	cc := pkt[3] & 0x0f
+
+	payload := pkt[4:]
+	discontinuity := false
+	if afc&0x02 != 0 { // adaptation field
+		afLen := int(payload[0])
+		if 1+afLen > len(payload) {
+			return errPacketIllegal
+		}
+		if afLen > 0 {
+			discontinuity = payload[1]&0x80 != 0
+		}
+		payload = payload[1+afLen:]
+	}
+	if afc&0x01 == 0 || len(payload) == 0 { // 无载荷
+		return nil
+	}
+
+	switch pid {
+	case patPid:
+		demuxer.parsePat(pusi, payload)
+		return nil
+	case demuxer.pmtPid:
+		demuxer.parsePmt(pusi, payload)
+		return nil
+	}
+
+	var pes *pesStream
+	switch pid {
+	case demuxer.video.pid:
+		pes = &demuxer.video
+	case demuxer.audio.pid:
+		pes = &demuxer.audio
+	default:
+		return nil
+	}
+
+	// 连续计数器不连续表示丢包，相同表示重复的包
+	if pes.started && !discontinuity {
+		if cc == pes.cc {
+			return nil
+		}
+		if cc != (pes.cc+1)&0x0f {
+			pes.lost = true
+		}
+	}
+	pes.cc = cc
+
+	if pusi {
+		if err := demuxer.flushPes(pes); err != nil {
+			return err
+		}
+		return demuxer.startPes(pes, payload)
+	}
+
+	if !pes.started {
+		return nil // 等待 PES 开始
+	}
+	pes.buf.Write(payload)
+	if pes.size > 0 && pes.buf.Len() >= pes.size {
+		return demuxer.flushPes(pes)
+	}
+	return nil
+}
+
+// 获取 PSI 的 section 数据(不含 CRC)，只处理包含在一个 ts 包中的 section
+func psiSection(pusi bool, payload []byte) []byte {
+	if !pusi {
+		return nil
+	}
+
+	pointer := int(payload[0])
+	if 1+pointer+3 > len(payload) {
+		return nil
+	}
+	section := payload[1+pointer:]
+	sectionLen := int(section[1]&0x0f)<<8 | int(section[2])
+	if sectionLen < 9 || 3+sectionLen > len(section) {
+		return nil
+	}
+
+	// 包括 CRC 在内计算的 CRC 为 0
+	if crc32Mpeg2(section[:3+sectionLen]) != 0 {
+		return nil
+	}
+	return section[:3+sectionLen-4]
+}
+
+func (demuxer *Demuxer) parsePat(pusi bool, payload []byte) {
+	section := psiSection(pusi, payload)
+	if section == nil || section[0] != 0x00 { // program_association_section
+		return
+	}
+
+	// 跳过 section 头，每个节目 4 字节
+	for entries := section[8:]; len(entries) >= 4; entries = entries[4:] {
+		programNumber := int(entries[0])<<8 | int(entries[1])
+		if programNumber != 0 { // 0 为网络信息表
+			demuxer.pmtPid = int(entries[2]&0x1f)<<8 | int(entries[3])
+			return
+		}
+	}
+}
+
+func (demuxer *Demuxer) parsePmt(pusi bool, payload []byte) {
+	section := psiSection(pusi, payload)
+	if section == nil || section[0] != 0x02 || len(section) < 12 { // TS_program_map_section
+		return
+	}
+
+	programInfoLen := int(section[10]&0x0f)<<8 | int(section[11])
+	if 12+programInfoLen > len(section) {
+		return
+	}
+
+	var videoPid, audioPid int
+	var videoCodec, audioCodec string
+	for es := section[12+programInfoLen:]; len(es) >= 5; {
+		streamType := es[0]
+		pid := int(es[1]&0x1f)<<8 | int(es[2])
+		esInfoLen := int(es[3]&0x0f)<<8 | int(es[4])
+
+		switch streamType {
+		case StreamTypeH264, StreamTypeH265:
+			if videoPid == 0 {
+				videoPid = pid
+				videoCodec = "H264"
+				if streamType == StreamTypeH265 {
+					videoCodec = "H265"
+				}
+			}
+		case StreamTypeAac:
+			if audioPid == 0 {
+				audioPid, audioCodec = pid, "AAC"
+			}
+		}
+
+		if 5+esInfoLen > len(es) {
+			break
+		}
+		es = es[5+esInfoLen:]
+	}
+
+	// 节目中的编码变化时忽略，保持最初的设置
+	if demuxer.videoMeta.Codec == "" || demuxer.videoMeta.Codec == videoCodec {
+		demuxer.videoMeta.Codec = videoCodec
+		demuxer.video.pid = videoPid
+	}
+	if demuxer.audioMeta.Codec == "" || demuxer.audioMeta.Codec == audioCodec {
+		demuxer.audioMeta.Codec = audioCodec
+		demuxer.audio.pid = audioPid
+	}
+}
+
+func (demuxer *Demuxer) startPes(pes *pesStream, payload []byte) error {
+	pes.started = false
+	pes.lost = false
+	pes.buf.Reset()
+
+	// packet_start_code_prefix(24) stream_id(8) PES_packet_length(16) flags(16) PES_header_data_length(8)
+	if len(payload) < 9 || payload[0] != 0 || payload[1] != 0 || payload[2] != 1 {
+		return nil
+	}
+	pesLen := int(payload[4])<<8 | int(payload[5])
+	flags := payload[7]
+	headerLen := int(payload[8])
+	if 9+headerLen > len(payload) {
+		return nil
+	}
+
+	header := payload[9 : 9+headerLen]
+	switch flags >> 6 {
+	case 0x02: // 只有 PTS
+		if len(header) < 5 {
+			return nil
+		}
+		pes.pts = pes.unwrap(readTimestamp(header))
+		pes.dts = pes.pts
+	case 0x03: // PTS 和 DTS
+		if len(header) < 10 {
+			return nil
+		}
+		pes.pts = pes.unwrap(readTimestamp(header))
+		pes.dts = pes.unwrap(readTimestamp(header[5:]))
+	default:
+		return nil
+	}
+
+	pes.size = 0
+	if pesLen > 0 {
+		pes.size = pesLen - 3 - headerLen
+	}
+	pes.started = true
+	pes.buf.Write(payload[9+headerLen:])
+	if pes.size > 0 && pes.buf.Len() >= pes.size {
+		return demuxer.flushPes(pes)
+	}
+	return nil
+}
+
+// 读取 PES 头中 33 位的 PTS 或 DTS
+func readTimestamp(b []byte) int64 {
+	return int64(b[0]>>1&0x07)<<30 |
+		int64(b[1])<<22 | int64(b[2]>>1)<<15 |
+		int64(b[3])<<7 | int64(b[4]>>1)
+}
+
+// 处理 33 位时间戳的回绕
+func (pes *pesStream) unwrap(ts int64) int64 {
+	if pes.hasLastTs {
+		if ts < pes.lastTs-tsWrapPeriod/2 {
+			pes.wrapCount++
+		} else if ts > pes.lastTs+tsWrapPeriod/2 && pes.wrapCount > 0 {
+			return ts + (pes.wrapCount-1)*tsWrapPeriod // 回绕前的乱序时间戳
+		}
+	}
+	pes.lastTs, pes.hasLastTs = ts, true
+	return ts + pes.wrapCount*tsWrapPeriod
+}
+
+func (demuxer *Demuxer) flushPes(pes *pesStream) (err error) {
+	if !pes.started {
+		return nil
+	}
+	pes.started = false
+	if pes.lost || pes.buf.Len() == 0 {
+		return nil
+	}
+
+	data := pes.buf.Bytes()
+	if pes.size > 0 && len(data) > pes.size {
+		data = data[:pes.size]
+	}
+	// 输出的帧引用载荷数据，因此不重用缓冲
+	data = append([]byte(nil), data...)
+	pes.buf.Reset()
+
+	if demuxer.baseTs < 0 {
+		demuxer.baseTs = pes.dts
+	}
+	if pes.dts < demuxer.baseTs {
+		return nil // 第一个 PES 之前的数据
+	}
+
+	dts := demuxer.offset + tsToDuration(pes.dts-demuxer.baseTs)
+	pts := demuxer.offset + tsToDuration(pes.pts-demuxer.baseTs)
+	if dts > demuxer.lastDts {
+		demuxer.lastDelta = dts - demuxer.lastDts
+		demuxer.lastDts = dts
+	}
+	if pes == &demuxer.video {
+		return demuxer.demuxVideo(data, dts, pts)
+	}
+	return demuxer.demuxAudio(data, pts)
+}
+
+// 90000Hz 时间戳转换为 ns
+func tsToDuration(ts int64) int64 {
+	return ts * int64(time.Second) / 90000
+}
+
+func (demuxer *Demuxer) demuxVideo(data []byte, dts, pts int64) error {
+	for _, nalu := range splitNalus(data) {
+		if !demuxer.acceptNalu(nalu) {
+			continue
+		}
+
+		frame := &codec.Frame{
+			MediaType: codec.MediaTypeVideo,
+			Dts:       dts,
+			Pts:       pts,
+			Payload:   nalu,
+		}
+		if err := demuxer.fw.WriteFrame(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 拆分 AnnexB 格式的 NALU
+func splitNalus(data []byte) (nalus [][]byte) {
+	start := -1
+	for i := 0; i+2 < len(data); {
+		if data[i+2] > 1 {
+			i += 3
+			continue
+		}
+		if data[i] == 0 && data[i+1] == 0 && data[i+2] == 1 {
+			if start >= 0 {
+				end := i
+				for end > start && data[end-1] == 0 { // 4 字节前缀及尾部填充
+					end--
+				}
+				if end > start {
+					nalus = append(nalus, data[start:end])
+				}
+			}
+			i += 3
+			start = i
+			continue
+		}
+		i++
+	}
+
+	if start >= 0 && start < len(data) {
+		nalus = append(nalus, data[start:])
+	}
+	return
+}
+
+// 提取 nalu 中的参数集，并过滤掉 AUD 等无需转发的 nalu
+func (demuxer *Demuxer) acceptNalu(nalu []byte) bool {
+	meta := demuxer.videoMeta
+	if meta.Codec == "H264" {
+		switch nalu[0] & h264.NalTypeBitmask {
+		case h264.NalSps:
+			demuxer.updateParameterSet(&meta.Sps, nalu, &meta.Pps)
+		case h264.NalPps:
+			demuxer.updateParameterSet(&meta.Pps, nalu)
+		case h264.NalAud, h264.NalFillerData:
+			return false
+		}
+		return true
+	}
+
+	switch (nalu[0] >> 1) & 0x3f {
+	case hevc.NalVps:
+		demuxer.updateParameterSet(&meta.Vps, nalu, &meta.Sps, &meta.Pps)
+	case hevc.NalSps:
+		demuxer.updateParameterSet(&meta.Sps, nalu, &meta.Pps)
+	case hevc.NalPps:
+		demuxer.updateParameterSet(&meta.Pps, nalu)
+	case hevc.NalAud:
+		return false
+	}
+	return true
+}
+
+// 参数集变化时替换保存的参数集，并清除随后的参数集，
+// 使元数据在新的参数集都收到之前不就绪
+func (demuxer *Demuxer) updateParameterSet(ps *[]byte, nalu []byte, follows ...*[]byte) {
+	if bytes.Equal(*ps, nalu) {
+		return
+	}
+
+	changed := len(*ps) > 0
+	*ps = nalu
+	if !changed {
+		return
+	}
+	for _, follow := range follows {
+		*follow = nil
+	}
+	// 重新解析宽高等信息
+	demuxer.videoMeta.Width = 0
+	demuxer.videoMeta.Height = 0
+}
+
+// 拆分 ADTS 格式的 AAC 帧，一个 PES 中可能包含多个帧
+func (demuxer *Demuxer) demuxAudio(data []byte, pts int64) error {
+	meta := demuxer.audioMeta
+	for len(data) >= 7 {
+		if data[0] != 0xff || data[1]&0xf0 != 0xf0 {
+			return nil // 同步字错误，丢弃剩余数据
+		}
+
+		var header aac.ADTSHeader
+		copy(header[:], data)
+		headerLen := 7
+		if data[1]&0x01 == 0 { // 包含 CRC
+			headerLen = 9
+		}
+		frameLen := header.FrameLength()
+		if frameLen <= headerLen || frameLen > len(data) {
+			return nil
+		}
+
+		if len(meta.Sps) == 0 {
+			meta.Sps = header.ToAsc()
+			meta.SampleRate = 0
+		}
+		if !demuxer.AudioMetadataIsReady() {
+			return nil
+		}
+
+		frame := &codec.Frame{
+			MediaType: codec.MediaTypeAudio,
+			Dts:       pts,
+			Pts:       pts,
+			Payload:   data[headerLen:frameLen],
+		}
+		if err := demuxer.fw.WriteFrame(frame); err != nil {
+			return err
+		}
+
+		// 每个 AAC 帧 1024 个采样
+		pts += int64(time.Second) * 1024 / int64(meta.SampleRate)
+		data = data[frameLen:]
+	}
+	return nil
+}
@@ -9,6 +9,7 @@ package mpegts
 import (
 	"github.com/cnotch/ipchub/av/codec/aac"
 	"github.com/cnotch/ipchub/av/codec/h264"
+	"github.com/cnotch/ipchub/av/codec/hevc"
 )
 
 // the mpegts header specifed the video/audio pid.
@@ -19,8 +20,9 @@ const (
 
 // the mpegts header specifed the stream id.
 const (
-	tsAudioAac = 0xc0 // ts aac stream id.
-	tsVideoAvc = 0xe0 // ts avc stream id.
+	tsAudioAac  = 0xc0 // ts aac stream id.
+	tsVideoAvc  = 0xe0 // ts avc stream id.
+	tsVideoHevc = 0xe0 // ts hevc stream id.
 )
 
 // Frame mpegts frame
@@ -49,6 +51,11 @@ func (frame *Frame) IsKeyFrame() bool {
 	return frame.key
 }
 
+// Size 帧数据大小
+func (frame *Frame) Size() int {
+	return len(frame.Header) + len(frame.Payload)
+}
+
 func (frame *Frame) prepareAvcHeader(sps, pps []byte) {
 	// a ts sample is format as:
 	// 00 00 00 01 // header
@@ -118,6 +125,34 @@ func (frame *Frame) prepareAvcHeader(sps, pps []byte) {
 	return
 }
 
+func (frame *Frame) prepareHevcHeader(vps, sps, pps []byte) {
+	// 与 AVC 相同，每个 VCL 或 SEI 前插入 AUD；
+	// AUD: nal_unit_type=35, nuh_layer_id=0, nuh_temporal_id_plus1=1, pic_type=2
+	audNal := []byte{0x00, 0x00, 0x00, 0x01, 0x46, 0x01, 0x50}
+
+	nalUnitType := (frame.Payload[0] >> 1) & 0x3f
+	if nalUnitType < hevc.NalVps || nalUnitType == hevc.NalSeiPrefix {
+		frame.Header = append(frame.Header, audNal...)
+	}
+
+	// IRAP(IDR、CRA、BLA) 前插入 VPS/SPS/PPS
+	if nalUnitType >= hevc.NalBlaWLp && nalUnitType <= hevc.NalCraNut {
+		for _, ps := range [][]byte{vps, sps, pps} {
+			if len(ps) > 0 {
+				frame.Header = append(frame.Header, audNal[:4]...)
+				frame.Header = append(frame.Header, ps...)
+			}
+		}
+	}
+
+	// 第一个 AnnexB 前缀使用 4 字节
+	if 0 == len(frame.Header) {
+		frame.Header = append(frame.Header, audNal[:4]...)
+	} else {
+		frame.Header = append(frame.Header, audNal[1:4]...)
+	}
+}
+
 func (frame *Frame) prepareAacHeader(sps *aac.RawSPS) {
 	adtsHeader := sps.ToAdtsHeader(len(frame.Payload))
 	frame.Header = adtsHeader[:]
@@ -128,3 +163,21 @@ func (frame *Frame) prepareAacHeader(sps *aac.RawSPS) {
 type FrameWriter interface {
 	WriteMpegtsFrame(frame *Frame) error
 }
+
+type multiFrameWriter struct {
+	writers []FrameWriter
+}
+
+// MultiFrameWriter 创建一个将帧写入所有 writers 的 FrameWriter
+func MultiFrameWriter(writers ...FrameWriter) FrameWriter {
+	return &multiFrameWriter{writers: writers}
+}
+
+func (mw *multiFrameWriter) WriteMpegtsFrame(frame *Frame) (err error) {
+	for _, w := range mw.writers {
+		if err2 := w.WriteMpegtsFrame(frame); err2 != nil {
+			err = err2
+		}
+	}
+	return
+}
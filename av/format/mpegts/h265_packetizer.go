@@ -0,0 +1,50 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mpegts
+
+import (
+	"time"
+
+	"github.com/cnotch/ipchub/av/codec"
+	"github.com/cnotch/ipchub/av/codec/hevc"
+)
+
+type h265Packetizer struct {
+	meta          *codec.VideoMeta
+	tsframeWriter FrameWriter
+}
+
+func NewH265Packetizer(meta *codec.VideoMeta, tsframeWriter FrameWriter) Packetizer {
+	h265p := &h265Packetizer{
+		meta:          meta,
+		tsframeWriter: tsframeWriter,
+	}
+	return h265p
+}
+
+func (h265p *h265Packetizer) Packetize(frame *codec.Frame) error {
+	nalType := (frame.Payload[0] >> 1) & 0x3f
+
+	// 参数集在 IRAP 前插入，AUD 自动生成
+	if nalType >= hevc.NalVps && nalType <= hevc.NalAud {
+		return nil
+	}
+
+	dts := frame.Dts * 90000 / int64(time.Second) // 90000Hz
+	pts := frame.Pts * 90000 / int64(time.Second) // 90000Hz
+	// set fields
+	tsframe := &Frame{
+		Pid:      tsVideoPid,
+		StreamID: tsVideoHevc,
+		Dts:      dts,
+		Pts:      pts,
+		Payload:  frame.Payload,
+		key:      nalType >= hevc.NalBlaWLp && nalType <= hevc.NalCraNut,
+	}
+
+	tsframe.prepareHevcHeader(h265p.meta.Vps, h265p.meta.Sps, h265p.meta.Pps)
+
+	return h265p.tsframeWriter.WriteMpegtsFrame(tsframe)
+}
@@ -6,6 +6,9 @@ package mpegts
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
@@ -40,7 +43,7 @@ func TestMpegtsWriter(t *testing.T) {
 	var video codec.VideoMeta
 	var audio codec.AudioMeta
 	sdp.ParseMetadata(string(sdpraw), &video, &audio)
-	writer, err := NewWriter(out)
+	writer, err := NewWriter(out, StreamTypeH264)
 	tsMuxer, _ := NewMuxer(&video, &audio, writer, xlog.L())
 
 	rtpDemuxer, _ := rtp.NewDemuxer(&video, &audio, tsMuxer, xlog.L())
@@ -60,3 +63,226 @@ func TestMpegtsWriter(t *testing.T) {
 	rtpDemuxer.Close()
 	tsMuxer.Close()
 }
+
+func TestCrc32Mpeg2(t *testing.T) {
+	// PAT
+	if crc := crc32Mpeg2(mpegtsHeader[5:17]); crc != 0x2e701905 {
+		t.Errorf("PAT crc = %08x, want 2e701905", crc)
+	}
+	// PMT
+	if crc := crc32Mpeg2(mpegtsHeader[pmtPsiOffset:pmtCrcOffset]); crc != 0x2f44b99b {
+		t.Errorf("PMT crc = %08x, want 2f44b99b", crc)
+	}
+	if mpegtsHevcHeader[pmtVideoStreamTypeOffset] != StreamTypeH265 {
+		t.Errorf("hevc stream type = %02x", mpegtsHevcHeader[pmtVideoStreamTypeOffset])
+	}
+}
+
+type tsFrameWriter struct {
+	frames []*Frame
+}
+
+func (w *tsFrameWriter) WriteMpegtsFrame(frame *Frame) error {
+	w.frames = append(w.frames, frame)
+	return nil
+}
+
+func TestH265Packetizer(t *testing.T) {
+	meta := codec.VideoMeta{
+		Codec: "H265",
+		Vps:   []byte{0x40, 0x01},
+		Sps:   []byte{0x42, 0x01},
+		Pps:   []byte{0x44, 0x01},
+	}
+	w := &tsFrameWriter{}
+	p := NewH265Packetizer(&meta, w)
+
+	p.Packetize(&codec.Frame{MediaType: codec.MediaTypeVideo, Payload: meta.Vps})
+	p.Packetize(&codec.Frame{MediaType: codec.MediaTypeVideo, Payload: []byte{0x26, 0x01, 0xaf}}) // IDR_W_RADL
+	p.Packetize(&codec.Frame{MediaType: codec.MediaTypeVideo, Payload: []byte{0x02, 0x01, 0xd0}}) // TRAIL_R
+
+	if len(w.frames) != 2 {
+		t.Fatalf("frames = %d, want 2", len(w.frames))
+	}
+
+	idr := w.frames[0]
+	wantHeader := []byte{
+		0, 0, 0, 1, 0x46, 0x01, 0x50, // AUD
+		0, 0, 0, 1, 0x40, 0x01, // VPS
+		0, 0, 0, 1, 0x42, 0x01, // SPS
+		0, 0, 0, 1, 0x44, 0x01, // PPS
+		0, 0, 1,
+	}
+	if !idr.IsKeyFrame() || !bytes.Equal(idr.Header, wantHeader) {
+		t.Errorf("idr key = %v, header = % x", idr.IsKeyFrame(), idr.Header)
+	}
+
+	trail := w.frames[1]
+	if trail.IsKeyFrame() || !bytes.Equal(trail.Header, []byte{0, 0, 0, 1, 0x46, 0x01, 0x50, 0, 0, 1}) {
+		t.Errorf("trail key = %v, header = % x", trail.IsKeyFrame(), trail.Header)
+	}
+}
+
+type frameWriter struct {
+	frames []*codec.Frame
+}
+
+func (w *frameWriter) WriteFrame(frame *codec.Frame) error {
+	w.frames = append(w.frames, frame)
+	return nil
+}
+
+func TestDemuxer(t *testing.T) {
+	sps, _ := base64.StdEncoding.DecodeString("Z2QAH6zZQFAFuhAAAAMAEAAAAwPI8YMZYA==")
+	pps, _ := base64.StdEncoding.DecodeString("aO+8sA==")
+	video := codec.VideoMeta{Codec: "H264", Sps: sps, Pps: pps}
+	audio := codec.AudioMeta{Codec: "AAC", Sps: []byte{0x12, 0x10}} // AAC LC 44100Hz 2ch
+
+	var buf bytes.Buffer
+	writer, _ := NewWriter(&buf, StreamTypeH264)
+	vp := NewH264Packetizer(&video, writer)
+	ap := NewAacPacketizer(&audio, writer)
+
+	idr := append([]byte{0x65}, bytes.Repeat([]byte{0x88}, 500)...)
+	ms := int64(time.Millisecond)
+	vp.Packetize(&codec.Frame{MediaType: codec.MediaTypeVideo, Dts: 1000 * ms, Pts: 1000 * ms, Payload: idr})
+	ap.Packetize(&codec.Frame{MediaType: codec.MediaTypeAudio, Dts: 1020 * ms, Pts: 1020 * ms, Payload: []byte{1, 2, 3}})
+	vp.Packetize(&codec.Frame{MediaType: codec.MediaTypeVideo, Dts: 1040 * ms, Pts: 1120 * ms, Payload: []byte{0x41, 1}})
+	vp.Packetize(&codec.Frame{MediaType: codec.MediaTypeVideo, Dts: 1080 * ms, Pts: 1080 * ms, Payload: []byte{0x41, 2}})
+
+	var dvideo codec.VideoMeta
+	var daudio codec.AudioMeta
+	w := &frameWriter{}
+	demuxer := NewDemuxer(&dvideo, &daudio, w)
+
+	// 不按 ts 包对齐写入，并在开头加入无效数据
+	data := append([]byte{0, 1, 2}, buf.Bytes()...)
+	for len(data) > 0 {
+		n := 100
+		if n > len(data) {
+			n = len(data)
+		}
+		if _, err := demuxer.Write(data[:n]); err != nil {
+			t.Fatal(err)
+		}
+		data = data[n:]
+	}
+	demuxer.Flush()
+
+	if !demuxer.ProgramIsReady() || !demuxer.VideoMetadataIsReady() || !demuxer.AudioMetadataIsReady() {
+		t.Fatalf("metadata not ready; video = %+v, audio = %+v", dvideo, daudio)
+	}
+	if dvideo.Width != 1280 || dvideo.Height != 720 || daudio.SampleRate != 44100 || daudio.Channels != 2 {
+		t.Errorf("metadata = %dx%d, %dHz %dch", dvideo.Width, dvideo.Height, daudio.SampleRate, daudio.Channels)
+	}
+
+	want := []struct {
+		mediaType codec.MediaType
+		dts, pts  int64
+		payload   []byte
+	}{
+		{codec.MediaTypeVideo, 0, 0, sps},
+		{codec.MediaTypeVideo, 0, 0, pps},
+		{codec.MediaTypeVideo, 0, 0, idr},
+		{codec.MediaTypeAudio, 20 * ms, 20 * ms, []byte{1, 2, 3}},
+		{codec.MediaTypeVideo, 40 * ms, 120 * ms, []byte{0x41, 1}},
+		{codec.MediaTypeVideo, 80 * ms, 80 * ms, []byte{0x41, 2}},
+	}
+	if len(w.frames) != len(want) {
+		t.Fatalf("frames = %d, want %d", len(w.frames), len(want))
+	}
+	for i, f := range w.frames {
+		if f.MediaType != want[i].mediaType || f.Dts != want[i].dts || f.Pts != want[i].pts ||
+			!bytes.Equal(f.Payload, want[i].payload) {
+			t.Errorf("frame %d = %s dts %d pts %d % x", i, f.MediaType, f.Dts, f.Pts, f.Payload)
+		}
+	}
+}
+
+func TestDemuxerTimestampWrap(t *testing.T) {
+	var pes pesStream
+	if ts := pes.unwrap(tsWrapPeriod - 90000); ts != tsWrapPeriod-90000 {
+		t.Errorf("ts = %d", ts)
+	}
+	if ts := pes.unwrap(90000); ts != tsWrapPeriod+90000 {
+		t.Errorf("wrapped ts = %d", ts)
+	}
+	if ts := pes.unwrap(tsWrapPeriod - 3000); ts != tsWrapPeriod-3000 {
+		t.Errorf("reordered ts = %d", ts)
+	}
+	if ts := pes.unwrap(93000); ts != tsWrapPeriod+93000 {
+		t.Errorf("ts = %d", ts)
+	}
+}
+
+func TestDemuxerDiscontinue(t *testing.T) {
+	sps, _ := base64.StdEncoding.DecodeString("Z2QAH6zZQFAFuhAAAAMAEAAAAwPI8YMZYA==")
+	pps, _ := base64.StdEncoding.DecodeString("aO+8sA==")
+	video := codec.VideoMeta{Codec: "H264", Sps: sps, Pps: pps}
+	idr := append([]byte{0x65}, bytes.Repeat([]byte{0x88}, 500)...)
+	ms := int64(time.Millisecond)
+
+	// 两段时间戳不连续的 ts
+	segment := func(start int64) []byte {
+		var buf bytes.Buffer
+		writer, _ := NewWriter(&buf, StreamTypeH264)
+		vp := NewH264Packetizer(&video, writer)
+		vp.Packetize(&codec.Frame{MediaType: codec.MediaTypeVideo, Dts: start, Pts: start, Payload: idr})
+		vp.Packetize(&codec.Frame{MediaType: codec.MediaTypeVideo, Dts: start + 40*ms, Pts: start + 40*ms, Payload: []byte{0x41, 1}})
+		return buf.Bytes()
+	}
+
+	var dvideo codec.VideoMeta
+	var daudio codec.AudioMeta
+	w := &frameWriter{}
+	demuxer := NewDemuxer(&dvideo, &daudio, w)
+	demuxer.Write(segment(1000 * ms))
+	if err := demuxer.Discontinue(); err != nil {
+		t.Fatal(err)
+	}
+	demuxer.Write(segment(0))
+	demuxer.Flush()
+
+	var dts []int64
+	for _, f := range w.frames {
+		if f.Payload[0]&0x1f != 7 && f.Payload[0]&0x1f != 8 { // 忽略 SPS、PPS
+			dts = append(dts, f.Dts/ms)
+		}
+	}
+	if want := []int64{0, 40, 80, 120}; fmt.Sprint(dts) != fmt.Sprint(want) {
+		t.Errorf("dts = %v, want %v", dts, want)
+	}
+}
+
+func TestDemuxerParameterSetChanged(t *testing.T) {
+	sps, _ := base64.StdEncoding.DecodeString("Z2QAH6zZQFAFuhAAAAMAEAAAAwPI8YMZYA==")
+	pps, _ := base64.StdEncoding.DecodeString("aO+8sA==")
+	sps4k, _ := base64.StdEncoding.DecodeString("Z2QAM6wspADwAQ+wFSAgICgAAB9IAAdTBO0LFok=")
+	pps4k, _ := base64.StdEncoding.DecodeString("aOtzUlA=")
+
+	dvideo := codec.VideoMeta{Codec: "H264"}
+	var daudio codec.AudioMeta
+	demuxer := NewDemuxer(&dvideo, &daudio, &frameWriter{})
+	demuxer.acceptNalu(sps)
+	demuxer.acceptNalu(pps)
+	if !demuxer.VideoMetadataIsReady() || dvideo.Width != 1280 {
+		t.Fatalf("metadata = %+v", dvideo)
+	}
+
+	// 重复的参数集不改变元数据
+	demuxer.acceptNalu(sps)
+	if !demuxer.VideoMetadataIsReady() || dvideo.Width != 1280 {
+		t.Fatalf("metadata = %+v", dvideo)
+	}
+
+	// 新的 SPS 替换旧的参数集，收到新的 PPS 之前元数据不就绪
+	demuxer.acceptNalu(sps4k)
+	if demuxer.VideoMetadataIsReady() {
+		t.Fatal("metadata is ready before the new pps")
+	}
+	demuxer.acceptNalu(pps4k)
+	if !demuxer.VideoMetadataIsReady() || dvideo.Width != 3840 || dvideo.Height != 2160 ||
+		!bytes.Equal(dvideo.Sps, sps4k) || !bytes.Equal(dvideo.Pps, pps4k) {
+		t.Errorf("metadata = %+v", dvideo)
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package mpegtstest 提供测试 ts 推流、拉流使用的 ts 流源
+package mpegtstest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"time"
+
+	"github.com/cnotch/ipchub/av/codec"
+	"github.com/cnotch/ipchub/av/format/mpegts"
+)
+
+// Source 生成 H264(1280x720)+AAC 的 ts 流
+type Source struct {
+	video  codec.VideoMeta
+	audio  codec.AudioMeta
+	vp, ap mpegts.Packetizer
+	dts    int64
+}
+
+// NewSource 创建向 w 写入 ts 流的源
+func NewSource(w io.Writer) (*Source, error) {
+	sps, _ := base64.StdEncoding.DecodeString("Z2QAH6zZQFAFuhAAAAMAEAAAAwPI8YMZYA==")
+	pps, _ := base64.StdEncoding.DecodeString("aO+8sA==")
+	src := &Source{
+		video: codec.VideoMeta{Codec: "H264", Sps: sps, Pps: pps},
+		audio: codec.AudioMeta{Codec: "AAC", Sps: []byte{0x12, 0x10}},
+	}
+	writer, err := mpegts.NewWriter(w, mpegts.StreamTypeH264)
+	if err != nil {
+		return nil, err
+	}
+	src.vp = mpegts.NewH264Packetizer(&src.video, writer)
+	src.ap = mpegts.NewAacPacketizer(&src.audio, writer)
+	return src, nil
+}
+
+// WriteFrames 写入一个关键帧和一个音频帧，下一次写入的时间戳增加 40ms
+func (src *Source) WriteFrames() error {
+	idr := append([]byte{0x65}, bytes.Repeat([]byte{0x88}, 500)...)
+	if err := src.vp.Packetize(&codec.Frame{MediaType: codec.MediaTypeVideo,
+		Dts: src.dts, Pts: src.dts, Payload: idr}); err != nil {
+		return err
+	}
+	if err := src.ap.Packetize(&codec.Frame{MediaType: codec.MediaTypeAudio,
+		Dts: src.dts, Pts: src.dts, Payload: []byte{1, 2, 3}}); err != nil {
+		return err
+	}
+	src.dts += int64(40 * time.Millisecond)
+	return nil
+}
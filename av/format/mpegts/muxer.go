@@ -22,7 +22,7 @@ type emptyPacketizer struct{}
 
 func (emptyPacketizer) Packetize(frame *codec.Frame) error { return nil }
 
-// Muxer mpegts muxer from av.Frame(H264[+AAC])
+// Muxer mpegts muxer from av.Frame(H264/H265[+AAC])
 type Muxer struct {
 	recvQueue *queue.SyncQueue
 	closed    bool
@@ -42,6 +42,8 @@ func NewMuxer(videoMeta *codec.VideoMeta, audioMeta *codec.AudioMeta, tsframeWri
 	switch videoMeta.Codec {
 	case "H264":
 		vp = NewH264Packetizer(videoMeta, tsframeWriter)
+	case "H265":
+		vp = NewH265Packetizer(videoMeta, tsframeWriter)
 	default:
 		return nil, fmt.Errorf("ts muxer unsupport video codec type:%s", videoMeta.Codec)
 	}
@@ -112,3 +114,14 @@ func (muxer *Muxer) process(vp, ap Packetizer) {
 		}
 	}
 }
+
+// VideoStreamType 视频编码对应的 mpegts stream_type，不支持时返回 0
+func VideoStreamType(codec string) byte {
+	switch codec {
+	case "H264":
+		return StreamTypeH264
+	case "H265":
+		return StreamTypeH265
+	}
+	return 0
+}
@@ -8,6 +8,7 @@ package mpegts
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"sync"
@@ -82,6 +83,30 @@ var mpegtsHeader = []uint8{
 	0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
 }
 
+// PMT 中的 stream_type
+const (
+	StreamTypeH264 = 0x1b
+	StreamTypeH265 = 0x24
+	StreamTypeAac  = 0x0f
+)
+
+// PMT 中视频 stream_type 及 PMT CRC 的位置
+const (
+	pmtPsiOffset             = 188 + 5
+	pmtVideoStreamTypeOffset = pmtPsiOffset + 12
+	pmtCrcOffset             = pmtPsiOffset + 22
+)
+
+// 视频为 H265 的 PAT/PMT，由 mpegtsHeader 修改 stream_type 并重新计算 CRC
+var mpegtsHevcHeader = func() []uint8 {
+	header := make([]uint8, len(mpegtsHeader))
+	copy(header, mpegtsHeader)
+	header[pmtVideoStreamTypeOffset] = StreamTypeH265
+	binary.BigEndian.PutUint32(header[pmtCrcOffset:],
+		crc32Mpeg2(header[pmtPsiOffset:pmtCrcOffset]))
+	return header
+}()
+
 // mpegts stuff using  0xff
 var mpegtsStuff [188]uint8
 
@@ -99,15 +124,18 @@ func init() {
 
 // Writer flv Writer
 type Writer struct {
-	w       io.Writer
-	videoCC int
-	audioCC int
+	w               io.Writer
+	videoStreamType byte
+	videoCC         int
+	audioCC         int
 }
 
-// NewWriter .
-func NewWriter(w io.Writer) (*Writer, error) {
+// NewWriter 创建 mpegts Writer，videoStreamType 为视频的 stream_type，
+// 如 StreamTypeH264、StreamTypeH265
+func NewWriter(w io.Writer, videoStreamType byte) (*Writer, error) {
 	writer := &Writer{
-		w: w,
+		w:               w,
+		videoStreamType: videoStreamType,
 	}
 
 	if err := writer.writeMpegtsHeader(); err != nil {
@@ -118,7 +146,11 @@ func NewWriter(w io.Writer) (*Writer, error) {
 }
 
 func (w *Writer) writeMpegtsHeader() error {
-	if _, err := w.w.Write(mpegtsHeader); err != nil {
+	header := mpegtsHeader
+	if w.videoStreamType == StreamTypeH265 {
+		header = mpegtsHevcHeader
+	}
+	if _, err := w.w.Write(header); err != nil {
 		return fmt.Errorf("write ts file header failed,resean=%v", err)
 	}
 	return nil
@@ -376,3 +408,19 @@ func fillStuff(pkt *[188]byte, pos *int, bodySize int, inSize int) {
 		}
 	}
 }
+
+// crc32Mpeg2 计算 PSI 的 CRC(CRC-32/MPEG-2)
+func crc32Mpeg2(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,342 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package rtmp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// 块消息头
+//
+//	+--------------+----------------+--------------------+--------------+
+//	| Basic Header | Message Header | Extended Timestamp |  Chunk Data  |
+//	+--------------+----------------+--------------------+--------------+
+//	|                                                    |
+//	|<------------------- Chunk Header ----------------->|
+type chunkStream struct {
+	timestamp uint32 // 当前消息的时间戳
+	delta     uint32 // 时间戳增量
+	length    uint32 // 消息长度
+	typeID    byte
+	streamID  uint32
+	extended  bool   // 是否使用扩展时间戳
+	payload   []byte // 已经接收的消息载荷
+}
+
+// ChunkReader 从块流中读取 RTMP 消息
+type ChunkReader struct {
+	r              io.Reader
+	chunkSize      uint32
+	maxMessageSize uint32
+	inBytes        uint64
+	streams        map[uint32]*chunkStream
+	buff           [16]byte
+}
+
+// NewChunkReader 创建块流读取器
+func NewChunkReader(r io.Reader) *ChunkReader {
+	return &ChunkReader{
+		r:              r,
+		chunkSize:      DefaultChunkSize,
+		maxMessageSize: DefaultMaxMessageSize,
+		streams:        make(map[uint32]*chunkStream, 8),
+	}
+}
+
+// SetMaxMessageSize 设置读取的消息的最大长度，更长的消息作为错误返回
+func (cr *ChunkReader) SetMaxMessageSize(size uint32) {
+	if size > 0 {
+		cr.maxMessageSize = size
+	}
+}
+
+// InBytes 已读取的字节数
+func (cr *ChunkReader) InBytes() uint64 {
+	return cr.inBytes
+}
+
+// ReadMessage 读取一个完整的消息；
+// 协议控制消息 SetChunkSize 和 Abort 会被自动处理，但仍然返回给调用者
+func (cr *ChunkReader) ReadMessage() (*Message, error) {
+	for {
+		csid, cs, err := cr.readChunk()
+		if err != nil {
+			return nil, err
+		}
+
+		if uint32(len(cs.payload)) < cs.length {
+			continue
+		}
+
+		msg := &Message{
+			ChunkStreamID: csid,
+			TypeID:        cs.typeID,
+			Timestamp:     cs.timestamp,
+			StreamID:      cs.streamID,
+			Payload:       cs.payload,
+		}
+		cs.payload = nil
+
+		switch msg.TypeID {
+		case MsgSetChunkSize:
+			if len(msg.Payload) < 4 {
+				return nil, errors.New("rtmp: invalid set chunk size message")
+			}
+			size := binary.BigEndian.Uint32(msg.Payload) & 0x7fffffff
+			if size < 1 || size > maxChunkSize {
+				return nil, fmt.Errorf("rtmp: invalid chunk size %d", size)
+			}
+			cr.chunkSize = size
+		case MsgAbort:
+			if len(msg.Payload) >= 4 {
+				if abort, ok := cr.streams[binary.BigEndian.Uint32(msg.Payload)]; ok {
+					abort.payload = nil
+				}
+			}
+		}
+		return msg, nil
+	}
+}
+
+func (cr *ChunkReader) readFull(p []byte) error {
+	n, err := io.ReadFull(cr.r, p)
+	cr.inBytes += uint64(n)
+	return err
+}
+
+func (cr *ChunkReader) readChunk() (csid uint32, cs *chunkStream, err error) {
+	// Basic Header
+	b := cr.buff[:1]
+	if err = cr.readFull(b); err != nil {
+		return
+	}
+
+	format := b[0] >> 6
+	csid = uint32(b[0] & 0x3f)
+	switch csid {
+	case 0:
+		if err = cr.readFull(b); err != nil {
+			return
+		}
+		csid = 64 + uint32(b[0])
+	case 1:
+		b = cr.buff[:2]
+		if err = cr.readFull(b); err != nil {
+			return
+		}
+		csid = 64 + uint32(b[0]) + uint32(b[1])<<8
+	}
+
+	cs = cr.streams[csid]
+	if cs == nil {
+		if format != 0 {
+			err = fmt.Errorf("rtmp: chunk stream %d must start with format 0", csid)
+			return
+		}
+		if len(cr.streams) >= maxChunkStreams {
+			err = fmt.Errorf("rtmp: too many chunk streams, max %d", maxChunkStreams)
+			return
+		}
+		cs = &chunkStream{}
+		cr.streams[csid] = cs
+	}
+
+	// Message Header
+	var timestamp uint32
+	switch format {
+	case 0:
+		b = cr.buff[:11]
+		if err = cr.readFull(b); err != nil {
+			return
+		}
+		timestamp = uint24(b)
+		cs.length = uint24(b[3:])
+		cs.typeID = b[6]
+		cs.streamID = binary.LittleEndian.Uint32(b[7:])
+	case 1:
+		b = cr.buff[:7]
+		if err = cr.readFull(b); err != nil {
+			return
+		}
+		timestamp = uint24(b)
+		cs.length = uint24(b[3:])
+		cs.typeID = b[6]
+	case 2:
+		b = cr.buff[:3]
+		if err = cr.readFull(b); err != nil {
+			return
+		}
+		timestamp = uint24(b)
+	}
+
+	if format < 3 {
+		cs.extended = timestamp == maxTimestamp
+	}
+	if format < 2 && cs.length > cr.maxMessageSize {
+		err = fmt.Errorf("rtmp: message length %d exceeds max %d", cs.length, cr.maxMessageSize)
+		return
+	}
+
+	// Extended Timestamp
+	if cs.extended {
+		b = cr.buff[:4]
+		if err = cr.readFull(b); err != nil {
+			return
+		}
+		if format < 3 {
+			timestamp = binary.BigEndian.Uint32(b)
+		}
+	}
+
+	if format < 3 {
+		// 非 format 3 的块总是新消息的开始
+		cs.payload = nil
+		if format == 0 {
+			cs.timestamp = timestamp
+		} else {
+			cs.timestamp += timestamp
+		}
+		cs.delta = timestamp
+	} else if cs.payload == nil {
+		// format 3 开始新消息，使用前一个时间戳增量
+		cs.timestamp += cs.delta
+	}
+
+	// Chunk Data
+	size := cs.length - uint32(len(cs.payload))
+	if size > cr.chunkSize {
+		size = cr.chunkSize
+	}
+	offset := len(cs.payload)
+	cs.payload = growPayload(cs.payload, offset+int(size), int(cs.length))
+	err = cr.readFull(cs.payload[offset:])
+	return
+}
+
+// 随块的到达扩展载荷到 n 字节，容量按倍数增长但不超过消息长度 length；
+// 不预先按对端声明的长度分配
+func growPayload(payload []byte, n, length int) []byte {
+	if n <= cap(payload) {
+		if payload == nil { // 空消息
+			return []byte{}
+		}
+		return payload[:n]
+	}
+
+	c := cap(payload) * 2
+	if c < n {
+		c = n
+	}
+	if c > length {
+		c = length
+	}
+	grown := make([]byte, n, c)
+	copy(grown, payload)
+	return grown
+}
+
+// ChunkWriter 将 RTMP 消息写入块流
+type ChunkWriter struct {
+	w         io.Writer
+	chunkSize uint32
+	buff      [18]byte
+}
+
+// NewChunkWriter 创建块流写入器
+func NewChunkWriter(w io.Writer) *ChunkWriter {
+	return &ChunkWriter{
+		w:         w,
+		chunkSize: DefaultChunkSize,
+	}
+}
+
+// SetChunkSize 设置输出的块大小；
+// 调用者应该先发送 SetChunkSize 消息
+func (cw *ChunkWriter) SetChunkSize(size uint32) {
+	if size < 1 || size > maxChunkSize {
+		return
+	}
+	cw.chunkSize = size
+}
+
+// WriteMessage 写入消息；
+// 第一个块使用 format 0，后续块使用 format 3
+func (cw *ChunkWriter) WriteMessage(msg *Message) (err error) {
+	extended := msg.Timestamp >= maxTimestamp
+
+	// 第一个块的块头
+	b := cw.basicHeader(0, msg.ChunkStreamID)
+	offset := len(b)
+	b = cw.buff[:offset+11]
+	timestamp := msg.Timestamp
+	if extended {
+		timestamp = maxTimestamp
+	}
+	putUint24(b[offset:], timestamp)
+	putUint24(b[offset+3:], uint32(len(msg.Payload)))
+	b[offset+6] = msg.TypeID
+	binary.LittleEndian.PutUint32(b[offset+7:], msg.StreamID)
+	if extended {
+		b = cw.buff[:offset+15]
+		binary.BigEndian.PutUint32(b[offset+11:], msg.Timestamp)
+	}
+
+	payload := msg.Payload
+	for {
+		if _, err = cw.w.Write(b); err != nil {
+			return
+		}
+
+		size := len(payload)
+		if size > int(cw.chunkSize) {
+			size = int(cw.chunkSize)
+		}
+		if _, err = cw.w.Write(payload[:size]); err != nil {
+			return
+		}
+		payload = payload[size:]
+		if len(payload) == 0 {
+			return
+		}
+
+		// 后续块的块头
+		b = cw.basicHeader(3, msg.ChunkStreamID)
+		if extended {
+			offset = len(b)
+			b = cw.buff[:offset+4]
+			binary.BigEndian.PutUint32(b[offset:], msg.Timestamp)
+		}
+	}
+}
+
+func (cw *ChunkWriter) basicHeader(format byte, csid uint32) []byte {
+	switch {
+	case csid < 64:
+		cw.buff[0] = format<<6 | byte(csid)
+		return cw.buff[:1]
+	case csid < 320:
+		cw.buff[0] = format << 6
+		cw.buff[1] = byte(csid - 64)
+		return cw.buff[:2]
+	default:
+		cw.buff[0] = format<<6 | 1
+		cw.buff[1] = byte((csid - 64) & 0xff)
+		cw.buff[2] = byte((csid - 64) >> 8)
+		return cw.buff[:3]
+	}
+}
+
+func uint24(b []byte) uint32 {
+	return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0] = byte(v >> 16)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v)
+}
@@ -0,0 +1,177 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package rtmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/cnotch/ipchub/av/format/amf"
+)
+
+// 常用命令名称
+const (
+	CmdConnect       = "connect"
+	CmdCall          = "call"
+	CmdClose         = "close"
+	CmdCreateStream  = "createStream"
+	CmdDeleteStream  = "deleteStream"
+	CmdCloseStream   = "closeStream"
+	CmdReleaseStream = "releaseStream"
+	CmdFCPublish     = "FCPublish"
+	CmdFCUnpublish   = "FCUnpublish"
+	CmdPublish       = "publish"
+	CmdPlay          = "play"
+	CmdPause         = "pause"
+	CmdGetStreamLen  = "getStreamLength"
+	CmdResult        = "_result"
+	CmdError         = "_error"
+	CmdOnStatus      = "onStatus"
+	CmdOnFCPublish   = "onFCPublish"
+)
+
+// DataSampleAccess 允许客户端访问音视频原始数据的数据消息名称
+const DataSampleAccess = "|RtmpSampleAccess"
+
+// Command AMF0 命令消息
+type Command struct {
+	Name          string        // 命令名称
+	TransactionID float64       // 事务ID
+	Object        interface{}   // 命令对象，没有时为 nil
+	Args          []interface{} // 可选参数
+}
+
+// Unmarshal .
+func (cmd *Command) Unmarshal(data []byte) (err error) {
+	r := bytes.NewReader(data)
+	if cmd.Name, err = amf.ReadString(r); err != nil {
+		return
+	}
+
+	if cmd.TransactionID, err = amf.ReadNumber(r); err != nil {
+		return
+	}
+
+	if r.Len() == 0 {
+		return
+	}
+	if cmd.Object, err = amf.ReadAny(r); err != nil {
+		return
+	}
+
+	cmd.Args = cmd.Args[:0]
+	for r.Len() > 0 {
+		var arg interface{}
+		if arg, err = amf.ReadAny(r); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+		cmd.Args = append(cmd.Args, arg)
+	}
+	return
+}
+
+// Marshal .
+func (cmd *Command) Marshal() ([]byte, error) {
+	buff := bytes.NewBuffer(make([]byte, 0, 256))
+
+	if err := amf.WriteString(buff, cmd.Name); err != nil {
+		return nil, err
+	}
+	if err := amf.WriteNumber(buff, cmd.TransactionID); err != nil {
+		return nil, err
+	}
+	if err := amf.WriteAny(buff, cmd.Object); err != nil {
+		return nil, err
+	}
+	for _, arg := range cmd.Args {
+		if err := amf.WriteAny(buff, arg); err != nil {
+			return nil, err
+		}
+	}
+	return buff.Bytes(), nil
+}
+
+// StringArg 获取指定位置的字串参数
+func (cmd *Command) StringArg(i int) string {
+	if i < len(cmd.Args) {
+		if s, ok := cmd.Args[i].(string); ok {
+			return s
+		}
+	}
+	return ""
+}
+
+// ObjectProperty 获取命令对象的属性值
+func (cmd *Command) ObjectProperty(name string) (value interface{}, ok bool) {
+	switch o := cmd.Object.(type) {
+	case amf.Object:
+		return amf.PropertyValue(o, name)
+	case amf.EcmaArray:
+		return amf.PropertyValue(o, name)
+	}
+	return nil, false
+}
+
+// NewCommandMessage 创建命令消息
+func NewCommandMessage(streamID uint32, cmd *Command) (*Message, error) {
+	payload, err := cmd.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return &Message{
+		ChunkStreamID: ChunkStreamCommand,
+		TypeID:        MsgAmf0Command,
+		StreamID:      streamID,
+		Payload:       payload,
+	}, nil
+}
+
+// NewSetChunkSizeMessage 创建设置块大小消息
+func NewSetChunkSizeMessage(size uint32) *Message {
+	return newUint32Message(MsgSetChunkSize, size&0x7fffffff)
+}
+
+// NewAckMessage 创建确认消息
+func NewAckMessage(sequence uint32) *Message {
+	return newUint32Message(MsgAck, sequence)
+}
+
+// NewWindowAckSizeMessage 创建确认窗口大小消息
+func NewWindowAckSizeMessage(size uint32) *Message {
+	return newUint32Message(MsgWindowAckSize, size)
+}
+
+// NewSetPeerBandwidthMessage 创建设置对端带宽消息
+func NewSetPeerBandwidthMessage(size uint32, limitType byte) *Message {
+	msg := newUint32Message(MsgSetPeerBandwidth, size)
+	msg.Payload = append(msg.Payload, limitType)
+	return msg
+}
+
+// NewUserControlMessage 创建用户控制消息
+func NewUserControlMessage(event uint16, value uint32) *Message {
+	payload := make([]byte, 6)
+	binary.BigEndian.PutUint16(payload, event)
+	binary.BigEndian.PutUint32(payload[2:], value)
+	return &Message{
+		ChunkStreamID: ChunkStreamProtocol,
+		TypeID:        MsgUserControl,
+		Payload:       payload,
+	}
+}
+
+func newUint32Message(typeID byte, value uint32) *Message {
+	payload := make([]byte, 4, 5)
+	binary.BigEndian.PutUint32(payload, value)
+	return &Message{
+		ChunkStreamID: ChunkStreamProtocol,
+		TypeID:        typeID,
+		Payload:       payload,
+	}
+}
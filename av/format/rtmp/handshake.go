@@ -0,0 +1,83 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package rtmp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// 握手常量
+const (
+	Version       = 3    // C0/S0 中的版本号
+	handshakeSize = 1536 // C1/S1/C2/S2 的长度
+)
+
+// Flusher 包装 Flush 方法的接口，如 buffered.Conn
+type Flusher interface {
+	Flush() (int, error)
+}
+
+// ServerHandshake 服务端简单握手(C0C1 -> S0S1S2 -> C2)
+// 注意：仅实现简单握手，不支持 Flash Player 需要的复杂握手(digest)
+func ServerHandshake(rw io.ReadWriter) (err error) {
+	var c0c1 [1 + handshakeSize]byte
+	if _, err = io.ReadFull(rw, c0c1[:]); err != nil {
+		return
+	}
+	if c0c1[0] != Version {
+		return fmt.Errorf("rtmp: unsupported version %d", c0c1[0])
+	}
+
+	var s0s1s2 [1 + handshakeSize*2]byte
+	s0s1s2[0] = Version
+	s1 := s0s1s2[1 : 1+handshakeSize]
+	binary.BigEndian.PutUint32(s1, uint32(time.Now().Unix()))
+	rand.Read(s1[8:])
+	// S2 是 C1 的回显
+	copy(s0s1s2[1+handshakeSize:], c0c1[1:])
+	if err = write(rw, s0s1s2[:]); err != nil {
+		return
+	}
+
+	var c2 [handshakeSize]byte
+	_, err = io.ReadFull(rw, c2[:])
+	return
+}
+
+// ClientHandshake 客户端简单握手(C0C1 -> S0S1S2 -> C2)
+func ClientHandshake(rw io.ReadWriter) (err error) {
+	var c0c1 [1 + handshakeSize]byte
+	c0c1[0] = Version
+	binary.BigEndian.PutUint32(c0c1[1:], uint32(time.Now().Unix()))
+	rand.Read(c0c1[9:])
+	if err = write(rw, c0c1[:]); err != nil {
+		return
+	}
+
+	var s0s1s2 [1 + handshakeSize*2]byte
+	if _, err = io.ReadFull(rw, s0s1s2[:]); err != nil {
+		return
+	}
+	if s0s1s2[0] != Version {
+		return fmt.Errorf("rtmp: unsupported version %d", s0s1s2[0])
+	}
+
+	// C2 是 S1 的回显
+	return write(rw, s0s1s2[1:1+handshakeSize])
+}
+
+func write(w io.Writer, p []byte) (err error) {
+	if _, err = w.Write(p); err != nil {
+		return
+	}
+	if f, ok := w.(Flusher); ok {
+		_, err = f.Flush()
+	}
+	return
+}
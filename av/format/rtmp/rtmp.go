@@ -0,0 +1,72 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package rtmp
+
+// RTMP 消息类型
+const (
+	MsgSetChunkSize     = 1  // 设置块大小
+	MsgAbort            = 2  // 终止消息
+	MsgAck              = 3  // 确认
+	MsgUserControl      = 4  // 用户控制消息
+	MsgWindowAckSize    = 5  // 确认窗口大小
+	MsgSetPeerBandwidth = 6  // 设置对端带宽
+	MsgAudio            = 8  // 音频，同 flv.TagTypeAudio
+	MsgVideo            = 9  // 视频，同 flv.TagTypeVideo
+	MsgAmf3Data         = 15 // AMF3 数据消息
+	MsgAmf3SharedObject = 16 // AMF3 共享对象
+	MsgAmf3Command      = 17 // AMF3 命令消息
+	MsgAmf0Data         = 18 // AMF0 数据消息，同 flv.TagTypeAmf0Data
+	MsgAmf0SharedObject = 19 // AMF0 共享对象
+	MsgAmf0Command      = 20 // AMF0 命令消息
+	MsgAggregate        = 22 // 聚合消息
+)
+
+// 用户控制消息事件类型
+const (
+	EventStreamBegin      = 0
+	EventStreamEOF        = 1
+	EventStreamDry        = 2
+	EventSetBufferLength  = 3
+	EventStreamIsRecorded = 4
+	EventPingRequest      = 6
+	EventPingResponse     = 7
+)
+
+// 常用的块流ID(chunk stream id)
+const (
+	ChunkStreamProtocol = 2 // 协议控制消息
+	ChunkStreamCommand  = 3 // 命令消息
+	ChunkStreamAudio    = 4 // 音频
+	ChunkStreamData     = 5 // 数据消息
+	ChunkStreamVideo    = 6 // 视频
+)
+
+// 设置对端带宽的限制类型
+const (
+	LimitHard    = 0
+	LimitSoft    = 1
+	LimitDynamic = 2
+)
+
+// 默认参数
+const (
+	DefaultChunkSize     = 128
+	DefaultWindowAckSize = 2500000
+	// DefaultMaxMessageSize 读取的消息的最大长度，避免对端声明的长度占用过多内存
+	DefaultMaxMessageSize = 4 << 20
+	// 一个连接最多的块流数
+	maxChunkStreams = 64
+	maxChunkSize    = 0xffffff
+	maxTimestamp    = 0xffffff
+)
+
+// Message RTMP 消息
+type Message struct {
+	ChunkStreamID uint32 // 块流ID
+	TypeID        byte   // 消息类型
+	Timestamp     uint32 // 时间戳，单位 ms
+	StreamID      uint32 // 消息流ID
+	Payload       []byte // 消息载荷
+}
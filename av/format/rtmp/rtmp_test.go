@@ -0,0 +1,154 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package rtmp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/cnotch/ipchub/av/format/amf"
+)
+
+func TestChunk(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  Message
+	}{
+		{"small", Message{ChunkStreamID: ChunkStreamCommand, TypeID: MsgAmf0Command, Timestamp: 100, StreamID: 0, Payload: bytes.Repeat([]byte{1}, 100)}},
+		{"multiChunk", Message{ChunkStreamID: ChunkStreamVideo, TypeID: MsgVideo, Timestamp: 40, StreamID: 1, Payload: bytes.Repeat([]byte{2}, 1000)}},
+		{"extTimestamp", Message{ChunkStreamID: ChunkStreamAudio, TypeID: MsgAudio, Timestamp: 0x1000000, StreamID: 1, Payload: bytes.Repeat([]byte{3}, 300)}},
+		{"largeCsid", Message{ChunkStreamID: 400, TypeID: MsgAmf0Data, Timestamp: 1, StreamID: 1, Payload: []byte{4, 5, 6}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buff bytes.Buffer
+			cw := NewChunkWriter(&buff)
+			if err := cw.WriteMessage(&tt.msg); err != nil {
+				t.Fatalf("WriteMessage() error = %v", err)
+			}
+			cr := NewChunkReader(&buff)
+			got, err := cr.ReadMessage()
+			if err != nil {
+				t.Fatalf("ReadMessage() error = %v", err)
+			}
+			if got.ChunkStreamID != tt.msg.ChunkStreamID || got.TypeID != tt.msg.TypeID ||
+				got.Timestamp != tt.msg.Timestamp || got.StreamID != tt.msg.StreamID ||
+				!bytes.Equal(got.Payload, tt.msg.Payload) {
+				t.Errorf("ReadMessage() = %+v, want %+v", got, tt.msg)
+			}
+		})
+	}
+}
+
+func TestChunk_SetChunkSize(t *testing.T) {
+	var buff bytes.Buffer
+	cw := NewChunkWriter(&buff)
+	cw.WriteMessage(NewSetChunkSizeMessage(4096))
+	cw.SetChunkSize(4096)
+	payload := bytes.Repeat([]byte{7}, 5000)
+	cw.WriteMessage(&Message{ChunkStreamID: ChunkStreamVideo, TypeID: MsgVideo, StreamID: 1, Payload: payload})
+
+	total := buff.Len()
+	cr := NewChunkReader(&buff)
+	msg, err := cr.ReadMessage()
+	if err != nil || msg.TypeID != MsgSetChunkSize {
+		t.Fatalf("ReadMessage() = %v, %v; want SetChunkSize", msg, err)
+	}
+	msg, err = cr.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+	if !bytes.Equal(msg.Payload, payload) {
+		t.Errorf("ReadMessage() payload length = %d, want %d", len(msg.Payload), len(payload))
+	}
+	if cr.InBytes() != uint64(total) {
+		t.Errorf("InBytes() = %d, want %d", cr.InBytes(), total)
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- ClientHandshake(c)
+	}()
+
+	if err := ServerHandshake(s); err != nil {
+		t.Fatalf("ServerHandshake() error = %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("ClientHandshake() error = %v", err)
+	}
+}
+
+func TestCommand(t *testing.T) {
+	cmd := &Command{
+		Name:          CmdConnect,
+		TransactionID: 1,
+		Object: amf.Object{
+			{Name: "app", Value: "live"},
+			{Name: "tcUrl", Value: "rtmp://localhost/live"},
+		},
+		Args: []interface{}{"stream1"},
+	}
+	msg, err := NewCommandMessage(0, cmd)
+	if err != nil {
+		t.Fatalf("NewCommandMessage() error = %v", err)
+	}
+
+	var got Command
+	if err = got.Unmarshal(msg.Payload); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if got.Name != CmdConnect || got.TransactionID != 1 {
+		t.Errorf("Unmarshal() = %s %v", got.Name, got.TransactionID)
+	}
+	if app, ok := got.ObjectProperty("app"); !ok || app != "live" {
+		t.Errorf("ObjectProperty(app) = %v", app)
+	}
+	if got.StringArg(0) != "stream1" {
+		t.Errorf("StringArg(0) = %s", got.StringArg(0))
+	}
+}
+
+func TestChunk_Limits(t *testing.T) {
+	// 超过最大长度的消息在读取载荷前被拒绝
+	var buff bytes.Buffer
+	cw := NewChunkWriter(&buff)
+	cw.WriteMessage(&Message{ChunkStreamID: ChunkStreamVideo, TypeID: MsgVideo, StreamID: 1, Payload: make([]byte, 2000)})
+	cr := NewChunkReader(&buff)
+	cr.SetMaxMessageSize(1000)
+	if _, err := cr.ReadMessage(); err == nil {
+		t.Error("ReadMessage() error = nil, want message too long")
+	}
+
+	// 块流数受限
+	buff.Reset()
+	for csid := uint32(2); csid < 2+maxChunkStreams+1; csid++ {
+		cw.WriteMessage(&Message{ChunkStreamID: csid, TypeID: MsgAmf0Data, StreamID: 1, Payload: []byte{1}})
+	}
+	cr = NewChunkReader(&buff)
+	n := 0
+	for ; ; n++ {
+		if _, err := cr.ReadMessage(); err != nil {
+			break
+		}
+	}
+	if n != maxChunkStreams {
+		t.Errorf("read %d messages before error, want %d", n, maxChunkStreams)
+	}
+
+	// 空消息
+	buff.Reset()
+	cw.WriteMessage(&Message{ChunkStreamID: ChunkStreamCommand, TypeID: MsgAmf0Data, StreamID: 1})
+	if msg, err := NewChunkReader(&buff).ReadMessage(); err != nil || len(msg.Payload) != 0 {
+		t.Errorf("ReadMessage() = %v, %v; want empty message", msg, err)
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package rtp
+
+import (
+	"fmt"
+
+	"github.com/cnotch/ipchub/av/codec"
+)
+
+type aacPacketizer struct {
+	packetizer
+	meta *codec.AudioMeta
+}
+
+// NewAacPacketizer 实例化 AAC 封包器
+func NewAacPacketizer(meta *codec.AudioMeta, w PacketWriter) Packetizer {
+	aacp := &aacPacketizer{
+		meta: meta,
+	}
+	aacp.init(ChannelAudio, audioPayloadType, meta.SampleRate, w)
+	return aacp
+}
+
+// Packetize 每个 RTP 包封装一个 AU；
+// 使用 sizelength=13;indexlength=3;indexdeltalength=3 的 AU-header，
+// AU-size 无法表示的 AU 返回错误
+func (aacp *aacPacketizer) Packetize(frame *codec.Frame) error {
+	size := len(frame.Payload)
+	if size < 1 {
+		return nil
+	}
+	if size >= 1<<13 {
+		return fmt.Errorf("rtp aac packetizer: AU size %d exceeds the 13-bit AU-size", size)
+	}
+
+	auHeaders := []byte{
+		0x00, 0x10, // AU-headers-length = 16 bits
+		byte(size >> 5), byte(size << 3), // AU-size(13) + AU-Index(3)
+	}
+	return aacp.writePacket(aacp.rtptime(frame.Pts), true, auHeaders, frame.Payload)
+}
@@ -0,0 +1,129 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package rtp
+
+import (
+	"github.com/cnotch/ipchub/av/codec"
+	"github.com/cnotch/ipchub/av/codec/h264"
+)
+
+type h264Packetizer struct {
+	packetizer
+	meta   *codec.VideoMeta
+	params [][]byte // 待发送的参数集
+	vcl    []byte   // 暂存的视频编码层 NAL，收到之后的 NAL 才能确定它是否为访问单元的最后一个
+	vclPts int64
+}
+
+// NewH264Packetizer 实例化 H264 封包器
+func NewH264Packetizer(meta *codec.VideoMeta, w PacketWriter) Packetizer {
+	h264p := &h264Packetizer{
+		meta: meta,
+	}
+	h264p.init(ChannelVideo, videoPayloadType, meta.ClockRate, w)
+	return h264p
+}
+
+func (h264p *h264Packetizer) Packetize(frame *codec.Frame) (err error) {
+	nal := frame.Payload
+	if len(nal) < 1 {
+		return
+	}
+
+	nalType := nal[0] & h264.NalTypeBitmask
+	switch nalType {
+	case h264.NalSps, h264.NalPps:
+		// 参数集和随后的帧一起发送
+		h264p.params = append(h264p.params, nal)
+		return
+	case h264.NalAud, h264.NalFillerData:
+		return
+	case h264.NalIdrSlice:
+		// 关键帧前必须有参数集，多个 slice 的关键帧只在第一个 slice 前发送
+		if len(h264p.params) == 0 && (h264p.vcl == nil || h264p.vclPts != frame.Pts) {
+			h264p.params = append(h264p.params, h264p.meta.Sps, h264p.meta.Pps)
+		}
+	}
+
+	// 下一个 NAL 的时间戳不同时，暂存的 NAL 为访问单元的最后一个
+	if err = h264p.flush(h264p.vclPts != frame.Pts); err != nil {
+		return
+	}
+
+	timestamp := h264p.rtptime(frame.Pts)
+	if len(h264p.params) > 0 {
+		err = h264p.packetizeStapa(timestamp, h264p.params)
+		h264p.params = h264p.params[:0]
+		if err != nil {
+			return
+		}
+	}
+
+	if nalType >= h264.NalSlice && nalType <= h264.NalIdrSlice {
+		h264p.vcl, h264p.vclPts = nal, frame.Pts
+		return
+	}
+	return h264p.packetizeNal(timestamp, false, nal)
+}
+
+// 发送暂存的视频编码层 NAL，marker 表示它是访问单元的最后一个 NAL
+func (h264p *h264Packetizer) flush(marker bool) error {
+	if h264p.vcl == nil {
+		return nil
+	}
+	nal := h264p.vcl
+	h264p.vcl = nil
+	return h264p.packetizeNal(h264p.rtptime(h264p.vclPts), marker, nal)
+}
+
+func (h264p *h264Packetizer) packetizeNal(timestamp uint32, marker bool, nal []byte) error {
+	if len(nal) <= maxPayloadSize {
+		return h264p.writePacket(timestamp, marker, nal)
+	}
+	return h264p.packetizeFuA(timestamp, marker, nal)
+}
+
+// 将多个 NAL 组合成一个 STAP-A 包
+func (h264p *h264Packetizer) packetizeStapa(timestamp uint32, nals [][]byte) error {
+	if len(nals) == 1 {
+		return h264p.writePacket(timestamp, false, nals[0])
+	}
+
+	// STAP-A NAL HDR 的 F 和 NRI 取所有 NAL 中的最大值
+	var header byte
+	payloads := make([][]byte, 0, len(nals)*2+1)
+	payloads = append(payloads, nil)
+	for _, nal := range nals {
+		if nal[0]&0x60 > header&0x60 {
+			header = nal[0] & 0x60
+		}
+		payloads = append(payloads, []byte{byte(len(nal) >> 8), byte(len(nal))}, nal)
+	}
+	payloads[0] = []byte{header | h264.NalStapaInRtp}
+	return h264p.writePacket(timestamp, false, payloads...)
+}
+
+// 将大的 NAL 拆分成多个 FU-A 包
+func (h264p *h264Packetizer) packetizeFuA(timestamp uint32, marker bool, nal []byte) (err error) {
+	indicator := nal[0]&0x60 | h264.NalFuAInRtp
+	fuHeader := nal[0]&h264.NalTypeBitmask | 0x80 // S
+	data := nal[1:]
+	for len(data) > 0 {
+		size := maxPayloadSize - 2
+		last := len(data) <= size
+		if last {
+			size = len(data)
+			fuHeader |= 0x40 // E
+		}
+
+		if err = h264p.writePacket(timestamp, marker && last,
+			[]byte{indicator, fuHeader}, data[:size]); err != nil {
+			return
+		}
+		data = data[size:]
+		fuHeader &^= 0x80
+	}
+	return
+}
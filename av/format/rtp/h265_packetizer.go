@@ -0,0 +1,149 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package rtp
+
+import (
+	"github.com/cnotch/ipchub/av/codec"
+	"github.com/cnotch/ipchub/av/codec/hevc"
+)
+
+type h265Packetizer struct {
+	packetizer
+	meta   *codec.VideoMeta
+	params [][]byte // 待发送的参数集
+	vcl    []byte   // 暂存的视频编码层 NAL，收到之后的 NAL 才能确定它是否为访问单元的最后一个
+	vclPts int64
+}
+
+// NewH265Packetizer 实例化 H265 封包器
+func NewH265Packetizer(meta *codec.VideoMeta, w PacketWriter) Packetizer {
+	h265p := &h265Packetizer{
+		meta: meta,
+	}
+	h265p.init(ChannelVideo, videoPayloadType, meta.ClockRate, w)
+	return h265p
+}
+
+func (h265p *h265Packetizer) Packetize(frame *codec.Frame) (err error) {
+	nal := frame.Payload
+	if len(nal) < 2 {
+		return
+	}
+
+	// +---------------+---------------+
+	// |0|1|2|3|4|5|6|7|0|1|2|3|4|5|6|7|
+	// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	// |F|   Type    |  LayerId  | TID |
+	// +-------------+-----------------+
+	nalType := (nal[0] >> 1) & 0x3f
+	switch {
+	case nalType >= hevc.NalVps && nalType <= hevc.NalPps:
+		// 参数集和随后的帧一起发送
+		h265p.params = append(h265p.params, nal)
+		return
+	case nalType == hevc.NalAud || nalType == hevc.NalFdNut:
+		return
+	case nalType >= hevc.NalBlaWLp && nalType <= hevc.NalCraNut:
+		// 关键帧前必须有参数集，多个 slice 的关键帧只在第一个 slice 前发送
+		if len(h265p.params) == 0 && (h265p.vcl == nil || h265p.vclPts != frame.Pts) {
+			h265p.params = append(h265p.params, h265p.meta.Vps, h265p.meta.Sps, h265p.meta.Pps)
+		}
+	}
+
+	// 下一个 NAL 的时间戳不同时，暂存的 NAL 为访问单元的最后一个
+	if err = h265p.flush(h265p.vclPts != frame.Pts); err != nil {
+		return
+	}
+
+	timestamp := h265p.rtptime(frame.Pts)
+	if len(h265p.params) > 0 {
+		err = h265p.packetizeAp(timestamp, h265p.params)
+		h265p.params = h265p.params[:0]
+		if err != nil {
+			return
+		}
+	}
+
+	if nalType < hevc.NalVps {
+		h265p.vcl, h265p.vclPts = nal, frame.Pts
+		return
+	}
+	return h265p.packetizeNal(timestamp, false, nal)
+}
+
+// 发送暂存的视频编码层 NAL，marker 表示它是访问单元的最后一个 NAL
+func (h265p *h265Packetizer) flush(marker bool) error {
+	if h265p.vcl == nil {
+		return nil
+	}
+	nal := h265p.vcl
+	h265p.vcl = nil
+	return h265p.packetizeNal(h265p.rtptime(h265p.vclPts), marker, nal)
+}
+
+func (h265p *h265Packetizer) packetizeNal(timestamp uint32, marker bool, nal []byte) error {
+	if len(nal) <= maxPayloadSize {
+		return h265p.writePacket(timestamp, marker, nal)
+	}
+	return h265p.packetizeFu(timestamp, marker, nal)
+}
+
+// 将多个 NAL 组合成一个 AP 包
+func (h265p *h265Packetizer) packetizeAp(timestamp uint32, nals [][]byte) error {
+	if len(nals) == 1 {
+		return h265p.writePacket(timestamp, false, nals[0])
+	}
+
+	//  0                   1                   2                   3
+	//  0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+	// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	// |    PayloadHdr (Type=48)       |         NALU 1 Size           |
+	// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	// |          NALU 1 HDR           |                               |
+	// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+         NALU 1 Data           |
+	// |                   . . .                                       |
+	// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	// |  . . .        | NALU 2 Size                   | NALU 2 HDR    |
+	// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	payloads := make([][]byte, 0, len(nals)*2+1)
+	payloads = append(payloads, []byte{hevc.NalStapInRtp << 1, nals[0][1]})
+	for _, nal := range nals {
+		payloads = append(payloads, []byte{byte(len(nal) >> 8), byte(len(nal))}, nal)
+	}
+	return h265p.writePacket(timestamp, false, payloads...)
+}
+
+// 将大的 NAL 拆分成多个 FU 包
+func (h265p *h265Packetizer) packetizeFu(timestamp uint32, marker bool, nal []byte) (err error) {
+	//  0                   1                   2                   3
+	//  0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+	// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	// |    PayloadHdr (Type=49)       |   FU header   |               |
+	// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+               |
+	// +---------------+
+	// |0|1|2|3|4|5|6|7|
+	// +-+-+-+-+-+-+-+-+
+	// |S|E|  FuType   |
+	// +---------------+
+	payloadHdr := []byte{nal[0]&0x81 | hevc.NalFuInRtp<<1, nal[1]}
+	fuHeader := (nal[0]>>1)&0x3f | 0x80 // S
+	data := nal[2:]
+	for len(data) > 0 {
+		size := maxPayloadSize - 3
+		last := len(data) <= size
+		if last {
+			size = len(data)
+			fuHeader |= 0x40 // E
+		}
+
+		if err = h265p.writePacket(timestamp, marker && last,
+			payloadHdr, []byte{fuHeader}, data[:size]); err != nil {
+			return
+		}
+		data = data[size:]
+		fuHeader &^= 0x80
+	}
+	return
+}
@@ -0,0 +1,187 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package rtp
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"runtime/debug"
+	"time"
+
+	"github.com/cnotch/ipchub/av/codec"
+	"github.com/cnotch/queue"
+	"github.com/cnotch/xlog"
+	"github.com/pion/rtp"
+)
+
+// 封包常量
+const (
+	rtpVersion       = 2
+	rtpHeaderSize    = 12
+	maxPayloadSize   = 1400 // RTP 包最大载荷，避免 UDP 传输时 IP 分片
+	videoPayloadType = 96   // 视频动态载荷类型
+	audioPayloadType = 97   // 音频动态载荷类型
+)
+
+// Packetizer 封包器
+type Packetizer interface {
+	Packetize(frame *codec.Frame) error
+}
+
+type emptyPacketizer struct{}
+
+func (emptyPacketizer) Packetize(frame *codec.Frame) error { return nil }
+
+type packetizer struct {
+	channel     byte
+	payloadType uint8
+	ssrc        uint32
+	sequence    uint16
+	rtpBase     uint32  // RTP 时间戳的随机初始值
+	rtpTimeUnit float64 // 每纳秒的 RTP 时间单位
+	w           PacketWriter
+}
+
+func (p *packetizer) init(channel byte, payloadType uint8, clockRate int, w PacketWriter) {
+	p.channel = channel
+	p.payloadType = payloadType
+	p.ssrc = rand.Uint32()
+	p.sequence = uint16(rand.Uint32())
+	p.rtpBase = rand.Uint32()
+	p.rtpTimeUnit = float64(clockRate) / float64(time.Second)
+	p.w = w
+}
+
+// ns 转换成 RTP 时间戳
+func (p *packetizer) rtptime(ns int64) uint32 {
+	return p.rtpBase + uint32(int64(float64(ns)*p.rtpTimeUnit))
+}
+
+// 使用指定的载荷片段创建 RTP 包并写入
+func (p *packetizer) writePacket(timestamp uint32, marker bool, payloads ...[]byte) error {
+	size := rtpHeaderSize
+	for _, payload := range payloads {
+		size += len(payload)
+	}
+
+	packet := &Packet{
+		Channel: p.channel,
+		Data:    make([]byte, size),
+		Header: rtp.Header{
+			Version:        rtpVersion,
+			Marker:         marker,
+			PayloadOffset:  rtpHeaderSize,
+			PayloadType:    p.payloadType,
+			SequenceNumber: p.sequence,
+			Timestamp:      timestamp,
+			SSRC:           p.ssrc,
+		},
+	}
+	p.sequence++
+
+	if _, err := packet.Header.MarshalTo(packet.Data); err != nil {
+		return err
+	}
+	offset := rtpHeaderSize
+	for _, payload := range payloads {
+		offset += copy(packet.Data[offset:], payload)
+	}
+	return p.w.WriteRtpPacket(packet)
+}
+
+// Muxer 将 codec.Frame 封装成 rtp.Packet
+type Muxer struct {
+	closed    bool
+	recvQueue *queue.SyncQueue
+	vp        Packetizer
+	ap        Packetizer
+	logger    *xlog.Logger
+}
+
+// NewMuxer 创建 rtp.Packet 封装处理器。
+func NewMuxer(video *codec.VideoMeta, audio *codec.AudioMeta, pw PacketWriter, logger *xlog.Logger) (*Muxer, error) {
+	muxer := &Muxer{
+		recvQueue: queue.NewSyncQueue(),
+		closed:    false,
+		vp:        emptyPacketizer{},
+		ap:        emptyPacketizer{},
+		logger:    logger,
+	}
+
+	switch video.Codec {
+	case "H264":
+		muxer.vp = NewH264Packetizer(video, pw)
+	case "H265":
+		muxer.vp = NewH265Packetizer(video, pw)
+	case "": // 只有音频
+		if audio.Codec != "AAC" {
+			return nil, errors.New("rtp muxer: no video or audio")
+		}
+	default:
+		return nil, fmt.Errorf("rtp muxer unsupport video codec type:%s", video.Codec)
+	}
+	if audio.Codec == "AAC" {
+		muxer.ap = NewAacPacketizer(audio, pw)
+	}
+
+	go muxer.process()
+	return muxer, nil
+}
+
+func (muxer *Muxer) process() {
+	defer func() {
+		defer func() { // 避免 handler 再 panic
+			recover()
+		}()
+
+		if r := recover(); r != nil {
+			muxer.logger.Errorf("rtp muxer routine panic；r = %v \n %s", r, debug.Stack())
+		}
+
+		// 尽早通知GC，回收内存
+		muxer.recvQueue.Reset()
+	}()
+
+	for !muxer.closed {
+		f := muxer.recvQueue.Pop()
+		if f == nil {
+			if !muxer.closed {
+				muxer.logger.Warn("rtp muxer:receive nil frame")
+			}
+			continue
+		}
+
+		frame := f.(*codec.Frame)
+		var err error
+		switch frame.MediaType {
+		case codec.MediaTypeVideo:
+			err = muxer.vp.Packetize(frame)
+		case codec.MediaTypeAudio:
+			err = muxer.ap.Packetize(frame)
+		}
+
+		if err != nil {
+			muxer.logger.Errorf("rtp muxer: packetize frame error :%s", err.Error())
+		}
+	}
+}
+
+// Close .
+func (muxer *Muxer) Close() error {
+	if muxer.closed {
+		return nil
+	}
+
+	muxer.closed = true
+	muxer.recvQueue.Signal()
+	return nil
+}
+
+// WriteFrame .
+func (muxer *Muxer) WriteFrame(frame *codec.Frame) error {
+	muxer.recvQueue.Push(frame)
+	return nil
+}
@@ -0,0 +1,195 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package rtp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/cnotch/ipchub/av/codec"
+	"github.com/stretchr/testify/assert"
+)
+
+// 直接将封包器输出的包交给解包器
+type loopback struct {
+	dp      Depacketizer
+	markers []bool
+}
+
+func (l *loopback) WriteRtpPacket(packet *Packet) error {
+	l.markers = append(l.markers, packet.Marker)
+	// 模拟网络接收，重新解析包头
+	p := &Packet{Channel: packet.Channel, Data: packet.Data}
+	if err := p.Header.Unmarshal(p.Data); err != nil {
+		return err
+	}
+	return l.dp.Depacketize(p)
+}
+
+type payloadWriter struct {
+	payloads [][]byte
+}
+
+func (w *payloadWriter) WriteFrame(frame *codec.Frame) error {
+	w.payloads = append(w.payloads, frame.Payload)
+	return nil
+}
+
+func b64(s string) []byte {
+	b, _ := base64.StdEncoding.DecodeString(s)
+	return b
+}
+
+func nalu(header []byte, size int) []byte {
+	nal := make([]byte, size)
+	copy(nal, header)
+	for i := len(header); i < size; i++ {
+		nal[i] = byte(i)
+	}
+	return nal
+}
+
+func TestH264Packetizer(t *testing.T) {
+	meta := codec.VideoMeta{
+		Codec:     "H264",
+		ClockRate: 90000,
+		Sps:       b64("Z2QAH6zZQFAFuhAAAAMAEAAAAwPI8YMZYA=="),
+		Pps:       []byte{0x68, 0xef, 0xbc, 0xb0},
+	}
+	w := &payloadWriter{}
+	dpMeta := meta
+	lb := &loopback{dp: NewH264Depacketizer(&dpMeta, w)}
+	p := NewH264Packetizer(&meta, lb)
+
+	frames := [][]byte{
+		nalu([]byte{0x65}, 5000), // IDR，需要 FU-A
+		nalu([]byte{0x41}, 100),  // P
+		meta.Sps,
+		meta.Pps,
+		nalu([]byte{0x65}, 800),
+	}
+	for i, payload := range frames {
+		err := p.Packetize(&codec.Frame{
+			MediaType: codec.MediaTypeVideo,
+			Pts:       int64(i) * int64(time.Second) / 25,
+			Payload:   payload,
+		})
+		assert.NoError(t, err)
+	}
+	// 最后一个 NAL 在收到下一帧后发送
+	assert.NoError(t, p.Packetize(&codec.Frame{
+		MediaType: codec.MediaTypeVideo,
+		Pts:       int64(len(frames)) * int64(time.Second) / 25,
+		Payload:   nalu([]byte{0x41}, 100),
+	}))
+
+	// 第一个 IDR 前自动插入参数集
+	want := append([][]byte{meta.Sps, meta.Pps}, frames...)
+	assert.Equal(t, want, w.payloads)
+}
+
+func TestH264PacketizerMarker(t *testing.T) {
+	meta := codec.VideoMeta{
+		Codec:     "H264",
+		ClockRate: 90000,
+		Sps:       b64("Z2QAH6zZQFAFuhAAAAMAEAAAAwPI8YMZYA=="),
+		Pps:       []byte{0x68, 0xef, 0xbc, 0xb0},
+	}
+	w := &payloadWriter{}
+	dpMeta := meta
+	lb := &loopback{dp: NewH264Depacketizer(&dpMeta, w)}
+	p := NewH264Packetizer(&meta, lb)
+
+	// 每帧两个 slice，只有访问单元的最后一个包设置 marker
+	frames := []struct {
+		pts     int64
+		payload []byte
+	}{
+		{0, nalu([]byte{0x65}, 100)},
+		{0, nalu([]byte{0x65}, 2000)}, // FU-A
+		{40, []byte{0x06, 1}},         // SEI
+		{40, nalu([]byte{0x41}, 100)},
+		{40, nalu([]byte{0x41}, 100)},
+		{80, nalu([]byte{0x41}, 100)},
+	}
+	for _, f := range frames {
+		assert.NoError(t, p.Packetize(&codec.Frame{
+			MediaType: codec.MediaTypeVideo,
+			Pts:       f.pts * int64(time.Millisecond),
+			Payload:   f.payload,
+		}))
+	}
+
+	// STAP-A(参数集), IDR, FU-A x2, SEI, P, P
+	assert.Equal(t, []bool{false, false, false, true, false, false, true}, lb.markers)
+}
+
+func TestH265Packetizer(t *testing.T) {
+	meta := codec.VideoMeta{
+		Codec:     "H265",
+		ClockRate: 90000,
+		Vps:       b64("QAEMAf//AWAAAAMAkAAAAwAAAwBdlZgJ"),
+		Sps:       b64("QgEBAWAAAAMAkAAAAwAAAwBdoAKAgC0WWVmkkyuAQAAA+kAAF3AC"),
+		Pps:       []byte{0x44, 0x01, 0xc1, 0x72, 0xb4, 0x62, 0x40},
+	}
+	w := &payloadWriter{}
+	dpMeta := meta
+	lb := &loopback{dp: NewH265Depacketizer(&dpMeta, w)}
+	p := NewH265Packetizer(&meta, lb)
+
+	frames := [][]byte{
+		nalu([]byte{0x26, 0x01}, 4000), // IDR_W_RADL，需要 FU
+		nalu([]byte{0x02, 0x01}, 200),  // TRAIL_R
+	}
+	for i, payload := range frames {
+		err := p.Packetize(&codec.Frame{
+			MediaType: codec.MediaTypeVideo,
+			Pts:       int64(i) * int64(time.Second) / 25,
+			Payload:   payload,
+		})
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, p.Packetize(&codec.Frame{
+		MediaType: codec.MediaTypeVideo,
+		Pts:       int64(len(frames)) * int64(time.Second) / 25,
+		Payload:   nalu([]byte{0x02, 0x01}, 200),
+	}))
+	assert.Equal(t, []bool{false, false, false, true, true}, lb.markers[len(lb.markers)-5:])
+
+	want := append([][]byte{meta.Vps, meta.Sps, meta.Pps}, frames...)
+	assert.Equal(t, want, w.payloads)
+}
+
+func TestAacPacketizer(t *testing.T) {
+	meta := codec.AudioMeta{
+		Codec:      "AAC",
+		SampleRate: 44100,
+		Channels:   2,
+	}
+	w := &payloadWriter{}
+	lb := &loopback{dp: NewAacDepacketizer(&meta, w)}
+	p := NewAacPacketizer(&meta, lb)
+
+	frames := [][]byte{
+		bytes.Repeat([]byte{1}, 300),
+		bytes.Repeat([]byte{2}, 1500),
+	}
+	for _, payload := range frames {
+		assert.NoError(t, p.Packetize(&codec.Frame{
+			MediaType: codec.MediaTypeAudio,
+			Payload:   payload,
+		}))
+	}
+	assert.Equal(t, frames, w.payloads)
+
+	// AU-size 只有 13 位
+	assert.Error(t, p.Packetize(&codec.Frame{
+		MediaType: codec.MediaTypeAudio,
+		Payload:   make([]byte, 1<<13),
+	}))
+	assert.Equal(t, frames, w.payloads)
+}
@@ -0,0 +1,151 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package rtp
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/pion/rtcp"
+)
+
+const (
+	rtcpSR = 200 // RTCP 发送者报告的包类型
+	// 序号跳变超过该值时认为是序号重置或迟到的包，见 RFC 3550 A.1
+	maxDropout = 3000
+)
+
+// NtpTime 将时间转换成 64 位的 NTP 时间戳
+func NtpTime(t time.Time) uint64 {
+	ns := t.UnixNano()
+	sec := uint64(ns/int64(time.Second)) + jan1970
+	frac := (uint64(ns%int64(time.Second)) << 32) / uint64(time.Second)
+	return sec<<32 | frac
+}
+
+// NtpMiddle 返回 NTP 时间戳的中间 32 位，即 RR 中 LSR 的格式
+func NtpMiddle(t time.Time) uint32 {
+	return uint32(NtpTime(t) >> 16)
+}
+
+// IsSenderReport 判断 RTCP 包(复合包的第一个包)是否为 SR
+func IsSenderReport(data []byte) bool {
+	return len(data) >= 28 && data[1] == rtcpSR
+}
+
+// Synced 是否已建立 RTP 时间和本地时间的对应关系
+func (sc *SyncClock) Synced() bool {
+	return sc.RTPTimeUnit > 0 && sc.NTPTime != 0
+}
+
+// Sync 设置 RTP 时间 rtptime 对应的本地时间
+func (sc *SyncClock) Sync(rtptime uint32, t time.Time) {
+	sc.RTPTime = rtptime
+	sc.NTPTime = t.UnixNano()
+}
+
+// RTPTimeAt 返回本地时间 t 对应的 RTP 时间
+func (sc *SyncClock) RTPTimeAt(t time.Time) uint32 {
+	diff := t.UnixNano() - sc.NTPTime
+	return sc.RTPTime + uint32(int64(float64(diff)/sc.RTPTimeUnit))
+}
+
+// ReceiverStats 按 RFC 3550 附录 A 统计一个 RTP 源的接收情况，用于生成 RR
+type ReceiverStats struct {
+	ClockRate int    // RTP 时钟频率，用于计算抖动
+	SSRC      uint32 // 源的 SSRC
+
+	started       bool
+	baseSeq       uint32
+	maxSeq        uint16
+	cycles        uint32 // 序号回绕次数 << 16
+	received      uint32
+	expectedPrior uint32
+	receivedPrior uint32
+	arrivalBase   time.Time // 第一个包的到达时间
+	transit       float64
+	jitter        float64
+	lastSR        uint32    // 最近收到的 SR 中 NTP 时间戳的中间 32 位
+	lastSRAt      time.Time // 最近收到 SR 的时间
+}
+
+// Update 统计在 at 时刻收到的 RTP 包
+func (s *ReceiverStats) Update(p *Packet, at time.Time) {
+	seq := p.SequenceNumber
+	if !s.started || p.SSRC != s.SSRC {
+		// 新的源重新统计
+		*s = ReceiverStats{ClockRate: s.ClockRate, SSRC: p.SSRC, started: true,
+			baseSeq: uint32(seq), maxSeq: seq, arrivalBase: at}
+	} else if delta := seq - s.maxSeq; delta > 0 && delta < maxDropout {
+		if seq < s.maxSeq { // 回绕
+			s.cycles += 1 << 16
+		}
+		s.maxSeq = seq
+	}
+	s.received++
+
+	if s.ClockRate <= 0 {
+		return
+	}
+	// 到达间隔抖动，单位为 RTP 时间
+	arrival := at.Sub(s.arrivalBase).Seconds() * float64(s.ClockRate)
+	transit := arrival - float64(p.Timestamp)
+	if s.received > 1 {
+		d := transit - s.transit
+		if d < 0 {
+			d = -d
+		}
+		s.jitter += (d - s.jitter) / 16
+	}
+	s.transit = transit
+}
+
+// UpdateSR 记录在 at 时刻收到的 SR，以便在 RR 中计算往返时延
+func (s *ReceiverStats) UpdateSR(data []byte, at time.Time) {
+	if !IsSenderReport(data) {
+		return
+	}
+	s.lastSR = binary.BigEndian.Uint32(data[10:])
+	s.lastSRAt = at
+}
+
+// Started 是否收到过 RTP 包
+func (s *ReceiverStats) Started() bool {
+	return s.started
+}
+
+// Report 生成 at 时刻的接收报告块，并开始新的统计周期
+func (s *ReceiverStats) Report(at time.Time) rtcp.ReceptionReport {
+	extMax := s.cycles + uint32(s.maxSeq)
+	expected := extMax - s.baseSeq + 1
+	lost := int64(expected) - int64(s.received)
+	if lost < 0 {
+		lost = 0
+	} else if lost > 0x7fffff {
+		lost = 0x7fffff
+	}
+
+	expectedInterval := expected - s.expectedPrior
+	receivedInterval := s.received - s.receivedPrior
+	s.expectedPrior = expected
+	s.receivedPrior = s.received
+	var fraction uint8
+	if expectedInterval > 0 && expectedInterval > receivedInterval {
+		fraction = uint8(((expectedInterval - receivedInterval) << 8) / expectedInterval)
+	}
+
+	report := rtcp.ReceptionReport{
+		SSRC:               s.SSRC,
+		FractionLost:       fraction,
+		TotalLost:          uint32(lost),
+		LastSequenceNumber: extMax,
+		Jitter:             uint32(s.jitter),
+		LastSenderReport:   s.lastSR,
+	}
+	if s.lastSR != 0 { // 单位为 1/65536 秒
+		report.Delay = uint32(at.Sub(s.lastSRAt) * 65536 / time.Second)
+	}
+	return report
+}
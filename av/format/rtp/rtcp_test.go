@@ -0,0 +1,81 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package rtp
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNtpTime(t *testing.T) {
+	at := time.Unix(1, int64(time.Second/2))
+	assert.Equal(t, uint64(jan1970+1)<<32|1<<31, NtpTime(at))
+	assert.Equal(t, uint32((jan1970+1)&0xffff)<<16|1<<15, NtpMiddle(at))
+}
+
+func TestSyncClock_RTPTimeAt(t *testing.T) {
+	var sc SyncClock
+	assert.False(t, sc.Synced())
+
+	sc.RTPTimeUnit = float64(time.Second) / 90000
+	now := time.Now()
+	base := uint32(0xffffff00)
+	sc.Sync(base, now)
+	assert.True(t, sc.Synced())
+	assert.Equal(t, base+9000, sc.RTPTimeAt(now.Add(100*time.Millisecond)))
+	assert.Equal(t, base+90000, sc.RTPTimeAt(now.Add(time.Second))) // 回绕
+	assert.Equal(t, base-90000, sc.RTPTimeAt(now.Add(-time.Second)))
+}
+
+func TestReceiverStats(t *testing.T) {
+	stats := ReceiverStats{ClockRate: 90000}
+	start := time.Now()
+
+	// 按时到达的包，回绕后丢失 2 个，重复和迟到的包抵消了丢包数
+	for i, seq := range []uint16{65533, 65534, 65535, 1, 3, 1, 65534} {
+		p := &Packet{Channel: ChannelVideo}
+		p.SSRC = 1
+		p.SequenceNumber = seq
+		n := uint32(seq - 65533)
+		p.Timestamp = n * 3600
+		stats.Update(p, start.Add(time.Duration(n)*40*time.Millisecond))
+		assert.True(t, stats.Started(), i)
+	}
+
+	sr := make([]byte, 28)
+	sr[1] = 200
+	binary.BigEndian.PutUint64(sr[8:], NtpTime(start))
+	stats.UpdateSR(sr, start)
+
+	report := stats.Report(start.Add(time.Second))
+	assert.Equal(t, uint32(1), report.SSRC)
+	assert.Equal(t, uint32(1<<16|3), report.LastSequenceNumber)
+	// 期望 7 个，收到 7 个(含重复)
+	assert.Equal(t, uint32(0), report.TotalLost)
+	assert.Equal(t, uint32(0), report.Jitter)
+	assert.Equal(t, NtpMiddle(start), report.LastSenderReport)
+	assert.Equal(t, uint32(65536), report.Delay)
+
+	// 新周期丢失 5 个中的 4 个
+	p := &Packet{Channel: ChannelVideo}
+	p.SSRC = 1
+	p.SequenceNumber = 8
+	p.Timestamp = 11 * 3600
+	stats.Update(p, start.Add(11*40*time.Millisecond))
+	report = stats.Report(start.Add(2 * time.Second))
+	assert.Equal(t, uint32(4), report.TotalLost)
+	assert.Equal(t, uint8(4*256/5), report.FractionLost)
+
+	// 新的源重新统计
+	p.SSRC = 2
+	stats.Update(p, start)
+	report = stats.Report(start)
+	assert.Equal(t, uint32(2), report.SSRC)
+	assert.Equal(t, uint32(0), report.TotalLost)
+	assert.Equal(t, uint32(0), report.LastSenderReport)
+}
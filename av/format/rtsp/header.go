@@ -41,6 +41,7 @@ const (
 	FieldExpires           = "Expires"            // (e:opt.:DESCRIBE, ANNOUNCE)
 	FieldFrom              = "From"               // (R:opt.:all)
 	FieldIfModifiedSince   = "If-Modified-Since"  // (R:opt.:DESCRIBE, SETUP)
+	FieldKeyMgmt           = "KeyMgmt"            // (R:opt.:SETUP; RFC 4567)
 	FieldLastModified      = "Last-Modified"      // (e:opt.:entity)
 	FieldProxyAuthenticate = "Proxy-Authenticate" //
 	FieldProxyRequire      = "Proxy-Require"      // (R:req.:all)
@@ -319,6 +320,7 @@ var canonicalKeys = map[string]string{
 	strings.ToUpper(FieldExpires):           FieldExpires,
 	strings.ToUpper(FieldFrom):              FieldFrom,
 	strings.ToUpper(FieldIfModifiedSince):   FieldIfModifiedSince,
+	strings.ToUpper(FieldKeyMgmt):           FieldKeyMgmt,
 	strings.ToUpper(FieldLastModified):      FieldLastModified,
 	strings.ToUpper(FieldProxyAuthenticate): FieldProxyAuthenticate,
 	strings.ToUpper(FieldProxyRequire):      FieldProxyRequire,
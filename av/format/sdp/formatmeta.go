@@ -0,0 +1,86 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package sdp
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/cnotch/ipchub/av/codec"
+)
+
+// RTP 动态载荷类型，与 rtp.Muxer 保持一致
+const (
+	videoPayloadType = 96
+	audioPayloadType = 97
+)
+
+// FormatMetadata 根据音视频元数据生成 sdp；
+// 视频轨道的 control 为 streamid=0，音频轨道为 streamid=1
+func FormatMetadata(video *codec.VideoMeta, audio *codec.AudioMeta) string {
+	var sb strings.Builder
+	sb.WriteString("v=0\r\n")
+	sb.WriteString("o=- 0 0 IN IP4 127.0.0.1\r\n")
+	sb.WriteString("s=No Name\r\n")
+	sb.WriteString("c=IN IP4 0.0.0.0\r\n")
+	sb.WriteString("t=0 0\r\n")
+	sb.WriteString("a=tool:ipchub\r\n")
+
+	formatVideoMeta(&sb, video)
+	formatAudioMeta(&sb, audio)
+	return sb.String()
+}
+
+func formatVideoMeta(sb *strings.Builder, video *codec.VideoMeta) {
+	var fmtp string
+	switch video.Codec {
+	case "H264":
+		fmtp = "packetization-mode=1"
+		if len(video.Sps) > 3 && len(video.Pps) > 0 {
+			fmtp += fmt.Sprintf("; sprop-parameter-sets=%s,%s; profile-level-id=%s",
+				base64.StdEncoding.EncodeToString(video.Sps),
+				base64.StdEncoding.EncodeToString(video.Pps),
+				strings.ToUpper(hex.EncodeToString(video.Sps[1:4])))
+		}
+	case "H265":
+		fmtp = fmt.Sprintf("sprop-vps=%s; sprop-sps=%s; sprop-pps=%s",
+			base64.StdEncoding.EncodeToString(video.Vps),
+			base64.StdEncoding.EncodeToString(video.Sps),
+			base64.StdEncoding.EncodeToString(video.Pps))
+	default:
+		return
+	}
+
+	clockRate := video.ClockRate
+	if clockRate == 0 {
+		clockRate = 90000
+	}
+
+	fmt.Fprintf(sb, "m=video 0 RTP/AVP %d\r\n", videoPayloadType)
+	if video.DataRate > 0 {
+		fmt.Fprintf(sb, "b=AS:%d\r\n", int(video.DataRate))
+	}
+	fmt.Fprintf(sb, "a=rtpmap:%d %s/%d\r\n", videoPayloadType, video.Codec, clockRate)
+	fmt.Fprintf(sb, "a=fmtp:%d %s\r\n", videoPayloadType, fmtp)
+	sb.WriteString("a=control:streamid=0\r\n")
+}
+
+func formatAudioMeta(sb *strings.Builder, audio *codec.AudioMeta) {
+	if audio.Codec != "AAC" {
+		return
+	}
+
+	fmt.Fprintf(sb, "m=audio 0 RTP/AVP %d\r\n", audioPayloadType)
+	if audio.DataRate > 0 {
+		fmt.Fprintf(sb, "b=AS:%d\r\n", int(audio.DataRate))
+	}
+	fmt.Fprintf(sb, "a=rtpmap:%d MPEG4-GENERIC/%d/%d\r\n",
+		audioPayloadType, audio.SampleRate, audio.Channels)
+	fmt.Fprintf(sb, "a=fmtp:%d profile-level-id=1;mode=AAC-hbr;sizelength=13;indexlength=3;indexdeltalength=3; config=%s\r\n",
+		audioPayloadType, hex.EncodeToString(audio.Sps))
+	sb.WriteString("a=control:streamid=1\r\n")
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package sdp
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/cnotch/ipchub/av/codec"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatMetadata(t *testing.T) {
+	sps, _ := base64.StdEncoding.DecodeString("Z2QAH6zZQFAFuhAAAAMAEAAAAwPI8YMZYA==")
+	vps, _ := base64.StdEncoding.DecodeString("QAEMAf//AWAAAAMAkAAAAwAAAwBdlZgJ")
+	hsps, _ := base64.StdEncoding.DecodeString("QgEBAWAAAAMAkAAAAwAAAwBdoAKAgC0WWVmkkyuAQAAA+kAAF3AC")
+
+	tests := []struct {
+		name  string
+		video codec.VideoMeta
+		audio codec.AudioMeta
+	}{
+		{
+			"h264+aac",
+			codec.VideoMeta{Codec: "H264", ClockRate: 90000, Sps: sps, Pps: []byte{0x68, 0xef, 0xbc, 0xb0}},
+			codec.AudioMeta{Codec: "AAC", SampleRate: 44100, Channels: 2, Sps: []byte{0x12, 0x10}},
+		},
+		{
+			"h265",
+			codec.VideoMeta{Codec: "H265", ClockRate: 90000, Vps: vps, Sps: hsps, Pps: []byte{0x44, 0x01, 0xc1, 0x72, 0xb4, 0x62, 0x40}},
+			codec.AudioMeta{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rawsdp := FormatMetadata(&tt.video, &tt.audio)
+
+			var video codec.VideoMeta
+			var audio codec.AudioMeta
+			err := ParseMetadata(rawsdp, &video, &audio)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, tt.video.Codec, video.Codec)
+			assert.Equal(t, tt.video.ClockRate, video.ClockRate)
+			assert.Equal(t, tt.video.Vps, video.Vps)
+			assert.Equal(t, tt.video.Sps, video.Sps)
+			assert.Equal(t, tt.video.Pps, video.Pps)
+			assert.Equal(t, tt.audio.Codec, audio.Codec)
+			if tt.audio.Codec != "" {
+				assert.Equal(t, tt.audio.SampleRate, audio.SampleRate)
+				assert.Equal(t, tt.audio.Channels, audio.Channels)
+				assert.Equal(t, tt.audio.Sps, audio.Sps)
+			}
+		})
+	}
+}
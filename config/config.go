@@ -15,8 +15,14 @@ type config struct {
 	CacheGop    bool            `json:"cache_gop"`            // 缓存图像组，以便提高播放端打开速度，但内存需求大
 	HlsPath     string          `json:"hlspath"`              // Hls 临时缓存目录
 	HlsFragment int             `json:"hlsfragment"`          // Hls 分段时长，单位秒
+	HlsPart     int             `json:"hlspart"`              // LL-HLS 部分片段时长，单位毫秒，0 不启用
+	HlsFormats  string          `json:"hlsformats"`           // 生成的 ts、fmp4(hls) 和 dash 格式，逗号分隔，空为 ts
+	WebrtcIPs   string          `json:"webrtcips"`            // WebRTC ICE 候选的公网 IP，多个用逗号分隔
+	WebrtcPorts string          `json:"webrtcports"`          // WebRTC UDP 端口范围，如 50000-50100
 	Profile     bool            `json:"profile"`              // 是否启动Profile
 	TLS         *TLSConfig      `json:"tls,omitempty"`        // https安全端口交互
+	SRT         *SRTConfig      `json:"srt,omitempty"`        // SRT 侦听配置
+	Record      *RecordConfig   `json:"record,omitempty"`     // 录像配置
 	Routetable  *ProviderConfig `json:"routetable,omitempty"` // 路由表
 	Users       *ProviderConfig `json:"users,omitempty"`      // 用户
 	Log         LogConfig       `json:"log"`                  // 日志配置
@@ -31,6 +37,10 @@ func (c *config) initFlags() {
 		"Determines if Gop should be cached to memory")
 	flag.StringVar(&c.HlsPath, "hlspath", "", "Set HLS live cache path")
 	flag.IntVar(&c.HlsFragment, "hlsfragment", 5, "Set HLS segment duration")
+	flag.IntVar(&c.HlsPart, "hlspart", 0, "Set LL-HLS partial segment duration in milliseconds, 0 to disable")
+	flag.StringVar(&c.HlsFormats, "hlsformats", "ts", "Set generated segment formats(ts, fmp4, dash) separated by commas, none to disable")
+	flag.StringVar(&c.WebrtcIPs, "webrtcips", "", "Set WebRTC public IPs announced in ICE candidates, separated by commas")
+	flag.StringVar(&c.WebrtcPorts, "webrtcports", "", "Set WebRTC UDP port range, such as 50000-50100")
 	flag.BoolVar(&c.Profile, "pprof", false,
 		"Determines if profile enabled")
 
@@ -8,6 +8,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -69,6 +70,15 @@ func InitConfig() {
 		}
 	}
 
+	if rc := globalC.Record; rc != nil {
+		if rc.Path == "" {
+			rc.Path = "records"
+		}
+		if !filepath.IsAbs(rc.Path) {
+			rc.Path = filepath.Join(filepath.Dir(exe), rc.Path)
+		}
+	}
+
 	// 初始化日志
 	globalC.Log.initLogger()
 }
@@ -113,6 +123,30 @@ func GetTLSConfig() *TLSConfig {
 	return globalC.TLS
 }
 
+// GetSRTConfig 获取SRTConfig，未配置时返回 nil
+func GetSRTConfig() *SRTConfig {
+	if globalC == nil {
+		return nil
+	}
+	return globalC.SRT
+}
+
+// GetRecordConfig 获取录像配置，未配置时返回 nil
+func GetRecordConfig() *RecordConfig {
+	if globalC == nil {
+		return nil
+	}
+	return globalC.Record
+}
+
+// PreRoll 流缓存最近帧的时长，没有录像配置时返回 0
+func PreRoll() time.Duration {
+	if globalC == nil || globalC.Record == nil {
+		return 0
+	}
+	return globalC.Record.PreRollDuration()
+}
+
 // ConsoleAppDir 管理员控制台应用的目录
 func ConsoleAppDir() (string, bool) {
 	if consoleAppDir == "" {
@@ -170,9 +204,35 @@ func MulticastTTL() int {
 	return 127
 }
 
-// HlsEnable 是否启动 Hls
+// HlsEnable 是否生成 TS 片段的 hls；录像归档 hls 片段时总是生成
 func HlsEnable() bool {
-	return true
+	if globalC != nil && globalC.Record != nil && globalC.Record.ArchiveHls() {
+		return true
+	}
+	return hlsFormatEnabled("ts")
+}
+
+// Fmp4HlsEnable 是否生成 fmp4(CMAF) 片段的 hls
+func Fmp4HlsEnable() bool {
+	return hlsFormatEnabled("fmp4")
+}
+
+// DashEnable 是否生成 dash
+func DashEnable() bool {
+	return hlsFormatEnabled("dash")
+}
+
+// 未配置时只生成 ts，fmp4 和 dash 需要显式开启
+func hlsFormatEnabled(format string) bool {
+	if globalC == nil || strings.TrimSpace(globalC.HlsFormats) == "" {
+		return format == "ts"
+	}
+	for _, f := range strings.Split(globalC.HlsFormats, ",") {
+		if strings.EqualFold(strings.TrimSpace(f), format) {
+			return true
+		}
+	}
+	return false
 }
 
 // HlsFragment TS片段时长（s）
@@ -183,6 +243,17 @@ func HlsFragment() int {
 	return globalC.HlsFragment
 }
 
+// HlsPart LL-HLS 部分片段时长，0 表示不启用
+func HlsPart() time.Duration {
+	if globalC == nil || globalC.HlsPart <= 0 {
+		return 0
+	}
+	if globalC.HlsPart < 200 {
+		return 200 * time.Millisecond
+	}
+	return time.Duration(globalC.HlsPart) * time.Millisecond
+}
+
 // HlsPath hls 存储目录
 func HlsPath() string {
 	if globalC == nil {
@@ -191,6 +262,39 @@ func HlsPath() string {
 	return globalC.HlsPath
 }
 
+// WebrtcIPs WebRTC ICE 候选的公网 IP
+func WebrtcIPs() []string {
+	if globalC == nil {
+		return nil
+	}
+
+	var ips []string
+	for _, ip := range strings.Split(globalC.WebrtcIPs, ",") {
+		if ip = strings.TrimSpace(ip); ip != "" {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// WebrtcPortRange WebRTC UDP 端口范围，未配置时返回 0,0
+func WebrtcPortRange() (min, max uint16) {
+	if globalC == nil {
+		return
+	}
+
+	i := strings.IndexByte(globalC.WebrtcPorts, '-')
+	if i < 0 {
+		return
+	}
+	pmin, err1 := strconv.ParseUint(strings.TrimSpace(globalC.WebrtcPorts[:i]), 10, 16)
+	pmax, err2 := strconv.ParseUint(strings.TrimSpace(globalC.WebrtcPorts[i+1:]), 10, 16)
+	if err1 != nil || err2 != nil || pmin == 0 || pmin > pmax {
+		return
+	}
+	return uint16(pmin), uint16(pmax)
+}
+
 // LoadRoutetableProvider 加载路由表提供者
 func LoadRoutetableProvider(providers ...Provider) Provider {
 	if globalC == nil {
@@ -0,0 +1,101 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package config
+
+import (
+	"strings"
+	"time"
+)
+
+// 录像的默认设置
+const (
+	defaultRecordSegment = 10 * time.Minute
+	defaultRecordLayout  = "{path}/{date}/{time}.mp4"
+)
+
+// RecordConfig 录像配置.
+type RecordConfig struct {
+	Path     string `json:"path"`     // 录像存储目录，相对路径基于程序所在目录
+	Segment  int    `json:"segment"`  // 录像文件时长，单位秒
+	Layout   string `json:"layout"`   // 录像文件的目录结构
+	Format   string `json:"format"`   // 录像格式，逗号分隔的 mp4(默认)、hls(归档 TS 片段，支持 VOD 回放) 和 rtp(归档 RTP 包，支持 RTSP 回放)
+	MaxAge   int    `json:"maxage"`   // 录像保留时长，单位小时，0 不限制
+	MaxSize  int    `json:"maxsize"`  // 每个流的录像最大总大小，单位 MB，0 不限制
+	MinFree  int    `json:"minfree"`  // 磁盘最小可用空间，单位 MB，不足时删除最早的录像，0 不检查
+	PreRoll  int    `json:"preroll"`  // 每个流缓存最近帧的时长，单位秒，用于事件录像的预录，0 不缓存
+	ClipHook string `json:"cliphook"` // 事件录像完成时 POST 事件的 URL，空不通知
+}
+
+// SegmentDuration 录像文件时长，未设置时返回默认的 10 分钟
+func (c *RecordConfig) SegmentDuration() time.Duration {
+	if c.Segment <= 0 {
+		return defaultRecordSegment
+	}
+	return time.Duration(c.Segment) * time.Second
+}
+
+// FileLayout 录像文件的目录结构，未设置时返回 "{path}/{date}/{time}.mp4"
+func (c *RecordConfig) FileLayout() string {
+	if c.Layout == "" {
+		return defaultRecordLayout
+	}
+	return c.Layout
+}
+
+// RecordMp4 是否录制 MP4 文件，未设置格式时默认录制
+func (c *RecordConfig) RecordMp4() bool {
+	return strings.TrimSpace(c.Format) == "" || c.hasFormat("mp4")
+}
+
+// ArchiveHls 是否以归档 hls TS 片段的方式录像
+func (c *RecordConfig) ArchiveHls() bool {
+	return c.hasFormat("hls")
+}
+
+// ArchiveRtp 是否以归档 RTP 包的方式录像
+func (c *RecordConfig) ArchiveRtp() bool {
+	return c.hasFormat("rtp")
+}
+
+func (c *RecordConfig) hasFormat(format string) bool {
+	for _, f := range strings.Split(c.Format, ",") {
+		if strings.EqualFold(strings.TrimSpace(f), format) {
+			return true
+		}
+	}
+	return false
+}
+
+// MaxAgeDuration 录像保留时长，0 表示不限制
+func (c *RecordConfig) MaxAgeDuration() time.Duration {
+	if c.MaxAge <= 0 {
+		return 0
+	}
+	return time.Duration(c.MaxAge) * time.Hour
+}
+
+// MaxSizeBytes 每个流的录像最大总字节数，0 表示不限制
+func (c *RecordConfig) MaxSizeBytes() int64 {
+	if c.MaxSize <= 0 {
+		return 0
+	}
+	return int64(c.MaxSize) << 20
+}
+
+// MinFreeBytes 磁盘最小可用字节数，0 表示不检查
+func (c *RecordConfig) MinFreeBytes() uint64 {
+	if c.MinFree <= 0 {
+		return 0
+	}
+	return uint64(c.MinFree) << 20
+}
+
+// PreRollDuration 流缓存最近帧的时长，0 表示不缓存
+func (c *RecordConfig) PreRollDuration() time.Duration {
+	if c.PreRoll <= 0 {
+		return 0
+	}
+	return time.Duration(c.PreRoll) * time.Second
+}
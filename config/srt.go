@@ -0,0 +1,25 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package config
+
+import "time"
+
+// 默认的 SRT 延时
+const defaultSRTLatency = 120 * time.Millisecond
+
+// SRTConfig SRT listen 配置.
+type SRTConfig struct {
+	ListenAddr string `json:"listen"`     // UDP 侦听地址，如 ":1935"
+	Passphrase string `json:"passphrase"` // 加密密码，10-79 个字符，空表示不加密
+	Latency    int    `json:"latency"`    // 延时，单位毫秒
+}
+
+// LatencyDuration SRT 延时，未设置时返回默认的 120 毫秒
+func (c *SRTConfig) LatencyDuration() time.Duration {
+	if c.Latency <= 0 {
+		return defaultSRTLatency
+	}
+	return time.Duration(c.Latency) * time.Millisecond
+}
@@ -1,22 +1,51 @@
 module github.com/cnotch/ipchub
 
-go 1.14
+go 1.20
 
 require (
-	github.com/BurntSushi/toml v0.3.1 // indirect
 	github.com/cnotch/apirouter v0.0.0-20200731232942-89e243a791f3
 	github.com/cnotch/loader v0.0.0-20200405015128-d9d964d09439
 	github.com/cnotch/queue v0.0.0-20201224060551-4191569ce8f6
 	github.com/cnotch/scheduler v0.0.0-20200522024700-1d2da93eefc5
 	github.com/cnotch/xlog v0.0.0-20201208005456-cfda439cd3a0
+	github.com/datarhei/gosrt v0.5.5
 	github.com/emitter-io/address v1.0.0
 	github.com/gorilla/websocket v1.4.2
 	github.com/kelindar/process v0.0.0-20170730150328-69a29e249ec3
 	github.com/kelindar/rate v1.0.0
 	github.com/kelindar/tcp v1.0.0
+	github.com/pion/rtcp v1.2.6
 	github.com/pion/rtp v1.6.2
+	github.com/pion/srtp/v2 v2.0.1
+	github.com/pion/webrtc/v3 v3.0.11
 	github.com/pixelbender/go-sdp v1.1.0
-	github.com/stretchr/testify v1.6.1
-	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
+	github.com/stretchr/testify v1.8.4
+	golang.org/x/crypto v0.15.0
 	gopkg.in/natefinch/lumberjack.v2 v2.0.0
 )
+
+require (
+	github.com/BurntSushi/toml v0.3.1 // indirect
+	github.com/benburkert/openpgp v0.0.0-20160410205803-c2471f86866c // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/google/uuid v1.1.5 // indirect
+	github.com/pion/datachannel v1.4.21 // indirect
+	github.com/pion/dtls/v2 v2.0.7 // indirect
+	github.com/pion/ice/v2 v2.0.15 // indirect
+	github.com/pion/interceptor v0.0.9 // indirect
+	github.com/pion/logging v0.2.2 // indirect
+	github.com/pion/mdns v0.0.4 // indirect
+	github.com/pion/randutil v0.1.0 // indirect
+	github.com/pion/sctp v1.7.11 // indirect
+	github.com/pion/sdp/v3 v3.0.4 // indirect
+	github.com/pion/stun v0.3.5 // indirect
+	github.com/pion/transport v0.12.2 // indirect
+	github.com/pion/turn/v2 v2.0.5 // indirect
+	github.com/pion/udp v0.1.0 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/net v0.10.0 // indirect
+	golang.org/x/sys v0.14.0 // indirect
+	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
@@ -0,0 +1,149 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package cache
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cnotch/ipchub/av/codec"
+	"github.com/cnotch/ipchub/av/codec/h264"
+	"github.com/cnotch/ipchub/av/codec/hevc"
+	"github.com/cnotch/queue"
+)
+
+// FrameCache 完整帧的环形缓存，保留最近一段时长的帧，
+// 第一个帧总是视频关键帧；用于事件录像的预录
+type FrameCache struct {
+	hevc     bool
+	duration int64 // 缓存时长，单位 ns；不大于 0 时只判断关键帧，不缓存
+	l        sync.RWMutex
+	frames   []*codec.Frame
+	keys     []int // 关键帧在 frames 中的位置
+}
+
+// NewFrameCache 创建视频编码为 videoCodec、缓存 duration 时长的帧缓存
+func NewFrameCache(videoCodec string, duration time.Duration) *FrameCache {
+	return &FrameCache{
+		hevc:     videoCodec == "H265",
+		duration: int64(duration),
+	}
+}
+
+// CachePack 向FrameCache中缓存帧，返回是否是视频关键帧
+func (cache *FrameCache) CachePack(pack Pack) bool {
+	frame := pack.(*codec.Frame)
+	keyframe := cache.isKeyFrame(frame)
+	if cache.duration <= 0 {
+		return keyframe
+	}
+
+	cache.l.Lock()
+	defer cache.l.Unlock()
+
+	if keyframe {
+		// 时间戳回退，如源重新开始，丢弃之前的帧
+		if n := len(cache.keys); n > 0 && frame.Dts < cache.frames[cache.keys[n-1]].Dts {
+			cache.reset()
+		}
+		cache.keys = append(cache.keys, len(cache.frames))
+	} else if len(cache.frames) == 0 { // 必须关键帧作为cache的第一个帧
+		return false
+	}
+	cache.frames = append(cache.frames, frame)
+
+	// 第二个 GOP 已经覆盖缓存时长时，丢弃最早的 GOP
+	for len(cache.keys) > 1 && frame.Dts-cache.frames[cache.keys[1]].Dts >= cache.duration {
+		cache.drop(cache.keys[1])
+	}
+	return keyframe
+}
+
+// 丢弃前 n 个帧
+func (cache *FrameCache) drop(n int) {
+	for i := 0; i < n; i++ {
+		cache.frames[i] = nil // 尽早通知GC，回收内存
+	}
+	cache.frames = cache.frames[n:]
+	cache.keys = cache.keys[1:]
+	for i := range cache.keys {
+		cache.keys[i] -= n
+	}
+}
+
+func (cache *FrameCache) reset() {
+	cache.frames = nil
+	cache.keys = cache.keys[:0]
+}
+
+// Reset 重置FrameCache缓存
+func (cache *FrameCache) Reset() {
+	cache.l.Lock()
+	defer cache.l.Unlock()
+	cache.reset()
+}
+
+// PushTo 入列到指定的队列
+func (cache *FrameCache) PushTo(q *queue.SyncQueue) int {
+	cache.l.RLock()
+	defer cache.l.RUnlock()
+
+	bytes := 0
+	for _, frame := range cache.frames {
+		q.Queue().Push(frame) // 启动阶段调用，无需加锁
+		bytes += frame.Size()
+	}
+	return bytes
+}
+
+// Recent 返回最近 d 时长的帧的快照，从 d 之前最近的关键帧开始
+func (cache *FrameCache) Recent(d time.Duration) *FrameCache {
+	cache.l.RLock()
+	defer cache.l.RUnlock()
+
+	recent := &FrameCache{hevc: cache.hevc, duration: cache.duration}
+	if len(cache.frames) == 0 || d <= 0 {
+		return recent
+	}
+
+	from := cache.frames[len(cache.frames)-1].Dts - int64(d)
+	start := 0
+	for _, k := range cache.keys {
+		if cache.frames[k].Dts > from {
+			break
+		}
+		start = k
+	}
+	recent.frames = append(recent.frames, cache.frames[start:]...)
+	for _, k := range cache.keys {
+		if k >= start {
+			recent.keys = append(recent.keys, k-start)
+		}
+	}
+	return recent
+}
+
+// Duration 缓存的帧的时长
+func (cache *FrameCache) Duration() time.Duration {
+	cache.l.RLock()
+	defer cache.l.RUnlock()
+
+	if len(cache.frames) == 0 {
+		return 0
+	}
+	return time.Duration(cache.frames[len(cache.frames)-1].Dts - cache.frames[0].Dts)
+}
+
+// 是否为视频关键帧，消费者在关键帧处决定是否丢弃积压的帧
+func (cache *FrameCache) isKeyFrame(frame *codec.Frame) bool {
+	if frame.MediaType != codec.MediaTypeVideo || len(frame.Payload) == 0 {
+		return false
+	}
+	if cache.hevc {
+		nalType := hevc.NulType(frame.Payload[0])
+		return nalType >= hevc.NalBlaWLp && nalType <= hevc.NalIrapVcl23
+	}
+	return h264.IsIdrSlice(frame.Payload[0])
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package cache
+
+import (
+	"sync"
+
+	"github.com/cnotch/ipchub/av/format/mpegts"
+	"github.com/cnotch/queue"
+)
+
+// TsCache mpegts 帧缓存，关键帧已包含参数集，无需单独缓存
+type TsCache struct {
+	cacheGop bool
+	l        sync.RWMutex
+	gop      queue.Queue
+}
+
+// NewTsCache 创建 mpegts 帧缓存
+func NewTsCache(cacheGop bool) *TsCache {
+	return &TsCache{
+		cacheGop: cacheGop,
+	}
+}
+
+// CachePack 向TsCache中缓存包
+func (cache *TsCache) CachePack(pack Pack) bool {
+	frame := pack.(*mpegts.Frame)
+	keyframe := frame.IsKeyFrame()
+
+	if cache.cacheGop { // 需要缓存 GOP
+		cache.l.Lock()
+		if keyframe { // 关键帧，重置GOP
+			cache.gop.Reset()
+			cache.gop.Push(pack)
+		} else if cache.gop.Len() > 0 { // 必须关键帧作为cache的第一个包
+			cache.gop.Push(pack)
+		}
+		cache.l.Unlock()
+	}
+	return keyframe
+}
+
+// Reset 重置TsCache缓存
+func (cache *TsCache) Reset() {
+	cache.l.Lock()
+	defer cache.l.Unlock()
+	cache.gop.Reset()
+}
+
+// PushTo 入列到指定的队列
+func (cache *TsCache) PushTo(q *queue.SyncQueue) int {
+	cache.l.RLock()
+	defer cache.l.RUnlock()
+
+	bytes := 0
+	packs := cache.gop.Elems()
+	q.Queue().PushN(packs) // 启动阶段调用，无需加锁
+	for _, p := range packs {
+		bytes += p.(Pack).Size()
+	}
+	return bytes
+}
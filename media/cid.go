@@ -15,6 +15,8 @@ type PacketType uint32
 const (
 	RTPPacket PacketType = iota // 根据 RTP 协议打包的媒体
 	FLVPacket
+	TSPacket    // mpegts 帧
+	FramePacket // codec.Frame 完整帧，如录像
 
 	maxConsumerSequence = 0x3fff_ffff
 )
@@ -30,6 +32,10 @@ func (t PacketType) String() string {
 		return "RTP"
 	case FLVPacket:
 		return "FLV"
+	case TSPacket:
+		return "TS"
+	case FramePacket:
+		return "FRAME"
 	default:
 		return "Unknown"
 	}
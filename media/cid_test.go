@@ -23,6 +23,10 @@ func TestCID(t *testing.T) {
 			"NewFLVConsumer",
 			FLVPacket,
 		},
+		{
+			"NewFrameConsumer",
+			FramePacket,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -109,6 +109,20 @@ func (c *consumption) consume() {
 	}
 }
 
+// ReceptionReporter 可以提供接收质量的消费者，如通过 RTCP RR 报告接收情况的 RTSP 播放者
+type ReceptionReporter interface {
+	ReceptionStats() []ReceptionStats
+}
+
+// ReceptionStats 消费者一个媒体轨道的接收质量
+type ReceptionStats struct {
+	Track        string  `json:"track"`         // video 或 audio
+	FractionLost float64 `json:"fraction_lost"` // 最近一个报告周期的丢包率
+	Lost         uint32  `json:"lost"`          // 累计丢包数
+	Jitter       float64 `json:"jitter"`        // 到达间隔抖动(毫秒)
+	RTT          float64 `json:"rtt"`           // 往返时延(毫秒)，未知时为 0
+}
+
 // ConsumptionInfo 消费者信息
 type ConsumptionInfo struct {
 	ID         uint32           `json:"id"`
@@ -116,6 +130,7 @@ type ConsumptionInfo struct {
 	PacketType string           `json:"packet_type"`
 	Extra      string           `json:"extra"`
 	Flow       stats.FlowSample `json:"flow"` // 转换成 K
+	Reception  []ReceptionStats `json:"reception,omitempty"`
 }
 
 // Info 获取消费者信息
@@ -124,11 +139,15 @@ func (c *consumption) Info() ConsumptionInfo {
 	flow.InBytes /= 1024
 	flow.OutBytes /= 1024
 
-	return ConsumptionInfo{
+	info := ConsumptionInfo{
 		ID:         uint32(c.cid),
 		StartOn:    c.startOn.Format(time.RFC3339Nano),
 		PacketType: c.packetType.String(),
 		Extra:      c.extra,
 		Flow:       flow,
 	}
+	if r, ok := c.consumer.(ReceptionReporter); ok {
+		info.Reception = r.ReceptionStats()
+	}
+	return info
 }
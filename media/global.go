@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cnotch/ipchub/provider/route"
@@ -60,6 +61,14 @@ func Regist(s *Stream) {
 	}
 }
 
+// Replace 源的元数据变化时，以新流 s 替换旧流 old 并关闭旧流；
+// 旧流由路由拉流创建时，没有消费者时自动关闭的任务转移到新流
+func Replace(old, s *Stream) {
+	old.next.Store(s)
+	Unregist(old)
+	Regist(s)
+}
+
 // Unregist 取消注册
 func Unregist(s *Stream) {
 	si, ok := streams.Load(s.path)
@@ -194,11 +203,25 @@ func (r *runZeroConsumersClose) Next(t time.Time) time.Time {
 }
 
 func (r *runZeroConsumersClose) run() {
-	if r.s.consumptions.Count() <= 0 {
-		hlsable := r.s.Hlsable()
-		if hlsable == nil || time.Now().Sub(hlsable.LastAccessTime()) >= r.d {
-			r.closed = true
-			r.s.close(r.closedStats)
+	if r.closedStats == StreamNoConsumer {
+		// 拉流的流因元数据变化被替换时，转而检查新流
+		for next, ok := r.s.next.Load().(*Stream); ok; next, ok = r.s.next.Load().(*Stream) {
+			r.s = next
+		}
+	}
+
+	// 各类消费者(包括 flv、ts 播放者和录像)都需要保持流
+	if r.s.ConsumerCount() <= 0 &&
+		atomic.LoadInt32(&r.s.hlsArchiving) == 0 {
+		for _, hlsable := range []Hlsable{r.s.Hlsable(), r.s.Fmp4Hlsable()} {
+			if hlsable != nil && time.Now().Sub(hlsable.LastAccessTime()) < r.d {
+				return
+			}
+		}
+		if dashable := r.s.Dashable(); dashable != nil && time.Now().Sub(dashable.LastAccessTime()) < r.d {
+			return
 		}
+		r.closed = true
+		r.s.close(r.closedStats)
 	}
 }
@@ -8,6 +8,8 @@ import (
 	"io"
 	"strings"
 	"time"
+
+	"github.com/cnotch/ipchub/av/codec"
 )
 
 // Multicastable 支持组播模式的源
@@ -23,7 +25,21 @@ type Multicastable interface {
 // Hlsable 支持Hls访问
 type Hlsable interface {
 	M3u8(token string) ([]byte, error)
+	// WaitM3u8 阻塞直到播放列表包含片段 msn 的部分片段 part；
+	// msn < 0 时只等待播放列表可用，part < 0 时等待完整的片段
+	WaitM3u8(token string, msn, part int, timeout time.Duration) ([]byte, error)
 	Segment(seq int) (io.Reader, int, error)
+	Part(seq, index int) (io.Reader, int, error) // LL-HLS 部分片段
+	InitSegment() (io.Reader, int, error)        // fmp4 的初始化片段
+	LastAccessTime() time.Time
+}
+
+// Dashable 支持 MPEG-DASH 访问
+type Dashable interface {
+	// WaitMpd 阻塞直到 MPD 可用
+	WaitMpd(token string, timeout time.Duration) ([]byte, error)
+	Segment(mediaType codec.MediaType, number int) (io.Reader, int, error)
+	InitSegment(mediaType codec.MediaType) (io.Reader, int, error)
 	LastAccessTime() time.Time
 }
 
@@ -60,3 +76,10 @@ func Hls(hls Hlsable) Option {
 		s.hls = hls
 	})
 }
+
+// PreRoll 缓存最近帧的时长选项，默认使用录像配置的 preroll
+func PreRoll(d time.Duration) Option {
+	return optionFunc(func(s *Stream) {
+		s.preRoll = d
+	})
+}
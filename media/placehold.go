@@ -57,3 +57,15 @@ type emptyRtpDemuxer struct{}
 func (emptyRtpDemuxer) TypeFlags() byte                  { return 0 }
 func (emptyRtpDemuxer) WriteRtpPacket(*rtp.Packet) error { return nil }
 func (emptyRtpDemuxer) Close() error                     { return nil }
+
+type frameMuxer interface {
+	codec.FrameWriter
+	io.Closer
+}
+
+var _ frameMuxer = emptyFrameMuxer{}
+
+type emptyFrameMuxer struct{}
+
+func (emptyFrameMuxer) WriteFrame(frame *codec.Frame) error { return nil }
+func (emptyFrameMuxer) Close() error                        { return nil }
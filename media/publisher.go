@@ -0,0 +1,153 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package media
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/cnotch/ipchub/av/codec"
+	"github.com/cnotch/xlog"
+)
+
+// 等待音频元数据的最长时间
+const metaWaitTimeout = time.Second * 2
+
+// MetadataDemuxer 从源解析音视频元数据的解复用器，如 flv、mpegts
+type MetadataDemuxer interface {
+	VideoMetadataIsReady() bool
+	AudioMetadataIsReady() bool
+}
+
+// FramePublisher 将解复用器输出的 codec.Frame 发布为流
+//
+// 视频元数据就绪或确认只有音频时创建并注册流，Close 时注销流；
+// 元数据变化时以新的元数据创建流并替换旧流。方法不是并发安全的。
+type FramePublisher struct {
+	Video codec.VideoMeta // 解复用器输出的视频元数据
+	Audio codec.AudioMeta // 解复用器输出的音频元数据
+
+	kind          string
+	path          string
+	addr          string
+	audioOnlyWait time.Duration
+	logger        *xlog.Logger
+	demuxer       MetadataDemuxer
+	stream        *Stream
+	old           *Stream // 元数据变化后，等待新的元数据就绪时被替换的流
+	waitDts       int64   // 开始等待元数据时的 DTS
+	closed        bool
+}
+
+// NewFramePublisher 创建发布者，kind 为源的格式，用于日志；addr 作为流的来源地址属性。
+// 没有视频时，音频就绪后等待 audioOnlyWait 时长仍没有视频才只发布音频，
+// 源在开始时已确定没有视频时(如 mpegts 的 PMT)为 0
+func NewFramePublisher(kind, path, addr string, audioOnlyWait time.Duration, logger *xlog.Logger) *FramePublisher {
+	return &FramePublisher{
+		kind:          kind,
+		path:          path,
+		addr:          addr,
+		audioOnlyWait: audioOnlyWait,
+		logger:        logger,
+	}
+}
+
+// SetDemuxer 设置输出元数据的解复用器，解复用器使用 Video、Audio 保存元数据
+func (p *FramePublisher) SetDemuxer(demuxer MetadataDemuxer) {
+	p.demuxer = demuxer
+}
+
+// Stream 已注册的流，元数据未就绪时返回 nil
+func (p *FramePublisher) Stream() *Stream {
+	return p.stream
+}
+
+// WriteFrame implements codec.FrameWriter
+func (p *FramePublisher) WriteFrame(frame *codec.Frame) error {
+	if p.stream != nil && p.metadataChanged() {
+		p.logger.Infof("%s stream metadata changed", p.kind)
+		p.old, p.stream = p.stream, nil
+		p.waitDts = 0
+	}
+
+	if p.stream == nil {
+		// 等待音视频元数据就绪后再创建流
+		if !p.metadataIsReady(frame) {
+			return nil
+		}
+
+		// 流使用元数据的副本，之后的变化由 metadataChanged 检测
+		video, audio := p.Video, p.Audio
+		p.stream = NewFrameStream(p.path, &video, &audio, Attr("addr", p.addr))
+		if p.old != nil {
+			Replace(p.old, p.stream)
+			p.old = nil
+		} else {
+			Regist(p.stream)
+		}
+		p.logger.Infof("%s stream is ready; video = %s, audio = %s",
+			p.kind, video.Codec, audio.Codec)
+	}
+	return p.stream.WriteFrame(frame)
+}
+
+// 视频元数据就绪(音频就绪或等待超时)，或确认没有视频且音频就绪
+func (p *FramePublisher) metadataIsReady(frame *codec.Frame) bool {
+	videoReady := p.demuxer.VideoMetadataIsReady()
+	audioReady := p.demuxer.AudioMetadataIsReady()
+	if videoReady && (audioReady || p.Audio.Codec == "") {
+		return true
+	}
+	if !videoReady && (!audioReady || p.Video.Codec != "") {
+		return false
+	}
+	if !videoReady && p.audioOnlyWait == 0 {
+		return true
+	}
+
+	wait := p.audioOnlyWait
+	if videoReady {
+		wait = metaWaitTimeout
+	}
+	if p.waitDts == 0 {
+		p.waitDts = frame.Dts + 1
+	}
+	if frame.Dts-p.waitDts < int64(wait) {
+		return false
+	}
+	if videoReady { // 超时未收到音频元数据，忽略音频
+		p.Audio = codec.AudioMeta{}
+	}
+	return true
+}
+
+// 已注册流的编码或参数集是否与当前的元数据不同
+func (p *FramePublisher) metadataChanged() bool {
+	v := &p.stream.Video
+	if p.demuxer.VideoMetadataIsReady() && (v.Codec != p.Video.Codec ||
+		!bytes.Equal(v.Sps, p.Video.Sps) || !bytes.Equal(v.Pps, p.Video.Pps) || !bytes.Equal(v.Vps, p.Video.Vps)) {
+		return true
+	}
+	a := &p.stream.Audio
+	return p.demuxer.AudioMetadataIsReady() && (a.Codec != p.Audio.Codec || !bytes.Equal(a.Sps, p.Audio.Sps))
+}
+
+// Close 注销流
+func (p *FramePublisher) Close() error {
+	if p.closed {
+		return nil
+	}
+
+	p.closed = true
+	if p.old != nil {
+		Unregist(p.old)
+		p.old = nil
+	}
+	if p.stream != nil {
+		Unregist(p.stream)
+		p.stream = nil
+	}
+	return nil
+}
@@ -7,11 +7,14 @@ package media
 import (
 	"errors"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/cnotch/ipchub/av/codec"
+	"github.com/cnotch/ipchub/av/format/dash"
 	"github.com/cnotch/ipchub/av/format/flv"
+	"github.com/cnotch/ipchub/av/format/fmp4"
 	"github.com/cnotch/ipchub/av/format/hls"
 	"github.com/cnotch/ipchub/av/format/mpegts"
 	"github.com/cnotch/ipchub/av/format/rtp"
@@ -46,19 +49,39 @@ type Stream struct {
 	startOn              time.Time // 启动时间
 	path                 string    // 流路径
 	rawsdp               string
+	frameSource          bool   // 输入源是 codec.Frame，如 RTMP 推流
 	size                 uint64 // 流已经接收到的输入（字节）
 	status               int32  // 流状态
 	consumerSequenceSeed uint32
 	consumptions         consumptions // 消费者列表
 	cache                packCache    // 媒体包缓存
 	rtpDemuxer           rtpDemuxer
+	rtpMuxer             frameMuxer // 输入源是 codec.Frame 时，生成 rtp.Packet
 	flvMuxer             flvMuxer
 	flvConsumptions      consumptions
 	flvCache             packCache
 	tsMuxer              *mpegts.Muxer
+	tsConsumptions       consumptions
+	tsCache              packCache
+	frameConsumptions    consumptions      // 完整帧消费者，如录像
+	frameCache           *cache.FrameCache // 最近帧的缓存，用于事件录像的预录
+	preRoll              time.Duration     // 缓存最近帧的时长
 	hlsSG                *hls.SegmentGenerator
 	hlsPlaylist          *hls.Playlist
+	hlsArchiving         int32 // 是否正在归档 hls 片段，如录像
+	fmp4Muxer            *fmp4.Muxer
+	fmp4SG               *hls.Fmp4SegmentGenerator
+	fmp4Playlist         *hls.Playlist
+	dashSG               *dash.SegmentGenerator
+	dashMpd              *dash.Mpd
 	attrs                map[string]string // 流属性
+	reconnects           int32             // 拉流的重连次数
+	lastError            atomic.Value      // 输入源最近的错误
+	next                 atomic.Value      // 元数据变化时替换该流的新流，见 Replace
+	clockLock            sync.Mutex
+	clocks               [2]rtp.SyncClock // 视频、音频轨道的同步时钟，用于生成 RTCP SR
+	clockOffset          int64            // 上游 SR 时钟与本地时钟的差(纳秒)
+	clockOffsetSet       bool
 	multicast            Multicastable
 	hls                  Hlsable
 	logger               *xlog.Logger // 日志对象
@@ -68,15 +91,7 @@ type Stream struct {
 
 // NewStream 创建新的流
 func NewStream(path string, rawsdp string, options ...Option) *Stream {
-	s := &Stream{
-		startOn:              time.Now(),
-		path:                 utils.CanonicalPath(path),
-		rawsdp:               rawsdp,
-		status:               StreamOK,
-		consumerSequenceSeed: 0,
-		attrs:                make(map[string]string, 2),
-		logger:               xlog.L().With(xlog.Fields(xlog.F("path", path))),
-	}
+	s := newStream(path, rawsdp)
 
 	// parseMeta
 	sdp.ParseMetadata(rawsdp, &s.Video, &s.Audio)
@@ -94,12 +109,73 @@ func NewStream(path string, rawsdp string, options ...Option) *Stream {
 	for _, option := range options {
 		option.apply(s)
 	}
+	s.frameCache = cache.NewFrameCache(s.Video.Codec, s.preRoll)
 
 	// prepareOtherStream
 	s.prepareOtherStream()
 	return s
 }
 
+// NewFrameStream 创建以 codec.Frame 为输入的流，如 RTMP 推流；
+// 创建前调用者必须准备好音视频元数据
+func NewFrameStream(path string, video *codec.VideoMeta, audio *codec.AudioMeta, options ...Option) *Stream {
+	s := newStream(path, "")
+	s.frameSource = true
+	s.Video = *video
+	s.Audio = *audio
+	if s.Video.ClockRate == 0 {
+		s.Video.ClockRate = 90000 // H264/H265 的 RTP 时钟频率
+	}
+	s.cache = emptyCache{}
+	s.rtpDemuxer = emptyRtpDemuxer{}
+
+	for _, option := range options {
+		option.apply(s)
+	}
+	s.frameCache = cache.NewFrameCache(s.Video.Codec, s.preRoll)
+
+	// steam(frame)->rtpmuxer->stream(rtp)
+	s.prepareRtpMuxer()
+
+	// steam(frame)->flvmuxer->stream(tag)
+	s.flvCache = emptyCache{}
+	s.flvMuxer = emptyFlvMuxer{}
+	s.prepareFrameMuxers()
+	return s
+}
+
+func (s *Stream) prepareRtpMuxer() {
+	rtpMuxer, err := rtp.NewMuxer(&s.Video, &s.Audio,
+		s, s.logger.With(xlog.Fields(xlog.F("extra", "frame2rtp"))))
+	if err != nil {
+		return
+	}
+
+	s.rawsdp = sdp.FormatMetadata(&s.Video, &s.Audio)
+	switch s.Video.Codec {
+	case "H264":
+		s.cache = cache.NewH264Cache(config.CacheGop())
+	case "H265":
+		s.cache = cache.NewHevcCache(config.CacheGop())
+	}
+	s.rtpMuxer = rtpMuxer
+}
+
+func newStream(path string, rawsdp string) *Stream {
+	return &Stream{
+		startOn:              time.Now(),
+		path:                 utils.CanonicalPath(path),
+		rawsdp:               rawsdp,
+		status:               StreamOK,
+		consumerSequenceSeed: 0,
+		rtpMuxer:             emptyFrameMuxer{},
+		tsCache:              emptyCache{},
+		preRoll:              config.PreRoll(),
+		attrs:                make(map[string]string, 2),
+		logger:               xlog.L().With(xlog.Fields(xlog.F("path", path))),
+	}
+}
+
 func (s *Stream) prepareOtherStream() {
 	// steam(rtp)->rtpdemuxer->stream(frame)->flvmuxer->stream(tag)
 
@@ -114,33 +190,101 @@ func (s *Stream) prepareOtherStream() {
 		return
 	}
 
+	s.prepareFrameMuxers()
+}
+
+func (s *Stream) prepareFrameMuxers() {
 	// prepare codec.Frame -> flv.Tag
-	var flvMuxer *flv.Muxer
-	if flvMuxer, err = flv.NewMuxer(&s.Video, &s.Audio,
+	if flvMuxer, err := flv.NewMuxer(&s.Video, &s.Audio,
 		s, s.logger.With(xlog.Fields(xlog.F("extra", "frame2flv")))); err == nil {
 		s.flvCache = cache.NewFlvCache(config.CacheGop())
 		s.flvMuxer = flvMuxer
 	}
 
 	// prepare codec.Frame -> mpegts.Frame
-	if s.Video.Codec == "H264" {
-		hlsPlaylist := hls.NewPlaylist()
-		sg, err := hls.NewSegmentGenerator(hlsPlaylist, s.path,
+	if videoStreamType := mpegts.VideoStreamType(s.Video.Codec); videoStreamType != 0 {
+		s.prepareTsMuxer(videoStreamType)
+		s.prepareFmp4Muxer()
+	}
+}
+
+// prepare codec.Frame -> mpegts.Frame (ts consumers and hls)
+func (s *Stream) prepareTsMuxer(videoStreamType byte) {
+	var hlsPlaylist *hls.Playlist
+	var sg *hls.SegmentGenerator
+	var fw mpegts.FrameWriter = s
+	if config.HlsEnable() {
+		hlsPlaylist = hls.NewLowLatencyPlaylist(config.HlsPart())
+		var err error
+		if sg, err = hls.NewSegmentGenerator(hlsPlaylist, s.path,
 			config.HlsFragment(),
-			config.HlsPath(), s.Audio.SampleRate,
-			s.logger.With(xlog.Fields(xlog.F("extra", "hls.Muxer"))))
-		if err != nil {
+			config.HlsPath(), videoStreamType, s.Audio.SampleRate,
+			s.logger.With(xlog.Fields(xlog.F("extra", "hls.Muxer")))); err != nil {
+			s.logger.Errorf("create hls segment generator failed; %v", err)
 			return
 		}
-		tsMuxer, err2 := mpegts.NewMuxer(&s.Video, &s.Audio, sg,
-			s.logger.With(xlog.Fields(xlog.F("extra", "ts.Muxer"))))
-		if err2 != nil {
-			return
+		// mpegts.Frame 同时输出到 hls 和 TS 消费者
+		fw = mpegts.MultiFrameWriter(sg, s)
+	}
+
+	tsMuxer, err := mpegts.NewMuxer(&s.Video, &s.Audio, fw,
+		s.logger.With(xlog.Fields(xlog.F("extra", "ts.Muxer"))))
+	if err != nil {
+		if sg != nil {
+			sg.Close()
+			hlsPlaylist.Close()
+		}
+		return
+	}
+	s.tsCache = cache.NewTsCache(config.CacheGop())
+	s.tsMuxer = tsMuxer
+	s.hlsSG = sg
+	s.hlsPlaylist = hlsPlaylist
+}
+
+// prepare codec.Frame -> fmp4.Fragment (hls and dash)
+func (s *Stream) prepareFmp4Muxer() {
+	var writers []fmp4.FragmentWriter
+	var fmp4Playlist *hls.Playlist
+	var sg *hls.Fmp4SegmentGenerator
+	if config.Fmp4HlsEnable() {
+		fmp4Playlist = hls.NewLowLatencyPlaylist(config.HlsPart())
+		sg = hls.NewFmp4SegmentGenerator(fmp4Playlist, s.path,
+			config.HlsFragment(), config.HlsPath(),
+			s.logger.With(xlog.Fields(xlog.F("extra", "hls.Fmp4Muxer"))))
+		writers = append(writers, sg)
+	}
+	var dashMpd *dash.Mpd
+	var dashSG *dash.SegmentGenerator
+	if config.DashEnable() {
+		dashMpd = dash.NewMpd(s.path, &s.Video, &s.Audio)
+		dashSG = dash.NewSegmentGenerator(dashMpd, config.HlsFragment(),
+			s.logger.With(xlog.Fields(xlog.F("extra", "dash.Muxer"))))
+		writers = append(writers, dashSG)
+	}
+	if len(writers) == 0 {
+		return
+	}
+
+	fmp4Muxer, err := fmp4.NewMuxer(&s.Video, &s.Audio, config.HlsPart(),
+		fmp4.MultiFragmentWriter(writers...),
+		s.logger.With(xlog.Fields(xlog.F("extra", "fmp4.Muxer"))))
+	if err != nil {
+		if sg != nil {
+			sg.Close()
+			fmp4Playlist.Close()
+		}
+		if dashSG != nil {
+			dashSG.Close()
+			dashMpd.Close()
 		}
-		s.tsMuxer = tsMuxer
-		s.hlsSG = sg
-		s.hlsPlaylist = hlsPlaylist
+		return
 	}
+	s.fmp4Muxer = fmp4Muxer
+	s.fmp4SG = sg
+	s.fmp4Playlist = fmp4Playlist
+	s.dashSG = dashSG
+	s.dashMpd = dashMpd
 }
 
 // Path 流路径
@@ -163,6 +307,21 @@ func (s *Stream) Attr(key string) string {
 	return s.attrs[strings.ToLower(strings.TrimSpace(key))]
 }
 
+// IsClosed 流是否已关闭
+func (s *Stream) IsClosed() bool {
+	return atomic.LoadInt32(&s.status) != StreamOK
+}
+
+// AddReconnect 增加拉流的重连计数
+func (s *Stream) AddReconnect() {
+	atomic.AddInt32(&s.reconnects, 1)
+}
+
+// SetLastError 记录输入源最近的错误，如拉流断开
+func (s *Stream) SetLastError(err error) {
+	s.lastError.Store(err.Error())
+}
+
 // Close 关闭流
 func (s *Stream) Close() error {
 	return s.close(StreamClosed)
@@ -181,9 +340,30 @@ func (s *Stream) close(status int32) error {
 	// 关闭 hls
 	if s.tsMuxer != nil {
 		s.tsMuxer.Close()
+	}
+	if s.hlsSG != nil {
 		s.hlsSG.Close()
 		s.hlsPlaylist.Close()
 	}
+	if s.fmp4Muxer != nil {
+		s.fmp4Muxer.Close()
+	}
+	if s.fmp4SG != nil {
+		s.fmp4SG.Close()
+		s.fmp4Playlist.Close()
+	}
+	if s.dashSG != nil {
+		s.dashSG.Close()
+		s.dashMpd.Close()
+	}
+
+	// 关闭帧消费者
+	s.frameConsumptions.RemoveAndCloseAll()
+	s.frameCache.Reset()
+
+	// 关闭 ts 消费者
+	s.tsConsumptions.RemoveAndCloseAll()
+	s.tsCache.Reset()
 
 	// 关闭 flv 消费者和 Muxer
 	s.flvConsumptions.RemoveAndCloseAll()
@@ -192,6 +372,7 @@ func (s *Stream) close(status int32) error {
 
 	// 关闭 av.Frame 转换器
 	s.rtpDemuxer.Close()
+	s.rtpMuxer.Close()
 
 	s.consumptions.RemoveAndCloseAll()
 	s.cache.Reset()
@@ -206,6 +387,7 @@ func (s *Stream) WriteRtpPacket(packet *rtp.Packet) error {
 	}
 
 	atomic.AddUint64(&s.size, uint64(packet.Size()))
+	s.syncClock(packet)
 
 	keyframe := s.cache.CachePack(packet)
 	s.consumptions.SendToAll(packet, keyframe)
@@ -214,8 +396,20 @@ func (s *Stream) WriteRtpPacket(packet *rtp.Packet) error {
 	return nil
 }
 
-// WriteFrame .
+// WriteFrame 向流写入一个帧；
+// 对于 NewFrameStream 创建的流，这是媒体数据的输入入口
 func (s *Stream) WriteFrame(frame *codec.Frame) error {
+	if s.frameSource {
+		status := atomic.LoadInt32(&s.status)
+		if status != StreamOK {
+			return statusErrors[status]
+		}
+		// 输入大小在 WriteRtpPacket 中统计
+		if err := s.rtpMuxer.WriteFrame(frame); err != nil {
+			s.logger.Error(err.Error())
+		}
+	}
+
 	if err := s.flvMuxer.WriteFrame(frame); err != nil {
 		s.logger.Error(err.Error())
 	}
@@ -224,6 +418,12 @@ func (s *Stream) WriteFrame(frame *codec.Frame) error {
 			s.logger.Error(err.Error())
 		}
 	}
+	if s.fmp4Muxer != nil {
+		if err := s.fmp4Muxer.WriteFrame(frame); err != nil {
+			s.logger.Error(err.Error())
+		}
+	}
+	s.frameConsumptions.SendToAll(frame, s.frameCache.CachePack(frame))
 	return nil
 }
 
@@ -239,6 +439,18 @@ func (s *Stream) WriteFlvTag(tag *flv.Tag) error {
 	return nil
 }
 
+// WriteMpegtsFrame 向 TS 消费者写入 mpegts 帧，由 ts.Muxer 调用
+func (s *Stream) WriteMpegtsFrame(frame *mpegts.Frame) error {
+	status := atomic.LoadInt32(&s.status)
+	if status != StreamOK {
+		return statusErrors[status]
+	}
+
+	keyframe := s.tsCache.CachePack(frame)
+	s.tsConsumptions.SendToAll(frame, keyframe)
+	return nil
+}
+
 // Multicastable 返回组播支持能力，不支持返回nil
 func (s *Stream) Multicastable() Multicastable {
 	return s.multicast
@@ -246,13 +458,52 @@ func (s *Stream) Multicastable() Multicastable {
 
 // Hlsable 返回支持hls能力，不支持返回nil
 func (s *Stream) Hlsable() Hlsable {
+	if s.hlsPlaylist == nil {
+		return nil
+	}
 	return s.hlsPlaylist
 }
 
-func (s *Stream) startConsume(consumer Consumer, packetType PacketType, extra string, useGopCache bool) CID {
+// SetHlsArchiver 设置 hls 片段的归档者，a 为 nil 时停止归档；
+// 流不支持 hls 时返回 false
+func (s *Stream) SetHlsArchiver(a hls.SegmentArchiver) bool {
+	if s.hlsSG == nil {
+		return false
+	}
+
+	s.hlsSG.SetArchiver(a)
+	if a == nil {
+		atomic.StoreInt32(&s.hlsArchiving, 0)
+	} else {
+		atomic.StoreInt32(&s.hlsArchiving, 1)
+	}
+	return true
+}
+
+// Fmp4Hlsable 返回支持 fmp4(CMAF) hls 能力，不支持返回nil
+func (s *Stream) Fmp4Hlsable() Hlsable {
+	if s.fmp4Playlist == nil {
+		return nil
+	}
+	return s.fmp4Playlist
+}
+
+// Dashable 返回支持 dash 能力，不支持返回nil
+func (s *Stream) Dashable() Dashable {
+	if s.dashMpd == nil {
+		return nil
+	}
+	return s.dashMpd
+}
+
+// gop 不为 nil 时先向新消费者发送其中缓存的包
+func (s *Stream) startConsume(consumer Consumer, packetType PacketType, extra string, gop packCache) CID {
 	if packetType == FLVPacket && s.flvMuxer == nil {
 		return CID(0) // 不支持
 	}
+	if packetType == TSPacket && s.tsMuxer == nil {
+		return CID(0) // 不支持
+	}
 
 	c := &consumption{
 		startOn:    time.Now(),
@@ -271,15 +522,10 @@ func (s *Stream) startConsume(consumer Consumer, packetType PacketType, extra st
 		xlog.F("packettype", c.packetType.String()),
 		xlog.F("extra", c.extra)))
 
-	cs := &s.consumptions
-	cache := s.cache
-	if packetType == FLVPacket {
-		cs = &s.flvConsumptions
-		cache = s.flvCache
-	}
+	cs, _ := s.consumptionsOf(packetType)
 
-	if useGopCache {
-		c.sendGop(cache) // 新消费者，先发送gop缓存
+	if gop != nil {
+		c.sendGop(gop) // 新消费者，先发送gop缓存
 	}
 	cs.Add(c)
 
@@ -289,21 +535,38 @@ func (s *Stream) startConsume(consumer Consumer, packetType PacketType, extra st
 
 // StartConsume 开始消费
 func (s *Stream) StartConsume(consumer Consumer, packetType PacketType, extra string) CID {
-	return s.startConsume(consumer, packetType, extra, true)
+	_, gop := s.consumptionsOf(packetType)
+	return s.startConsume(consumer, packetType, extra, gop)
 }
 
 // StartConsumeNoGopCache 开始消费,不使用GopCahce
 func (s *Stream) StartConsumeNoGopCache(consumer Consumer, packetType PacketType, extra string) CID {
-	return s.startConsume(consumer, packetType, extra, false)
+	return s.startConsume(consumer, packetType, extra, nil)
 }
 
-// StopConsume 开始消费
-func (s *Stream) StopConsume(cid CID) {
-	cs := &s.consumptions
-	if cid.Type() == FLVPacket {
-		cs = &s.flvConsumptions
+// StartConsumeFrames 开始消费完整帧，先发送缓存的最近 preRoll 时长的帧，
+// 从关键帧开始；返回消费者 ID 和实际发送的缓存帧的时长
+func (s *Stream) StartConsumeFrames(consumer Consumer, extra string, preRoll time.Duration) (CID, time.Duration) {
+	gop := s.frameCache.Recent(preRoll)
+	return s.startConsume(consumer, FramePacket, extra, gop), gop.Duration()
+}
+
+// 获取指定包类型的消费者列表和缓存
+func (s *Stream) consumptionsOf(packetType PacketType) (*consumptions, packCache) {
+	switch packetType {
+	case FLVPacket:
+		return &s.flvConsumptions, s.flvCache
+	case TSPacket:
+		return &s.tsConsumptions, s.tsCache
+	case FramePacket:
+		return &s.frameConsumptions, s.frameCache
 	}
+	return &s.consumptions, s.cache
+}
 
+// StopConsume 开始消费
+func (s *Stream) StopConsume(cid CID) {
+	cs, _ := s.consumptionsOf(cid.Type())
 	c := cs.Remove(cid)
 	if c != nil {
 		c.Close()
@@ -312,7 +575,8 @@ func (s *Stream) StopConsume(cid CID) {
 
 // ConsumerCount 流消费者计数
 func (s *Stream) ConsumerCount() int {
-	return s.consumptions.Count() + s.flvConsumptions.Count()
+	return s.consumptions.Count() + s.flvConsumptions.Count() + s.tsConsumptions.Count() +
+		s.frameConsumptions.Count()
 }
 
 // StreamInfo 流信息
@@ -325,6 +589,8 @@ type StreamInfo struct {
 	Audio            *codec.AudioMeta  `json:"audio,omitempty"`
 	ConsumptionCount int               `json:"cc"`
 	Consumptions     []ConsumptionInfo `json:"cs,omitempty"`
+	Reconnects       int               `json:"reconnects,omitempty"`
+	LastError        string            `json:"last_error,omitempty"`
 }
 
 // Info 获取流信息
@@ -335,7 +601,9 @@ func (s *Stream) Info(includeCS bool) *StreamInfo {
 		Addr:             s.Attr("addr"),
 		Size:             int(atomic.LoadUint64(&s.size) / 1024),
 		ConsumptionCount: s.ConsumerCount(),
+		Reconnects:       int(atomic.LoadInt32(&s.reconnects)),
 	}
+	si.LastError, _ = s.lastError.Load().(string)
 
 	if len(s.Video.Codec) != 0 {
 		si.Video = &s.Video
@@ -346,17 +614,15 @@ func (s *Stream) Info(includeCS bool) *StreamInfo {
 	if includeCS {
 		si.Consumptions = s.consumptions.Infos()
 		si.Consumptions = append(si.Consumptions, s.flvConsumptions.Infos()...)
+		si.Consumptions = append(si.Consumptions, s.tsConsumptions.Infos()...)
+		si.Consumptions = append(si.Consumptions, s.frameConsumptions.Infos()...)
 	}
 	return si
 }
 
 // GetConsumption 获取指定消费信息
 func (s *Stream) GetConsumption(cid CID) (ConsumptionInfo, bool) {
-	cs := &s.consumptions
-	if cid.Type() == FLVPacket {
-		cs = &s.flvConsumptions
-	}
-
+	cs, _ := s.consumptionsOf(cid.Type())
 	c, ok := cs.Load(cid)
 	if ok {
 		return c.(*consumption).Info(), ok
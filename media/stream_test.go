@@ -9,6 +9,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/cnotch/ipchub/av/codec"
 	"github.com/cnotch/ipchub/av/format/rtp"
 	"github.com/stretchr/testify/assert"
 )
@@ -167,3 +168,79 @@ func Benchmark_Stream_Dispatch1000(b *testing.B) {
 func Benchmark_Stream_Dispatch10000(b *testing.B) {
 	benchDispatch(10000, b)
 }
+
+type frameConsumer struct {
+	frames chan *codec.Frame
+}
+
+func (c *frameConsumer) Consume(pack Pack) { c.frames <- pack.(*codec.Frame) }
+func (c *frameConsumer) Close() error      { return nil }
+
+func TestStartConsumeFrames(t *testing.T) {
+	video := codec.VideoMeta{Codec: "H264"}
+	s := NewFrameStream("/live/preroll", &video, &codec.AudioMeta{}, PreRoll(3*time.Second))
+	defer s.Close()
+
+	// 10 秒、每秒一个 GOP 的 25fps 视频
+	for i := 0; i < 250; i++ {
+		payload := []byte{0x41, 0x9a}
+		if i%25 == 0 {
+			payload = []byte{0x65, 0x88}
+		}
+		dts := int64(i) * int64(40*time.Millisecond)
+		s.WriteFrame(&codec.Frame{MediaType: codec.MediaTypeVideo, Dts: dts, Pts: dts, Payload: payload})
+	}
+
+	// 缓存保留覆盖 3 秒的 GOP，预录从 2 秒之前最近的关键帧开始
+	assert.Equal(t, 3*time.Second+960*time.Millisecond, s.frameCache.Duration())
+	c := &frameConsumer{frames: make(chan *codec.Frame, 100)}
+	cid, pre := s.StartConsumeFrames(c, "", 2*time.Second)
+	defer s.StopConsume(cid)
+	assert.Equal(t, 2*time.Second+960*time.Millisecond, pre)
+	select {
+	case frame := <-c.frames:
+		assert.Equal(t, int64(7*time.Second), frame.Dts)
+		assert.Equal(t, byte(0x65), frame.Payload[0])
+	case <-time.After(time.Second):
+		t.Error("no pre-roll frames")
+	}
+
+	// 不预录
+	_, pre = s.StartConsumeFrames(emptyConsumer{}, "", 0)
+	assert.Equal(t, time.Duration(0), pre)
+}
+
+func TestZeroConsumersClose(t *testing.T) {
+	s := NewStream("/live/zeroconsumers", sdpRaw)
+	defer s.Close()
+
+	// 只有 flv 播放者时保持流
+	cid := s.StartConsume(emptyConsumer{}, FLVPacket, "")
+	r := &runZeroConsumersClose{s: s, d: time.Millisecond, closedStats: StreamNoConsumer}
+	time.Sleep(2 * time.Millisecond)
+	r.run()
+	assert.False(t, s.IsClosed())
+
+	s.StopConsume(cid)
+	r.run()
+	assert.True(t, s.IsClosed())
+}
+
+func TestReplaceKeepsZeroConsumersClose(t *testing.T) {
+	const path = "/live/replace"
+	old := NewStream(path, sdpRaw)
+	Regist(old)
+	r := &runZeroConsumersClose{s: old, d: time.Millisecond, closedStats: StreamNoConsumer}
+
+	// 元数据变化替换流后，关闭任务检查新流
+	s := NewStream(path, sdpRaw)
+	Replace(old, s)
+	defer Unregist(s)
+	assert.True(t, old.IsClosed())
+	assert.Equal(t, s, Get(path))
+
+	time.Sleep(2 * time.Millisecond)
+	r.run()
+	assert.Equal(t, s, r.s)
+	assert.True(t, s.IsClosed())
+}
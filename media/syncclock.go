@@ -0,0 +1,64 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package media
+
+import (
+	"time"
+
+	"github.com/cnotch/ipchub/av/format/rtp"
+)
+
+// 根据写入的包更新轨道的同步时钟，只在写入 routine 中调用；
+// 上游的 SR 提供时间对应关系，收到之前以第一个包的到达时间为准。
+// 上游的时钟和本地时钟可能不一致，所有轨道使用第一个 SR 到达时的时差换算成本地时间，以保持音视频同步
+func (s *Stream) syncClock(p *rtp.Packet) {
+	index := int(p.Channel / 2)
+	if index >= len(s.clocks) {
+		return
+	}
+	clock := &s.clocks[index]
+
+	isMedia := p.Channel&1 == 0
+	if isMedia && clock.Synced() || !isMedia && !rtp.IsSenderReport(p.Data) {
+		return
+	}
+
+	clockRate := s.Video.ClockRate
+	if index == 1 {
+		clockRate = s.Audio.SampleRate
+	}
+	if clockRate <= 0 {
+		return
+	}
+
+	now := time.Now()
+	s.clockLock.Lock()
+	clock.RTPTimeUnit = float64(time.Second) / float64(clockRate)
+	if isMedia {
+		clock.Sync(p.Timestamp, now)
+	} else {
+		clock.Decode(p.Data)
+		if !s.clockOffsetSet {
+			s.clockOffset = clock.NTPTime - now.UnixNano()
+			s.clockOffsetSet = true
+		}
+		clock.NTPTime -= s.clockOffset
+	}
+	s.clockLock.Unlock()
+}
+
+// SyncClock 返回媒体通道(rtp.ChannelVideo 或 rtp.ChannelAudio)的同步时钟，
+// 用于生成 RTCP SR；尚未建立时间对应关系时 ok 为 false
+func (s *Stream) SyncClock(channel byte) (clock rtp.SyncClock, ok bool) {
+	index := int(channel / 2)
+	if index >= len(s.clocks) {
+		return
+	}
+
+	s.clockLock.Lock()
+	clock = s.clocks[index]
+	s.clockLock.Unlock()
+	return clock, clock.Synced()
+}
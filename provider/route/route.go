@@ -5,16 +5,38 @@
 package route
 
 import (
+	"encoding/hex"
+	"fmt"
 	"net/url"
+	"strings"
 
 	"github.com/cnotch/ipchub/utils"
 )
 
 // Route 路由
 type Route struct {
-	Pattern   string `json:"pattern"`             // 路由模式字串
-	URL       string `json:"url"`                 // 目标url
-	KeepAlive bool   `json:"keepalive,omitempty"` // 是否一直保持连接，直到对方断开；默认 false，会在没有人使用时关闭
+	Pattern   string      `json:"pattern"`             // 路由模式字串
+	URL       string      `json:"url"`                 // 目标url
+	KeepAlive bool        `json:"keepalive,omitempty"` // 是否一直保持连接，直到对方断开；默认 false，会在没有人使用时关闭
+	Transport string      `json:"transport,omitempty"` // rtsp 拉流的传输方式：tcp(默认)、udp、multicast、auto
+	TLS       *TLSOptions `json:"tls,omitempty"`       // rtsps 拉流的证书验证选项
+	Record    bool        `json:"record,omitempty"`    // 是否录像；模式以'/'结尾时录制所有匹配的在线流
+}
+
+// TLSOptions rtsps 拉流的证书验证选项
+type TLSOptions struct {
+	Insecure bool     `json:"insecure,omitempty"` // 不验证服务器证书链
+	CA       string   `json:"ca,omitempty"`       // 自定义 CA 证书文件(PEM)
+	Pins     []string `json:"pins,omitempty"`     // 固定的服务器证书 SHA-256 指纹(十六进制，可用':'分隔)
+}
+
+// PinBytes 返回证书指纹的二进制形式
+func PinBytes(pin string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.Replace(pin, ":", "", -1))
+	if err != nil || len(b) != 32 {
+		return nil, fmt.Errorf("certificate pin '%s' is not a sha-256 fingerprint", pin)
+	}
+	return b, nil
 }
 
 func (r *Route) init() error {
@@ -23,6 +45,20 @@ func (r *Route) init() error {
 	if err != nil {
 		return err
 	}
+
+	switch r.Transport {
+	case "", "tcp", "udp", "multicast", "auto":
+	default:
+		return fmt.Errorf("route transport '%s' is not supported", r.Transport)
+	}
+
+	if r.TLS != nil {
+		for _, pin := range r.TLS.Pins {
+			if _, err = PinBytes(pin); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
@@ -30,6 +66,14 @@ func (r *Route) init() error {
 func (r *Route) CopyFrom(src *Route) {
 	r.URL = src.URL
 	r.KeepAlive = src.KeepAlive
+	r.Transport = src.Transport
+	r.Record = src.Record
+	r.TLS = nil
+	if src.TLS != nil {
+		opts := *src.TLS
+		opts.Pins = append([]string(nil), src.TLS.Pins...)
+		r.TLS = &opts
+	}
 }
 
 // Provider 路由提供者
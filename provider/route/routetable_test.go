@@ -13,24 +13,31 @@ import (
 func Test_routetable(t *testing.T) {
 
 	t.Run("routetable", func(t *testing.T) {
-		Save(&Route{"/test/live1", "rtsp://localhost:5540/live1", false})
+		Save(&Route{Pattern: "/test/live1", URL: "rtsp://localhost:5540/live1"})
 		assert.Equal(t, 1, len(globalT.l))
 		r := Get("/test/live1")
 		assert.NotNil(t, r)
-		Save(&Route{"/easy/", "rtsp://localhost:5540/test", false})
+		Save(&Route{Pattern: "/easy/", URL: "rtsp://localhost:5540/test"})
 		assert.Equal(t, 2, len(globalT.l))
 		r = Match("/easy/live4")
 		assert.NotNil(t, r)
 		assert.Equal(t, "rtsp://localhost:5540/test/live4", r.URL)
 		Del("/test/live1")
-		Save(&Route{"/test/live1", "rtsp://localhost:5540/live1", false})
-		Save(&Route{"/test/live1", "rtsp://localhost:5540/live1", false})
+		Save(&Route{Pattern: "/test/live1", URL: "rtsp://localhost:5540/live1"})
+		Save(&Route{Pattern: "/test/live1", URL: "rtsp://localhost:5540/live1"})
 		Del("/test/live1")
-		Save(&Route{"/test/live1", "rtsp://localhost:5540/live1", false})
+		Save(&Route{Pattern: "/test/live1", URL: "rtsp://localhost:5540/live1"})
 		assert.Equal(t, 2, len(globalT.saves))
 		assert.Equal(t, 0, len(globalT.removes))
 		Flush()
 		assert.Equal(t, 0, len(globalT.saves))
 	})
 
+	t.Run("tls", func(t *testing.T) {
+		pin := "9F:86:D0:81:88:4C:7D:65:9A:2F:EA:A0:C5:5A:D0:15:A3:BF:4F:1B:2B:0B:82:2C:D1:5D:6C:15:B0:F0:0A:08"
+		assert.NoError(t, Save(&Route{Pattern: "/tls/live1", URL: "rtsps://localhost/live1", TLS: &TLSOptions{Pins: []string{pin}}}))
+		assert.Error(t, Save(&Route{Pattern: "/tls/live2", URL: "rtsps://localhost/live2", TLS: &TLSOptions{Pins: []string{"9f86d0"}}}))
+		Del("/tls/live1")
+	})
+
 }
@@ -0,0 +1,294 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package record
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cnotch/ipchub/utils"
+	"github.com/cnotch/xlog"
+)
+
+// 每个流的归档索引文件名，位于录像目录下流路径对应的目录中
+const indexFileName = "index.jsonl"
+
+// 全局变量
+var (
+	archives sync.Map // 流的归档 索引文件->*archive
+	scanned  sync.Map // 已扫描过归档索引的录像目录
+)
+
+// Segment 归档中的一个录像文件
+type Segment struct {
+	File     string    `json:"file"`     // 相对录像目录的文件路径，使用'/'分隔
+	Start    time.Time `json:"start"`    // 开始录制的时间
+	Duration float64   `json:"duration"` // 时长，单位秒
+	Size     int64     `json:"size"`     // 文件大小，单位字节
+	// 是否与前一个文件不连续，如流重连后的第一个 TS 片段
+	Discontinuity bool `json:"discontinuity,omitempty"`
+	// 录像文件的时间索引文件，删除录像文件时一并删除
+	Index string `json:"index,omitempty"`
+}
+
+// End 录像文件的结束时间
+func (seg *Segment) End() time.Time {
+	return seg.Start.Add(time.Duration(seg.Duration * float64(time.Second)))
+}
+
+// archive 一个流已完成录像文件的归档，按开始时间排序；
+// 索引以每行一个 JSON 对象的形式保存在磁盘上，重启后可以恢复
+type archive struct {
+	dir      string // 录像目录
+	path     string // 流路径
+	index    string // 索引文件
+	lock     sync.Mutex
+	segments []Segment
+	size     int64
+	writing  map[string]Segment // 正在写入的文件，不保存到索引，文件->录像文件
+}
+
+func indexFile(dir, path string) string {
+	return filepath.Join(dir, filepath.FromSlash(strings.Trim(path, "/")), indexFileName)
+}
+
+// 获取录像目录 dir 中流 path 的归档，不存在时从索引文件加载
+func openArchive(dir, path string) *archive {
+	index := indexFile(dir, path)
+	if ai, ok := archives.Load(index); ok {
+		return ai.(*archive)
+	}
+
+	a := &archive{dir: dir, path: utils.CanonicalPath(path), index: index}
+	a.load()
+	ai, _ := archives.LoadOrStore(index, a)
+	return ai.(*archive)
+}
+
+// 加载录像目录 dir 中全部流的归档
+func loadArchives(dir string) []*archive {
+	if _, ok := scanned.LoadOrStore(dir, true); !ok {
+		filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() || info.Name() != indexFileName {
+				return nil
+			}
+			if rel, err := filepath.Rel(dir, filepath.Dir(file)); err == nil {
+				openArchive(dir, filepath.ToSlash(rel))
+			}
+			return nil
+		})
+	}
+
+	var as []*archive
+	archives.Range(func(key, value interface{}) bool {
+		if a := value.(*archive); a.dir == dir {
+			as = append(as, a)
+		}
+		return true
+	})
+	sort.Slice(as, func(i, j int) bool {
+		return as[i].path < as[j].path
+	})
+	return as
+}
+
+// 加载索引，忽略无法解析的行和已不存在的文件
+func (a *archive) load() {
+	f, err := os.Open(a.index)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var seg Segment
+		if json.Unmarshal(scanner.Bytes(), &seg) != nil {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(a.dir, filepath.FromSlash(seg.File))); err != nil {
+			continue
+		}
+		a.segments = append(a.segments, seg)
+		a.size += seg.Size
+	}
+	sort.Slice(a.segments, func(i, j int) bool {
+		return a.segments[i].Start.Before(a.segments[j].Start)
+	})
+}
+
+// 登记或更新正在写入的文件，完成后由 add 添加到归档
+func (a *archive) update(seg Segment) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.writing == nil {
+		a.writing = make(map[string]Segment)
+	}
+	a.writing[seg.File] = seg
+}
+
+// 添加完成的录像文件，并追加到索引文件
+func (a *archive) add(seg Segment) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	delete(a.writing, seg.File)
+
+	i := sort.Search(len(a.segments), func(i int) bool {
+		return a.segments[i].Start.After(seg.Start)
+	})
+	a.segments = append(a.segments, Segment{})
+	copy(a.segments[i+1:], a.segments[i:])
+	a.segments[i] = seg
+	a.size += seg.Size
+
+	data, err := json.Marshal(&seg)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(a.index), os.ModePerm); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(a.index, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// 返回归档的录像文件列表
+func (a *archive) list() []Segment {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return append([]Segment(nil), a.segments...)
+}
+
+// 返回归档的录像文件列表，包括正在写入的文件
+func (a *archive) listAll() []Segment {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	segs := append([]Segment(nil), a.segments...)
+	for _, seg := range a.writing {
+		segs = append(segs, seg)
+	}
+	sort.Slice(segs, func(i, j int) bool {
+		return segs[i].Start.Before(segs[j].Start)
+	})
+	return segs
+}
+
+// 最早的录像文件，没有时返回 false
+func (a *archive) oldest() (Segment, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if len(a.segments) == 0 {
+		return Segment{}, false
+	}
+	return a.segments[0], true
+}
+
+// 从最早的文件开始删除，直到 cond 返回 false；返回删除的字节数
+func (a *archive) removeWhile(cond func(seg *Segment, size int64) bool) (removed int64) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	n := 0
+	for n < len(a.segments) && cond(&a.segments[n], a.size-removed) {
+		seg := &a.segments[n]
+		file := filepath.Join(a.dir, filepath.FromSlash(seg.File))
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			xlog.Warnf("remove recording file failed; %s", err.Error())
+			break
+		}
+		if seg.Index != "" {
+			os.Remove(filepath.Join(a.dir, filepath.FromSlash(seg.Index)))
+		}
+		removeEmptyDirs(a.dir, filepath.Dir(file))
+		xlog.Infof("remove recording file %s", file)
+		removed += seg.Size
+		n++
+	}
+	if n == 0 {
+		return
+	}
+
+	a.segments = append(a.segments[:0], a.segments[n:]...)
+	a.size -= removed
+	if err := a.save(); err != nil {
+		xlog.Warnf("save recording index failed; %s", err.Error())
+	}
+	return
+}
+
+// 重写索引文件
+func (a *archive) save() error {
+	tmp := a.index + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for i := range a.segments {
+		data, _ := json.Marshal(&a.segments[i])
+		w.Write(data)
+		w.WriteByte('\n')
+	}
+	err = w.Flush()
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, a.index)
+}
+
+// 删除 dir 下从 sub 开始向上的空目录，如按日期创建的目录
+func removeEmptyDirs(dir, sub string) {
+	for sub != dir && strings.HasPrefix(sub, dir) {
+		if os.Remove(sub) != nil {
+			return
+		}
+		sub = filepath.Dir(sub)
+	}
+}
+
+// ArchiveInfo 流的录像归档信息
+type ArchiveInfo struct {
+	Path     string `json:"path"`
+	Segments int    `json:"segments"`         // 录像文件数
+	Size     int    `json:"size"`             // 总大小(KB)
+	Oldest   string `json:"oldest,omitempty"` // 最早录像的开始时间
+	Newest   string `json:"newest,omitempty"` // 最近录像的结束时间
+}
+
+func (a *archive) info() ArchiveInfo {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	info := ArchiveInfo{
+		Path:     a.path,
+		Segments: len(a.segments),
+		Size:     int(a.size / 1024),
+	}
+	if len(a.segments) > 0 {
+		info.Oldest = a.segments[0].Start.Format(time.RFC3339Nano)
+		info.Newest = a.segments[len(a.segments)-1].End().Format(time.RFC3339Nano)
+	}
+	return info
+}
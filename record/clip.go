@@ -0,0 +1,302 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package record
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/cnotch/ipchub/av/codec"
+	"github.com/cnotch/ipchub/av/format/fmp4"
+	"github.com/cnotch/ipchub/config"
+	"github.com/cnotch/ipchub/media"
+	"github.com/cnotch/ipchub/utils"
+	"github.com/cnotch/xlog"
+)
+
+const (
+	clipLayout   = "clips/{path}/{date}/{time}.mp4"
+	clipFragment = time.Second      // 片段时长，事件录像在片段处结束
+	clipTimeout  = 10 * time.Second // 超过预期结束时间仍未完成时停止，如流没有新的帧
+	maxClips     = 100              // 保留的最近事件录像信息数
+)
+
+var (
+	// ErrStreamNotFound 流不在线
+	ErrStreamNotFound = errors.New("stream is not online")
+	// ErrInvalidClip 事件录像的时长无效
+	ErrInvalidClip = errors.New("postroll must be positive and preroll must not be negative")
+)
+
+var (
+	clipsLock  sync.Mutex
+	clips      []*clip // 最近的事件录像，按触发时间排序
+	hookClient = &http.Client{Timeout: 5 * time.Second}
+)
+
+// ClipInfo 事件录像信息，录像完成时作为事件 POST 到配置的 cliphook
+type ClipInfo struct {
+	Path     string    `json:"path"`
+	Event    string    `json:"event,omitempty"` // 触发录像的事件，如 motion
+	File     string    `json:"file"`            // 相对录像目录的文件路径
+	Trigger  time.Time `json:"trigger"`         // 触发时间
+	PreRoll  float64   `json:"preroll"`         // 实际预录的时长(秒)
+	Duration float64   `json:"duration"`        // 时长(秒)
+	Size     int64     `json:"size"`            // 文件大小(字节)
+	Done     bool      `json:"done"`            // 是否已完成
+	Error    string    `json:"error,omitempty"`
+}
+
+// TriggerClip 触发流 path 的事件录像，录制触发前 preRoll 和触发后 postRoll 时长的画面
+// 到单独的 MP4 文件；预录受流缓存的时长(录像配置的 preroll)限制
+func TriggerClip(path, event string, preRoll, postRoll time.Duration) (ClipInfo, error) {
+	conf := getConfig()
+	if conf == nil {
+		return ClipInfo{}, ErrNotConfigured
+	}
+	if preRoll < 0 || postRoll <= 0 {
+		return ClipInfo{}, ErrInvalidClip
+	}
+
+	path = utils.CanonicalPath(path)
+	s := media.Get(path)
+	if s == nil {
+		return ClipInfo{}, ErrStreamNotFound
+	}
+
+	c, err := newClip(s, event, conf, xlog.L().With(xlog.Fields(
+		xlog.F("path", path),
+		xlog.F("extra", "clip"))))
+	if err != nil {
+		return ClipInfo{}, err
+	}
+	c.start(s, preRoll, postRoll)
+
+	clipsLock.Lock()
+	clips = append(clips, c)
+	if len(clips) > maxClips {
+		clips = append(clips[:0], clips[len(clips)-maxClips:]...)
+	}
+	clipsLock.Unlock()
+	return c.Info(), nil
+}
+
+// Clips 返回最近的事件录像信息，包括正在录制的
+func Clips() []ClipInfo {
+	clipsLock.Lock()
+	defer clipsLock.Unlock()
+
+	infos := make([]ClipInfo, len(clips))
+	for i, c := range clips {
+		infos[i] = c.Info()
+	}
+	return infos
+}
+
+// 一次事件录像，作为 FramePacket 消费者挂接到流上
+type clip struct {
+	lock      sync.Mutex
+	info      ClipInfo
+	hook      string
+	muxer     *fmp4.Muxer
+	file      *os.File
+	fileName  string
+	init      []byte
+	started   bool
+	startDts  int64 // 第一个片段的 DTS
+	length    int64 // 录像的时长，单位为 ns
+	closeOnce sync.Once
+	closed    chan struct{}
+	archive   *archive // 完成的录像加入事件录像的归档，按保留策略删除
+	logger    *xlog.Logger
+}
+
+// 流 path 的事件录像归档的路径，与 clipLayout 的目录一致
+func clipArchivePath(path string) string {
+	return "/clips" + utils.CanonicalPath(path)
+}
+
+func newClip(s *media.Stream, event string, conf *config.RecordConfig, logger *xlog.Logger) (*clip, error) {
+	now := time.Now()
+	f, name, err := createFile(FileName(conf.Path, clipLayout, s.Path(), now))
+	if err != nil {
+		return nil, err
+	}
+
+	c := &clip{
+		hook:     conf.ClipHook,
+		file:     f,
+		fileName: name,
+		closed:   make(chan struct{}),
+		archive:  openArchive(conf.Path, clipArchivePath(s.Path())),
+		logger:   logger,
+	}
+	rel, _ := filepath.Rel(conf.Path, name)
+	c.info = ClipInfo{
+		Path:    s.Path(),
+		Event:   event,
+		File:    filepath.ToSlash(rel),
+		Trigger: now,
+	}
+
+	if c.muxer, err = fmp4.NewMuxer(&s.Video, &s.Audio, clipFragment, c, logger); err != nil {
+		f.Close()
+		os.Remove(name)
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *clip) start(s *media.Stream, preRoll, postRoll time.Duration) {
+	c.lock.Lock()
+	cid, pre := s.StartConsumeFrames(c, "clip", preRoll)
+	c.info.PreRoll = pre.Seconds()
+	c.length = int64(pre + postRoll)
+	c.lock.Unlock()
+	c.logger.Infof("start clip %s, preroll %.3fs", c.fileName, pre.Seconds())
+
+	go func() {
+		select {
+		case <-c.closed:
+		case <-time.After(pre + postRoll + clipTimeout):
+			c.logger.Warn("clip timeout")
+		}
+		s.StopConsume(cid)
+		c.Close()
+	}()
+}
+
+// Info 获取事件录像信息
+func (c *clip) Info() ClipInfo {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.info
+}
+
+// Consume 消费完整帧
+func (c *clip) Consume(pack media.Pack) {
+	if frame, ok := pack.(*codec.Frame); ok {
+		c.muxer.WriteFrame(frame)
+	}
+}
+
+func (c *clip) WriteInitSegment(init []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.init == nil {
+		c.init = append([]byte(nil), init...)
+	}
+	return nil
+}
+
+func (c *clip) WriteFragment(fragment *fmp4.Fragment) (err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.info.Done || c.init == nil {
+		return
+	}
+	if !c.started {
+		if !fragment.Independent {
+			return
+		}
+		if _, err = c.file.Write(c.init); err != nil {
+			c.finish(err)
+			return
+		}
+		c.started = true
+		c.startDts = fragment.Dts
+		c.info.Size = int64(len(c.init))
+	}
+
+	if _, err = c.file.Write(fragment.Data); err != nil {
+		c.finish(err)
+		return
+	}
+	c.info.Size += int64(len(fragment.Data))
+	end := fragment.Dts + fragment.Duration - c.startDts
+	c.info.Duration = float64(end) / float64(time.Second)
+	if end >= c.length {
+		c.finish(nil)
+	}
+	return
+}
+
+// 关闭文件并发出事件，调用者需持有锁
+func (c *clip) finish(err error) {
+	if c.info.Done {
+		return
+	}
+	c.info.Done = true
+
+	if err2 := c.file.Close(); err == nil {
+		err = err2
+	}
+	if err == nil && !c.started {
+		err = errors.New("no frames received")
+	}
+	if err != nil {
+		c.info.Error = err.Error()
+		c.logger.Errorf("clip %s failed; %s", c.fileName, err.Error())
+		if !c.started {
+			os.Remove(c.fileName)
+		}
+	} else {
+		c.logger.Infof("clip %s completed, duration %.3fs", c.fileName, c.info.Duration)
+	}
+	if c.started { // 出错时也保留已写入的部分
+		if err := c.archive.add(Segment{
+			File:     c.info.File,
+			Start:    c.info.Trigger.Add(-time.Duration(c.info.PreRoll * float64(time.Second))),
+			Duration: c.info.Duration,
+			Size:     c.info.Size,
+		}); err != nil {
+			c.logger.Errorf("add clip to archive failed; %s", err.Error())
+		}
+	}
+
+	select {
+	case <-c.closed:
+	default:
+		close(c.closed)
+	}
+	go c.notify(c.info)
+}
+
+// 将事件 POST 到 cliphook
+func (c *clip) notify(info ClipInfo) {
+	if c.hook == "" {
+		return
+	}
+
+	body, _ := json.Marshal(&info)
+	resp, err := hookClient.Post(c.hook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		c.logger.Errorf("post clip event failed; %s", err.Error())
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		c.logger.Errorf("post clip event failed; status %s", resp.Status)
+	}
+}
+
+// Close 停止事件录像，流断开时未完成的录像在已写入的片段处结束
+func (c *clip) Close() error {
+	c.closeOnce.Do(func() {
+		c.muxer.Close()
+		c.lock.Lock()
+		c.finish(nil)
+		c.lock.Unlock()
+	})
+	return nil
+}
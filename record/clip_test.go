@@ -0,0 +1,113 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package record
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cnotch/ipchub/av/codec"
+	"github.com/cnotch/ipchub/config"
+	"github.com/cnotch/ipchub/media"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTriggerClip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "record")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	events := make(chan ClipInfo, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var info ClipInfo
+		json.NewDecoder(r.Body).Decode(&info)
+		events <- info
+	}))
+	defer hook.Close()
+
+	conf := &config.RecordConfig{Path: dir, ClipHook: hook.URL}
+	getConfig = func() *config.RecordConfig { return conf }
+	defer func() { getConfig = config.GetRecordConfig }()
+
+	sps, _ := base64.StdEncoding.DecodeString("Z2QAH6zZQFAFuhAAAAMAEAAAAwPI8YMZYA==")
+	video := codec.VideoMeta{Codec: "H264", Sps: sps, Pps: []byte{0x68, 0xef, 0xbc, 0xb0}}
+	s := media.NewFrameStream("/live/clipcam", &video, &codec.AudioMeta{}, media.PreRoll(3*time.Second))
+	media.Regist(s)
+	defer media.Unregist(s)
+
+	// 写入 from 到 to 秒、每秒一个 GOP 的 25fps 视频
+	write := func(from, to int) {
+		for i := from * 25; i < to*25; i++ {
+			payload := []byte{0x41, 0x9a, 0x00, 0x01}
+			if i%25 == 0 {
+				payload = []byte{0x65, 0x88, 0x80, 0x40}
+			}
+			dts := int64(i) * int64(40*time.Millisecond)
+			s.WriteFrame(&codec.Frame{MediaType: codec.MediaTypeVideo, Dts: dts, Pts: dts, Payload: payload})
+		}
+	}
+
+	_, err = TriggerClip("/live/none", "motion", time.Second, time.Second)
+	assert.Equal(t, ErrStreamNotFound, err)
+	_, err = TriggerClip("/live/clipcam", "motion", time.Second, 0)
+	assert.Equal(t, ErrInvalidClip, err)
+
+	// 最新的帧在 4.96 秒，预录从其 2 秒之前最近的关键帧(第 2 秒)开始
+	write(0, 5)
+	info, err := TriggerClip("live/clipcam", "motion", 2*time.Second, 2*time.Second)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "/live/clipcam", info.Path)
+	assert.True(t, strings.HasPrefix(info.File, "clips/live/clipcam/"))
+	assert.InDelta(t, 2.96, info.PreRoll, 0.001)
+	assert.False(t, info.Done)
+	write(5, 10)
+
+	select {
+	case event := <-events:
+		assert.Equal(t, info.File, event.File)
+		assert.Equal(t, "motion", event.Event)
+		assert.True(t, event.Done)
+		assert.Empty(t, event.Error)
+		assert.InDelta(t, 5, event.Duration, 0.001)
+
+		data, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(event.File)))
+		if assert.NoError(t, err) && assert.True(t, len(data) > 8) {
+			assert.Equal(t, int64(len(data)), event.Size)
+			assert.Equal(t, "ftyp", string(data[4:8]))
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("clip event not received")
+	}
+
+	clips := Clips()
+	if assert.NotEmpty(t, clips) {
+		assert.Equal(t, info.File, clips[len(clips)-1].File)
+		assert.True(t, clips[len(clips)-1].Done)
+	}
+
+	// 完成的录像加入事件录像的归档，由保留策略删除
+	_, segs, ok := GetArchive("/clips/live/clipcam")
+	if assert.True(t, ok) && assert.Len(t, segs, 1) {
+		assert.Equal(t, info.File, segs[0].File)
+	}
+	diskSpaceOf = func(dir string) (uint64, uint64, error) { return 1 << 30, 0, nil }
+	defer func() { diskSpaceOf = diskSpace }()
+	conf.MinFree = 1
+	EnforceRetention()
+	_, err = os.Stat(filepath.Join(dir, filepath.FromSlash(info.File)))
+	assert.True(t, os.IsNotExist(err))
+}
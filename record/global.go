@@ -0,0 +1,335 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package record
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cnotch/ipchub/config"
+	"github.com/cnotch/ipchub/media"
+	"github.com/cnotch/ipchub/provider/route"
+	"github.com/cnotch/ipchub/utils"
+	"github.com/cnotch/xlog"
+)
+
+var (
+	// ErrNotConfigured 没有录像配置
+	ErrNotConfigured = errors.New("recording is not configured")
+	// ErrInvalidPath 录像路径不是具体的流路径
+	ErrInvalidPath = errors.New("recording path must be a stream path")
+)
+
+// 全局变量
+var (
+	tasks         sync.Map   // 录像任务 string->*task
+	tasksLock     sync.Mutex // 使停止时的查找和删除成为原子操作，每个任务只关闭一次
+	getConfig     = config.GetRecordConfig
+	checkInterval = time.Second * 5 // 检查流是否上线或被替换的间隔
+)
+
+// Info 录像任务信息
+type Info struct {
+	Path      string `json:"path"`
+	StartOn   string `json:"start_on"`
+	Route     bool   `json:"route,omitempty"` // 是否由路由的 record 选项启动
+	Recording bool   `json:"recording"`       // 流是否在线并正在录像
+	File      string `json:"file,omitempty"`  // 当前录像文件
+	Files     int    `json:"files"`           // 已创建的文件数
+	Size      int    `json:"size"`            // 已写入的大小(KB)
+	LastError string `json:"last_error,omitempty"`
+}
+
+// Start 开始录制路径为 path 的流；流不在线时会持续等待流上线或自动拉流，
+// 直到调用 Stop
+func Start(path string) error {
+	return start(path, false)
+}
+
+func start(path string, byRoute bool) error {
+	conf := getConfig()
+	if conf == nil {
+		return ErrNotConfigured
+	}
+
+	path = utils.CanonicalPath(path)
+	if path[len(path)-1] == '/' {
+		return ErrInvalidPath
+	}
+
+	t := &task{
+		path:    path,
+		conf:    conf,
+		byRoute: byRoute,
+		startOn: time.Now(),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}, 1),
+		logger: xlog.L().With(xlog.Fields(
+			xlog.F("path", path),
+			xlog.F("extra", "record"))),
+	}
+	if _, loaded := tasks.LoadOrStore(path, t); !loaded {
+		go t.run()
+	}
+	return nil
+}
+
+// Stop 停止录制路径为 path 的流，不存在录像任务时返回 false
+func Stop(path string) bool {
+	return stop(utils.CanonicalPath(path), nil)
+}
+
+// 停止路径为 path 的录像任务；expected 不为 nil 时只在任务仍是 expected 时停止
+func stop(path string, expected *task) bool {
+	tasksLock.Lock()
+	defer tasksLock.Unlock()
+
+	ti, ok := tasks.Load(path)
+	if !ok || (expected != nil && ti.(*task) != expected) {
+		return false
+	}
+	tasks.Delete(path)
+	close(ti.(*task).stop)
+	return true
+}
+
+// StopAll 停止全部录像
+func StopAll() {
+	tasksLock.Lock()
+	defer tasksLock.Unlock()
+
+	tasks.Range(func(key, value interface{}) bool {
+		tasks.Delete(key)
+		close(value.(*task).stop)
+		return true
+	})
+}
+
+// Get 获取路径为 path 的录像任务信息
+func Get(path string) (Info, bool) {
+	ti, ok := tasks.Load(utils.CanonicalPath(path))
+	if ok {
+		return ti.(*task).Info(), true
+	}
+	return Info{}, false
+}
+
+// Infos 返回按路径排序的全部录像任务信息
+func Infos() []Info {
+	infos := make([]Info, 0, 8)
+	tasks.Range(func(key, value interface{}) bool {
+		infos = append(infos, value.(*task).Info())
+		return true
+	})
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Path < infos[j].Path
+	})
+	return infos
+}
+
+// SyncRoutes 根据路由的 record 选项启动或停止录像；
+// 精确路由一直录像，模式以'/'结尾的路由录制所有匹配的在线流
+func SyncRoutes() {
+	if getConfig() == nil {
+		return
+	}
+
+	for _, r := range route.All() {
+		if r.Record && r.Pattern[len(r.Pattern)-1] != '/' {
+			start(r.Pattern, true)
+		}
+	}
+
+	_, streams := media.Infos("", math.MaxInt32, false)
+	for _, si := range streams {
+		if r := route.Match(si.Path); r != nil && r.Record {
+			start(si.Path, true)
+		}
+	}
+
+	// 停止路由已取消录像的任务
+	tasks.Range(func(key, value interface{}) bool {
+		t := value.(*task)
+		if !t.byRoute {
+			return true
+		}
+		if r := route.Match(t.path); r == nil || !r.Record {
+			stop(t.path, t)
+		}
+		return true
+	})
+}
+
+// 作为流消费者的录像者，流断开时关闭
+type streamRecorder interface {
+	media.Consumer
+	Done() <-chan struct{}
+}
+
+// 挂接到流上的录像者
+type attachedRecorder struct {
+	cid      media.CID
+	recorder streamRecorder
+}
+
+// 一个流路径的录像任务，按配置的格式挂接一个或多个录像者，
+// 流断开或被替换时重新挂接
+type task struct {
+	path    string
+	conf    *config.RecordConfig
+	byRoute bool
+	startOn time.Time
+	stats   recordStats
+	stop    chan struct{}
+	done    chan struct{} // 有录像者关闭时通知重新检查
+	logger  *xlog.Logger
+
+	lock      sync.Mutex
+	stream    *media.Stream
+	recorders []attachedRecorder // 格式包括 mp4、rtp 时的录像者
+	archiver  *tsArchiver        // 格式包括 hls 时归档流的 TS 片段
+	lastError string
+}
+
+func (t *task) run() {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	for {
+		t.check()
+
+		select {
+		case <-t.stop:
+			t.detach()
+			return
+		case <-t.done:
+		case <-ticker.C:
+		}
+	}
+}
+
+// 检查录像者是否挂接在当前的流上，必要时重新挂接
+func (t *task) check() {
+	s := media.Get(t.path)
+	if t.stream != nil {
+		if s == t.stream && !t.stream.IsClosed() && !t.recorderDone() {
+			return
+		}
+		t.detach()
+	}
+
+	if s == nil {
+		if s = media.GetOrCreate(t.path); s == nil {
+			return
+		}
+	}
+
+	// 各格式相互独立，部分格式失败时其他格式照常录像
+	var recorders []attachedRecorder
+	var archiver *tsArchiver
+	var errs []string
+	if t.conf.ArchiveHls() {
+		a := newTsArchiver(t.path, t.conf, &t.stats, t.logger)
+		if s.SetHlsArchiver(a) {
+			archiver = a
+		} else {
+			errs = append(errs, "stream does not support hls")
+		}
+	}
+	if t.conf.RecordMp4() {
+		r, err := newRecorder(s, t.conf, &t.stats, t.logger)
+		if err == nil {
+			recorders = append(recorders, t.attach(s, r, media.FramePacket))
+		} else {
+			errs = append(errs, err.Error())
+		}
+	}
+	if t.conf.ArchiveRtp() {
+		r, err := newRtpRecorder(s, t.conf, &t.stats, t.logger)
+		if err == nil {
+			recorders = append(recorders, t.attach(s, r, media.RTPPacket))
+		} else {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	t.lock.Lock()
+	if archiver != nil || len(recorders) > 0 {
+		t.stream, t.recorders, t.archiver = s, recorders, archiver
+	}
+	t.lastError = strings.Join(errs, "; ")
+	t.lock.Unlock()
+}
+
+// 将录像者挂接到流上，录像者关闭时通知 run 重新检查
+func (t *task) attach(s *media.Stream, r streamRecorder, packetType media.PacketType) attachedRecorder {
+	cid := s.StartConsumeNoGopCache(r, packetType, "record")
+	go func() {
+		select {
+		case <-r.Done():
+			select {
+			case t.done <- struct{}{}:
+			default:
+			}
+		case <-t.stop:
+		}
+	}()
+	return attachedRecorder{cid: cid, recorder: r}
+}
+
+// 是否有录像者已关闭，如录像文件写入失败
+func (t *task) recorderDone() bool {
+	for _, ar := range t.recorders {
+		select {
+		case <-ar.recorder.Done():
+			return true
+		default:
+		}
+	}
+	return false
+}
+
+func (t *task) detach() {
+	if t.stream == nil {
+		return
+	}
+
+	for _, ar := range t.recorders {
+		t.stream.StopConsume(ar.cid)
+		ar.recorder.Close()
+	}
+	if t.archiver != nil {
+		t.stream.SetHlsArchiver(nil)
+		t.archiver.Close()
+	}
+
+	t.lock.Lock()
+	t.stream, t.recorders, t.archiver = nil, nil, nil
+	t.lock.Unlock()
+}
+
+// Info 获取录像任务信息
+func (t *task) Info() Info {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	info := Info{
+		Path:      t.path,
+		StartOn:   t.startOn.Format(time.RFC3339Nano),
+		Route:     t.byRoute,
+		Recording: t.stream != nil,
+		Files:     int(atomic.LoadInt32(&t.stats.files)),
+		Size:      int(atomic.LoadInt64(&t.stats.bytes) / 1024),
+		LastError: t.lastError,
+	}
+	info.File, _ = t.stats.file.Load().(string)
+	return info
+}
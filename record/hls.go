@@ -0,0 +1,135 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package record
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cnotch/ipchub/av/format/hls"
+	"github.com/cnotch/ipchub/config"
+	"github.com/cnotch/xlog"
+)
+
+// 归档 TS 片段的文件扩展名
+const tsExt = ".ts"
+
+// tsArchiver 将流的 hls 片段归档为 TS 文件，用于 VOD 回放
+type tsArchiver struct {
+	lock    sync.Mutex
+	dir     string
+	layout  string
+	path    string
+	archive *archive
+	stats   *recordStats
+	logger  *xlog.Logger
+	started bool // 是否已归档过片段
+	closed  bool
+}
+
+var _ hls.SegmentArchiver = (*tsArchiver)(nil)
+
+func newTsArchiver(path string, conf *config.RecordConfig, stats *recordStats, logger *xlog.Logger) *tsArchiver {
+	layout := conf.FileLayout()
+	layout = strings.TrimSuffix(layout, filepath.Ext(layout)) + tsExt
+	return &tsArchiver{
+		dir:     conf.Path,
+		layout:  layout,
+		path:    path,
+		archive: openArchive(conf.Path, path),
+		stats:   stats,
+		logger:  logger,
+	}
+}
+
+// ArchiveSegment 将完成的片段写入文件并加入归档
+func (a *tsArchiver) ArchiveSegment(data io.Reader, size int, duration float64, discontinuity bool) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.closed {
+		return nil
+	}
+
+	// 片段在下一个片段开始时完成
+	start := time.Now().Add(-time.Duration(duration * float64(time.Second)))
+	f, name, err := createFile(FileName(a.dir, a.layout, a.path, start))
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, data)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(name)
+		return err
+	}
+
+	atomic.AddInt32(&a.stats.files, 1)
+	atomic.AddInt64(&a.stats.bytes, n)
+	a.stats.file.Store(name)
+
+	rel, _ := filepath.Rel(a.dir, name)
+	err = a.archive.add(Segment{
+		File:          filepath.ToSlash(rel),
+		Start:         start,
+		Duration:      duration,
+		Size:          n,
+		Discontinuity: discontinuity || !a.started,
+	})
+	a.started = true
+	return err
+}
+
+// Close 停止归档，之后的片段被忽略
+func (a *tsArchiver) Close() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.closed = true
+	a.stats.file.Store("")
+	return nil
+}
+
+// TsSegments 返回流 path 在 [start,end) 时间范围内归档的 TS 片段
+func TsSegments(path string, start, end time.Time) []Segment {
+	a := lookupArchive(path)
+	if a == nil {
+		return nil
+	}
+
+	var segs []Segment
+	for _, seg := range a.list() {
+		if filepath.Ext(seg.File) != tsExt {
+			continue
+		}
+		if seg.Start.Before(end) && seg.End().After(start) {
+			segs = append(segs, seg)
+		}
+	}
+	return segs
+}
+
+// OpenTsSegment 打开流 path 中在 start 时刻开始的 TS 片段
+func OpenTsSegment(path string, start time.Time) (*os.File, int64, error) {
+	a := lookupArchive(path)
+	if a == nil {
+		return nil, 0, os.ErrNotExist
+	}
+
+	for _, seg := range a.list() {
+		if seg.Start.Equal(start) && filepath.Ext(seg.File) == tsExt {
+			f, err := os.Open(filepath.Join(a.dir, filepath.FromSlash(seg.File)))
+			return f, seg.Size, err
+		}
+	}
+	return nil, 0, os.ErrNotExist
+}
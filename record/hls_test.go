@@ -0,0 +1,101 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package record
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cnotch/ipchub/av/codec"
+	"github.com/cnotch/ipchub/config"
+	"github.com/cnotch/ipchub/media"
+	"github.com/cnotch/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTsArchiver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "record")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	conf := &config.RecordConfig{Path: dir, Format: "hls"}
+	getConfig = func() *config.RecordConfig { return conf }
+	defer func() { getConfig = config.GetRecordConfig }()
+
+	var stats recordStats
+	a := newTsArchiver("/live/tscam", conf, &stats, xlog.L())
+	for i := 0; i < 3; i++ {
+		data := bytes.Repeat([]byte{byte(i)}, 188)
+		assert.NoError(t, a.ArchiveSegment(bytes.NewReader(data), len(data), 2, false))
+	}
+	a.Close()
+	assert.NoError(t, a.ArchiveSegment(bytes.NewReader(nil), 0, 2, false))
+	assert.Equal(t, int32(3), stats.files)
+	assert.Equal(t, int64(3*188), stats.bytes)
+
+	segs := TsSegments("live/tscam", time.Now().Add(-time.Minute), time.Now())
+	if !assert.Len(t, segs, 3) {
+		return
+	}
+	// 归档者的第一个片段与之前的归档不连续
+	assert.True(t, segs[0].Discontinuity)
+	assert.False(t, segs[1].Discontinuity)
+	assert.Equal(t, ".ts", filepath.Ext(segs[0].File))
+	assert.Empty(t, TsSegments("/live/tscam", time.Now().Add(time.Minute), time.Now().Add(2*time.Minute)))
+
+	f, size, err := OpenTsSegment("/live/tscam", segs[1].Start)
+	if assert.NoError(t, err) {
+		data, _ := ioutil.ReadAll(f)
+		f.Close()
+		assert.Equal(t, int64(188), size)
+		assert.Equal(t, bytes.Repeat([]byte{1}, 188), data)
+	}
+	_, _, err = OpenTsSegment("/live/tscam", segs[1].Start.Add(time.Millisecond))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestStreamTsArchiver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "record")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	// TS 封装需要 AAC 音频轨道
+	sps, _ := base64.StdEncoding.DecodeString("Z2QAH6zZQFAFuhAAAAMAEAAAAwPI8YMZYA==")
+	video := codec.VideoMeta{Codec: "H264", Sps: sps, Pps: []byte{0x68, 0xef, 0xbc, 0xb0}}
+	audio := codec.AudioMeta{Codec: "AAC", SampleRate: 44100, Channels: 2, Sps: []byte{0x12, 0x10}}
+	s := media.NewFrameStream("/live/tsstream", &video, &audio)
+	defer s.Close()
+
+	var stats recordStats
+	a := newTsArchiver(s.Path(), &config.RecordConfig{Path: dir, Format: "hls"}, &stats, xlog.L())
+	assert.True(t, s.SetHlsArchiver(a))
+
+	// 默认 5 秒一个 hls 片段
+	writeFrames(s, 20)
+	archive := openArchive(dir, s.Path())
+	assert.True(t, waitFor(func() bool { return len(archive.list()) >= 2 }))
+	s.SetHlsArchiver(nil)
+	a.Close()
+
+	segs := archive.list()
+	if assert.True(t, len(segs) >= 2) {
+		assert.True(t, segs[0].Duration >= 5)
+		assert.True(t, segs[0].Discontinuity)
+		assert.False(t, segs[1].Discontinuity)
+		data, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(segs[0].File)))
+		if assert.NoError(t, err) && assert.NotEmpty(t, data) {
+			assert.Equal(t, byte(0x47), data[0]) // TS 同步字节
+		}
+	}
+}
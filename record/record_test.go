@@ -0,0 +1,203 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package record
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cnotch/ipchub/av/codec"
+	"github.com/cnotch/ipchub/config"
+	"github.com/cnotch/ipchub/media"
+	"github.com/cnotch/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestStream(path string) *media.Stream {
+	sps, _ := base64.StdEncoding.DecodeString("Z2QAH6zZQFAFuhAAAAMAEAAAAwPI8YMZYA==")
+	video := codec.VideoMeta{Codec: "H264", Sps: sps, Pps: []byte{0x68, 0xef, 0xbc, 0xb0}}
+	return media.NewFrameStream(path, &video, &codec.AudioMeta{})
+}
+
+// 写入 seconds 秒、每秒一个 GOP 的 25fps 视频，最后写入下一个 GOP 的首帧以便输出最后一个片段
+func writeFrames(s *media.Stream, seconds int) {
+	for i := 0; i <= seconds*25+1; i++ {
+		payload := []byte{0x41, 0x9a, 0x00, 0x01}
+		if i%25 == 0 {
+			payload = []byte{0x65, 0x88, 0x80, 0x40}
+		}
+		dts := int64(i) * int64(40*time.Millisecond)
+		s.WriteFrame(&codec.Frame{MediaType: codec.MediaTypeVideo, Dts: dts, Pts: dts, Payload: payload})
+	}
+}
+
+func waitFor(cond func() bool) bool {
+	for i := 0; i < 200; i++ {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestFileName(t *testing.T) {
+	at := time.Date(2020, 5, 1, 8, 30, 5, 0, time.Local)
+	assert.Equal(t, filepath.Join("/data", "live", "cam1", "2020-05-01", "083005.mp4"),
+		FileName("/data", "{path}/{date}/{time}.mp4", "/live/cam1", at))
+	assert.Equal(t, filepath.Join("/data", "2020-05-01", "live", "cam1-083005.mp4"),
+		FileName("/data", "{date}/{path}-{time}.mp4", "/live/cam1", at))
+}
+
+func TestRecorder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "record")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	s := newTestStream("/live/recorder")
+	defer s.Close()
+
+	var stats recordStats
+	recorder, err := newRecorder(s, &config.RecordConfig{Path: dir, Segment: 1}, &stats, xlog.L())
+	if !assert.NoError(t, err) {
+		return
+	}
+	s.StartConsume(recorder, media.FramePacket, "record")
+	assert.Equal(t, 1, s.ConsumerCount())
+
+	// 3 个 GOP，每个文件 1 秒
+	writeFrames(s, 3)
+	assert.True(t, waitFor(func() bool { return atomic.LoadInt32(&stats.files) == 3 }))
+	recorder.Close()
+	<-recorder.Done()
+
+	var files []string
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && filepath.Ext(path) == ".mp4" {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if !assert.Len(t, files, 3) {
+		return
+	}
+	// 完成的文件加入归档
+	segs := openArchive(dir, "/live/recorder").list()
+	if assert.Len(t, segs, 3) {
+		assert.Equal(t, 1.0, segs[0].Duration)
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if assert.NoError(t, err) && assert.True(t, len(data) > 8) {
+			assert.Equal(t, "ftyp", string(data[4:8]))
+			assert.Contains(t, string(data), "moof")
+		}
+	}
+}
+
+func TestStartStop(t *testing.T) {
+	getConfig = func() *config.RecordConfig { return nil }
+	assert.Equal(t, ErrNotConfigured, Start("/live/cam1"))
+
+	dir, err := ioutil.TempDir("", "record")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	conf := &config.RecordConfig{Path: dir}
+	getConfig = func() *config.RecordConfig { return conf }
+	defer func() { getConfig = config.GetRecordConfig }()
+	assert.Equal(t, ErrInvalidPath, Start("/live/"))
+
+	// 流上线前开始录像
+	assert.NoError(t, Start("/live/cam1"))
+	assert.NoError(t, Start("/live/cam1"))
+	info, ok := Get("live/cam1")
+	if assert.True(t, ok) {
+		assert.False(t, info.Recording)
+	}
+
+	checkInterval = 10 * time.Millisecond
+	defer func() { checkInterval = time.Second * 5 }()
+	s := newTestStream("/live/cam1")
+	media.Regist(s)
+	defer media.Unregist(s)
+
+	assert.True(t, waitFor(func() bool {
+		info, _ := Get("/live/cam1")
+		return info.Recording
+	}))
+	writeFrames(s, 1)
+	assert.True(t, waitFor(func() bool {
+		info, _ := Get("/live/cam1")
+		return info.Files == 1 && info.File != ""
+	}))
+	assert.Len(t, Infos(), 1)
+
+	assert.True(t, Stop("/live/cam1"))
+	assert.False(t, Stop("/live/cam1"))
+	assert.Empty(t, Infos())
+	assert.True(t, waitFor(func() bool { return s.ConsumerCount() == 0 }))
+
+	// 并发停止同一任务只关闭一次
+	assert.NoError(t, Start("/live/cam1"))
+	var wg sync.WaitGroup
+	var stopped int32
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if Stop("/live/cam1") {
+				atomic.AddInt32(&stopped, 1)
+			}
+			StopAll()
+		}()
+	}
+	wg.Wait()
+	assert.True(t, stopped <= 1)
+	assert.Empty(t, Infos())
+}
+
+// 同时启用多种格式时，每种格式挂接各自的录像者
+func TestStartMultipleFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "record")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	conf := &config.RecordConfig{Path: dir, Format: "mp4, rtp"}
+	getConfig = func() *config.RecordConfig { return conf }
+	defer func() { getConfig = config.GetRecordConfig }()
+	assert.True(t, conf.RecordMp4())
+	assert.True(t, conf.ArchiveRtp())
+	assert.False(t, conf.ArchiveHls())
+
+	s := newTestStream("/live/multicam")
+	media.Regist(s)
+	defer media.Unregist(s)
+
+	assert.NoError(t, Start("/live/multicam"))
+	defer Stop("/live/multicam")
+	assert.True(t, waitFor(func() bool {
+		info, _ := Get("/live/multicam")
+		return info.Recording
+	}))
+	info, _ := Get("/live/multicam")
+	assert.Empty(t, info.LastError)
+	assert.Equal(t, 2, s.ConsumerCount())
+
+	assert.True(t, Stop("/live/multicam"))
+	assert.True(t, waitFor(func() bool { return s.ConsumerCount() == 0 }))
+}
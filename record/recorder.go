@@ -0,0 +1,77 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package record
+
+import (
+	"sync"
+
+	"github.com/cnotch/ipchub/av/codec"
+	"github.com/cnotch/ipchub/av/format/fmp4"
+	"github.com/cnotch/ipchub/config"
+	"github.com/cnotch/ipchub/media"
+	"github.com/cnotch/xlog"
+)
+
+// Recorder 将流的完整帧录制成按时长切分的 fMP4 文件，
+// 作为 FramePacket 消费者挂接到流上
+type Recorder struct {
+	muxer     *fmp4.Muxer
+	w         *segmentWriter
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+var _ media.Consumer = (*Recorder)(nil)
+
+// NewRecorder 创建流 stream 的录像者
+func NewRecorder(stream *media.Stream, conf *config.RecordConfig, logger *xlog.Logger) (*Recorder, error) {
+	return newRecorder(stream, conf, new(recordStats), logger)
+}
+
+func newRecorder(stream *media.Stream, conf *config.RecordConfig, stats *recordStats, logger *xlog.Logger) (*Recorder, error) {
+	w := &segmentWriter{
+		dir:     conf.Path,
+		layout:  conf.FileLayout(),
+		path:    stream.Path(),
+		segment: int64(conf.SegmentDuration()),
+		archive: openArchive(conf.Path, stream.Path()),
+		stats:   stats,
+		logger:  logger,
+	}
+
+	// 片段时长为 0，每个 GOP 一个片段，保证文件在关键帧处切分
+	muxer, err := fmp4.NewMuxer(&stream.Video, &stream.Audio, 0, w, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Recorder{
+		muxer:  muxer,
+		w:      w,
+		closed: make(chan struct{}),
+	}, nil
+}
+
+// Consume 消费完整帧
+func (r *Recorder) Consume(pack media.Pack) {
+	if frame, ok := pack.(*codec.Frame); ok {
+		r.muxer.WriteFrame(frame)
+	}
+}
+
+// Close 停止录像并关闭当前文件
+func (r *Recorder) Close() error {
+	r.closeOnce.Do(func() {
+		r.muxer.Close()
+		r.w.Close()
+		close(r.closed)
+	})
+	return nil
+}
+
+// Done 返回录像者关闭时被关闭的通道，如流断开时
+func (r *Recorder) Done() <-chan struct{} {
+	return r.closed
+}
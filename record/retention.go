@@ -0,0 +1,135 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package record
+
+import (
+	"time"
+
+	"github.com/cnotch/ipchub/utils"
+	"github.com/cnotch/xlog"
+)
+
+// 获取磁盘空间，测试时替换
+var diskSpaceOf = diskSpace
+
+// Usage 录像存储的使用情况
+type Usage struct {
+	Dir       string        `json:"dir"`        // 录像目录
+	Size      int           `json:"size"`       // 全部归档的大小(KB)
+	DiskTotal int           `json:"disk_total"` // 磁盘容量(MB)
+	DiskFree  int           `json:"disk_free"`  // 磁盘可用空间(MB)
+	Archives  []ArchiveInfo `json:"archives"`
+}
+
+// GetUsage 获取录像存储的使用情况
+func GetUsage() (Usage, error) {
+	conf := getConfig()
+	if conf == nil {
+		return Usage{}, ErrNotConfigured
+	}
+
+	usage := Usage{Dir: conf.Path, Archives: make([]ArchiveInfo, 0, 8)}
+	for _, a := range loadArchives(conf.Path) {
+		info := a.info()
+		usage.Size += info.Size
+		usage.Archives = append(usage.Archives, info)
+	}
+	if total, free, err := diskSpaceOf(conf.Path); err == nil {
+		usage.DiskTotal = int(total >> 20)
+		usage.DiskFree = int(free >> 20)
+	}
+	return usage, nil
+}
+
+// GetArchive 获取流 path 的归档信息和录像文件列表，没有归档时返回 false
+func GetArchive(path string) (ArchiveInfo, []Segment, bool) {
+	if a := lookupArchive(path); a != nil {
+		return a.info(), a.list(), true
+	}
+	return ArchiveInfo{}, nil, false
+}
+
+// 查找流 path 的归档，没有时返回 nil
+func lookupArchive(path string) *archive {
+	conf := getConfig()
+	if conf == nil {
+		return nil
+	}
+
+	path = utils.CanonicalPath(path)
+	for _, a := range loadArchives(conf.Path) {
+		if a.path == path {
+			return a
+		}
+	}
+	return nil
+}
+
+// EnforceRetention 按保留时长、每个流的最大大小和磁盘最小可用空间，
+// 从最早的录像文件开始删除
+func EnforceRetention() {
+	conf := getConfig()
+	if conf == nil {
+		return
+	}
+
+	as := loadArchives(conf.Path)
+	if maxAge := conf.MaxAgeDuration(); maxAge > 0 {
+		expired := time.Now().Add(-maxAge)
+		for _, a := range as {
+			a.removeWhile(func(seg *Segment, size int64) bool {
+				return seg.End().Before(expired)
+			})
+		}
+	}
+
+	if maxSize := conf.MaxSizeBytes(); maxSize > 0 {
+		for _, a := range as {
+			a.removeWhile(func(seg *Segment, size int64) bool {
+				return size > maxSize
+			})
+		}
+	}
+
+	if minFree := conf.MinFreeBytes(); minFree > 0 {
+		freeSpace(conf.Path, as, minFree)
+	}
+}
+
+// 磁盘可用空间不足时，逐个删除所有流中最早的录像文件
+func freeSpace(dir string, as []*archive, minFree uint64) {
+	for {
+		_, free, err := diskSpaceOf(dir)
+		if err != nil {
+			xlog.Warnf("get disk space of %s failed; %s", dir, err.Error())
+			return
+		}
+		if free >= minFree {
+			return
+		}
+
+		var oldest *archive
+		var start time.Time
+		for _, a := range as {
+			if seg, ok := a.oldest(); ok && (oldest == nil || seg.Start.Before(start)) {
+				oldest, start = a, seg.Start
+			}
+		}
+		if oldest == nil {
+			xlog.Warnf("disk space of %s is low, but there are no recording files to remove", dir)
+			return
+		}
+
+		first := true
+		removed := oldest.removeWhile(func(seg *Segment, size int64) bool {
+			ret := first
+			first = false
+			return ret
+		})
+		if removed == 0 { // 删除失败，避免死循环
+			return
+		}
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package record
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cnotch/ipchub/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// 在归档中添加一个 size 字节、从 start 开始的 1 分钟录像文件
+func addTestSegment(t *testing.T, a *archive, start time.Time, size int) {
+	file := FileName(a.dir, defaultTestLayout, a.path, start)
+	os.MkdirAll(filepath.Dir(file), os.ModePerm)
+	assert.NoError(t, ioutil.WriteFile(file, make([]byte, size), 0644))
+	rel, _ := filepath.Rel(a.dir, file)
+	assert.NoError(t, a.add(Segment{File: filepath.ToSlash(rel), Start: start, Duration: 60, Size: int64(size)}))
+}
+
+const defaultTestLayout = "{path}/{date}/{time}.mp4"
+
+func TestArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	a := openArchive(dir, "/live/cam1")
+	start := time.Date(2020, 5, 1, 8, 0, 0, 0, time.UTC)
+	addTestSegment(t, a, start.Add(time.Minute), 200)
+	addTestSegment(t, a, start, 100)
+	addTestSegment(t, a, start.Add(2*time.Minute), 300)
+	assert.Equal(t, int64(600), a.size)
+	assert.Equal(t, start, a.list()[0].Start)
+
+	// 重新加载索引
+	b := &archive{dir: dir, path: "/live/cam1", index: a.index}
+	b.load()
+	assert.Equal(t, a.list(), b.list())
+
+	removed := b.removeWhile(func(seg *Segment, size int64) bool { return size > 300 })
+	assert.Equal(t, int64(300), removed)
+	segs := b.list()
+	if assert.Len(t, segs, 1) {
+		assert.Equal(t, start.Add(2*time.Minute), segs[0].Start)
+	}
+	_, err = os.Stat(filepath.Join(dir, filepath.FromSlash(a.list()[0].File)))
+	assert.True(t, os.IsNotExist(err))
+
+	c := &archive{dir: dir, path: "/live/cam1", index: a.index}
+	c.load()
+	assert.Equal(t, segs, c.list())
+
+	info := c.info()
+	assert.Equal(t, "/live/cam1", info.Path)
+	assert.Equal(t, 1, info.Segments)
+	assert.Equal(t, start.Add(3*time.Minute).Format(time.RFC3339Nano), info.Newest)
+}
+
+func TestEnforceRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retention")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	conf := &config.RecordConfig{Path: dir, MaxAge: 1, MaxSize: 2, MinFree: 1}
+	getConfig = func() *config.RecordConfig { return conf }
+	defer func() { getConfig = config.GetRecordConfig }()
+
+	var free uint64 = 1 << 30
+	diskSpaceOf = func(string) (uint64, uint64, error) { return 1 << 40, free, nil }
+	defer func() { diskSpaceOf = diskSpace }()
+
+	now := time.Now().UTC()
+	cam1 := openArchive(dir, "/live/cam1")
+	addTestSegment(t, cam1, now.Add(-2*time.Hour), 1024) // 过期
+	addTestSegment(t, cam1, now.Add(-10*time.Minute), 1<<20)
+	addTestSegment(t, cam1, now.Add(-5*time.Minute), 1<<20)
+	addTestSegment(t, cam1, now.Add(-2*time.Minute), 1<<20) // 超过 2MB
+	cam2 := openArchive(dir, "/live/cam2")
+	addTestSegment(t, cam2, now.Add(-8*time.Minute), 1024)
+	addTestSegment(t, cam2, now.Add(-3*time.Minute), 1024)
+
+	EnforceRetention()
+	assert.Len(t, cam1.list(), 2)
+	assert.Equal(t, now.Add(-5*time.Minute), cam1.list()[0].Start)
+	assert.Len(t, cam2.list(), 2)
+
+	// 磁盘空间不足时，删除所有流中最早的文件
+	free = 0
+	removed := 0
+	diskSpaceOf = func(string) (uint64, uint64, error) {
+		if removed++; removed > 2 {
+			free = 1 << 30
+		}
+		return 1 << 40, free, nil
+	}
+	EnforceRetention()
+	assert.Len(t, cam1.list(), 1)
+	assert.Len(t, cam2.list(), 1)
+	assert.Equal(t, now.Add(-3*time.Minute), cam2.list()[0].Start)
+
+	usage, err := GetUsage()
+	if assert.NoError(t, err) && assert.Len(t, usage.Archives, 2) {
+		assert.Equal(t, dir, usage.Dir)
+		assert.Equal(t, 1024+1, usage.Size)
+		assert.Equal(t, "/live/cam1", usage.Archives[0].Path)
+	}
+	info, segs, ok := GetArchive("live/cam2")
+	if assert.True(t, ok) {
+		assert.Equal(t, 1, info.Segments)
+		assert.Len(t, segs, 1)
+	}
+	_, _, ok = GetArchive("/live/cam3")
+	assert.False(t, ok)
+}
@@ -0,0 +1,294 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package record
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cnotch/ipchub/av/codec/h264"
+	"github.com/cnotch/ipchub/av/codec/hevc"
+	"github.com/cnotch/ipchub/av/format/rtp"
+	"github.com/cnotch/ipchub/config"
+	"github.com/cnotch/ipchub/media"
+	"github.com/cnotch/xlog"
+)
+
+// RTP 归档文件格式：
+//
+//	文件头: "IRTP" | 版本(1 字节) | SDP 长度(4 字节) | SDP
+//	包记录: 接收时间(8 字节，Unix 纳秒) | 通道(1 字节) | 长度(2 字节) | RTP 包
+//
+// 时间索引文件与归档文件同名，扩展名为 .idx，
+// 每个视频关键帧一条记录: 时间(8 字节，Unix 纳秒) | 关键帧在归档文件中的偏移(8 字节)
+const (
+	rtpExt          = ".rtp"
+	rtpIndexExt     = ".idx"
+	rtpMagic        = "IRTP"
+	rtpVersion      = 1
+	rtpHeaderSize   = 9
+	rtpRecordSize   = 11
+	rtpIndexEntSize = 16
+)
+
+var errInvalidRtpFile = errors.New("invalid rtp archive file")
+
+// 视频 RTP 包的负载是否以参数集或关键帧开始
+func isKeyPayload(isHevc bool, payload []byte) bool {
+	if isHevc {
+		if len(payload) < 3 {
+			return false
+		}
+		nalType := (payload[0] >> 1) & 0x3f
+		switch nalType {
+		case hevc.NalStapInRtp:
+			if len(payload) < 5 {
+				return false
+			}
+			nalType = (payload[4] >> 1) & 0x3f
+		case hevc.NalFuInRtp:
+			if payload[2]&0x80 == 0 { // 不是第一个分片
+				return false
+			}
+			nalType = payload[2] & 0x3f
+		}
+		return (nalType >= hevc.NalBlaWLp && nalType <= hevc.NalIrapVcl23) ||
+			(nalType >= hevc.NalVps && nalType <= hevc.NalPps)
+	}
+
+	if len(payload) < 2 {
+		return false
+	}
+	nalType := payload[0] & 0x1f
+	switch nalType {
+	case h264.NalStapaInRtp:
+		if len(payload) < 4 {
+			return false
+		}
+		nalType = payload[3] & 0x1f
+	case h264.NalFuAInRtp:
+		if payload[1]&0x80 == 0 {
+			return false
+		}
+		nalType = payload[1] & 0x1f
+	}
+	return nalType == h264.NalIdrSlice || nalType == h264.NalSps || nalType == h264.NalPps
+}
+
+// rtpRecorder 将流的 RTP 包归档到按时长切分的文件，并为视频关键帧建立时间索引，
+// 作为 RTPPacket 消费者挂接到流上
+type rtpRecorder struct {
+	lock      sync.Mutex
+	dir       string
+	layout    string
+	path      string
+	sdp       string
+	hevc      bool
+	segment   time.Duration
+	archive   *archive
+	stats     *recordStats
+	logger    *xlog.Logger
+	file      *os.File
+	w         *bufio.Writer
+	idx       *os.File
+	fileName  string
+	fileAt    time.Time // 第一个包的接收时间
+	lastAt    time.Time // 最后一个包的接收时间
+	fileSize  int64
+	idxSize   int64
+	keyTs     uint32 // 最近关键帧的 RTP 时间戳，同一帧的多个包只索引一次
+	hasKey    bool
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newRtpRecorder(stream *media.Stream, conf *config.RecordConfig, stats *recordStats, logger *xlog.Logger) (*rtpRecorder, error) {
+	if stream.Sdp() == "" {
+		return nil, errors.New("stream has no sdp")
+	}
+	if stream.Video.Codec != "H264" && stream.Video.Codec != "H265" {
+		return nil, errors.New("rtp recording requires H264 or H265 video")
+	}
+
+	layout := conf.FileLayout()
+	return &rtpRecorder{
+		dir:     conf.Path,
+		layout:  strings.TrimSuffix(layout, filepath.Ext(layout)) + rtpExt,
+		path:    stream.Path(),
+		sdp:     stream.Sdp(),
+		hevc:    stream.Video.Codec == "H265",
+		segment: conf.SegmentDuration(),
+		archive: openArchive(conf.Path, stream.Path()),
+		stats:   stats,
+		logger:  logger,
+		closed:  make(chan struct{}),
+	}, nil
+}
+
+// Consume 消费 RTP 包，控制通道的包被忽略
+func (r *rtpRecorder) Consume(pack media.Pack) {
+	if p, ok := pack.(*rtp.Packet); ok && p.Channel&1 == 0 {
+		r.write(p, time.Now())
+	}
+}
+
+// 写入在 now 时刻接收的 RTP 包
+func (r *rtpRecorder) write(p *rtp.Packet, now time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	select {
+	case <-r.closed:
+		return
+	default:
+	}
+
+	// 在关键帧处切分文件并建立索引
+	if p.Channel == rtp.ChannelVideo && isKeyPayload(r.hevc, p.Payload()) &&
+		!(r.hasKey && p.Timestamp == r.keyTs) {
+		if r.file != nil && now.Sub(r.fileAt) >= r.segment {
+			r.closeFile()
+		}
+		if r.file == nil {
+			if err := r.openFile(now); err != nil {
+				r.logger.Errorf("open recording file failed; %s", err.Error())
+				return
+			}
+		}
+		r.keyTs, r.hasKey = p.Timestamp, true
+		if err := r.writeIndex(now); err != nil {
+			r.logger.Errorf("write recording index failed; %s", err.Error())
+		}
+		r.flush()
+	}
+	if r.file == nil { // 等待第一个关键帧
+		return
+	}
+
+	var head [rtpRecordSize]byte
+	binary.BigEndian.PutUint64(head[:], uint64(now.UnixNano()))
+	head[8] = p.Channel
+	binary.BigEndian.PutUint16(head[9:], uint16(len(p.Data)))
+	r.w.Write(head[:])
+	if _, err := r.w.Write(p.Data); err != nil {
+		r.logger.Errorf("write recording file failed; %s", err.Error())
+		r.closeFile()
+		return
+	}
+	r.lastAt = now
+	r.fileSize += int64(rtpRecordSize + len(p.Data))
+	atomic.AddInt64(&r.stats.bytes, int64(rtpRecordSize+len(p.Data)))
+}
+
+func (r *rtpRecorder) openFile(t time.Time) (err error) {
+	var name string
+	if r.file, name, err = createFile(FileName(r.dir, r.layout, r.path, t)); err != nil {
+		return
+	}
+	if r.idx, err = os.Create(strings.TrimSuffix(name, rtpExt) + rtpIndexExt); err != nil {
+		r.file.Close()
+		r.file = nil
+		os.Remove(name)
+		return
+	}
+
+	head := make([]byte, rtpHeaderSize, rtpHeaderSize+len(r.sdp))
+	copy(head, rtpMagic)
+	head[4] = rtpVersion
+	binary.BigEndian.PutUint32(head[5:], uint32(len(r.sdp)))
+	head = append(head, r.sdp...)
+
+	r.w = bufio.NewWriterSize(r.file, 64*1024)
+	r.w.Write(head)
+	r.fileName = name
+	r.fileAt, r.lastAt = t, t
+	r.fileSize = int64(len(head))
+	r.idxSize = 0
+
+	atomic.AddInt32(&r.stats.files, 1)
+	atomic.AddInt64(&r.stats.bytes, int64(len(head)))
+	r.stats.file.Store(name)
+	r.logger.Infof("start recording file %s", name)
+	return
+}
+
+func (r *rtpRecorder) writeIndex(t time.Time) error {
+	var ent [rtpIndexEntSize]byte
+	binary.BigEndian.PutUint64(ent[:], uint64(t.UnixNano()))
+	binary.BigEndian.PutUint64(ent[8:], uint64(r.fileSize))
+	_, err := r.idx.Write(ent[:])
+	if err == nil {
+		r.idxSize += rtpIndexEntSize
+	}
+	return err
+}
+
+// 当前文件的录像信息
+func (r *rtpRecorder) segmentInfo() Segment {
+	idxName := strings.TrimSuffix(r.fileName, rtpExt) + rtpIndexExt
+	rel, _ := filepath.Rel(r.dir, r.fileName)
+	relIdx, _ := filepath.Rel(r.dir, idxName)
+	return Segment{
+		File:     filepath.ToSlash(rel),
+		Start:    r.fileAt,
+		Duration: r.lastAt.Sub(r.fileAt).Seconds(),
+		Size:     r.fileSize + r.idxSize,
+		Index:    filepath.ToSlash(relIdx),
+	}
+}
+
+// 在关键帧处将已写入的包刷新到文件，并更新归档中正在写入的文件，
+// 以便回放读取到最近的关键帧
+func (r *rtpRecorder) flush() {
+	if err := r.w.Flush(); err != nil {
+		r.logger.Errorf("flush recording file failed; %s", err.Error())
+		return
+	}
+	r.archive.update(r.segmentInfo())
+}
+
+func (r *rtpRecorder) closeFile() {
+	if r.file == nil {
+		return
+	}
+
+	err := r.w.Flush()
+	if err2 := r.file.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		r.logger.Errorf("close recording file failed; %s", err.Error())
+	}
+	r.idx.Close()
+	r.file, r.w, r.idx = nil, nil, nil
+	r.stats.file.Store("")
+
+	if err := r.archive.add(r.segmentInfo()); err != nil {
+		r.logger.Errorf("add recording file to archive failed; %s", err.Error())
+	}
+}
+
+// Close 停止录像并关闭当前文件
+func (r *rtpRecorder) Close() error {
+	r.closeOnce.Do(func() {
+		r.lock.Lock()
+		close(r.closed)
+		r.closeFile()
+		r.lock.Unlock()
+	})
+	return nil
+}
+
+// Done 返回录像者关闭时被关闭的通道，如流断开时
+func (r *rtpRecorder) Done() <-chan struct{} {
+	return r.closed
+}
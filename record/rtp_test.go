@@ -0,0 +1,179 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package record
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cnotch/ipchub/av/format/rtp"
+	"github.com/cnotch/ipchub/config"
+	"github.com/cnotch/xlog"
+	pionrtp "github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRtpPacket(ch byte, seq uint16, ts uint32, payload ...byte) *rtp.Packet {
+	data, _ := (&pionrtp.Packet{
+		Header:  pionrtp.Header{Version: 2, PayloadType: 96, SequenceNumber: seq, Timestamp: ts, SSRC: 1},
+		Payload: payload,
+	}).Marshal()
+	p := &rtp.Packet{Channel: ch, Data: data}
+	p.Header.Unmarshal(data)
+	return p
+}
+
+// 写入从 start 开始 seconds 秒、每秒一个 GOP 的 25fps 视频 RTP 包，
+// 关键帧前带有 SPS，每帧之后有一个音频包
+func writeTestRtp(r *rtpRecorder, start time.Time, seconds int) {
+	seq := uint16(0)
+	for i := 0; i < seconds*25; i++ {
+		at := start.Add(time.Duration(i) * 40 * time.Millisecond)
+		ts := uint32(i * 3600)
+		if i%25 == 0 {
+			seq++
+			r.write(newTestRtpPacket(rtp.ChannelVideo, seq, ts, 0x67, 0x64), at)
+			seq++
+			r.write(newTestRtpPacket(rtp.ChannelVideo, seq, ts, 0x65, 0x88), at)
+		} else {
+			seq++
+			r.write(newTestRtpPacket(rtp.ChannelVideo, seq, ts, 0x41, 0x9a), at)
+		}
+		r.write(newTestRtpPacket(rtp.ChannelAudio, uint16(i), uint32(i*320), 0x01), at)
+	}
+}
+
+func TestRtpArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "record")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	conf := &config.RecordConfig{Path: dir, Segment: 2, Format: "rtp"}
+	getConfig = func() *config.RecordConfig { return conf }
+	defer func() { getConfig = config.GetRecordConfig }()
+
+	s := newTestStream("/live/rtpcam")
+	defer s.Close()
+	var stats recordStats
+	r, err := newRtpRecorder(s, conf, &stats, xlog.L())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// 6 秒，每个文件 2 秒
+	start := time.Date(2020, 5, 1, 8, 0, 0, 0, time.UTC)
+	writeTestRtp(r, start, 6)
+
+	// 正在写入的文件在关键帧处登记到归档，可以读取到最近的关键帧之前
+	live, err := OpenRtpReader("/live/rtpcam")
+	if assert.NoError(t, err) {
+		assert.True(t, start.Add(4960*time.Millisecond).Equal(live.End()))
+		assert.NoError(t, live.Seek(start.Add(4500*time.Millisecond)))
+		at, _, err := live.ReadPacket()
+		if assert.NoError(t, err) {
+			assert.True(t, start.Add(4*time.Second).Equal(at))
+		}
+		live.Close()
+	}
+	r.Close()
+	assert.Equal(t, int32(3), stats.files)
+	assert.Len(t, r.archive.list(), 3)
+
+	reader, err := OpenRtpReader("/live/rtpcam")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer reader.Close()
+	assert.Equal(t, s.Sdp(), reader.Sdp())
+	assert.Equal(t, start, reader.Start())
+
+	// 从开始连续读取全部文件
+	packets := 0
+	for {
+		_, _, err := reader.ReadPacket()
+		if err != nil {
+			assert.Equal(t, io.EOF, err)
+			break
+		}
+		packets++
+	}
+	assert.Equal(t, 6*25*2+6, packets)
+
+	// 定位到之前最近的关键帧，从 SPS 开始
+	assert.NoError(t, reader.Seek(start.Add(3500*time.Millisecond)))
+	at, p, err := reader.ReadPacket()
+	if assert.NoError(t, err) {
+		assert.True(t, start.Add(3*time.Second).Equal(at))
+		assert.Equal(t, byte(0x67), p.Payload()[0])
+	}
+
+	// 跳到下一个关键帧，跨越文件
+	assert.NoError(t, reader.NextKeyFrame())
+	at, p, err = reader.ReadPacket()
+	if assert.NoError(t, err) {
+		assert.True(t, start.Add(4*time.Second).Equal(at))
+		assert.Equal(t, uint32(100*3600), p.Timestamp)
+	}
+
+	assert.Equal(t, io.EOF, reader.Seek(start.Add(time.Minute)))
+	_, err = OpenRtpReader("/live/none")
+	assert.True(t, os.IsNotExist(err))
+}
+
+// 编码参数变化前录制的文件被跳过
+func TestRtpReaderSdpChanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "record")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	conf := &config.RecordConfig{Path: dir, Segment: 2, Format: "rtp"}
+	getConfig = func() *config.RecordConfig { return conf }
+	defer func() { getConfig = config.GetRecordConfig }()
+
+	s := newTestStream("/live/rtpsdp")
+	defer s.Close()
+	var stats recordStats
+	r, err := newRtpRecorder(s, conf, &stats, xlog.L())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	start := time.Date(2020, 5, 1, 8, 0, 0, 0, time.UTC)
+	r.sdp = strings.Replace(s.Sdp(), "H264/90000", "H265/90000", 1)
+	writeTestRtp(r, start, 2)
+	r.sdp = s.Sdp()
+	writeTestRtp(r, start.Add(2*time.Second), 2)
+	r.Close()
+	assert.Equal(t, int32(2), stats.files)
+
+	reader, err := OpenRtpReader("/live/rtpsdp")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer reader.Close()
+	assert.Equal(t, s.Sdp(), reader.Sdp())
+
+	at, _, err := reader.ReadPacket()
+	if assert.NoError(t, err) {
+		assert.True(t, start.Add(2*time.Second).Equal(at))
+	}
+	packets := 1
+	for {
+		if _, _, err = reader.ReadPacket(); err != nil {
+			break
+		}
+		packets++
+	}
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 2*25*2+2, packets)
+}
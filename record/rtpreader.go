@@ -0,0 +1,284 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package record
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cnotch/ipchub/av/format/rtp"
+)
+
+// 归档文件中 SDP 的最大长度
+const maxRtpSdpSize = 64 * 1024
+
+var errSdpChanged = errors.New("sdp of rtp archive file changed")
+
+// 关键帧的时间索引
+type rtpIndexEntry struct {
+	t      int64 // Unix 纳秒
+	offset int64
+}
+
+// RtpReader 按时间顺序读取流归档的 RTP 包，跨文件连续读取，
+// 支持按时间定位和跳到下一个关键帧
+type RtpReader struct {
+	archive *archive
+	segs    []Segment // 归档中的 RTP 文件
+	i       int       // 当前文件在 segs 中的位置
+	f       *os.File
+	r       *bufio.Reader
+	offset  int64 // 下一个包记录在文件中的偏移
+	index   []rtpIndexEntry
+	sdp     string // 最近文件的 SDP，描述读取的流
+	key     string // sdp 中决定解码参数的部分
+}
+
+// OpenRtpReader 打开流 path 的 RTP 归档，没有 RTP 文件时返回 os.ErrNotExist；
+// 读取位置在归档的开始。流的编码参数变化前录制的文件与 SDP 不一致，读取时被跳过
+func OpenRtpReader(path string) (*RtpReader, error) {
+	a := lookupArchive(path)
+	if a == nil {
+		return nil, os.ErrNotExist
+	}
+
+	r := &RtpReader{archive: a, i: -1}
+	r.refresh()
+	if len(r.segs) == 0 {
+		return nil, os.ErrNotExist
+	}
+
+	// 使用最近文件的 SDP 描述流
+	for i := len(r.segs) - 1; i >= 0; i-- {
+		if r.open(i) == nil {
+			r.key = sdpKey(r.sdp)
+			break
+		}
+	}
+	if r.f == nil {
+		return nil, os.ErrNotExist
+	}
+	if err := r.openFrom(0); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// 重新获取归档中的 RTP 文件，包括打开后新增和正在写入的文件
+func (r *RtpReader) refresh() {
+	r.segs = r.segs[:0]
+	for _, seg := range r.archive.listAll() {
+		if filepath.Ext(seg.File) == rtpExt {
+			r.segs = append(r.segs, seg)
+		}
+	}
+}
+
+// Sdp 流的会话描述
+func (r *RtpReader) Sdp() string {
+	return r.sdp
+}
+
+// Start 归档的开始时间
+func (r *RtpReader) Start() time.Time {
+	return r.segs[0].Start
+}
+
+// End 归档的结束时间
+func (r *RtpReader) End() time.Time {
+	return r.segs[len(r.segs)-1].End()
+}
+
+// SDP 中媒体、负载类型和编码参数的行，忽略会话 ID 等每次推流都会变化的行
+func sdpKey(sdp string) string {
+	var b strings.Builder
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "m=") || strings.HasPrefix(line, "a=rtpmap:") ||
+			strings.HasPrefix(line, "a=fmtp:") {
+			b.WriteString(line)
+			b.WriteByte('\n')
+		}
+	}
+	return b.String()
+}
+
+// 打开第 i 个文件，读取位置在第一个包记录；
+// 失败或文件的 SDP 与读取的流不一致时保持当前文件
+func (r *RtpReader) open(i int) error {
+	seg := &r.segs[i]
+	f, err := os.Open(filepath.Join(r.archive.dir, filepath.FromSlash(seg.File)))
+	if err != nil {
+		return err
+	}
+	br := bufio.NewReaderSize(f, 64*1024)
+
+	var head [rtpHeaderSize]byte
+	if _, err = io.ReadFull(br, head[:]); err != nil || string(head[:4]) != rtpMagic {
+		f.Close()
+		return errInvalidRtpFile
+	}
+	size := binary.BigEndian.Uint32(head[5:])
+	if size > maxRtpSdpSize {
+		f.Close()
+		return errInvalidRtpFile
+	}
+	sdp := make([]byte, size)
+	if _, err = io.ReadFull(br, sdp); err != nil {
+		f.Close()
+		return errInvalidRtpFile
+	}
+	if r.key != "" && sdpKey(string(sdp)) != r.key {
+		f.Close()
+		return errSdpChanged
+	}
+
+	if r.f != nil {
+		r.f.Close()
+	}
+	r.index = r.index[:0]
+	if seg.Index != "" {
+		data, _ := ioutil.ReadFile(filepath.Join(r.archive.dir, filepath.FromSlash(seg.Index)))
+		for ; len(data) >= rtpIndexEntSize; data = data[rtpIndexEntSize:] {
+			r.index = append(r.index, rtpIndexEntry{
+				t:      int64(binary.BigEndian.Uint64(data)),
+				offset: int64(binary.BigEndian.Uint64(data[8:])),
+			})
+		}
+	}
+
+	r.f, r.r, r.i = f, br, i
+	if r.key == "" {
+		r.sdp = string(sdp)
+	}
+	r.offset = int64(rtpHeaderSize + len(sdp))
+	return nil
+}
+
+// 打开 i 及之后第一个可以打开的文件，已删除或 SDP 不一致的文件被跳过
+func (r *RtpReader) openFrom(i int) error {
+	for ; i < len(r.segs); i++ {
+		if err := r.open(i); err == nil {
+			return nil
+		}
+	}
+	// 到达结尾时检查是否有新完成的文件
+	if len(r.segs) > 0 {
+		last := r.segs[len(r.segs)-1].Start
+		r.refresh()
+		for i = 0; i < len(r.segs); i++ {
+			if r.segs[i].Start.After(last) && r.open(i) == nil {
+				return nil
+			}
+		}
+		r.i = len(r.segs) - 1 // 之后从新的文件继续
+	}
+	return io.EOF
+}
+
+func (r *RtpReader) seekOffset(offset int64) error {
+	if _, err := r.f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	r.r.Reset(r.f)
+	r.offset = offset
+	return nil
+}
+
+// Seek 定位到时间 t 之前最近的关键帧；t 早于归档开始时定位到开始，
+// 晚于归档结束时返回 io.EOF
+func (r *RtpReader) Seek(t time.Time) error {
+	r.refresh()
+	i := sort.Search(len(r.segs), func(i int) bool {
+		return r.segs[i].Start.After(t)
+	}) - 1
+	if i < 0 {
+		i = 0
+	} else if t.After(r.segs[i].End()) {
+		i++ // 位于两个文件之间
+	}
+	if err := r.openFrom(i); err != nil {
+		return err
+	}
+
+	nsec := t.UnixNano()
+	j := sort.Search(len(r.index), func(j int) bool {
+		return r.index[j].t > nsec
+	}) - 1
+	if j < 0 {
+		return nil
+	}
+	return r.seekOffset(r.index[j].offset)
+}
+
+// NextKeyFrame 跳到当前读取位置之后的下一个关键帧
+func (r *RtpReader) NextKeyFrame() error {
+	for {
+		j := sort.Search(len(r.index), func(j int) bool {
+			return r.index[j].offset >= r.offset
+		})
+		if j < len(r.index) {
+			return r.seekOffset(r.index[j].offset)
+		}
+		if err := r.openFrom(r.i + 1); err != nil {
+			return err
+		}
+		if len(r.index) > 0 && r.index[0].offset == r.offset {
+			return nil
+		}
+	}
+}
+
+// ReadPacket 读取下一个 RTP 包及其接收时间，到达归档结尾时返回 io.EOF
+func (r *RtpReader) ReadPacket() (time.Time, *rtp.Packet, error) {
+	var head [rtpRecordSize]byte
+	for {
+		_, err := io.ReadFull(r.r, head[:])
+		if err == nil {
+			break
+		}
+		// 当前文件结束，可能因录像中断而不完整
+		if err = r.openFrom(r.i + 1); err != nil {
+			return time.Time{}, nil, err
+		}
+	}
+
+	p := &rtp.Packet{
+		Channel: head[8],
+		Data:    make([]byte, binary.BigEndian.Uint16(head[9:])),
+	}
+	if _, err := io.ReadFull(r.r, p.Data); err != nil {
+		if err = r.openFrom(r.i + 1); err != nil {
+			return time.Time{}, nil, err
+		}
+		return r.ReadPacket()
+	}
+	if p.Channel == rtp.ChannelVideo || p.Channel == rtp.ChannelAudio {
+		if err := p.Header.Unmarshal(p.Data); err != nil {
+			return time.Time{}, nil, err
+		}
+	}
+	r.offset += int64(rtpRecordSize + len(p.Data))
+	return time.Unix(0, int64(binary.BigEndian.Uint64(head[:]))), p, nil
+}
+
+// Close 关闭读取者
+func (r *RtpReader) Close() error {
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
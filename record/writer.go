@@ -0,0 +1,179 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package record
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cnotch/ipchub/av/format/fmp4"
+	"github.com/cnotch/xlog"
+)
+
+// 录像统计，流重连后继续累计
+type recordStats struct {
+	files int32        // 已创建的文件数
+	bytes int64        // 已写入的字节数
+	file  atomic.Value // 当前录像文件
+}
+
+// FileName 根据目录结构 layout 生成流 path 在 t 时刻开始的录像文件名；
+// layout 支持 {path}、{date}(2006-01-02)、{time}(150405) 占位符
+func FileName(dir, layout, path string, t time.Time) string {
+	name := strings.NewReplacer(
+		"{path}", strings.Trim(path, "/"),
+		"{date}", t.Format("2006-01-02"),
+		"{time}", t.Format("150405"),
+	).Replace(layout)
+	return filepath.Join(dir, filepath.FromSlash(name))
+}
+
+// segmentWriter 将 fmp4 片段写入按时长切分的文件，
+// 每个文件都以初始化片段开始，可以单独播放
+type segmentWriter struct {
+	lock      sync.Mutex
+	dir       string
+	layout    string
+	path      string
+	segment   int64 // 文件时长，单位为 ns
+	init      []byte
+	file      *os.File
+	fileName  string
+	fileAt    time.Time // 当前文件开始录制的时间
+	fileStart int64     // 当前文件第一个片段的 DTS
+	fileEnd   int64     // 当前文件最后一个片段的结束 DTS
+	fileSize  int64
+	closed    bool
+	archive   *archive // 完成的文件加入流的归档
+	stats     *recordStats
+	logger    *xlog.Logger
+}
+
+func (w *segmentWriter) WriteInitSegment(init []byte) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.closeFile() // 新的初始化片段从新文件开始
+	w.init = append([]byte(nil), init...)
+	return nil
+}
+
+func (w *segmentWriter) WriteFragment(fragment *fmp4.Fragment) (err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.closed || w.init == nil {
+		return
+	}
+
+	// 在关键帧处切分文件
+	if w.file != nil && fragment.Independent && fragment.Dts-w.fileStart >= w.segment {
+		w.closeFile()
+	}
+	if w.file == nil {
+		if !fragment.Independent {
+			return
+		}
+		if err = w.openFile(time.Now()); err != nil {
+			return
+		}
+		w.fileStart = fragment.Dts
+	}
+
+	if _, err = w.file.Write(fragment.Data); err != nil {
+		w.closeFile()
+		return
+	}
+	w.fileEnd = fragment.Dts + fragment.Duration
+	w.fileSize += int64(len(fragment.Data))
+	atomic.AddInt64(&w.stats.bytes, int64(len(fragment.Data)))
+	return
+}
+
+// 创建新的录像文件，文件已存在时在文件名后添加序号；返回实际的文件名
+func createFile(name string) (f *os.File, _ string, err error) {
+	if err = os.MkdirAll(filepath.Dir(name), os.ModePerm); err != nil {
+		return
+	}
+
+	// 同一秒内重新开始录像时，避免覆盖已有文件
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		f, err = os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if !os.IsExist(err) {
+			break
+		}
+		name = base + "-" + strconv.Itoa(i) + ext
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return f, name, nil
+}
+
+func (w *segmentWriter) openFile(t time.Time) (err error) {
+	var name string
+	if w.file, name, err = createFile(FileName(w.dir, w.layout, w.path, t)); err != nil {
+		return
+	}
+
+	if _, err = w.file.Write(w.init); err != nil {
+		w.file.Close()
+		w.file = nil
+		os.Remove(name)
+		return
+	}
+	w.fileName = name
+	w.fileAt = t
+	w.fileSize = int64(len(w.init))
+
+	atomic.AddInt32(&w.stats.files, 1)
+	atomic.AddInt64(&w.stats.bytes, int64(len(w.init)))
+	w.stats.file.Store(name)
+	w.logger.Infof("start recording file %s", name)
+	return
+}
+
+func (w *segmentWriter) closeFile() {
+	if w.file == nil {
+		return
+	}
+
+	if err := w.file.Close(); err != nil {
+		w.logger.Errorf("close recording file failed; %s", err.Error())
+	}
+	w.file = nil
+	w.stats.file.Store("")
+
+	if w.fileSize <= int64(len(w.init)) { // 没有片段
+		os.Remove(w.fileName)
+		return
+	}
+	rel, _ := filepath.Rel(w.dir, w.fileName)
+	if err := w.archive.add(Segment{
+		File:     filepath.ToSlash(rel),
+		Start:    w.fileAt,
+		Duration: float64(w.fileEnd-w.fileStart) / float64(time.Second),
+		Size:     w.fileSize,
+	}); err != nil {
+		w.logger.Errorf("add recording file to archive failed; %s", err.Error())
+	}
+}
+
+// Close 关闭当前文件，之后的片段被忽略
+func (w *segmentWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.closed = true
+	w.closeFile()
+	return nil
+}
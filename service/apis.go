@@ -23,6 +23,7 @@ import (
 	"github.com/cnotch/ipchub/media"
 	"github.com/cnotch/ipchub/provider/auth"
 	"github.com/cnotch/ipchub/provider/route"
+	"github.com/cnotch/ipchub/record"
 	"github.com/cnotch/ipchub/stats"
 )
 
@@ -70,6 +71,16 @@ func (s *Service) initApis(mux *http.ServeMux) {
 		apirouter.DELETE("/api/v1/routes/{pattern=**}", s.onDelRoute),
 		apirouter.POST("/api/v1/routes", s.onSaveRoute),
 
+		// 录像管理API
+		apirouter.GET("/api/v1/recordings", s.onListRecordings),
+		apirouter.GET("/api/v1/recordings/{path=**}", s.onGetRecording),
+		apirouter.DELETE("/api/v1/recordings/{path=**}", s.onStopRecording),
+		apirouter.POST("/api/v1/recordings", s.onStartRecording),
+		apirouter.GET("/api/v1/archives", s.onGetArchiveUsage),
+		apirouter.GET("/api/v1/archives/{path=**}", s.onGetArchive),
+		apirouter.GET("/api/v1/clips", s.onListClips),
+		apirouter.POST("/api/v1/clips", s.onTriggerClip),
+
 		// 用户管理API
 		apirouter.GET("/api/v1/users", s.onListUsers),
 		apirouter.GET("/api/v1/users/{userName=*}", s.onGetUser),
@@ -188,8 +199,11 @@ func (s *Service) onGetRuntime(w http.ResponseWriter, r *http.Request, pathParam
 		Proc    stats.Proc        `json:"proc"`
 		Streams sccc              `json:"streams"`
 		Rtsp    stats.ConnsSample `json:"rtsp"`
+		Rtmp    stats.ConnsSample `json:"rtmp"`
 		Flv     stats.ConnsSample `json:"flv"`
 		Wsp     stats.ConnsSample `json:"wsp"`
+		Webrtc  stats.ConnsSample `json:"webrtc"`
+		Srt     stats.ConnsSample `json:"srt"`
 		Extra   *stats.Runtime    `json:"extra,omitempty"`
 	}
 	sc, cc := media.Count()
@@ -199,8 +213,11 @@ func (s *Service) onGetRuntime(w http.ResponseWriter, r *http.Request, pathParam
 		Proc:    stats.MeasureRuntime(),
 		Streams: sccc{sc, cc},
 		Rtsp:    stats.RtspConns.GetSample(),
+		Rtmp:    stats.RtmpConns.GetSample(),
 		Flv:     stats.FlvConns.GetSample(),
 		Wsp:     stats.WspConns.GetSample(),
+		Webrtc:  stats.RtcConns.GetSample(),
+		Srt:     stats.SrtConns.GetSample(),
 	}
 
 	params := r.URL.Query()
@@ -360,6 +377,7 @@ func (s *Service) onDelRoute(w http.ResponseWriter, r *http.Request, pathParams
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	} else {
+		record.SyncRoutes()
 		w.WriteHeader(http.StatusOK)
 	}
 }
@@ -376,10 +394,135 @@ func (s *Service) onSaveRoute(w http.ResponseWriter, r *http.Request, pathParams
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	} else {
+		record.SyncRoutes()
 		w.WriteHeader(http.StatusOK)
 	}
 }
 
+func (s *Service) onListRecordings(w http.ResponseWriter, r *http.Request, pathParams apirouter.Params) {
+	type recordingList struct {
+		Total      int           `json:"total"`
+		Recordings []record.Info `json:"recordings"`
+	}
+
+	recordings := record.Infos()
+	if err := jsonTo(w, &recordingList{Total: len(recordings), Recordings: recordings}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *Service) onGetRecording(w http.ResponseWriter, r *http.Request, pathParams apirouter.Params) {
+	path := pathParams.ByName("path")
+	info, ok := record.Get(path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err := jsonTo(w, &info); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *Service) onStopRecording(w http.ResponseWriter, r *http.Request, pathParams apirouter.Params) {
+	path := pathParams.ByName("path")
+	if !record.Stop(path) {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Service) onStartRecording(w http.ResponseWriter, r *http.Request, pathParams apirouter.Params) {
+	var req struct {
+		Path string `json:"path"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = record.Start(req.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (s *Service) onGetArchiveUsage(w http.ResponseWriter, r *http.Request, pathParams apirouter.Params) {
+	usage, err := record.GetUsage()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := jsonTo(w, &usage); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *Service) onGetArchive(w http.ResponseWriter, r *http.Request, pathParams apirouter.Params) {
+	type archive struct {
+		record.ArchiveInfo
+		Files []record.Segment `json:"files"`
+	}
+
+	path := pathParams.ByName("path")
+	info, segments, ok := record.GetArchive(path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err := jsonTo(w, &archive{ArchiveInfo: info, Files: segments}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *Service) onListClips(w http.ResponseWriter, r *http.Request, pathParams apirouter.Params) {
+	type clipList struct {
+		Total int               `json:"total"`
+		Clips []record.ClipInfo `json:"clips"`
+	}
+
+	clips := record.Clips()
+	if err := jsonTo(w, &clipList{Total: len(clips), Clips: clips}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *Service) onTriggerClip(w http.ResponseWriter, r *http.Request, pathParams apirouter.Params) {
+	var req struct {
+		Path     string  `json:"path"`
+		Event    string  `json:"event"`
+		PreRoll  float64 `json:"preroll"`  // 秒
+		PostRoll float64 `json:"postroll"` // 秒
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	info, err := record.TriggerClip(req.Path, req.Event,
+		time.Duration(req.PreRoll*float64(time.Second)),
+		time.Duration(req.PostRoll*float64(time.Second)))
+	if err == record.ErrStreamNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := jsonTo(w, &info); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 func (s *Service) onListUsers(w http.ResponseWriter, r *http.Request, pathParams apirouter.Params) {
 	params := r.URL.Query()
 	pageSize, pageToken, err := listParamers(params)
@@ -507,6 +650,12 @@ func listParamers(params url.Values) (pageSize int, pageToken string, err error)
 // ?token=
 func (s *Service) authInterceptor(w http.ResponseWriter, r *http.Request) bool {
 	token := r.URL.Query().Get("token")
+	if token == "" {
+		// WHIP/WHEP 客户端使用 Bearer token
+		if bearer := r.Header.Get("Authorization"); strings.HasPrefix(bearer, "Bearer ") {
+			token = strings.TrimSpace(bearer[len("Bearer "):])
+		}
+	}
 	if token != "" {
 		username := s.tokens.AccessCheck(token)
 		if username != "" {
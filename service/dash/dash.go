@@ -0,0 +1,130 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cnotch/ipchub/av/codec"
+	"github.com/cnotch/ipchub/config"
+	"github.com/cnotch/ipchub/media"
+	"github.com/cnotch/xlog"
+)
+
+func getDashable(path string) media.Dashable {
+	s := media.GetOrCreate(path)
+	if s == nil {
+		return nil
+	}
+	return s.Dashable()
+}
+
+// GetMpd .
+func GetMpd(logger *xlog.Logger, path string, token string, addr string, w http.ResponseWriter) {
+	logger = logger.With(xlog.Fields(
+		xlog.F("path", path), xlog.F("ext", "mpd"),
+		xlog.F("addr", addr)))
+
+	logger.Info("http-dash: access mpd")
+
+	// 需要手动启动,如果需要转换或拉流，很耗时
+	c := getDashable(path)
+
+	if c == nil {
+		logger.Errorf("http-dash: not found stream '%s'", path)
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	// 最多等待完成 30 秒
+	timeout := time.Duration(1.5 * float64(3*config.HlsFragment()) * float64(time.Second))
+	cont, err := c.WaitMpd(token, timeout)
+	if err != nil {
+		logger.Errorf("http-dash: request mpd error, %v.", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Type", "application/dash+xml")
+	w.Header().Set("Content-Length", strconv.Itoa(len(cont)))
+	w.Write(cont)
+
+	if logger.LevelEnabled(xlog.DebugLevel) {
+		logger.Debugf("mpd ===>>>\r\n%s", string(cont))
+	}
+}
+
+// GetVideoSegment 获取视频片段(.m4v)，path 为 <流路径>/<片段编号> 或 <流路径>/init
+func GetVideoSegment(logger *xlog.Logger, path string, addr string, w http.ResponseWriter) {
+	getSegment(logger, path, addr, codec.MediaTypeVideo, w)
+}
+
+// GetAudioSegment 获取音频片段(.m4a)，path 为 <流路径>/<片段编号> 或 <流路径>/init
+func GetAudioSegment(logger *xlog.Logger, path string, addr string, w http.ResponseWriter) {
+	getSegment(logger, path, addr, codec.MediaTypeAudio, w)
+}
+
+func getSegment(logger *xlog.Logger, path string, addr string, mediaType codec.MediaType, w http.ResponseWriter) {
+	ext, contentType := "m4v", "video/mp4"
+	if mediaType == codec.MediaTypeAudio {
+		ext, contentType = "m4a", "audio/mp4"
+	}
+	logger = logger.With(xlog.Fields(
+		xlog.F("path", path), xlog.F("ext", ext),
+		xlog.F("addr", addr)))
+
+	logger.Info("http-dash: access segment")
+
+	i := strings.LastIndex(path, "/")
+	if i < 0 {
+		logger.Errorf("http-dash: path illegal `%s`", path)
+		http.Error(w, "Path illegal", http.StatusBadRequest)
+		return
+	}
+
+	streamPath := path[:i]
+	name := path[i+1:]
+	number := -1
+	if name != "init" {
+		var err error
+		if number, err = strconv.Atoi(name); err != nil || number < 0 {
+			logger.Errorf("http-dash: path illegal `%s`", path)
+			http.Error(w, "Path illegal", http.StatusBadRequest)
+			return
+		}
+	}
+
+	c := getDashable(streamPath)
+	if c == nil {
+		logger.Errorf("http-dash: not found `%s`", path)
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	var reader io.Reader
+	var size int
+	var err error
+	if number < 0 {
+		reader, size, err = c.InitSegment(mediaType)
+	} else {
+		reader, size, err = c.Segment(mediaType, number)
+	}
+	if err != nil {
+		logger.Errorf("http-dash: not found `%s`", path)
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(size))
+	io.Copy(w, reader)
+}
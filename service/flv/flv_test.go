@@ -0,0 +1,124 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package flv
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cnotch/ipchub/av/codec"
+	"github.com/cnotch/ipchub/av/format/flv"
+	"github.com/cnotch/ipchub/media"
+	"github.com/cnotch/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPullStreamFactory_Can(t *testing.T) {
+	f := NewPullStreamFacotry()
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"http://localhost/live/test.flv", true},
+		{"HTTPS://localhost/live/test.FLV?token=1", true},
+		{"http://localhost/live/test.ts", false},
+		{"rtmp://localhost/live/test.flv", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, f.Can(tt.url), tt.url)
+	}
+}
+
+func TestPullHTTPFlv(t *testing.T) {
+	sps, _ := base64.StdEncoding.DecodeString("Z2QAH6zZQFAFuhAAAAMAEAAAAwPI8YMZYA==")
+	pps, _ := base64.StdEncoding.DecodeString("aO+8sA==")
+	video := codec.VideoMeta{Codec: "H264", Sps: sps, Pps: pps}
+	audio := codec.AudioMeta{Codec: "AAC", Sps: []byte{0x12, 0x10}}
+
+	done := make(chan struct{})
+	defer close(done)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/live/test.flv" {
+			http.NotFound(w, r)
+			return
+		}
+
+		writer, _ := flv.NewWriter(w, flv.TypeFlagsVideo|flv.TypeFlagsAudio)
+		vp := flv.NewH264Packetizer(&video, writer)
+		ap := flv.NewAacPacketizer(&audio, writer)
+		vp.PacketizeSequenceHeader()
+		ap.PacketizeSequenceHeader()
+
+		idr := append([]byte{0x65}, bytes.Repeat([]byte{0x88}, 500)...)
+		for dts := int64(0); ; dts += int64(40 * time.Millisecond) {
+			vp.Packetize(&codec.Frame{MediaType: codec.MediaTypeVideo, Dts: dts, Pts: dts, Payload: idr})
+			ap.Packetize(&codec.Frame{MediaType: codec.MediaTypeAudio, Dts: dts, Pts: dts, Payload: []byte{1, 2, 3}})
+			w.(http.Flusher).Flush()
+			select {
+			case <-done:
+				return
+			case <-r.Context().Done():
+				return
+			case <-time.After(40 * time.Millisecond):
+			}
+		}
+	}))
+	defer server.Close()
+
+	stream, err := NewPullStreamFacotry().Create("/live/httpflv", server.URL+"/live/test.flv")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "H264", stream.Video.Codec)
+	assert.Equal(t, "AAC", stream.Audio.Codec)
+	assert.Equal(t, stream, media.Get("/live/httpflv"))
+	media.Unregist(stream)
+
+	_, err = NewPullStreamFacotry().Create("/live/httpflv", server.URL+"/live/none.flv")
+	assert.Error(t, err)
+}
+
+// 只有音频时等待超时后注册流，出现视频后以新的元数据重新注册
+func TestPublisherAudioOnly(t *testing.T) {
+	sps, _ := base64.StdEncoding.DecodeString("Z2QAH6zZQFAFuhAAAAMAEAAAAwPI8YMZYA==")
+	pps, _ := base64.StdEncoding.DecodeString("aO+8sA==")
+	video := codec.VideoMeta{Codec: "H264", Sps: sps, Pps: pps}
+	audio := codec.AudioMeta{Codec: "AAC", Sps: []byte{0x12, 0x10}}
+
+	p := NewPublisher("/live/audioonly", "test", xlog.L())
+	defer p.Close()
+	ap := flv.NewAacPacketizer(&audio, p)
+	ap.PacketizeSequenceHeader()
+
+	var dts int64
+	for ; p.Stream() == nil && dts < int64(5*time.Second); dts += int64(20 * time.Millisecond) {
+		ap.Packetize(&codec.Frame{MediaType: codec.MediaTypeAudio, Dts: dts, Pts: dts, Payload: []byte{1, 2, 3}})
+	}
+	audioOnly := p.Stream()
+	if !assert.NotNil(t, audioOnly) {
+		return
+	}
+	assert.True(t, dts >= int64(metaWaitTimeout))
+	assert.Equal(t, "", audioOnly.Video.Codec)
+	assert.Equal(t, "AAC", audioOnly.Audio.Codec)
+	assert.Equal(t, audioOnly, media.Get("/live/audioonly"))
+	assert.Equal(t, byte(flv.TypeFlagsAudio), audioOnly.FlvTypeFlags())
+
+	// 视频序列头到达后重新注册流
+	vp := flv.NewH264Packetizer(&video, p)
+	vp.PacketizeSequenceHeader()
+	vp.Packetize(&codec.Frame{MediaType: codec.MediaTypeVideo, Dts: dts, Pts: dts, Payload: []byte{0x65, 0x88}})
+	s := p.Stream()
+	if assert.NotNil(t, s) {
+		assert.True(t, audioOnly.IsClosed())
+		assert.Equal(t, "H264", s.Video.Codec)
+		assert.Equal(t, "AAC", s.Audio.Codec)
+		assert.Equal(t, s, media.Get("/live/audioonly"))
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package flv
+
+import (
+	"time"
+
+	"github.com/cnotch/ipchub/av/format/flv"
+	"github.com/cnotch/ipchub/media"
+	"github.com/cnotch/xlog"
+)
+
+// 等待视频元数据的最长时间，超时仍没有视频时只发布音频
+const metaWaitTimeout = time.Second * 2
+
+// Publisher 推流，flv.Tag -> codec.Frame -> media.Stream
+//
+// 流的创建、注册和元数据变化时的替换见 media.FramePublisher。方法不是并发安全的。
+type Publisher struct {
+	*media.FramePublisher
+	demuxer *flv.Demuxer
+}
+
+// NewPublisher 创建 flv 推流，addr 作为流的来源地址属性
+func NewPublisher(path, addr string, logger *xlog.Logger) *Publisher {
+	p := &Publisher{
+		FramePublisher: media.NewFramePublisher("flv", path, addr, metaWaitTimeout, logger),
+	}
+	p.demuxer = flv.NewDemuxer(&p.Video, &p.Audio, p.FramePublisher)
+	p.SetDemuxer(p.demuxer)
+	return p
+}
+
+// WriteFlvTag implements flv.TagWriter
+func (p *Publisher) WriteFlvTag(tag *flv.Tag) error {
+	return p.demuxer.WriteFlvTag(tag)
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package flv
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cnotch/ipchub/av/format/flv"
+	"github.com/cnotch/ipchub/config"
+	"github.com/cnotch/ipchub/media"
+	"github.com/cnotch/ipchub/stats"
+	"github.com/cnotch/xlog"
+)
+
+var errWaitTimeout = errors.New("http-flv: wait for stream timeout")
+
+// 只限制等待响应头的时间，响应体是持续的 flv 流
+var httpClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		ResponseHeaderTimeout: config.NetTimeout(),
+	},
+}
+
+func init() {
+	// 注册拉流工厂
+	media.RegistPullStreamFactory(NewPullStreamFacotry())
+}
+
+type pullStreamFactory struct {
+}
+
+// NewPullStreamFacotry 创建 HTTP-FLV 拉流工厂，远端地址如 http(s)://host/live/test.flv
+func NewPullStreamFacotry() media.PullStreamFactory {
+	return &pullStreamFactory{}
+}
+
+func (f *pullStreamFactory) Can(remoteURL string) bool {
+	u, err := url.Parse(remoteURL)
+	if err != nil {
+		return false
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	return (scheme == "http" || scheme == "https") &&
+		strings.HasSuffix(strings.ToLower(u.Path), ".flv")
+}
+
+func (f *pullStreamFactory) Create(localPath, remoteURL string) (*media.Stream, error) {
+	resp, err := httpClient.Get(remoteURL)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("http-flv: http status '%s'", resp.Status)
+	}
+
+	logger := xlog.L().With(xlog.Fields(
+		xlog.F("path", localPath), xlog.F("rurl", remoteURL),
+		xlog.F("type", "puller")))
+	p := NewPublisher(localPath, resp.Request.URL.Host, logger)
+
+	// 等待流就绪，超时关闭连接
+	timer := time.AfterFunc(config.NetTimeout(), func() { resp.Body.Close() })
+	r, err := flv.NewReader(bufio.NewReaderSize(resp.Body, config.NetBufferSize()))
+	for err == nil && p.Stream() == nil {
+		var tag *flv.Tag
+		if tag, err = r.ReadFlvTag(); err == nil {
+			err = p.WriteFlvTag(tag)
+		}
+	}
+	if !timer.Stop() { // 超时已关闭连接
+		err = errWaitTimeout
+	}
+	if err != nil {
+		p.Close()
+		resp.Body.Close()
+		return nil, err
+	}
+
+	stats.FlvConns.Add()
+	stream := p.Stream()
+	go func() {
+		defer stats.FlvConns.Release()
+
+		var err error
+		for err == nil {
+			var tag *flv.Tag
+			if tag, err = r.ReadFlvTag(); err == nil {
+				err = p.WriteFlvTag(tag)
+			}
+		}
+		p.Close()
+		resp.Body.Close()
+		if err != io.EOF {
+			logger.Errorf("http-flv: pull stopped; %v", err)
+		}
+		logger.Info("http-flv: puller closed")
+	}()
+	return stream, nil
+}
@@ -11,25 +11,36 @@ import (
 	"strings"
 	"time"
 
+	avhls "github.com/cnotch/ipchub/av/format/hls"
 	"github.com/cnotch/ipchub/config"
 	"github.com/cnotch/ipchub/media"
 	"github.com/cnotch/xlog"
 )
 
+// 获取流的 hls 能力，fmp4 为 true 时获取 CMAF 格式
+func getHlsable(path string, fmp4 bool) media.Hlsable {
+	s := media.GetOrCreate(path)
+	if s == nil {
+		return nil
+	}
+	if fmp4 {
+		return s.Fmp4Hlsable()
+	}
+	return s.Hlsable()
+}
+
 // GetM3u8 .
-func GetM3u8(logger *xlog.Logger, path string, token string, addr string, w http.ResponseWriter) {
+// fmp4 为 true 时返回 fmp4(CMAF) 片段的播放列表；
+// msn、part 为 LL-HLS 阻塞请求参数 _HLS_msn、_HLS_part，没有时为 -1
+func GetM3u8(logger *xlog.Logger, path string, token string, fmp4 bool, msn, part int, addr string, w http.ResponseWriter) {
 	logger = logger.With(xlog.Fields(
 		xlog.F("path", path), xlog.F("ext", "m3u8"),
-		xlog.F("addr", addr)))
+		xlog.F("fmp4", fmp4), xlog.F("addr", addr)))
 
 	logger.Info("http-hls: access playlist")
 
 	// 需要手动启动,如果需要转换或拉流，很耗时
-	var c media.Hlsable
-	s := media.GetOrCreate(path)
-	if s != nil {
-		c = s.Hlsable()
-	}
+	c := getHlsable(path, fmp4)
 
 	if c == nil {
 		logger.Errorf("http-hls: not found stream '%s'", path)
@@ -37,23 +48,20 @@ func GetM3u8(logger *xlog.Logger, path string, token string, addr string, w http
 		return
 	}
 
-	var err error
-	var cont []byte
-
-	// 最多等待完成 30 秒
-	waitSeconds := int(1.5 * float64(3*config.HlsFragment()))
-	for i := 0; i < waitSeconds; i++ {
-		cont, err = c.M3u8(token)
-		if err == nil {
-			break
-		}
-
-		<-time.After(time.Second)
+	// 最多等待完成 30 秒；阻塞请求最多等待 3 倍片段时长
+	timeout := time.Duration(1.5 * float64(3*config.HlsFragment()) * float64(time.Second))
+	if msn >= 0 {
+		timeout = time.Duration(3*config.HlsFragment()) * time.Second
 	}
+	cont, err := c.WaitM3u8(token, msn, part, timeout)
 
 	if err != nil {
 		logger.Errorf("http-hls: request playlist error, %v.", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		status := http.StatusBadRequest
+		if msn >= 0 && err == avhls.ErrPlaylistTimeout {
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, err.Error(), status)
 		return
 	}
 
@@ -70,8 +78,55 @@ func GetM3u8(logger *xlog.Logger, path string, token string, addr string, w http
 
 // GetTS .
 func GetTS(logger *xlog.Logger, path string, addr string, w http.ResponseWriter) {
+	getSegment(logger, path, addr, false, w)
+}
+
+// GetM4s 获取 fmp4(CMAF) 片段
+func GetM4s(logger *xlog.Logger, path string, addr string, w http.ResponseWriter) {
+	getSegment(logger, path, addr, true, w)
+}
+
+// GetInitSegment 获取 fmp4(CMAF) 的初始化片段，path 为 <流路径>/init
+func GetInitSegment(logger *xlog.Logger, path string, addr string, w http.ResponseWriter) {
 	logger = logger.With(xlog.Fields(
-		xlog.F("path", path), xlog.F("ext", "ts"),
+		xlog.F("path", path), xlog.F("ext", "mp4"),
+		xlog.F("addr", addr)))
+
+	logger.Info("http-hls: access init segment")
+
+	if !strings.HasSuffix(path, "/init") {
+		logger.Errorf("http-hls: path illegal `%s`", path)
+		http.Error(w, "Path illegal", http.StatusBadRequest)
+		return
+	}
+
+	c := getHlsable(path[:len(path)-len("/init")], true)
+	if c == nil {
+		logger.Errorf("http-hls: not found `%s`", path)
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	reader, size, err := c.InitSegment()
+	if err != nil {
+		logger.Errorf("http-hls: not found `%s`", path)
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Content-Length", strconv.Itoa(size))
+	io.Copy(w, reader)
+}
+
+func getSegment(logger *xlog.Logger, path string, addr string, fmp4 bool, w http.ResponseWriter) {
+	ext, contentType := "ts", "video/mp2ts"
+	if fmp4 {
+		ext, contentType = "m4s", "video/mp4"
+	}
+	logger = logger.With(xlog.Fields(
+		xlog.F("path", path), xlog.F("ext", ext),
 		xlog.F("addr", addr)))
 
 	logger.Info("http-hls: access segment file")
@@ -83,8 +138,19 @@ func GetTS(logger *xlog.Logger, path string, addr string, w http.ResponseWriter)
 		return
 	}
 
+	// <seq> 或 LL-HLS 部分片段 <seq>.<part>
 	streamPath := path[:i]
 	seqStr := path[i+1:]
+	partIndex := -1
+	var err error
+	if j := strings.IndexByte(seqStr, '.'); j >= 0 {
+		if partIndex, err = strconv.Atoi(seqStr[j+1:]); err != nil || partIndex < 0 {
+			logger.Errorf("http-hls: path illegal `%s`", path)
+			http.Error(w, "Path illegal", http.StatusBadRequest)
+			return
+		}
+		seqStr = seqStr[:j]
+	}
 	seq, err := strconv.Atoi(seqStr)
 	if err != nil {
 		logger.Errorf("http-hls: path illegal `%s`", path)
@@ -93,19 +159,20 @@ func GetTS(logger *xlog.Logger, path string, addr string, w http.ResponseWriter)
 	}
 
 	// 查找的消费者但不创建
-	var c media.Hlsable
-	s := media.GetOrCreate(streamPath)
-	if s != nil {
-		c = s.Hlsable()
-	}
-
+	c := getHlsable(streamPath, fmp4)
 	if c == nil {
 		logger.Errorf("http-hls: not found `%s`", path)
 		http.Error(w, "404 page not found", http.StatusNotFound)
 		return
 	}
 
-	reader, size, err := c.Segment(seq)
+	var reader io.Reader
+	var size int
+	if partIndex >= 0 {
+		reader, size, err = c.Part(seq, partIndex)
+	} else {
+		reader, size, err = c.Segment(seq)
+	}
 	if err != nil {
 		logger.Errorf("http-hls: not found `%s`", path)
 		http.Error(w, "404 page not found", http.StatusNotFound)
@@ -118,7 +185,7 @@ func GetTS(logger *xlog.Logger, path string, addr string, w http.ResponseWriter)
 	}()
 
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Content-Type", "video/mp2ts")
+	w.Header().Set("Content-Type", contentType)
 	w.Header().Set("Content-Length", strconv.Itoa(size))
 	io.Copy(w, reader)
 }
@@ -0,0 +1,128 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package hls
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cnotch/ipchub/av/codec"
+	"github.com/cnotch/ipchub/av/format/mpegts"
+	"github.com/cnotch/ipchub/media"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPullStreamFactory_Can(t *testing.T) {
+	f := NewPullStreamFacotry()
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"http://localhost/live/test.m3u8", true},
+		{"HTTPS://localhost/live/test.M3U8?token=1", true},
+		{"http://localhost/live/test.ts", false},
+		{"rtsp://localhost/live/test.m3u8", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, f.Can(tt.url), tt.url)
+	}
+}
+
+// 每个片段 1 秒，第 3 个片段开始时间戳不连续
+func testSegment(seq int64) []byte {
+	sps, _ := base64.StdEncoding.DecodeString("Z2QAH6zZQFAFuhAAAAMAEAAAAwPI8YMZYA==")
+	pps, _ := base64.StdEncoding.DecodeString("aO+8sA==")
+	video := codec.VideoMeta{Codec: "H264", Sps: sps, Pps: pps}
+	idr := append([]byte{0x65}, bytes.Repeat([]byte{0x88}, 500)...)
+
+	start := seq * int64(time.Second)
+	if seq >= 3 {
+		start += 100 * int64(time.Second)
+	}
+	var buf bytes.Buffer
+	writer, _ := mpegts.NewWriter(&buf, mpegts.StreamTypeH264)
+	vp := mpegts.NewH264Packetizer(&video, writer)
+	for i := int64(0); i < 25; i++ {
+		payload := []byte{0x41, byte(i)}
+		if i == 0 {
+			payload = idr
+		}
+		dts := start + i*int64(40*time.Millisecond)
+		vp.Packetize(&codec.Frame{MediaType: codec.MediaTypeVideo, Dts: dts, Pts: dts, Payload: payload})
+	}
+	return buf.Bytes()
+}
+
+func TestPullHLS(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/live/master.m3u8":
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=100000\nlow/index.m3u8\n"+
+				"#EXT-X-STREAM-INF:BANDWIDTH=500000\nhigh/index.m3u8\n")
+		case r.URL.Path == "/live/high/index.m3u8":
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-MEDIA-SEQUENCE:1\n"+
+				"#EXTINF:1,\n1.ts\n#EXTINF:1,\n2.ts\n#EXT-X-DISCONTINUITY\n#EXTINF:1,\n3.ts\n#EXTINF:1,\n4.ts\n")
+		case strings.HasPrefix(r.URL.Path, "/live/high/") && strings.HasSuffix(r.URL.Path, ".ts"):
+			var seq int64
+			fmt.Sscanf(r.URL.Path, "/live/high/%d.ts", &seq)
+			w.Write(testSegment(seq))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	stream, err := NewPullStreamFacotry().Create("/live/hlspull", server.URL+"/live/master.m3u8")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "H264", stream.Video.Codec)
+	assert.Equal(t, "", stream.Audio.Codec)
+	assert.Equal(t, stream, media.Get("/live/hlspull"))
+	media.Unregist(stream)
+
+	_, err = NewPullStreamFacotry().Create("/live/hlspull", server.URL+"/live/none.m3u8")
+	assert.Error(t, err)
+}
+
+func TestPullHLSVod(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/vod/index.m3u8":
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-PLAYLIST-TYPE:VOD\n"+
+				"#EXTINF:1,\n0.ts\n#EXTINF:1,\n1.ts\n#EXTINF:1,\n2.ts\n#EXTINF:1,\n3.ts\n#EXTINF:1,\n4.ts\n"+
+				"#EXT-X-ENDLIST\n")
+		case strings.HasSuffix(r.URL.Path, ".ts"):
+			var seq int64
+			fmt.Sscanf(r.URL.Path, "/vod/%d.ts", &seq)
+			w.Write(testSegment(seq))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	// 第一个片段使流就绪后立即返回，不等待点播结束
+	begin := time.Now()
+	stream, err := NewPullStreamFacotry().Create("/live/hlsvod", server.URL+"/vod/index.m3u8")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, time.Since(begin) < time.Second)
+	assert.False(t, stream.IsClosed())
+
+	// 全部片段按时长拉取完成后流正常结束
+	for i := 0; i < 50 && !stream.IsClosed(); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.True(t, stream.IsClosed())
+	assert.True(t, time.Since(begin) >= time.Second)
+}
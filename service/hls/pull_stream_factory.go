@@ -0,0 +1,287 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package hls
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	avhls "github.com/cnotch/ipchub/av/format/hls"
+	"github.com/cnotch/ipchub/config"
+	"github.com/cnotch/ipchub/media"
+	"github.com/cnotch/ipchub/service/ts"
+	"github.com/cnotch/xlog"
+)
+
+// 直播从倒数第几个片段开始拉取
+const liveStartSegments = 3
+
+// 播放列表的最大长度
+const maxPlaylistSize = 1024 * 1024
+
+var (
+	errWaitTimeout     = errors.New("hls: wait for stream timeout")
+	errNotUpdated      = errors.New("hls: playlist is not updated")
+	errEncrypted       = errors.New("hls: encrypted segments are not supported")
+	errFmp4Unsupported = errors.New("hls: fmp4 segments are not supported")
+)
+
+var httpClient = &http.Client{Timeout: config.NetTimeout()}
+
+func init() {
+	// 注册拉流工厂
+	media.RegistPullStreamFactory(NewPullStreamFacotry())
+}
+
+type pullStreamFactory struct {
+}
+
+// NewPullStreamFacotry 创建 HLS 拉流工厂，远端地址如 http(s)://host/live/test.m3u8；
+// 主播放列表时选择码率最高的码流，只支持 ts 片段
+func NewPullStreamFacotry() media.PullStreamFactory {
+	return &pullStreamFactory{}
+}
+
+func (f *pullStreamFactory) Can(remoteURL string) bool {
+	u, err := url.Parse(remoteURL)
+	if err != nil {
+		return false
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	return (scheme == "http" || scheme == "https") &&
+		strings.HasSuffix(strings.ToLower(u.Path), ".m3u8")
+}
+
+func (f *pullStreamFactory) Create(localPath, remoteURL string) (*media.Stream, error) {
+	u, err := url.Parse(remoteURL)
+	if err != nil {
+		return nil, err
+	}
+
+	logger := xlog.L().With(xlog.Fields(
+		xlog.F("path", localPath), xlog.F("rurl", remoteURL),
+		xlog.F("type", "puller")))
+	p := &puller{
+		url:       u,
+		logger:    logger,
+		publisher: ts.NewPublisher(localPath, u.Host, logger),
+		nextSeq:   -1,
+		ready:     make(chan error, 1),
+		closed:    make(chan struct{}),
+	}
+
+	// 在后台拉流，第一个片段使流就绪后返回；点播列表不必等待全部片段
+	go p.run()
+	select {
+	case err = <-p.ready:
+	case <-time.After(config.NetTimeout()):
+		err = errWaitTimeout
+	}
+	if err != nil {
+		close(p.closed)
+		return nil, err
+	}
+	return p.publisher.Stream(), nil
+}
+
+// puller 轮询远端播放列表，按序下载 ts 片段写入流
+type puller struct {
+	url        *url.URL // 媒体播放列表地址
+	logger     *xlog.Logger
+	publisher  *ts.Publisher
+	nextSeq    int           // 下一个要下载的片段序号，-1 表示未开始
+	lastUpdate time.Time     // 最近一次获得新片段的时间
+	start      time.Time     // 开始下载片段的时间，用于控制速度
+	pulled     time.Duration // 已下载片段的总时长
+	ready      chan error    // 流就绪或就绪前失败时通知 Create，之后置为 nil
+	closed     chan struct{} // Create 放弃等待时关闭
+}
+
+func (p *puller) run() {
+	var err error
+	defer func() {
+		p.publisher.Close()
+		if p.ready != nil { // 流就绪前结束
+			if err == nil || err == io.EOF {
+				err = errWaitTimeout
+			}
+			p.ready <- err
+		}
+		p.logger.Info("hls: puller closed")
+	}()
+
+	for {
+		var wait time.Duration
+		if wait, err = p.pull(); err != nil {
+			// 点播列表(EXT-X-ENDLIST)全部片段拉取完成是正常结束
+			if err != io.EOF {
+				p.logger.Errorf("hls: pull stopped; %v", err)
+			}
+			return
+		}
+		if !p.sleep(wait) {
+			return
+		}
+	}
+}
+
+// 等待 d 时长，Create 放弃等待时返回 false
+func (p *puller) sleep(d time.Duration) bool {
+	select {
+	case <-p.closed:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// 获取播放列表并下载新的片段，返回下次获取播放列表前的等待时间
+func (p *puller) pull() (time.Duration, error) {
+	m, base, err := fetchPlaylist(p.url)
+	if err != nil {
+		return 0, err
+	}
+	if m.IsMaster() {
+		v := selectVariant(m.Variants)
+		ref, err := url.Parse(v.URI)
+		if err != nil {
+			return 0, err
+		}
+		p.url = base.ResolveReference(ref)
+		p.logger.Infof("hls: select variant '%s', bandwidth = %d", p.url, v.Bandwidth)
+		if m, base, err = fetchPlaylist(p.url); err != nil {
+			return 0, err
+		}
+		if m.IsMaster() {
+			return 0, fmt.Errorf("hls: variant '%s' is not a media playlist", p.url)
+		}
+	}
+	if m.Encrypted {
+		return 0, errEncrypted
+	}
+	if m.MapURI != "" {
+		return 0, errFmp4Unsupported
+	}
+
+	targetDuration := time.Duration(m.TargetDuration * float64(time.Second))
+	if targetDuration <= 0 {
+		targetDuration = time.Second
+	}
+	if p.nextSeq < 0 {
+		p.lastUpdate = time.Now()
+		if len(m.Segments) == 0 {
+			return targetDuration, nil
+		}
+		start := 0
+		if !m.EndList && len(m.Segments) > liveStartSegments {
+			start = len(m.Segments) - liveStartSegments
+		}
+		p.nextSeq = m.Segments[start].Sequence
+		p.start = time.Now()
+	}
+
+	updated := false
+	for _, seg := range m.Segments {
+		// 缺失的片段不下载，之后的片段按丢失片段重新计算时间戳
+		if seg.Sequence < p.nextSeq || seg.Gap {
+			continue
+		}
+
+		// 不连续或丢失片段时，重新计算时间戳
+		if seg.Sequence > p.nextSeq {
+			p.logger.Warnf("hls: segments %d-%d lost", p.nextSeq, seg.Sequence-1)
+		}
+		if seg.Discontinuity || seg.Sequence > p.nextSeq {
+			if err = p.publisher.Discontinue(); err != nil {
+				return 0, err
+			}
+		}
+
+		// 最多提前下载 3 个片段时长的数据，避免点播列表过快写入
+		if ahead := p.pulled - time.Since(p.start); ahead > 3*targetDuration {
+			if !p.sleep(ahead - 3*targetDuration) {
+				return 0, io.EOF
+			}
+		}
+		if err = p.pullSegment(base, &seg); err != nil {
+			return 0, err
+		}
+		p.nextSeq = seg.Sequence + 1
+		p.pulled += time.Duration(seg.Duration * float64(time.Second))
+		updated = true
+
+		if p.ready != nil && p.publisher.Stream() != nil {
+			p.ready <- nil
+			p.ready = nil
+		}
+	}
+
+	if m.EndList {
+		return 0, io.EOF
+	}
+	if updated {
+		p.lastUpdate = time.Now()
+		return targetDuration, nil
+	}
+	if time.Since(p.lastUpdate) > config.NetTimeout()+3*targetDuration {
+		return 0, errNotUpdated
+	}
+	// 播放列表未变化时，等待半个目标时长
+	return targetDuration / 2, nil
+}
+
+func (p *puller) pullSegment(base *url.URL, seg *avhls.MediaSegment) error {
+	ref, err := url.Parse(seg.URI)
+	if err != nil {
+		return err
+	}
+
+	resp, err := httpClient.Get(base.ResolveReference(ref).String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("hls: get segment '%s' status '%s'", seg.URI, resp.Status)
+	}
+	_, err = io.Copy(p.publisher, resp.Body)
+	return err
+}
+
+// 获取并解析播放列表，返回重定向后的地址作为片段地址的基准
+func fetchPlaylist(u *url.URL) (*avhls.M3u8, *url.URL, error) {
+	resp, err := httpClient.Get(u.String())
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("hls: get playlist status '%s'", resp.Status)
+	}
+	m, err := avhls.ParseM3u8(io.LimitReader(resp.Body, maxPlaylistSize))
+	if err != nil {
+		return nil, nil, err
+	}
+	return m, resp.Request.URL, nil
+}
+
+// 选择码率最高的码流
+func selectVariant(variants []avhls.Variant) *avhls.Variant {
+	v := &variants[0]
+	for i := range variants {
+		if variants[i].Bandwidth > v.Bandwidth {
+			v = &variants[i]
+		}
+	}
+	return v
+}
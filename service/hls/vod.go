@@ -0,0 +1,79 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package hls
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	avhls "github.com/cnotch/ipchub/av/format/hls"
+	"github.com/cnotch/ipchub/record"
+	"github.com/cnotch/xlog"
+)
+
+// GetVodM3u8 返回流 path 在 [start,end) 时间范围内归档 TS 片段的 VOD 播放列表
+func GetVodM3u8(logger *xlog.Logger, path string, token string, start, end time.Time, addr string, w http.ResponseWriter) {
+	logger = logger.With(xlog.Fields(
+		xlog.F("path", path), xlog.F("ext", "m3u8"),
+		xlog.F("vod", true), xlog.F("addr", addr)))
+
+	logger.Infof("http-hls: access vod playlist from %s to %s",
+		start.Format(time.RFC3339), end.Format(time.RFC3339))
+
+	segs := record.TsSegments(path, start, end)
+	if len(segs) == 0 {
+		logger.Errorf("http-hls: not found archived segments of '%s'", path)
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	vsegs := make([]avhls.VodSegment, len(segs))
+	for i := range segs {
+		uri := "/streams" + path + ".ts?seg=" + strconv.FormatInt(segs[i].Start.UnixNano(), 10)
+		if len(token) > 0 {
+			uri += "&token=" + token
+		}
+		vsegs[i] = avhls.VodSegment{
+			URI:           uri,
+			Duration:      segs[i].Duration,
+			Start:         segs[i].Start,
+			Discontinuity: segs[i].Discontinuity,
+		}
+	}
+	cont := avhls.VodM3u8(vsegs)
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/x-mpegURL")
+	w.Header().Set("Content-Length", strconv.Itoa(len(cont)))
+	w.Write(cont)
+
+	if logger.LevelEnabled(xlog.DebugLevel) {
+		logger.Debugf("m3u8 ===>>>\r\n%s", string(cont))
+	}
+}
+
+// GetVodTS 获取流 path 归档中在 start 时刻开始的 TS 片段
+func GetVodTS(logger *xlog.Logger, path string, start time.Time, addr string, w http.ResponseWriter) {
+	logger = logger.With(xlog.Fields(
+		xlog.F("path", path), xlog.F("ext", "ts"),
+		xlog.F("vod", true), xlog.F("addr", addr)))
+
+	logger.Info("http-hls: access vod segment file")
+
+	f, size, err := record.OpenTsSegment(path, start)
+	if err != nil {
+		logger.Errorf("http-hls: not found vod segment of '%s'; %s", path, err.Error())
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "video/mp2ts")
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	io.Copy(w, f)
+}
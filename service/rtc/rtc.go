@@ -0,0 +1,192 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package rtc
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cnotch/ipchub/config"
+	"github.com/pion/webrtc/v3"
+)
+
+// 最大的 SDP 大小
+const maxSdpSize = 64 * 1024
+
+// 等待 ICE 候选收集完成的最长时间
+const gatheringTimeout = 5 * time.Second
+
+var (
+	whepOnce sync.Once
+	whepAPI  *webrtc.API
+	whipOnce sync.Once
+	whipAPI  *webrtc.API
+
+	// 活动的会话，用于 DELETE 请求结束会话；WHEP、WHIP 分开保存
+	whepSessions sync.Map
+	whipSessions sync.Map
+)
+
+// 获取 WHEP 的 webrtc API，支持默认的编码
+func getWhepAPI() *webrtc.API {
+	whepOnce.Do(func() {
+		m := &webrtc.MediaEngine{}
+		if err := m.RegisterDefaultCodecs(); err != nil {
+			panic(err)
+		}
+		whepAPI = newAPI(m)
+	})
+	return whepAPI
+}
+
+// 获取 WHIP 的 webrtc API，只接收 H264 和 Opus，使推送的流可以被其他协议播放
+func getWhipAPI() *webrtc.API {
+	whipOnce.Do(func() {
+		m := &webrtc.MediaEngine{}
+		videoRTCPFeedback := []webrtc.RTCPFeedback{{Type: "nack"}, {Type: "nack", Parameter: "pli"}}
+		for i, fmtp := range []string{
+			"level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
+			"level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f",
+		} {
+			if err := m.RegisterCodec(webrtc.RTPCodecParameters{
+				RTPCodecCapability: webrtc.RTPCodecCapability{
+					MimeType:     webrtc.MimeTypeH264,
+					ClockRate:    90000,
+					SDPFmtpLine:  fmtp,
+					RTCPFeedback: videoRTCPFeedback,
+				},
+				PayloadType: webrtc.PayloadType(102 + i*2),
+			}, webrtc.RTPCodecTypeVideo); err != nil {
+				panic(err)
+			}
+		}
+		if err := m.RegisterCodec(webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:    webrtc.MimeTypeOpus,
+				ClockRate:   48000,
+				Channels:    2,
+				SDPFmtpLine: "minptime=10;useinbandfec=1",
+			},
+			PayloadType: 111,
+		}, webrtc.RTPCodecTypeAudio); err != nil {
+			panic(err)
+		}
+		whipAPI = newAPI(m)
+	})
+	return whipAPI
+}
+
+// 服务端使用 ICE-lite，并在应答中给出全部候选
+func newAPI(m *webrtc.MediaEngine) *webrtc.API {
+	se := webrtc.SettingEngine{}
+	se.SetLite(true)
+	if ips := config.WebrtcIPs(); len(ips) > 0 {
+		se.SetNAT1To1IPs(ips, webrtc.ICECandidateTypeHost)
+	}
+	if min, max := config.WebrtcPortRange(); max > 0 {
+		se.SetEphemeralUDPPortRange(min, max)
+	}
+	return webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithSettingEngine(se))
+}
+
+// 会话接口
+type session interface {
+	io.Closer
+	// Path 会话所属流的路径
+	Path() string
+}
+
+func newSessionID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// 读取请求中的 SDP
+func readSdp(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/sdp") {
+		http.Error(w, "Content-Type must be application/sdp", http.StatusUnsupportedMediaType)
+		return "", false
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxSdpSize))
+	if err != nil || len(body) == 0 {
+		http.Error(w, "SDP offer illegal", http.StatusBadRequest)
+		return "", false
+	}
+	return string(body), true
+}
+
+// 设置远端的 offer 并生成包含全部候选的 answer
+func answer(pc *webrtc.PeerConnection, offer string) (string, error) {
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  offer,
+	}); err != nil {
+		return "", err
+	}
+
+	desc, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return "", err
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err = pc.SetLocalDescription(desc); err != nil {
+		return "", err
+	}
+
+	select {
+	case <-gatherComplete:
+	case <-time.After(gatheringTimeout):
+	}
+	return pc.LocalDescription().SDP, nil
+}
+
+// 写入 201 应答，Location 为会话资源地址
+func writeAnswer(w http.ResponseWriter, r *http.Request, id string, sdp string) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Expose-Headers", "Location")
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", r.URL.Path+"?session="+id)
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, sdp)
+}
+
+// 处理 OPTIONS、DELETE 等非 POST 请求，返回是否已处理；
+// DELETE 只结束 sessions 中属于 path 流的会话，权限验证与 POST 相同
+func serveResource(w http.ResponseWriter, r *http.Request, sessions *sync.Map, path string) bool {
+	switch r.Method {
+	case http.MethodPost:
+		return false
+	case http.MethodOptions:
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+		w.Header().Set("Accept-Post", "application/sdp")
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		id := r.URL.Query().Get("session")
+		s, ok := sessions.Load(id)
+		if !ok || s.(session).Path() != path {
+			http.Error(w, "404 session not found", http.StatusNotFound)
+			break
+		}
+		s.(session).Close()
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.WriteHeader(http.StatusOK)
+	default:
+		// ICE-lite 在应答中给出全部候选，不支持 trickle ICE(PATCH)
+		w.Header().Set("Allow", "POST, DELETE, OPTIONS")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+	return true
+}
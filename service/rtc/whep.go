@@ -0,0 +1,300 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package rtc
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cnotch/ipchub/av/codec"
+	"github.com/cnotch/ipchub/av/codec/h264"
+	"github.com/cnotch/ipchub/av/format/rtp"
+	"github.com/cnotch/ipchub/media"
+	"github.com/cnotch/ipchub/stats"
+	"github.com/cnotch/xlog"
+	pionrtp "github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// whepSession WHEP 播放会话，将流的 rtp.Packet 直接转发给浏览器
+type whepSession struct {
+	id     string
+	addr   string
+	logger *xlog.Logger
+	stream *media.Stream
+	pc     *webrtc.PeerConnection
+	video  *webrtc.TrackLocalStaticRTP
+	audio  *webrtc.TrackLocalStaticRTP // 音频编码浏览器不支持时为 nil
+
+	stapA       []byte // SPS、PPS 组成的 STAP-A 载荷
+	started     bool   // 是否已收到第一个关键帧
+	paramsTs    uint32 // 最近发送参数集的时间戳
+	hasParamsTs bool
+	seqOffset   uint16 // 插入参数集包后的序号偏移
+
+	l      sync.Mutex
+	cid    media.CID
+	closed int32
+}
+
+// ServeWHEP 处理 WHEP(WebRTC-HTTP Egress Protocol) 请求；
+// POST 提交 SDP offer 创建会话，DELETE 结束会话
+func ServeWHEP(logger *xlog.Logger, path string, w http.ResponseWriter, r *http.Request) {
+	if serveResource(w, r, &whepSessions, path) {
+		return
+	}
+
+	logger = logger.With(xlog.Fields(
+		xlog.F("path", path), xlog.F("ext", "whep"),
+		xlog.F("addr", r.RemoteAddr)))
+
+	offer, ok := readSdp(w, r)
+	if !ok {
+		logger.Error("whep: request sdp illegal")
+		return
+	}
+
+	stream := media.GetOrCreate(path)
+	if stream == nil {
+		logger.Errorf("whep: not found stream '%s'", path)
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	if stream.Video.Codec != "H264" {
+		logger.Errorf("whep: unsupport video codec '%s'", stream.Video.Codec)
+		http.Error(w, "stream codec not supported by webrtc", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	s, err := newWhepSession(logger, stream, r.RemoteAddr)
+	if err != nil {
+		logger.Errorf("whep: create peer connection failed; %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sdp, err := answer(s.pc, offer)
+	if err != nil {
+		logger.Errorf("whep: negotiate failed; %v", err)
+		s.Close()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	whepSessions.Store(s.id, s)
+	writeAnswer(w, r, s.id, sdp)
+	logger.Info("whep: session created")
+}
+
+func newWhepSession(logger *xlog.Logger, stream *media.Stream, addr string) (s *whepSession, err error) {
+	pc, err := getWhepAPI().NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return
+	}
+
+	s = &whepSession{
+		id:     newSessionID(),
+		addr:   addr,
+		logger: logger,
+		stream: stream,
+		pc:     pc,
+		stapA:  stapA(stream.Video.Sps, stream.Video.Pps),
+	}
+	stats.RtcConns.Add()
+
+	if s.video, err = s.addTrack(webrtc.RTPCodecCapability{
+		MimeType:  webrtc.MimeTypeH264,
+		ClockRate: 90000,
+	}, "video"); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	if capability, ok := audioCapability(&stream.Audio); ok {
+		if s.audio, err = s.addTrack(capability, "audio"); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+
+	pc.OnConnectionStateChange(s.onConnectionStateChange)
+	return
+}
+
+func (s *whepSession) addTrack(capability webrtc.RTPCodecCapability, id string) (*webrtc.TrackLocalStaticRTP, error) {
+	track, err := webrtc.NewTrackLocalStaticRTP(capability, id, "ipchub")
+	if err != nil {
+		return nil, err
+	}
+
+	sender, err := s.pc.AddTrack(track)
+	if err != nil {
+		return nil, err
+	}
+
+	// 读取并丢弃 RTCP
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			if _, _, err := sender.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	return track, nil
+}
+
+// 浏览器支持的音频直接转发，其他(如 AAC)不输出音频
+func audioCapability(audio *codec.AudioMeta) (webrtc.RTPCodecCapability, bool) {
+	switch strings.ToUpper(audio.Codec) {
+	case "OPUS":
+		return webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, true
+	case "PCMA":
+		return webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMA, ClockRate: 8000}, true
+	case "PCMU":
+		return webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: 8000}, true
+	}
+	return webrtc.RTPCodecCapability{}, false
+}
+
+func (s *whepSession) onConnectionStateChange(state webrtc.PeerConnectionState) {
+	s.logger.Infof("whep: connection state changed to %s", state.String())
+	switch state {
+	case webrtc.PeerConnectionStateConnected:
+		s.l.Lock()
+		if s.cid == 0 && atomic.LoadInt32(&s.closed) == 0 {
+			s.cid = s.stream.StartConsume(s, media.RTPPacket, "net=webrtc-whep,"+s.addr)
+		}
+		s.l.Unlock()
+	case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+		s.Close()
+	}
+}
+
+// Consume implements media.Consumer
+func (s *whepSession) Consume(pack media.Pack) {
+	if atomic.LoadInt32(&s.closed) != 0 {
+		return
+	}
+
+	p := pack.(*rtp.Packet)
+	var err error
+	switch p.Channel {
+	case rtp.ChannelVideo:
+		err = s.writeVideo(p)
+	case rtp.ChannelAudio:
+		if s.audio != nil {
+			err = s.audio.WriteRTP(&pionrtp.Packet{Header: p.Header, Payload: p.Payload()})
+		}
+	}
+
+	if err != nil {
+		s.logger.Errorf("whep: send rtp failed; %v", err)
+		s.Close()
+	}
+}
+
+// 从关键帧开始转发；关键帧前没有参数集时，插入 SPS、PPS 组成的 STAP-A 包
+func (s *whepSession) writeVideo(p *rtp.Packet) error {
+	payload := p.Payload()
+	if len(payload) == 0 {
+		return nil
+	}
+
+	idr, params := inspectH264(payload)
+	if !s.started {
+		if !idr && !params {
+			return nil // 等待关键帧
+		}
+		s.started = true
+	}
+
+	if params {
+		s.paramsTs, s.hasParamsTs = p.Timestamp, true
+	}
+
+	if idr && len(s.stapA) > 0 && !(s.hasParamsTs && s.paramsTs == p.Timestamp) {
+		stap := &pionrtp.Packet{Header: p.Header, Payload: s.stapA}
+		stap.Marker = false
+		stap.SequenceNumber += s.seqOffset
+		s.seqOffset++
+		s.paramsTs, s.hasParamsTs = p.Timestamp, true
+		if err := s.video.WriteRTP(stap); err != nil {
+			return err
+		}
+	}
+
+	packet := &pionrtp.Packet{Header: p.Header, Payload: payload}
+	packet.SequenceNumber += s.seqOffset
+	return s.video.WriteRTP(packet)
+}
+
+// 检测 H264 RTP 载荷是否包含 IDR 的开始和参数集
+func inspectH264(payload []byte) (idr, params bool) {
+	switch payload[0] & h264.NalTypeBitmask {
+	case h264.NalIdrSlice:
+		idr = true
+	case h264.NalSps, h264.NalPps:
+		params = true
+	case h264.NalStapaInRtp:
+		for i := 1; i+2 < len(payload); {
+			size := int(payload[i])<<8 | int(payload[i+1])
+			switch payload[i+2] & h264.NalTypeBitmask {
+			case h264.NalIdrSlice:
+				idr = true
+			case h264.NalSps, h264.NalPps:
+				params = true
+			}
+			i += 2 + size
+		}
+	case h264.NalFuAInRtp:
+		// FU header 的 S 位表示分片开始
+		idr = len(payload) > 1 && payload[1]&0x80 != 0 &&
+			payload[1]&h264.NalTypeBitmask == h264.NalIdrSlice
+	}
+	return
+}
+
+// SPS、PPS 组成的 STAP-A 载荷
+func stapA(sps, pps []byte) []byte {
+	if len(sps) == 0 || len(pps) == 0 {
+		return nil
+	}
+
+	payload := make([]byte, 0, 5+len(sps)+len(pps))
+	payload = append(payload, sps[0]&0x60|h264.NalStapaInRtp)
+	payload = append(payload, byte(len(sps)>>8), byte(len(sps)))
+	payload = append(payload, sps...)
+	payload = append(payload, byte(len(pps)>>8), byte(len(pps)))
+	payload = append(payload, pps...)
+	return payload
+}
+
+// Path 播放的流路径
+func (s *whepSession) Path() string {
+	return s.stream.Path()
+}
+
+// Close implements media.Consumer
+func (s *whepSession) Close() error {
+	if !atomic.CompareAndSwapInt32(&s.closed, 0, 1) {
+		return nil
+	}
+
+	whepSessions.Delete(s.id)
+	s.l.Lock()
+	cid := s.cid
+	s.l.Unlock()
+	if cid != 0 {
+		s.stream.StopConsume(cid)
+	}
+	s.pc.Close()
+	stats.RtcConns.Release()
+	s.logger.Info("whep: session closed")
+	return nil
+}
@@ -0,0 +1,194 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package rtc
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cnotch/ipchub/av/codec/h264"
+	"github.com/cnotch/ipchub/av/format/rtp"
+	"github.com/cnotch/ipchub/media"
+	"github.com/cnotch/xlog"
+	pionrtp "github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+const h264Sdp = `v=0
+o=- 0 0 IN IP4 127.0.0.1
+s=No Name
+c=IN IP4 127.0.0.1
+t=0 0
+m=video 0 RTP/AVP 96
+a=rtpmap:96 H264/90000
+a=fmtp:96 packetization-mode=1; sprop-parameter-sets=Z2QAH6zZQFAFuhAAAAMAEAAAAwPI8YMZYA==,aO+8sA==; profile-level-id=64001F
+a=control:streamid=0
+`
+
+func TestInspectH264(t *testing.T) {
+	sps, pps := []byte{0x67, 1, 2}, []byte{0x68, 3}
+	tests := []struct {
+		name    string
+		payload []byte
+		idr     bool
+		params  bool
+	}{
+		{"idr", []byte{0x65, 1}, true, false},
+		{"slice", []byte{0x41, 1}, false, false},
+		{"sps", sps, false, true},
+		{"stap-a", stapA(sps, pps), false, true},
+		{"fu-a start", []byte{0x7c, 0x85, 1}, true, false},
+		{"fu-a middle", []byte{0x7c, 0x05, 1}, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idr, params := inspectH264(tt.payload)
+			assert.Equal(t, tt.idr, idr)
+			assert.Equal(t, tt.params, params)
+		})
+	}
+
+	assert.Equal(t, []byte{0x78, 0, 3, 0x67, 1, 2, 0, 2, 0x68, 3}, stapA(sps, pps))
+}
+
+// 使用本地的 WebRTC 对端测试 WHEP 播放
+func TestWHEP(t *testing.T) {
+	const path = "/live/whep"
+	stream := media.NewStream(path, h264Sdp)
+	media.Regist(stream)
+	defer stream.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeWHEP(xlog.L(), path, w, r)
+	}))
+	defer server.Close()
+
+	// 播放端
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer pc.Close()
+
+	_, err = pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo,
+		webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+	assert.NoError(t, err)
+
+	received := make(chan *pionrtp.Packet, 16)
+	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		for {
+			p, _, err := track.ReadRTP()
+			if err != nil {
+				return
+			}
+			select {
+			case received <- p:
+			default:
+			}
+		}
+	})
+
+	offer, err := pc.CreateOffer(nil)
+	assert.NoError(t, err)
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	assert.NoError(t, pc.SetLocalDescription(offer))
+	<-gatherComplete
+
+	resp, err := http.Post(server.URL+path+".whep", "application/sdp",
+		strings.NewReader(pc.LocalDescription().SDP))
+	if !assert.NoError(t, err) {
+		return
+	}
+	answer, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !assert.Equal(t, http.StatusCreated, resp.StatusCode) {
+		return
+	}
+	location := resp.Header.Get("Location")
+	assert.True(t, strings.HasPrefix(location, path+".whep?session="))
+	assert.Contains(t, string(answer), "a=ice-lite")
+	assert.NoError(t, pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP:  string(answer),
+	}))
+
+	// 周期写入非关键帧和关键帧，直到播放端收到数据
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		var seq uint16
+		for ts := uint32(0); ; ts += 3000 {
+			for _, payload := range [][]byte{{0x41, 1}, {0x65, 2}} {
+				seq++
+				writePacket(stream, seq, ts, payload)
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+		}
+	}()
+
+	// 关键帧之前插入参数集
+	var packets []*pionrtp.Packet
+	timeout := time.After(10 * time.Second)
+	for len(packets) < 2 {
+		select {
+		case p := <-received:
+			packets = append(packets, p)
+		case <-timeout:
+			t.Fatal("wait for rtp packets timeout")
+		}
+	}
+	assert.Equal(t, byte(h264.NalStapaInRtp), packets[0].Payload[0]&h264.NalTypeBitmask)
+	assert.Equal(t, []byte{0x65, 2}, packets[1].Payload)
+	assert.Equal(t, packets[0].SequenceNumber+1, packets[1].SequenceNumber)
+	assert.Equal(t, packets[0].Timestamp, packets[1].Timestamp)
+
+	// 其他流或 WHIP 的 DELETE 不能结束会话
+	rec := httptest.NewRecorder()
+	ServeWHEP(xlog.L(), "/live/other", rec, httptest.NewRequest(http.MethodDelete, location, nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	rec = httptest.NewRecorder()
+	ServeWHIP(xlog.L(), path, rec, httptest.NewRequest(http.MethodDelete, location, nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	// 结束会话
+	req, _ := http.NewRequest(http.MethodDelete, server.URL+location, nil)
+	resp, err = http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	resp, err = http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func writePacket(stream *media.Stream, seq uint16, ts uint32, payload []byte) {
+	p := pionrtp.Packet{
+		Header: pionrtp.Header{
+			Version:        2,
+			Marker:         true,
+			PayloadType:    96,
+			SequenceNumber: seq,
+			Timestamp:      ts,
+			SSRC:           1,
+		},
+		Payload: payload,
+	}
+	data, _ := p.Marshal()
+	packet := &rtp.Packet{Channel: rtp.ChannelVideo, Data: data}
+	packet.Header.Unmarshal(data)
+	stream.WriteRtpPacket(packet)
+}
@@ -0,0 +1,253 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package rtc
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cnotch/ipchub/av/format/rtp"
+	"github.com/cnotch/ipchub/config"
+	"github.com/cnotch/ipchub/media"
+	"github.com/cnotch/ipchub/stats"
+	"github.com/cnotch/xlog"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pixelbender/go-sdp/sdp"
+)
+
+// 推送流 SDP 中的负载类型
+const (
+	videoPayloadType = 96
+	audioPayloadType = 97
+)
+
+// whipSession WHIP 推流会话，将收到的 RTP 作为 rtp.Packet 写入流
+type whipSession struct {
+	id     string
+	path   string
+	addr   string
+	logger *xlog.Logger
+	pc     *webrtc.PeerConnection
+	rawsdp string // 推送流的 SDP
+	done   chan struct{}
+
+	l      sync.Mutex
+	stream *media.Stream
+	closed int32
+}
+
+// ServeWHIP 处理 WHIP(WebRTC-HTTP Ingestion Protocol) 请求；
+// POST 提交 SDP offer 创建推流会话，DELETE 结束会话
+func ServeWHIP(logger *xlog.Logger, path string, w http.ResponseWriter, r *http.Request) {
+	if serveResource(w, r, &whipSessions, path) {
+		return
+	}
+
+	logger = logger.With(xlog.Fields(
+		xlog.F("path", path), xlog.F("ext", "whip"),
+		xlog.F("addr", r.RemoteAddr)))
+
+	offer, ok := readSdp(w, r)
+	if !ok {
+		logger.Error("whip: request sdp illegal")
+		return
+	}
+
+	s, err := newWhipSession(logger, path, r.RemoteAddr)
+	if err != nil {
+		logger.Errorf("whip: create peer connection failed; %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	answerSdp, err := answer(s.pc, offer)
+	if err == nil {
+		s.rawsdp, err = streamSdp(answerSdp)
+	}
+	if err != nil {
+		logger.Errorf("whip: negotiate failed; %v", err)
+		s.Close()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	whipSessions.Store(s.id, s)
+	writeAnswer(w, r, s.id, answerSdp)
+	logger.Info("whip: session created")
+}
+
+func newWhipSession(logger *xlog.Logger, path string, addr string) (s *whipSession, err error) {
+	pc, err := getWhipAPI().NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return
+	}
+
+	s = &whipSession{
+		id:     newSessionID(),
+		path:   path,
+		addr:   addr,
+		logger: logger,
+		pc:     pc,
+		done:   make(chan struct{}),
+	}
+	stats.RtcConns.Add()
+
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		if _, err = pc.AddTransceiverFromKind(kind,
+			webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+
+	pc.OnTrack(s.onTrack)
+	pc.OnConnectionStateChange(s.onConnectionStateChange)
+	return
+}
+
+// 根据应答中接受的媒体生成推送流的 SDP，负载类型统一为 96(H264)、97(opus)
+func streamSdp(answerSdp string) (string, error) {
+	desc, err := sdp.ParseString(answerSdp)
+	if err != nil {
+		return "", err
+	}
+
+	var video, audio bool
+	for _, m := range desc.Media {
+		if m.Port == 0 || len(m.Format) == 0 {
+			continue // 拒绝的媒体
+		}
+		switch {
+		case m.Type == "video" && strings.EqualFold(m.Format[0].Name, "H264"):
+			video = true
+		case m.Type == "audio" && strings.EqualFold(m.Format[0].Name, "opus"):
+			audio = true
+		}
+	}
+	if !video {
+		return "", errors.New("whip requires H264 video")
+	}
+
+	var b strings.Builder
+	b.WriteString("v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=WHIP\r\nc=IN IP4 0.0.0.0\r\nt=0 0\r\n")
+	fmt.Fprintf(&b, "m=video 0 RTP/AVP %d\r\na=rtpmap:%d H264/90000\r\n"+
+		"a=fmtp:%d packetization-mode=1\r\na=control:streamid=0\r\n",
+		videoPayloadType, videoPayloadType, videoPayloadType)
+	if audio {
+		fmt.Fprintf(&b, "m=audio 0 RTP/AVP %d\r\na=rtpmap:%d opus/48000/2\r\na=control:streamid=1\r\n",
+			audioPayloadType, audioPayloadType)
+	}
+	return b.String(), nil
+}
+
+func (s *whipSession) onConnectionStateChange(state webrtc.PeerConnectionState) {
+	s.logger.Infof("whip: connection state changed to %s", state.String())
+	switch state {
+	case webrtc.PeerConnectionStateConnected:
+		s.l.Lock()
+		if s.stream == nil && atomic.LoadInt32(&s.closed) == 0 {
+			s.stream = media.NewStream(s.path, s.rawsdp,
+				media.Attr("addr", s.addr))
+			media.Regist(s.stream)
+		}
+		s.l.Unlock()
+	case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+		s.Close()
+	}
+}
+
+func (s *whipSession) getStream() *media.Stream {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.stream
+}
+
+func (s *whipSession) onTrack(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	channel, payloadType := byte(rtp.ChannelVideo), uint8(videoPayloadType)
+	if track.Kind() == webrtc.RTPCodecTypeAudio {
+		channel, payloadType = rtp.ChannelAudio, audioPayloadType
+	} else {
+		go s.requestKeyframes(track.SSRC())
+	}
+
+	for {
+		p, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+
+		stream := s.getStream()
+		if stream == nil {
+			continue
+		}
+
+		p.PayloadType = payloadType
+		data, err := p.Marshal()
+		if err != nil {
+			continue
+		}
+		packet := &rtp.Packet{Channel: channel, Data: data}
+		if err = packet.Header.Unmarshal(data); err != nil {
+			continue
+		}
+		if err = stream.WriteRtpPacket(packet); err != nil {
+			s.logger.Errorf("whip: write rtp failed; %v", err)
+			s.Close()
+			return
+		}
+	}
+}
+
+// 浏览器只在收到请求时发送关键帧，定期请求以便新的播放者和 hls 片段可以从关键帧开始
+func (s *whipSession) requestKeyframes(ssrc webrtc.SSRC) {
+	ticker := time.NewTicker(time.Duration(config.HlsFragment()) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		if err := s.pc.WriteRTCP([]rtcp.Packet{
+			&rtcp.PictureLossIndication{MediaSSRC: uint32(ssrc)},
+		}); err != nil {
+			return
+		}
+
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Path 推送的流路径
+func (s *whipSession) Path() string {
+	return s.path
+}
+
+// Close .
+func (s *whipSession) Close() error {
+	if !atomic.CompareAndSwapInt32(&s.closed, 0, 1) {
+		return nil
+	}
+
+	whipSessions.Delete(s.id)
+	close(s.done)
+	s.l.Lock()
+	stream := s.stream
+	s.stream = nil
+	s.l.Unlock()
+	if stream != nil {
+		media.Unregist(stream)
+	}
+	s.pc.Close()
+	stats.RtcConns.Release()
+	s.logger.Info("whip: session closed")
+	return nil
+}
@@ -0,0 +1,164 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package rtc
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cnotch/ipchub/av/format/rtp"
+	"github.com/cnotch/ipchub/media"
+	"github.com/cnotch/xlog"
+	pionrtp "github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamSdp(t *testing.T) {
+	answer := `v=0
+o=- 0 0 IN IP4 127.0.0.1
+s=-
+t=0 0
+m=video 9 UDP/TLS/RTP/SAVPF 102
+a=rtpmap:102 H264/90000
+m=audio 9 UDP/TLS/RTP/SAVPF 111
+a=rtpmap:111 opus/48000/2
+`
+	rawsdp, err := streamSdp(answer)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Contains(t, rawsdp, "a=rtpmap:96 H264/90000")
+	assert.Contains(t, rawsdp, "a=rtpmap:97 opus/48000/2")
+
+	// 拒绝的音频
+	rawsdp, err = streamSdp(strings.Replace(answer, "m=audio 9", "m=audio 0", 1))
+	assert.NoError(t, err)
+	assert.NotContains(t, rawsdp, "m=audio")
+
+	_, err = streamSdp(strings.Replace(answer, "H264", "VP8", 1))
+	assert.Error(t, err)
+}
+
+type packetConsumer chan *rtp.Packet
+
+func (c packetConsumer) Consume(pack media.Pack) {
+	select {
+	case c <- pack.(*rtp.Packet):
+	default:
+	}
+}
+
+func (c packetConsumer) Close() error { return nil }
+
+// 使用本地的 WebRTC 对端测试 WHIP 推流
+func TestWHIP(t *testing.T) {
+	const path = "/live/whip"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeWHIP(xlog.L(), path, w, r)
+	}))
+	defer server.Close()
+
+	// 推流端
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer pc.Close()
+
+	video, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{
+		MimeType:    webrtc.MimeTypeH264,
+		ClockRate:   90000,
+		SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
+	}, "video", "test")
+	assert.NoError(t, err)
+	_, err = pc.AddTrack(video)
+	assert.NoError(t, err)
+
+	offer, err := pc.CreateOffer(nil)
+	assert.NoError(t, err)
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	assert.NoError(t, pc.SetLocalDescription(offer))
+	<-gatherComplete
+
+	resp, err := http.Post(server.URL+path+".whip", "application/sdp",
+		strings.NewReader(pc.LocalDescription().SDP))
+	if !assert.NoError(t, err) {
+		return
+	}
+	answer, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !assert.Equal(t, http.StatusCreated, resp.StatusCode) {
+		return
+	}
+	location := resp.Header.Get("Location")
+	assert.True(t, strings.HasPrefix(location, path+".whip?session="))
+	assert.NoError(t, pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP:  string(answer),
+	}))
+
+	// 等待流注册
+	var stream *media.Stream
+	timeout := time.After(10 * time.Second)
+	for stream == nil {
+		select {
+		case <-timeout:
+			t.Fatal("wait for stream timeout")
+		case <-time.After(20 * time.Millisecond):
+			stream = media.Get(path)
+		}
+	}
+	assert.Equal(t, "H264", stream.Video.Codec)
+
+	received := make(packetConsumer, 16)
+	stream.StartConsume(received, media.RTPPacket, "net=test")
+
+	// 周期写入关键帧，直到流收到数据
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		var seq uint16
+		for ts := uint32(0); ; ts += 3000 {
+			seq++
+			video.WriteRTP(&pionrtp.Packet{
+				Header: pionrtp.Header{
+					Version:        2,
+					Marker:         true,
+					SequenceNumber: seq,
+					Timestamp:      ts,
+				},
+				Payload: []byte{0x65, 1},
+			})
+			select {
+			case <-done:
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+		}
+	}()
+
+	select {
+	case p := <-received:
+		assert.Equal(t, byte(rtp.ChannelVideo), p.Channel)
+		assert.Equal(t, uint8(videoPayloadType), p.PayloadType)
+		assert.Equal(t, []byte{0x65, 1}, p.Payload())
+	case <-time.After(10 * time.Second):
+		t.Fatal("wait for rtp packets timeout")
+	}
+
+	// 结束会话，流随之注销
+	req, _ := http.NewRequest(http.MethodDelete, server.URL+location, nil)
+	resp, err = http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	assert.Nil(t, media.Get(path))
+}
@@ -0,0 +1,301 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package rtmp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/cnotch/ipchub/av/format/amf"
+	"github.com/cnotch/ipchub/av/format/rtmp"
+	"github.com/cnotch/ipchub/config"
+	flvs "github.com/cnotch/ipchub/service/flv"
+	"github.com/cnotch/ipchub/stats"
+	"github.com/cnotch/xlog"
+)
+
+const (
+	rtmpURLPrefix   = "rtmp://"
+	rtmpDefaultPort = "1935"
+)
+
+// 拉流命令的事务ID
+const (
+	transConnect      = 1
+	transCreateStream = 2
+)
+
+// PullClient RTMP 拉流客户端，flv.Tag -> codec.Frame -> media.Stream
+type PullClient struct {
+	path      string // 本地路径
+	url       *url.URL
+	app       string
+	name      string // 播放的流名称，包含查询参数
+	logger    *xlog.Logger
+	conn      net.Conn
+	cr        *rtmp.ChunkReader
+	cw        *rtmp.ChunkWriter
+	ackWindow uint32
+	ackBytes  uint64
+	streamID  uint32
+	publisher *flvs.Publisher
+}
+
+// NewPullClient 创建 RTMP 拉流客户端，远端地址如 rtmp://host/live/test?token=xxx
+func NewPullClient(localPath, remoteURL string) (*PullClient, error) {
+	u, err := url.Parse(remoteURL)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(u.Scheme, "rtmp") {
+		return nil, errors.New("rtmp: url scheme must be rtmp")
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), rtmpDefaultPort)
+	}
+
+	// 第一级路径为 app，其余作为流名称
+	path := strings.TrimPrefix(u.Path, "/")
+	i := strings.IndexByte(path, '/')
+	if i < 0 {
+		return nil, errors.New("rtmp: url must contain app and stream name")
+	}
+	name := path[i+1:]
+	if u.RawQuery != "" {
+		name += "?" + u.RawQuery
+	}
+
+	c := &PullClient{
+		path: localPath,
+		url:  u,
+		app:  path[:i],
+		name: name,
+	}
+	c.logger = xlog.L().With(xlog.Fields(
+		xlog.F("path", localPath), xlog.F("rurl", remoteURL),
+		xlog.F("type", "puller")))
+	return c, nil
+}
+
+// Open 连接远端服务器，依次发送 connect、createStream、play；
+// 流就绪后启动接收 go routine
+func (c *PullClient) Open() (err error) {
+	defer func() {
+		if err != nil {
+			c.disconnect()
+		}
+	}()
+
+	if c.conn, err = net.DialTimeout("tcp", c.url.Host, config.NetTimeout()); err != nil {
+		return
+	}
+	c.conn.SetDeadline(time.Now().Add(config.NetTimeout()))
+	if err = rtmp.ClientHandshake(c.conn); err != nil {
+		return
+	}
+
+	c.cr = rtmp.NewChunkReader(bufio.NewReaderSize(c.conn, config.NetBufferSize()))
+	c.cw = rtmp.NewChunkWriter(c.conn)
+	c.publisher = flvs.NewPublisher(c.path, c.url.Host, c.logger)
+
+	tcURL := fmt.Sprintf("rtmp://%s/%s", c.url.Host, c.app)
+	if err = c.writeCommand(0, &rtmp.Command{
+		Name:          rtmp.CmdConnect,
+		TransactionID: transConnect,
+		Object: amf.Object{
+			{Name: "app", Value: c.app},
+			{Name: "flashVer", Value: "LNX 9,0,124,2"},
+			{Name: "tcUrl", Value: tcURL},
+			{Name: "fpad", Value: false},
+			{Name: "capabilities", Value: 15},
+			{Name: "audioCodecs", Value: 4071},
+			{Name: "videoCodecs", Value: 252},
+			{Name: "videoFunction", Value: 1},
+		},
+	}); err != nil {
+		return
+	}
+
+	// 等待流就绪
+	for c.publisher.Stream() == nil {
+		if err = c.receive(); err != nil {
+			return
+		}
+	}
+
+	c.conn.SetDeadline(time.Time{})
+	go c.playStream()
+	return nil
+}
+
+// Close 关闭客户端
+func (c *PullClient) Close() error {
+	c.disconnect()
+	return nil
+}
+
+func (c *PullClient) disconnect() {
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	if c.publisher != nil {
+		c.publisher.Close()
+	}
+}
+
+func (c *PullClient) playStream() {
+	defer func() {
+		if r := recover(); r != nil {
+			c.logger.Errorf("pull stream panic; %v \n %s", r, debug.Stack())
+		}
+
+		stats.RtmpConns.Release() // 减少RTMP连接计数
+		c.disconnect()
+		c.logger.Infof("close pull stream")
+	}()
+
+	c.logger.Infof("open pull stream")
+	stats.RtmpConns.Add() // 增加一个 RTMP 连接计数
+
+	timeout := config.NetTimeout()
+	for {
+		if err := c.conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			c.logger.Error(err.Error())
+			return
+		}
+		if err := c.receive(); err != nil {
+			if err != io.EOF {
+				c.logger.Error(err.Error())
+			}
+			return
+		}
+	}
+}
+
+// 接收并处理一个消息
+func (c *PullClient) receive() error {
+	msg, err := c.cr.ReadMessage()
+	if err != nil {
+		return err
+	}
+
+	switch msg.TypeID {
+	case rtmp.MsgAudio, rtmp.MsgVideo, rtmp.MsgAmf0Data, rtmp.MsgAmf3Data, rtmp.MsgAggregate:
+		err = writeMediaMessage(c.publisher, msg)
+	case rtmp.MsgAmf0Command:
+		err = c.onCommand(msg.Payload)
+	case rtmp.MsgAmf3Command:
+		// AMF3 命令的第一个字节为 0，后续内容为 AMF0 编码
+		if len(msg.Payload) > 0 {
+			err = c.onCommand(msg.Payload[1:])
+		}
+	case rtmp.MsgWindowAckSize:
+		if len(msg.Payload) >= 4 {
+			c.ackWindow = binary.BigEndian.Uint32(msg.Payload)
+		}
+	case rtmp.MsgUserControl:
+		if len(msg.Payload) >= 6 &&
+			binary.BigEndian.Uint16(msg.Payload) == rtmp.EventPingRequest {
+			err = c.writeMessage(rtmp.NewUserControlMessage(rtmp.EventPingResponse,
+				binary.BigEndian.Uint32(msg.Payload[2:])))
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// 接收的字节数超过确认窗口时，发送确认消息
+	if c.ackWindow > 0 {
+		if inBytes := c.cr.InBytes(); inBytes-c.ackBytes >= uint64(c.ackWindow) {
+			c.ackBytes = inBytes
+			return c.writeMessage(rtmp.NewAckMessage(uint32(inBytes)))
+		}
+	}
+	return nil
+}
+
+func (c *PullClient) onCommand(payload []byte) error {
+	var cmd rtmp.Command
+	if err := cmd.Unmarshal(payload); err != nil {
+		return err
+	}
+
+	if c.logger.LevelEnabled(xlog.DebugLevel) {
+		c.logger.Debugf("<<<=== %s %v %v", cmd.Name, cmd.Object, cmd.Args)
+	}
+
+	switch cmd.Name {
+	case rtmp.CmdResult:
+		switch cmd.TransactionID {
+		case transConnect:
+			return c.writeCommand(0, &rtmp.Command{
+				Name:          rtmp.CmdCreateStream,
+				TransactionID: transCreateStream,
+			})
+		case transCreateStream:
+			if len(cmd.Args) > 0 {
+				if id, ok := cmd.Args[0].(float64); ok {
+					c.streamID = uint32(id)
+				}
+			}
+			return c.writeCommand(c.streamID, &rtmp.Command{
+				Name: rtmp.CmdPlay,
+				Args: []interface{}{c.name},
+			})
+		}
+	case rtmp.CmdError:
+		return fmt.Errorf("rtmp: %s", statusDescription(&cmd))
+	case rtmp.CmdOnStatus:
+		if statusProperty(&cmd, "level") == "error" {
+			return fmt.Errorf("rtmp: %s", statusDescription(&cmd))
+		}
+		switch statusProperty(&cmd, "code") {
+		case "NetStream.Play.Stop", "NetStream.Play.UnpublishNotify":
+			return io.EOF // 远端流已结束
+		}
+	}
+	return nil
+}
+
+// 获取状态对象的属性
+func statusProperty(cmd *rtmp.Command, name string) string {
+	if len(cmd.Args) > 0 {
+		if info, ok := cmd.Args[0].(amf.Object); ok {
+			if v, ok := amf.PropertyValue(info, name); ok {
+				s, _ := v.(string)
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+func statusDescription(cmd *rtmp.Command) string {
+	return statusProperty(cmd, "code") + " " + statusProperty(cmd, "description")
+}
+
+func (c *PullClient) writeCommand(streamID uint32, cmd *rtmp.Command) error {
+	msg, err := rtmp.NewCommandMessage(streamID, cmd)
+	if err != nil {
+		return err
+	}
+
+	if c.logger.LevelEnabled(xlog.DebugLevel) {
+		c.logger.Debugf("===>>> %s %v %v", cmd.Name, cmd.Object, cmd.Args)
+	}
+	return c.writeMessage(msg)
+}
+
+func (c *PullClient) writeMessage(msg *rtmp.Message) error {
+	return c.cw.WriteMessage(msg)
+}
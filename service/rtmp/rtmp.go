@@ -0,0 +1,38 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package rtmp
+
+import (
+	"net"
+
+	"github.com/cnotch/ipchub/av/format/rtmp"
+	"github.com/cnotch/ipchub/network/socket/listener"
+	"github.com/cnotch/xlog"
+	"github.com/kelindar/tcp"
+)
+
+// MatchRTMP 匹配 RTMP 握手的 C0(版本号 3)
+func MatchRTMP() listener.Matcher {
+	return listener.MatchPrefixBytes([]byte{rtmp.Version})
+}
+
+// Server rtmp 服务器
+type Server struct {
+	logger *xlog.Logger
+}
+
+// CreateAcceptHandler 创建连接接入处理器
+func CreateAcceptHandler() tcp.OnAccept {
+	svr := &Server{
+		logger: xlog.L(),
+	}
+	return svr.onAcceptConn
+}
+
+// onAcceptConn 当新连接接入时触发
+func (svr *Server) onAcceptConn(c net.Conn) {
+	s := newSession(svr, c)
+	go s.process()
+}
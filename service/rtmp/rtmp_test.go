@@ -0,0 +1,97 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package rtmp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cnotch/ipchub/av/codec"
+	"github.com/cnotch/ipchub/av/format/flv"
+	"github.com/cnotch/ipchub/media"
+	flvs "github.com/cnotch/ipchub/service/flv"
+	"github.com/cnotch/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewPullClient(t *testing.T) {
+	c, err := NewPullClient("/live/test", "rtmp://localhost/live/a/b?token=1")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "localhost:1935", c.url.Host)
+		assert.Equal(t, "live", c.app)
+		assert.Equal(t, "a/b?token=1", c.name)
+	}
+
+	c, err = NewPullClient("/live/test", "rtmp://localhost:1554/live/test")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "localhost:1554", c.url.Host)
+		assert.Equal(t, "test", c.name)
+	}
+
+	_, err = NewPullClient("/live/test", "rtmp://localhost/live")
+	assert.Error(t, err)
+}
+
+// 从本地 rtmp 服务拉流
+func TestPullRTMP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ln.Close()
+	onAccept := CreateAcceptHandler()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			onAccept(conn)
+		}
+	}()
+
+	// 源流
+	sps, _ := base64.StdEncoding.DecodeString("Z2QAH6zZQFAFuhAAAAMAEAAAAwPI8YMZYA==")
+	pps, _ := base64.StdEncoding.DecodeString("aO+8sA==")
+	video := codec.VideoMeta{Codec: "H264", Sps: sps, Pps: pps}
+	audio := codec.AudioMeta{Codec: "AAC", Sps: []byte{0x12, 0x10}}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		source := flvs.NewPublisher("/live/src", "local", xlog.L())
+		defer source.Close()
+
+		vp := flv.NewH264Packetizer(&video, source)
+		ap := flv.NewAacPacketizer(&audio, source)
+		vp.PacketizeSequenceHeader()
+		ap.PacketizeSequenceHeader()
+		idr := append([]byte{0x65}, bytes.Repeat([]byte{0x88}, 500)...)
+		for dts := int64(0); ; dts += int64(40 * time.Millisecond) {
+			vp.Packetize(&codec.Frame{MediaType: codec.MediaTypeVideo, Dts: dts, Pts: dts, Payload: idr})
+			ap.Packetize(&codec.Frame{MediaType: codec.MediaTypeAudio, Dts: dts, Pts: dts, Payload: []byte{1, 2, 3}})
+			select {
+			case <-done:
+				return
+			case <-time.After(40 * time.Millisecond):
+			}
+		}
+	}()
+
+	addr := ln.Addr().String()
+	stream, err := NewPullStreamFacotry().Create("/live/rtmppull", "rtmp://"+addr+"/live/src")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "H264", stream.Video.Codec)
+	assert.Equal(t, "AAC", stream.Audio.Codec)
+	assert.Equal(t, stream, media.Get("/live/rtmppull"))
+	media.Unregist(stream)
+
+	_, err = NewPullStreamFacotry().Create("/live/rtmppull", "rtmp://"+addr+"/live/none")
+	assert.Error(t, err)
+}
@@ -0,0 +1,487 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package rtmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cnotch/ipchub/av/format/amf"
+	"github.com/cnotch/ipchub/av/format/flv"
+	"github.com/cnotch/ipchub/av/format/rtmp"
+	"github.com/cnotch/ipchub/config"
+	"github.com/cnotch/ipchub/media"
+	"github.com/cnotch/ipchub/network/socket/buffered"
+	"github.com/cnotch/ipchub/provider/auth"
+	"github.com/cnotch/ipchub/provider/security"
+	"github.com/cnotch/ipchub/stats"
+	"github.com/cnotch/ipchub/utils"
+	"github.com/cnotch/xlog"
+)
+
+const (
+	statusInit = iota
+	statusConnected
+	statusPlaying
+	statusPublishing
+)
+
+const (
+	outChunkSize    = 4096 // 输出块大小
+	defaultStreamID = 1    // createStream 分配的流ID
+)
+
+// Session RTMP 会话
+type Session struct {
+	// 创建时设置
+	svr      *Server
+	logger   *xlog.Logger
+	closed   bool
+	lsession string // 本地会话标识
+	timeout  time.Duration
+	conn     *buffered.Conn
+	lockW    sync.Mutex
+	cr       *rtmp.ChunkReader
+	cw       *rtmp.ChunkWriter
+
+	// 确认窗口
+	ackWindow uint32
+	ackBytes  uint64
+
+	// connect 后设置
+	app            string
+	query          url.Values
+	objectEncoding float64
+
+	// publish 或 play 后设置
+	path     string
+	user     *auth.User
+	status   int            // session状态
+	stream   mediaStream    // 媒体流
+	consumer media.Consumer // 消费者
+}
+
+func newSession(svr *Server, conn net.Conn) *Session {
+	session := &Session{
+		svr:      svr,
+		lsession: security.NewID().Base64(),
+		timeout:  config.NetTimeout(),
+		conn: buffered.NewConn(conn,
+			buffered.FlushRate(config.NetFlushRate()),
+			buffered.BufferSize(config.NetBufferSize())),
+		status:   statusInit,
+		stream:   defaultStream,
+		consumer: defaultConsumer,
+	}
+
+	session.cr = rtmp.NewChunkReader(session.conn)
+	session.cw = rtmp.NewChunkWriter(session.conn)
+	session.logger = svr.logger.With(xlog.Fields(
+		xlog.F("session", session.lsession)))
+
+	return session
+}
+
+// Addr Session地址
+func (s *Session) Addr() string {
+	return s.conn.RemoteAddr().String()
+}
+
+// Close 关闭会话
+func (s *Session) Close() error {
+	if s.closed {
+		return nil
+	}
+
+	s.closed = true
+	s.conn.Close()
+	return nil
+}
+
+func (s *Session) process() {
+	defer func() {
+		if r := recover(); r != nil {
+			s.logger.Errorf("session panic; %v \n %s", r, debug.Stack())
+		}
+
+		stats.RtmpConns.Release()
+		s.Close()
+		s.consumer.Close()
+		s.stream.Close()
+
+		// 重置到初始状态
+		s.status = statusInit
+		s.stream = defaultStream
+		s.consumer = defaultConsumer
+		s.logger.Infof("close rtmp session")
+	}()
+
+	s.logger.Infof("open rtmp session")
+	stats.RtmpConns.Add() // 增加一个 RTMP 连接计数
+
+	if s.timeout > 0 {
+		s.conn.SetDeadline(time.Now().Add(s.timeout))
+	}
+	if err := rtmp.ServerHandshake(s.conn); err != nil {
+		s.logger.Errorf("rtmp handshake failed; %v", err)
+		return
+	}
+	s.conn.SetWriteDeadline(time.Time{})
+
+	for !s.closed {
+		deadLine := time.Time{}
+		if s.timeout > 0 {
+			deadLine = time.Now().Add(s.timeout)
+		}
+		if err := s.conn.SetReadDeadline(deadLine); err != nil {
+			s.logger.Error(err.Error())
+			break
+		}
+
+		msg, err := s.cr.ReadMessage()
+		if err == nil {
+			err = s.onMessage(msg)
+		}
+		if err == nil {
+			err = s.acknowledge()
+		}
+
+		if err != nil {
+			if err == io.EOF { // 如果客户端断开提醒
+				s.logger.Warn("The client actively disconnects")
+			} else if !s.closed { // 如果主动关闭，不提示
+				s.logger.Error(err.Error())
+			}
+			break
+		}
+	}
+}
+
+// 接收的字节数超过确认窗口时，发送确认消息
+func (s *Session) acknowledge() error {
+	if s.ackWindow == 0 {
+		return nil
+	}
+
+	inBytes := s.cr.InBytes()
+	if inBytes-s.ackBytes < uint64(s.ackWindow) {
+		return nil
+	}
+
+	s.ackBytes = inBytes
+	return s.writeMessage(rtmp.NewAckMessage(uint32(inBytes)))
+}
+
+func (s *Session) onMessage(msg *rtmp.Message) error {
+	switch msg.TypeID {
+	case rtmp.MsgAudio, rtmp.MsgVideo, rtmp.MsgAmf0Data, rtmp.MsgAmf3Data, rtmp.MsgAggregate:
+		return writeMediaMessage(s.stream, msg)
+	case rtmp.MsgAmf0Command:
+		return s.onCommand(msg.StreamID, msg.Payload)
+	case rtmp.MsgAmf3Command:
+		// AMF3 命令的第一个字节为 0，后续内容为 AMF0 编码
+		if len(msg.Payload) > 0 {
+			return s.onCommand(msg.StreamID, msg.Payload[1:])
+		}
+	case rtmp.MsgWindowAckSize:
+		if len(msg.Payload) >= 4 {
+			s.ackWindow = binary.BigEndian.Uint32(msg.Payload)
+		}
+	case rtmp.MsgUserControl:
+		if len(msg.Payload) >= 6 &&
+			binary.BigEndian.Uint16(msg.Payload) == rtmp.EventPingRequest {
+			return s.writeMessage(rtmp.NewUserControlMessage(rtmp.EventPingResponse,
+				binary.BigEndian.Uint32(msg.Payload[2:])))
+		}
+	}
+	return nil
+}
+
+// 将音视频和数据消息转换成 flv.Tag 写入流
+func writeMediaMessage(stream mediaStream, msg *rtmp.Message) error {
+	switch msg.TypeID {
+	case rtmp.MsgAudio, rtmp.MsgVideo, rtmp.MsgAmf0Data:
+		return stream.WriteFlvTag(&flv.Tag{
+			TagType:   msg.TypeID,
+			DataSize:  uint32(len(msg.Payload)),
+			Timestamp: msg.Timestamp,
+			Data:      msg.Payload,
+		})
+	case rtmp.MsgAmf3Data:
+		if len(msg.Payload) > 0 && msg.Payload[0] == 0 {
+			return stream.WriteFlvTag(&flv.Tag{
+				TagType:   flv.TagTypeAmf0Data,
+				DataSize:  uint32(len(msg.Payload) - 1),
+				Timestamp: msg.Timestamp,
+				Data:      msg.Payload[1:],
+			})
+		}
+	case rtmp.MsgAggregate:
+		return writeAggregate(stream, msg)
+	}
+	return nil
+}
+
+// 聚合消息由多个 flv tag(包含 PreviousTagSize)组成
+func writeAggregate(stream mediaStream, msg *rtmp.Message) error {
+	r := bytes.NewReader(msg.Payload)
+	var baseTimestamp uint32
+	for i := 0; r.Len() > 0; i++ {
+		var tag flv.Tag
+		if err := tag.Read(r); err != nil {
+			return err
+		}
+		if i == 0 {
+			baseTimestamp = tag.Timestamp
+		}
+		tag.Timestamp = msg.Timestamp + tag.Timestamp - baseTimestamp
+
+		if err := stream.WriteFlvTag(&tag); err != nil {
+			return err
+		}
+
+		// 跳过 PreviousTagSize
+		if _, err := r.Seek(4, io.SeekCurrent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Session) onCommand(streamID uint32, payload []byte) error {
+	var cmd rtmp.Command
+	if err := cmd.Unmarshal(payload); err != nil {
+		return err
+	}
+
+	if s.logger.LevelEnabled(xlog.DebugLevel) {
+		s.logger.Debugf("<<<=== %s %v %v", cmd.Name, cmd.Object, cmd.Args)
+	}
+
+	switch cmd.Name {
+	case rtmp.CmdConnect:
+		return s.onConnect(&cmd)
+	case rtmp.CmdCreateStream:
+		return s.writeCommand(0, &rtmp.Command{
+			Name:          rtmp.CmdResult,
+			TransactionID: cmd.TransactionID,
+			Args:          []interface{}{defaultStreamID},
+		})
+	case rtmp.CmdReleaseStream, rtmp.CmdGetStreamLen:
+		return s.writeCommand(0, &rtmp.Command{
+			Name:          rtmp.CmdResult,
+			TransactionID: cmd.TransactionID,
+			Args:          []interface{}{amf.UndefinedValue{}},
+		})
+	case rtmp.CmdFCPublish:
+		return s.writeCommand(0, &rtmp.Command{
+			Name: rtmp.CmdOnFCPublish,
+			Args: []interface{}{statusObject("status", "NetStream.Publish.Start", cmd.StringArg(0))},
+		})
+	case rtmp.CmdPublish:
+		return s.onPublish(streamID, &cmd)
+	case rtmp.CmdPlay:
+		return s.onPlay(streamID, &cmd)
+	case rtmp.CmdFCUnpublish, rtmp.CmdDeleteStream, rtmp.CmdCloseStream:
+		// 停止推流或播放
+		s.Close()
+	}
+	return nil
+}
+
+func (s *Session) onConnect(cmd *rtmp.Command) error {
+	if s.status != statusInit {
+		return errors.New("rtmp: connect command is not valid in this state")
+	}
+
+	if v, ok := cmd.ObjectProperty("app"); ok {
+		s.app, _ = v.(string)
+	}
+	if v, ok := cmd.ObjectProperty("objectEncoding"); ok {
+		s.objectEncoding, _ = v.(float64)
+	}
+
+	// app 和 tcUrl 中可能包含查询参数，如用户名和密码
+	s.query = make(url.Values)
+	s.app = s.parseQuery(s.app)
+	if v, ok := cmd.ObjectProperty("tcUrl"); ok {
+		tcURL, _ := v.(string)
+		s.parseQuery(tcURL)
+	}
+
+	err := s.writeMessage(
+		rtmp.NewWindowAckSizeMessage(rtmp.DefaultWindowAckSize),
+		rtmp.NewSetPeerBandwidthMessage(rtmp.DefaultWindowAckSize, rtmp.LimitDynamic),
+		rtmp.NewSetChunkSizeMessage(outChunkSize))
+	if err != nil {
+		return err
+	}
+	s.lockW.Lock()
+	s.cw.SetChunkSize(outChunkSize)
+	s.lockW.Unlock()
+
+	info := statusObject("status", "NetConnection.Connect.Success", "Connection succeeded.")
+	info = append(info, amf.ObjectProperty{Name: "objectEncoding", Value: s.objectEncoding})
+	err = s.writeCommand(0, &rtmp.Command{
+		Name:          rtmp.CmdResult,
+		TransactionID: cmd.TransactionID,
+		Object: amf.Object{
+			{Name: "fmsVer", Value: "FMS/3,0,1,123"},
+			{Name: "capabilities", Value: 31},
+		},
+		Args: []interface{}{info},
+	})
+	if err != nil {
+		return err
+	}
+
+	s.status = statusConnected
+	return nil
+}
+
+func (s *Session) onPublish(streamID uint32, cmd *rtmp.Command) error {
+	if s.status != statusConnected {
+		return errors.New("rtmp: publish command is not valid in this state")
+	}
+
+	s.path = utils.CanonicalPath(s.app + "/" + s.parseQuery(cmd.StringArg(0)))
+	if !s.checkPermission(auth.PushRight) {
+		s.onStatus(streamID, "error", "NetStream.Publish.Unauthorized", "Authorization required.")
+		return errors.New("rtmp: publish unauthorized")
+	}
+
+	s.asPusher()
+	s.status = statusPublishing
+	return s.onStatus(streamID, "status", "NetStream.Publish.Start", s.path+" is now published.")
+}
+
+func (s *Session) onPlay(streamID uint32, cmd *rtmp.Command) error {
+	if s.status != statusConnected {
+		return errors.New("rtmp: play command is not valid in this state")
+	}
+
+	s.path = utils.CanonicalPath(s.app + "/" + s.parseQuery(cmd.StringArg(0)))
+	if !s.checkPermission(auth.PullRight) {
+		s.onStatus(streamID, "error", "NetStream.Play.Unauthorized", "Authorization required.")
+		return errors.New("rtmp: play unauthorized")
+	}
+
+	stream := media.GetOrCreate(s.path)
+	if stream == nil || stream.FlvTypeFlags() == 0 {
+		s.onStatus(streamID, "error", "NetStream.Play.StreamNotFound", s.path+" not found.")
+		return errors.New("rtmp: stream not found or not support flv")
+	}
+
+	err := s.writeMessage(rtmp.NewUserControlMessage(rtmp.EventStreamBegin, streamID))
+	if err == nil {
+		err = s.onStatus(streamID, "status", "NetStream.Play.Reset", "Playing and resetting "+s.path+".")
+	}
+	if err == nil {
+		err = s.onStatus(streamID, "status", "NetStream.Play.Start", "Started playing "+s.path+".")
+	}
+	if err == nil {
+		err = s.writeSampleAccess(streamID)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.asConsumer(streamID, stream)
+	s.status = statusPlaying
+	return nil
+}
+
+// 允许客户端访问音视频原始数据
+func (s *Session) writeSampleAccess(streamID uint32) error {
+	buff := bytes.NewBuffer(make([]byte, 0, 32))
+	amf.WriteString(buff, rtmp.DataSampleAccess)
+	amf.WriteBool(buff, true)
+	amf.WriteBool(buff, true)
+	return s.writeMessage(&rtmp.Message{
+		ChunkStreamID: rtmp.ChunkStreamData,
+		TypeID:        rtmp.MsgAmf0Data,
+		StreamID:      streamID,
+		Payload:       buff.Bytes(),
+	})
+}
+
+// 提取字串中的查询参数，返回去掉查询参数后的字串
+func (s *Session) parseQuery(str string) string {
+	i := strings.IndexByte(str, '?')
+	if i < 0 {
+		return str
+	}
+
+	if values, err := url.ParseQuery(str[i+1:]); err == nil {
+		for k, v := range values {
+			s.query[k] = v
+		}
+	}
+	return str[:i]
+}
+
+func (s *Session) checkPermission(right auth.AccessRight) bool {
+	if !config.Auth() {
+		return true
+	}
+
+	if s.user == nil {
+		user := auth.Get(s.query.Get("username"))
+		if user == nil || user.ValidatePassword(s.query.Get("password")) != nil {
+			return false
+		}
+		s.user = user
+	}
+
+	return s.user.ValidatePermission(s.path, right)
+}
+
+func (s *Session) onStatus(streamID uint32, level, code, description string) error {
+	return s.writeCommand(streamID, &rtmp.Command{
+		Name: rtmp.CmdOnStatus,
+		Args: []interface{}{statusObject(level, code, description)},
+	})
+}
+
+func (s *Session) writeCommand(streamID uint32, cmd *rtmp.Command) error {
+	msg, err := rtmp.NewCommandMessage(streamID, cmd)
+	if err != nil {
+		return err
+	}
+
+	if s.logger.LevelEnabled(xlog.DebugLevel) {
+		s.logger.Debugf("===>>> %s %v %v", cmd.Name, cmd.Object, cmd.Args)
+	}
+	return s.writeMessage(msg)
+}
+
+func (s *Session) writeMessage(msgs ...*rtmp.Message) (err error) {
+	s.lockW.Lock()
+	defer s.lockW.Unlock()
+
+	for _, msg := range msgs {
+		if err = s.cw.WriteMessage(msg); err != nil {
+			return
+		}
+	}
+	_, err = s.conn.Flush()
+	return
+}
+
+func statusObject(level, code, description string) amf.Object {
+	return amf.Object{
+		{Name: "level", Value: level},
+		{Name: "code", Value: code},
+		{Name: "description", Value: description},
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package rtmp
+
+import (
+	"errors"
+
+	"github.com/cnotch/ipchub/av/format"
+	"github.com/cnotch/ipchub/av/format/flv"
+	"github.com/cnotch/ipchub/av/format/rtmp"
+	"github.com/cnotch/ipchub/media"
+	flvs "github.com/cnotch/ipchub/service/flv"
+	"github.com/cnotch/xlog"
+)
+
+// Pack .
+type Pack = format.Packet
+
+var (
+	errModeBehavior                = errors.New("Play mode can't send media data")
+	defaultStream   mediaStream    = emptyStream{}
+	defaultConsumer media.Consumer = emptyConsumer{}
+)
+
+// 媒体流
+type mediaStream interface {
+	Close() error
+	WriteFlvTag(tag *flv.Tag) error
+}
+
+// 占位流，简化判断
+type emptyStream struct {
+}
+
+func (s emptyStream) Close() error               { return nil }
+func (s emptyStream) WriteFlvTag(*flv.Tag) error { return errModeBehavior }
+
+// 占位消费者，简化判断
+type emptyConsumer struct {
+}
+
+func (c emptyConsumer) Consume(p Pack) {}
+func (c emptyConsumer) Close() error   { return nil }
+
+// 将Session作为Pusher角色
+func (s *Session) asPusher() {
+	s.logger = s.logger.With(xlog.Fields(
+		xlog.F("path", s.path),
+		xlog.F("type", "pusher")))
+
+	// 设置Session字段，flv.Tag -> codec.Frame -> media.Stream
+	s.stream = flvs.NewPublisher(s.path, s.conn.RemoteAddr().String(), s.logger)
+}
+
+// 播放，media.Stream -> flv.Tag -> RTMP 消息
+type flvConsumer struct {
+	*Session
+	closed   bool
+	streamID uint32
+	source   *media.Stream
+	cid      media.CID
+}
+
+func (c *flvConsumer) Consume(p Pack) {
+	if c.closed {
+		return
+	}
+
+	tag := p.(*flv.Tag)
+	msg := &rtmp.Message{
+		TypeID:    tag.TagType,
+		Timestamp: tag.Timestamp,
+		StreamID:  c.streamID,
+		Payload:   tag.Data,
+	}
+	switch tag.TagType {
+	case flv.TagTypeAudio:
+		msg.ChunkStreamID = rtmp.ChunkStreamAudio
+	case flv.TagTypeVideo:
+		msg.ChunkStreamID = rtmp.ChunkStreamVideo
+	default:
+		msg.ChunkStreamID = rtmp.ChunkStreamData
+	}
+
+	// 媒体数据由 buffered.Conn 按频率刷新，无需每次 Flush
+	c.lockW.Lock()
+	err := c.cw.WriteMessage(msg)
+	c.lockW.Unlock()
+
+	if err != nil {
+		c.logger.Errorf("send tag error = %v , close socket", err)
+		c.Close()
+		return
+	}
+}
+
+func (c *flvConsumer) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	c.source.StopConsume(c.cid)
+	c.source = nil
+	// 流已关闭或发送失败，断开播放连接
+	c.Session.Close()
+	return nil
+}
+
+// 将Session作为Player角色
+func (s *Session) asConsumer(streamID uint32, stream *media.Stream) {
+	s.logger = s.logger.With(xlog.Fields(
+		xlog.F("path", s.path),
+		xlog.F("type", "player")))
+
+	c := &flvConsumer{
+		Session:  s,
+		streamID: streamID,
+		source:   stream,
+	}
+
+	s.timeout = 0 // play 只需发送，客户端可能长时间不发送数据，因此设置不超时
+	s.consumer = c
+	c.cid = stream.StartConsume(c, media.FLVPacket, "net=rtmp,"+s.Addr())
+}
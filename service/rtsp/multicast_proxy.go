@@ -9,6 +9,7 @@ import (
 	"io"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/cnotch/ipchub/media"
 	"github.com/cnotch/ipchub/network"
@@ -31,6 +32,7 @@ type multicastProxy struct {
 	udpConn  *net.UDPConn
 	destAddr [rtpChannelCount]*net.UDPAddr
 	cid      media.CID
+	rtcp     *rtcpSender
 
 	multicastLock sync.Mutex
 	members       []io.Closer
@@ -63,6 +65,7 @@ func (proxy *multicastProxy) AddMember(m io.Closer) {
 		}
 
 		proxy.members = append(proxy.members, m)
+		proxy.rtcp = newRtcpSender(stream)
 		proxy.cid = stream.StartConsume(proxy, media.RTPPacket,
 			"net = rtsp-multicast, "+proxy.multicastIP)
 		proxy.closed = false
@@ -120,12 +123,21 @@ func (proxy *multicastProxy) Consume(p Pack) {
 	}
 
 	p2 := p.(*RTPPack)
-	addr := proxy.destAddr[int(p2.Channel)]
+	if p2.Channel&1 == 1 { // 上游的 RTCP 由本地生成的 SR 代替
+		return
+	}
+	proxy.send(p2)
+	if sr := proxy.rtcp.onSend(p2, time.Now()); sr != nil {
+		proxy.send(sr)
+	}
+}
+
+func (proxy *multicastProxy) send(p *RTPPack) {
+	addr := proxy.destAddr[int(p.Channel)]
 	if addr != nil {
-		_, err := proxy.udpConn.WriteToUDP(p2.Data, addr)
+		_, err := proxy.udpConn.WriteToUDP(p.Data, addr)
 		if err != nil {
 			proxy.logger.Error(err.Error())
-			return
 		}
 	}
 }
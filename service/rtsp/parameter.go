@@ -0,0 +1,73 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package rtsp
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+const parametersContentType = "text/parameters"
+
+var (
+	errParameterNotFound = errors.New("parameter not understood")
+	errParameterReadOnly = errors.New("parameter is read-only")
+)
+
+// Parameter 可通过 GET_PARAMETER、SET_PARAMETER 访问的参数，path 为会话的流路径
+type Parameter struct {
+	Get func(path string) (string, error) // 为空时只写
+	Set func(path, value string) error    // 为空时只读
+}
+
+var parameters sync.Map // name(小写) -> Parameter
+
+// RegistParameter 注册参数处理钩子，同名的参数会被替换；名称不区分大小写
+func RegistParameter(name string, p Parameter) {
+	parameters.Store(strings.ToLower(name), p)
+}
+
+// UnregistParameter 注销参数
+func UnregistParameter(name string) {
+	parameters.Delete(strings.ToLower(name))
+}
+
+func getParameter(path, name string) (string, error) {
+	v, ok := parameters.Load(strings.ToLower(name))
+	if !ok || v.(Parameter).Get == nil {
+		return "", errParameterNotFound
+	}
+	return v.(Parameter).Get(path)
+}
+
+func setParameter(path, name, value string) error {
+	v, ok := parameters.Load(strings.ToLower(name))
+	if !ok {
+		return errParameterNotFound
+	}
+	if v.(Parameter).Set == nil {
+		return errParameterReadOnly
+	}
+	return v.(Parameter).Set(path, value)
+}
+
+// 解析 text/parameters 消息体的行，GET_PARAMETER 每行只有参数名
+func parseParameters(body string) (names, values []string) {
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		name, value := line, ""
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			name, value = strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		}
+		names = append(names, name)
+		values = append(values, value)
+	}
+	return
+}
@@ -0,0 +1,519 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package rtsp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cnotch/ipchub/network"
+	"github.com/cnotch/ipchub/provider/auth"
+	"github.com/cnotch/ipchub/record"
+	"github.com/cnotch/xlog"
+)
+
+const (
+	// 回放速度不小于该值时只发送关键帧
+	keyFrameOnlyScale = 4
+	// 相邻包的接收时间超过该间隔时视为录像中断，不等待直接发送后续的包
+	maxPlaybackGap = 10 * time.Second
+	// 定位后为 RTP-Info 预读的最大包数
+	maxPrefetchPackets = 64
+	// Range 中 clock 的格式
+	clockLayout = "20060102T150405Z"
+)
+
+var errInvalidRange = errors.New("invalid range")
+
+// 录像回放的媒体源，由 RTP 归档提供
+type playbackSource interface {
+	Sdp() string
+	Start() time.Time
+	Seek(t time.Time) error
+	NextKeyFrame() error
+	ReadPacket() (time.Time, *RTPPack, error)
+	Close() error
+}
+
+// 打开流的回放源，测试时替换
+var openPlayback = func(path string) (playbackSource, error) {
+	r, err := record.OpenRtpReader(path)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+type playbackPacket struct {
+	t    time.Time // 录像时的接收时间
+	pack *RTPPack
+}
+
+// player 按录像时的接收时间和回放速度发送回放源的 RTP 包
+type player struct {
+	s      *Session
+	source playbackSource
+	origin time.Time // 回放源的起始时间，创建时读取，之后读取源需要持有 lock
+	wake   chan struct{}
+
+	lock     sync.Mutex
+	pending  *playbackPacket // 等待发送时被唤醒而推迟发送的包
+	end      time.Time       // 回放的结束时间，零值表示到归档结尾
+	scale    float64
+	started  bool
+	paused   bool
+	closed   bool
+	gen      int       // 每次定位加 1，丢弃定位前读取的包
+	reanchor bool      // 重新计算发送时间的基准，如恢复播放或改变速度后
+	pos      time.Time // 最近发送的包的时间
+	inKey    bool      // 只发送关键帧时，是否正在发送关键帧
+	keyTs    uint32
+	keyTsSet bool
+}
+
+func newPlayer(s *Session, source playbackSource) *player {
+	origin := source.Start()
+	return &player{
+		s:      s,
+		source: source,
+		origin: origin,
+		wake:   make(chan struct{}, 1),
+		scale:  1,
+		paused: true,
+		pos:    origin,
+	}
+}
+
+func (p *player) signal() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// 定位到 start 之前最近的关键帧，并返回视频、音频通道的第一个包
+func (p *player) seek(start, end time.Time) (firsts [2]*RTPPack, err error) {
+	p.lock.Lock()
+	defer func() {
+		p.lock.Unlock()
+		p.signal()
+	}()
+
+	if err = p.source.Seek(start); err != nil {
+		return
+	}
+	p.pending = nil
+	p.end = end
+	p.gen++
+	p.reanchor = true
+	p.inKey, p.keyTsSet = true, false
+	p.pos = start
+
+	for i := 0; i < maxPrefetchPackets && (firsts[0] == nil || firsts[1] == nil); i++ {
+		_, pack, err2 := p.source.ReadPacket()
+		if err2 != nil {
+			break
+		}
+		if ch := pack.Channel; ch&1 == 0 && ch/2 < 2 && firsts[ch/2] == nil {
+			firsts[ch/2] = pack
+		}
+	}
+	// 预读只用于 RTP-Info，回到定位处以便只发送关键帧时从读取位置跳转
+	err = p.source.Seek(start)
+	return
+}
+
+// 以 scale 倍速开始或恢复播放
+func (p *player) play(scale float64) {
+	p.lock.Lock()
+	p.scale = scale
+	p.lock.Unlock()
+	p.resume()
+}
+
+func (p *player) resume() {
+	p.lock.Lock()
+	p.paused = false
+	p.reanchor = true
+	if !p.started {
+		p.started = true
+		go p.run()
+	}
+	p.lock.Unlock()
+	p.signal()
+}
+
+func (p *player) pause() {
+	p.lock.Lock()
+	p.paused = true
+	p.lock.Unlock()
+	p.signal()
+}
+
+// 最近发送的包的时间
+func (p *player) position() time.Time {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.pos
+}
+
+func (p *player) close() {
+	p.lock.Lock()
+	p.closed = true
+	if !p.started {
+		p.source.Close()
+	}
+	p.lock.Unlock()
+	p.signal()
+}
+
+func (p *player) run() {
+	defer p.source.Close()
+
+	var anchorT, anchorWall, prevT time.Time
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		p.lock.Lock()
+		if p.closed {
+			p.lock.Unlock()
+			return
+		}
+		if p.paused {
+			p.lock.Unlock()
+			<-p.wake
+			continue
+		}
+		if p.reanchor {
+			anchorWall, p.reanchor = time.Time{}, false
+		}
+		gen, scale := p.gen, p.scale
+		pkt, err := p.next()
+		if err != nil { // 回放结束，等待重新定位或关闭
+			if err != io.EOF {
+				p.s.logger.Errorf("read playback packet failed; %s", err.Error())
+			}
+			p.paused = true
+			p.lock.Unlock()
+			continue
+		}
+		p.lock.Unlock()
+
+		if anchorWall.IsZero() || pkt.t.Before(prevT) || pkt.t.Sub(prevT) > maxPlaybackGap {
+			anchorT, anchorWall = pkt.t, time.Now()
+		}
+		prevT = pkt.t
+
+		due := anchorWall.Add(time.Duration(float64(pkt.t.Sub(anchorT)) / scale))
+		if d := time.Until(due); d > 0 {
+			timer.Reset(d)
+			select {
+			case <-timer.C:
+			case <-p.wake:
+				if !timer.Stop() {
+					<-timer.C
+				}
+				p.lock.Lock()
+				if p.gen == gen { // 没有重新定位，稍后继续发送该包
+					p.pending = &pkt
+				}
+				p.lock.Unlock()
+				continue
+			}
+		}
+
+		// 读取后可能已定位、暂停或关闭：定位前读取的包丢弃，暂停时稍后继续发送；
+		// 持有锁发送，定位返回后不会再发送旧位置的包
+		p.lock.Lock()
+		if p.gen != gen || p.paused || p.closed {
+			if p.gen == gen {
+				p.pending = &pkt
+			}
+			p.lock.Unlock()
+			continue
+		}
+		p.s.Consume(pkt.pack)
+		p.pos = pkt.t
+		p.lock.Unlock()
+	}
+}
+
+// 获取下一个要发送的包，调用者需持有锁
+func (p *player) next() (pkt playbackPacket, err error) {
+	if p.pending != nil { // 已经过滤
+		pkt, p.pending = *p.pending, nil
+		return
+	}
+
+	for {
+		var t time.Time
+		var pack *RTPPack
+		if t, pack, err = p.source.ReadPacket(); err != nil {
+			return
+		}
+		pkt = playbackPacket{t, pack}
+
+		if !p.end.IsZero() && pkt.t.After(p.end) {
+			return pkt, io.EOF
+		}
+		if p.scale < keyFrameOnlyScale {
+			return
+		}
+		if send, err := p.keyFramePacket(pkt.pack); err != nil || send {
+			return pkt, err
+		}
+	}
+}
+
+// 只发送关键帧时，过滤关键帧之外的包，关键帧结束后跳到下一个关键帧
+func (p *player) keyFramePacket(pack *RTPPack) (bool, error) {
+	if !p.inKey {
+		if err := p.source.NextKeyFrame(); err != nil {
+			return false, err
+		}
+		p.inKey, p.keyTsSet = true, false
+		return false, nil
+	}
+
+	if pack.Channel != ChannelVideo {
+		return false, nil
+	}
+	if !p.keyTsSet {
+		p.keyTs, p.keyTsSet = pack.Timestamp, true
+	}
+	if pack.Timestamp != p.keyTs { // 关键帧已结束
+		p.inKey = false
+		return false, nil
+	}
+	if pack.Marker { // 关键帧的最后一个包
+		p.inKey = false
+	}
+	return true, nil
+}
+
+// 解析 PLAY 的 Range，支持 clock=20200501T080000Z-20200501T090000Z
+// 和相对于归档开始时间 origin 的 npt=10.5-20；未指定开始时 start 为零值
+func parsePlayRange(value string, origin time.Time) (start, end time.Time, npt bool, err error) {
+	if i := strings.IndexByte(value, ';'); i >= 0 { // 忽略 time 参数
+		value = value[:i]
+	}
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return
+	}
+
+	var parse func(string) (time.Time, error)
+	switch {
+	case strings.HasPrefix(value, "clock="):
+		value = value[len("clock="):]
+		parse = func(v string) (time.Time, error) {
+			return time.Parse(clockLayout, v)
+		}
+	case strings.HasPrefix(value, "npt="):
+		value = value[len("npt="):]
+		npt = true
+		parse = func(v string) (time.Time, error) {
+			d, err := parseNpt(v)
+			return origin.Add(d), err
+		}
+	default:
+		err = errInvalidRange
+		return
+	}
+
+	i := strings.IndexByte(value, '-')
+	if i < 0 {
+		err = errInvalidRange
+		return
+	}
+	if v := value[:i]; v != "" && v != "now" {
+		if start, err = parse(v); err != nil {
+			return
+		}
+	}
+	if v := value[i+1:]; v != "" {
+		if end, err = parse(v); err != nil {
+			return
+		}
+		if !start.IsZero() && !end.After(start) {
+			err = errInvalidRange
+		}
+	}
+	return
+}
+
+// 解析 npt 时间，支持秒数或 h:mm:ss.frac
+func parseNpt(v string) (time.Duration, error) {
+	var seconds float64
+	for _, field := range strings.Split(v, ":") {
+		f, err := strconv.ParseFloat(field, 64)
+		if err != nil || f < 0 {
+			return 0, errInvalidRange
+		}
+		seconds = seconds*60 + f
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// 按请求的格式生成响应的 Range
+func formatRange(npt bool, start, end, origin time.Time) string {
+	if npt {
+		s := fmt.Sprintf("npt=%.3f-", start.Sub(origin).Seconds())
+		if !end.IsZero() {
+			s += fmt.Sprintf("%.3f", end.Sub(origin).Seconds())
+		}
+		return s
+	}
+
+	const layout = "20060102T150405.000Z"
+	s := "clock=" + start.UTC().Format(layout) + "-"
+	if !end.IsZero() {
+		s += end.UTC().Format(layout)
+	}
+	return s
+}
+
+// 生成 PLAY 响应的 RTP-Info，以便播放者在定位后同步序号和时间戳
+func (s *Session) rtpInfo(firsts [2]*RTPPack) string {
+	base := *s.url
+	base.RawQuery = "" // 去掉 playback 参数
+
+	var infos []string
+	for i, control := range []string{s.vControl, s.aControl} {
+		pack := firsts[i]
+		if pack == nil || control == "" {
+			continue
+		}
+		uri := control
+		if !strings.HasPrefix(strings.ToLower(control), rtspURLPrefix) {
+			uri = strings.TrimSuffix(base.String(), "/") + "/" + control
+		}
+		infos = append(infos, fmt.Sprintf("url=%s;seq=%d;rtptime=%d",
+			uri, pack.SequenceNumber, pack.Timestamp))
+	}
+	return strings.Join(infos, ",")
+}
+
+// DESCRIBE 的 URL 带有 playback 参数时，以流的 RTP 归档作为媒体源
+func (s *Session) onDescribePlayback(resp *Response) {
+	if !s.checkPermission(auth.PullRight) {
+		resp.StatusCode = StatusForbidden
+		return
+	}
+
+	source, err := openPlayback(s.path)
+	if err != nil {
+		resp.StatusCode = StatusNotFound
+		return
+	}
+	if err = s.parseSdp(source.Sdp()); err != nil {
+		source.Close()
+		resp.StatusCode = StatusNotFound
+		return
+	}
+
+	if s.player != nil { // 重复的 DESCRIBE
+		s.player.close()
+	}
+	s.player = newPlayer(s, source)
+	resp.Header.Set(FieldContentType, "application/sdp")
+	resp.Body = s.rawSdp
+	s.mode = PlaySession
+}
+
+// 回放的 PLAY：Range 定位，Scale 倍速，不带 Range 时从暂停处继续
+func (s *Session) onPlayback(resp *Response, req *Request) (err error) {
+	if s.mode != PlaySession || s.transport.Type == RTPUnknownTrans {
+		resp.StatusCode = StatusMethodNotValidInThisState
+		return s.response(resp)
+	}
+	if !s.checkPermission(auth.PullRight) {
+		resp.StatusCode = StatusForbidden
+		return s.response(resp)
+	}
+
+	scale := 1.0
+	if v := strings.TrimSpace(req.Header.Get(FieldScale)); v != "" {
+		if scale, err = strconv.ParseFloat(v, 64); err != nil || scale <= 0 {
+			resp.StatusCode = StatusHeaderFieldNotValid
+			resp.Status = "Unsupported Scale"
+			return s.response(resp)
+		}
+	}
+
+	p := s.player
+	p.pause() // 定位期间不发送
+	rangeValue := req.Header.Get(FieldRange)
+	if rangeValue != "" || s.status == statusReady {
+		origin := p.origin
+		start, end, npt, err2 := parsePlayRange(rangeValue, origin)
+		if err2 == nil && start.IsZero() {
+			start = p.position()
+		}
+		var firsts [2]*RTPPack
+		if err2 == nil {
+			firsts, err2 = p.seek(start, end)
+		}
+		if err2 != nil {
+			resp.StatusCode = StatusInvalidRange
+			if s.status == statusPlaying {
+				p.resume()
+			}
+			return s.response(resp)
+		}
+		resp.Header.Set(FieldRange, formatRange(npt, start, end, origin))
+		if rtpInfo := s.rtpInfo(firsts); rtpInfo != "" {
+			resp.Header.Set(FieldRTPInfo, rtpInfo)
+		}
+	} else {
+		resp.Header.Set(FieldRange, formatRange(false, p.position(), time.Time{}, time.Time{}))
+	}
+	resp.Header.Set(FieldScale, strconv.FormatFloat(scale, 'f', -1, 64))
+
+	if s.status == statusReady {
+		if err = s.asPlaybackConsumer(resp); err != nil || resp.StatusCode != StatusOK {
+			return
+		}
+	} else if err = s.response(resp); err != nil {
+		return
+	}
+
+	p.play(scale)
+	s.status = statusPlaying
+	return
+}
+
+// 将 Session 作为回放的播放者，回复 PLAY 后由 player 发送包
+func (s *Session) asPlaybackConsumer(resp *Response) error {
+	typ := "tcp-playback"
+	switch s.transport.Type {
+	case RTPTCPUnicast:
+		s.consumer = &tcpConsumer{Session: s}
+	case RTPUDPUnicast:
+		c := &udpConsumer{Session: s}
+		if err := c.prepareUDP(network.GetIP(s.conn.RemoteAddr()), s.transport.ClientPorts); err != nil {
+			resp.StatusCode = StatusInternalServerError
+			return s.response(resp)
+		}
+		s.consumer = c
+		typ = "udp-playback"
+	}
+
+	s.logger = s.logger.With(xlog.Fields(
+		xlog.F("path", s.path),
+		xlog.F("type", typ)))
+	if err := s.response(resp); err != nil {
+		return err
+	}
+	s.timeout = 0 // play 只需发送不用接收，因此设置不超时
+	return nil
+}
@@ -0,0 +1,219 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package rtsp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testPlaybackStart = time.Date(2020, 5, 1, 8, 0, 0, 0, time.UTC)
+
+// 内存中的回放源：10 秒 25fps 视频，每秒一个关键帧
+type testPlaybackSource struct {
+	times []time.Time
+	packs []*RTPPack
+	pos   int
+}
+
+func newTestPlaybackSource() *testPlaybackSource {
+	src := &testPlaybackSource{}
+	for i := 0; i < 250; i++ {
+		nal := byte(0x41)
+		if i%25 == 0 {
+			nal = 0x65
+		}
+		data := []byte{0x80, 0x80 | 96, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, nal, 0x88}
+		binary.BigEndian.PutUint16(data[2:], uint16(i))
+		binary.BigEndian.PutUint32(data[4:], uint32(i*3600))
+		p := &RTPPack{Channel: ChannelVideo, Data: data}
+		p.Header.Unmarshal(data)
+		src.times = append(src.times, testPlaybackStart.Add(time.Duration(i)*40*time.Millisecond))
+		src.packs = append(src.packs, p)
+	}
+	return src
+}
+
+func (src *testPlaybackSource) Sdp() string      { return sdpRaw }
+func (src *testPlaybackSource) Start() time.Time { return src.times[0] }
+func (src *testPlaybackSource) Close() error     { return nil }
+
+func (src *testPlaybackSource) isKey(i int) bool {
+	return src.packs[i].Payload()[0] == 0x65
+}
+
+func (src *testPlaybackSource) Seek(t time.Time) error {
+	if t.After(src.times[len(src.times)-1]) {
+		return io.EOF
+	}
+	src.pos = 0
+	for i := range src.times {
+		if src.times[i].After(t) {
+			break
+		}
+		if src.isKey(i) {
+			src.pos = i
+		}
+	}
+	return nil
+}
+
+func (src *testPlaybackSource) NextKeyFrame() error {
+	for ; src.pos < len(src.packs); src.pos++ {
+		if src.isKey(src.pos) {
+			return nil
+		}
+	}
+	return io.EOF
+}
+
+func (src *testPlaybackSource) ReadPacket() (time.Time, *RTPPack, error) {
+	if src.pos >= len(src.packs) {
+		return time.Time{}, nil, io.EOF
+	}
+	src.pos++
+	return src.times[src.pos-1], src.packs[src.pos-1], nil
+}
+
+func TestParsePlayRange(t *testing.T) {
+	origin := testPlaybackStart
+	start, end, npt, err := parsePlayRange("clock=20200501T080010Z-20200501T080020Z", origin)
+	if assert.NoError(t, err) {
+		assert.False(t, npt)
+		assert.True(t, origin.Add(10*time.Second).Equal(start))
+		assert.True(t, origin.Add(20*time.Second).Equal(end))
+	}
+
+	start, end, npt, err = parsePlayRange("npt=0:01:02.5-;time=19970123T143720Z", origin)
+	if assert.NoError(t, err) {
+		assert.True(t, npt)
+		assert.True(t, origin.Add(62500*time.Millisecond).Equal(start))
+		assert.True(t, end.IsZero())
+	}
+
+	start, _, _, err = parsePlayRange("npt=now-", origin)
+	if assert.NoError(t, err) {
+		assert.True(t, start.IsZero())
+	}
+
+	for _, v := range []string{"smpte=0:10:00-", "npt=5", "npt=10-5", "npt=-1-", "clock=2020-"} {
+		_, _, _, err = parsePlayRange(v, origin)
+		assert.Error(t, err, v)
+	}
+
+	assert.Equal(t, "npt=2.500-", formatRange(true, origin.Add(2500*time.Millisecond), time.Time{}, origin))
+	assert.Equal(t, "clock=20200501T080010.000Z-20200501T080020.000Z",
+		formatRange(false, origin.Add(10*time.Second), origin.Add(20*time.Second), origin))
+}
+
+func TestPlayback(t *testing.T) {
+	orig := openPlayback
+	defer func() { openPlayback = orig }()
+	openPlayback = func(path string) (playbackSource, error) {
+		if path != "/live/playback" {
+			return nil, os.ErrNotExist
+		}
+		return newTestPlaybackSource(), nil
+	}
+
+	ln := listenRTSP(t)
+	defer ln.Close()
+
+	client := newTestClient(t, ln.Addr().String())
+	defer client.conn.Close()
+	base := "rtsp://" + ln.Addr().String() + "/live/playback"
+
+	resp := client.request(MethodDescribe, base+"/none?playback", nil, "")
+	if resp == nil || !assert.Equal(t, StatusNotFound, resp.StatusCode) {
+		return
+	}
+	resp = client.request(MethodDescribe, base+"?playback", nil, "")
+	if resp == nil || !assert.Equal(t, StatusOK, resp.StatusCode) {
+		return
+	}
+	assert.Contains(t, resp.Body, "H264/90000")
+
+	rtpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer rtpConn.Close()
+	clientPort := rtpConn.LocalAddr().(*net.UDPAddr).Port
+	ts := fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d", clientPort, clientPort+1)
+	resp = client.request(MethodSetup, base+"/streamid=0", Header{FieldTransport: {ts}}, "")
+	if resp == nil || !assert.Equal(t, StatusOK, resp.StatusCode) {
+		return
+	}
+
+	// 读取 UDP 包，返回超时时间内收到的包的 RTP 时间戳
+	buf := make([]byte, 1500)
+	receive := func(d time.Duration) (tss []uint32) {
+		deadline := time.Now().Add(d)
+		for {
+			rtpConn.SetReadDeadline(deadline)
+			n, _, err := rtpConn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if n >= 12 {
+				tss = append(tss, binary.BigEndian.Uint32(buf[4:]))
+			}
+		}
+	}
+
+	resp = client.request(MethodPlay, base, Header{FieldScale: {"0"}}, "")
+	if resp == nil || !assert.Equal(t, StatusHeaderFieldNotValid, resp.StatusCode) {
+		return
+	}
+
+	// 从 2.5 秒之前最近的关键帧开始播放
+	resp = client.request(MethodPlay, base, Header{FieldRange: {"npt=2.5-"}}, "")
+	if resp == nil || !assert.Equal(t, StatusOK, resp.StatusCode) {
+		return
+	}
+	assert.Equal(t, "npt=2.500-", resp.Header.Get(FieldRange))
+	assert.Equal(t, "1", resp.Header.Get(FieldScale))
+	assert.Contains(t, resp.Header.Get(FieldRTPInfo), "/live/playback/streamid=0;seq=50;rtptime=180000")
+	tss := receive(300 * time.Millisecond)
+	if assert.True(t, len(tss) > 2) && assert.True(t, len(tss) < 15) {
+		assert.Equal(t, uint32(50*3600), tss[0])
+	}
+
+	// 暂停后不再收到包
+	resp = client.request(MethodPause, base, nil, "")
+	if resp == nil || !assert.Equal(t, StatusOK, resp.StatusCode) {
+		return
+	}
+	assert.True(t, strings.HasPrefix(resp.Header.Get(FieldRange), "clock=20200501T08000"))
+	receive(50 * time.Millisecond)
+	assert.Empty(t, receive(200*time.Millisecond))
+
+	// 超出归档的定位
+	resp = client.request(MethodPlay, base, Header{FieldRange: {"clock=20200501T090000Z-"}}, "")
+	if resp == nil || !assert.Equal(t, StatusInvalidRange, resp.StatusCode) {
+		return
+	}
+
+	// 8 倍速从头播放，只发送关键帧
+	resp = client.request(MethodPlay, base, Header{FieldRange: {"npt=0-"}, FieldScale: {"8"}}, "")
+	if resp == nil || !assert.Equal(t, StatusOK, resp.StatusCode) {
+		return
+	}
+	assert.Equal(t, "8", resp.Header.Get(FieldScale))
+	tss = receive(400 * time.Millisecond)
+	if assert.True(t, len(tss) >= 2) {
+		for i, ts := range tss {
+			assert.Equal(t, uint32(i*25*3600), ts)
+		}
+	}
+}
@@ -6,6 +6,8 @@ package rtsp
 
 import (
 	"crypto/md5"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -21,10 +23,12 @@ import (
 
 	"github.com/cnotch/ipchub/config"
 	"github.com/cnotch/ipchub/media"
+	"github.com/cnotch/ipchub/network"
 	"github.com/cnotch/ipchub/network/socket/buffered"
 	"github.com/cnotch/ipchub/stats"
 	"github.com/cnotch/ipchub/utils"
 	"github.com/cnotch/xlog"
+	"github.com/pion/srtp/v2"
 	"github.com/pixelbender/go-sdp/sdp"
 )
 
@@ -32,15 +36,25 @@ const (
 	defaultUserAgent = config.Name + "-rstp-client/1.0"
 )
 
+var (
+	errSdpIncompatible = errors.New("the sdp of remote stream is incompatible")
+	errClientClosed    = errors.New("the pull client is closed")
+)
+
 // PullClient 负责拉流到服务器
 type PullClient struct {
 	// 打开前设置
-	closed      bool
+	closed      bool          // 连接是否已断开，只在打开或接收的 go routine 中访问
+	stopped     int32         // 调用 Close 后不再重连
+	stop        chan struct{} // 调用 Close 时关闭，唤醒重连等待
 	url         *url.URL
 	userName    string
 	password    string
 	md5password string
 	path        string
+	tunnel      bool        // 是否通过 HTTP 隧道连接
+	tlsConfig   *tls.Config // rtsps 时的 TLS 配置
+	transport   string      // 拉流的传输方式，PullTCP 等
 	rtpChannels [rtpChannelCount]int
 	logger      *xlog.Logger
 
@@ -49,11 +63,17 @@ type PullClient struct {
 
 	// 打开连接后设置
 	conn     *buffered.Conn
+	connLock sync.Mutex // 保护 conn 的设置和 Close 中的关闭
 	lockW    sync.Mutex
 	realm    string
 	nonce    string
 	rsession string
 	seq      int64
+	rtpType  RTPTransportType               // 当前连接的 RTP 传输方式
+	udp      *udpReceiver                   // UDP 单播或组播方式时接收 RTP
+	srtp     [rtpChannelCount]*srtp.Context // 安全媒体(RTP/SAVP)的解密上下文，按媒体通道索引
+	offers   [rtpChannelCount]*srtpKey      // 需要在 SETUP 时发送给服务器的密钥
+	reporter rtcpReporter                   // 统计接收情况，向服务器发送 RR
 
 	rawSdp   string
 	sdp      *sdp.Session
@@ -70,7 +90,19 @@ func NewPullClient(localPath, remoteURL string) (*PullClient, error) {
 	if err != nil {
 		return nil, err
 	}
-	if strings.ToLower(url.Scheme) != "rtsp" {
+	var tunnel bool
+	var tlsConfig *tls.Config
+	defaultPort := "554"
+	switch strings.ToLower(url.Scheme) {
+	case "rtsp":
+	case "rtsps": // RTSP over TLS
+		defaultPort = "322"
+		tlsConfig = &tls.Config{ServerName: url.Hostname()}
+	case "rtsp+http": // RTSP over HTTP 隧道，请求中仍使用 rtsp 地址
+		url.Scheme = "rtsp"
+		defaultPort = "80"
+		tunnel = true
+	default:
 		return nil, fmt.Errorf("RemoteURL '%s' is not RTSP url", remoteURL)
 	}
 	if strings.ToLower(url.Hostname()) == "" {
@@ -79,7 +111,7 @@ func NewPullClient(localPath, remoteURL string) (*PullClient, error) {
 	// 如果没有 port，补上默认端口
 	port := url.Port()
 	if len(port) == 0 {
-		url.Host = url.Hostname() + ":554"
+		url.Host = url.Hostname() + ":" + defaultPort
 	}
 
 	// 提取用户名和密码
@@ -103,11 +135,15 @@ func NewPullClient(localPath, remoteURL string) (*PullClient, error) {
 	}
 
 	client := &PullClient{
-		closed:   true,
-		url:      url,
-		userName: userName,
-		password: password,
-		path:     path,
+		closed:    true,
+		stop:      make(chan struct{}),
+		url:       url,
+		userName:  userName,
+		password:  password,
+		path:      path,
+		tunnel:    tunnel,
+		tlsConfig: tlsConfig,
+		transport: PullTCP,
 	}
 
 	for i := rtpChannelMin; i < rtpChannelCount; i++ {
@@ -122,6 +158,31 @@ func NewPullClient(localPath, remoteURL string) (*PullClient, error) {
 	return client, nil
 }
 
+// SetTransport 设置拉流的传输方式：tcp(默认)、udp、multicast 或 auto(先尝试 udp，失败时使用 tcp)
+func (c *PullClient) SetTransport(transport string) error {
+	switch transport {
+	case "":
+		transport = PullTCP
+	case PullTCP, PullUDP, PullMulticast, PullAuto:
+	default:
+		return fmt.Errorf("unsupported transport '%s'", transport)
+	}
+	c.transport = transport
+	return nil
+}
+
+// SetTLSConfig 设置 rtsps 连接的 TLS 配置，未指定 ServerName 时使用远端地址的主机名；
+// 非 rtsps 地址时忽略
+func (c *PullClient) SetTLSConfig(conf *tls.Config) {
+	if c.tlsConfig == nil || conf == nil {
+		return
+	}
+	c.tlsConfig = conf.Clone()
+	if c.tlsConfig.ServerName == "" {
+		c.tlsConfig.ServerName = c.url.Hostname()
+	}
+}
+
 // Ping 测试网络和服务器
 func (c *PullClient) Ping() error {
 	if !c.closed {
@@ -130,7 +191,7 @@ func (c *PullClient) Ping() error {
 
 	defer func() {
 		c.disconnect()
-		c.conn = nil
+		c.setConn(nil)
 		c.stream = nil
 	}()
 
@@ -160,48 +221,154 @@ func (c *PullClient) Open() (err error) {
 	defer func() {
 		if err != nil { // 出现任何错误执行断链操作
 			c.disconnect()
-			c.conn = nil
+			c.setConn(nil)
 			c.stream = nil
 		}
 	}()
 
-	// 连接
-	err = c.connect()
+	err = c.openSession(false)
 	if err != nil {
 		return err
 	}
 
-	// 请求握手
-	err = c.requestHandshake()
-	if err != nil {
-		return err
+	mproxy := &multicastProxy{
+		path:        c.path,
+		bufferSize:  config.NetBufferSize(),
+		multicastIP: utils.Multicast.NextIP(), // 设置组播IP
+		ttl:         config.MulticastTTL(),
+		logger:      c.logger,
 	}
 
-	// 获取流信息
-	err = c.requestSDP()
-	if err != nil {
+	for i := rtpChannelMin; i < rtpChannelCount; i++ {
+		mproxy.ports[i] = utils.Multicast.NextPort()
+	}
+
+	c.stream = media.NewStream(c.path, c.rawSdp,
+		media.Attr("addr", c.url.String()),
+		media.Multicast(mproxy))
+	media.Regist(c.stream) // 向媒体中心注册流
+	c.attachUDP()
+	go c.playStream()
+	return nil
+}
+
+// Close 关闭客户端；只通知停止并关闭当前连接，其他资源由接收 go routine 释放
+func (c *PullClient) Close() error {
+	if !atomic.CompareAndSwapInt32(&c.stopped, 0, 1) {
+		return nil
+	}
+	close(c.stop)
+
+	c.connLock.Lock()
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.connLock.Unlock()
+	return nil
+}
+
+func (c *PullClient) setConn(conn *buffered.Conn) {
+	c.connLock.Lock()
+	c.conn = conn
+	c.connLock.Unlock()
+}
+
+// 重新连接远端服务器并请求播放，sdp 必须与现有的流兼容
+func (c *PullClient) reconnect() error {
+	if err := c.openSession(true); err != nil {
 		return err
 	}
+	c.attachUDP()
+	return nil
+}
 
-	// 设置通讯通道
-	err = c.requestSetup()
+// 依次发送请求：OPTIONS、DESCRIBE、SETUP、PLAY；
+// auto 方式时先使用 UDP，SETUP 失败或收不到 RTP 包时改用 TCP
+func (c *PullClient) openSession(checkSdp bool) (err error) {
+	types := []RTPTransportType{RTPTCPUnicast}
+	switch c.transport {
+	case PullUDP:
+		types[0] = RTPUDPUnicast
+	case PullMulticast:
+		types[0] = RTPMulticast
+	case PullAuto:
+		types = []RTPTransportType{RTPUDPUnicast, RTPTCPUnicast}
+	}
+
+	for _, rtpType := range types {
+		c.rtpType = rtpType
+		if err = c.openSessionWith(checkSdp); err == nil || err == errSdpIncompatible {
+			break
+		}
+		c.disconnect()
+		if c.rtpType != RTPTCPUnicast {
+			c.logger.Warnf("play over udp failed; %v", err)
+		}
+	}
 	if err != nil {
-		return err
+		c.disconnect()
 	}
+	return
+}
 
+func (c *PullClient) openSessionWith(checkSdp bool) (err error) {
+	// 连接
+	if err = c.connect(); err != nil {
+		return
+	}
+	// 请求握手
+	if err = c.requestHandshake(); err != nil {
+		return
+	}
+	// 获取流信息
+	if err = c.requestSDP(); err != nil {
+		return
+	}
+	if checkSdp && !sdpCompatible(c.stream.Sdp(), c.rawSdp) {
+		return errSdpIncompatible
+	}
+	// 设置通讯通道
+	if err = c.requestSetup(); err != nil {
+		return
+	}
 	// 请求播放
-	err = c.requestPlay()
-	if err != nil {
-		return err
+	if err = c.requestPlay(); err != nil {
+		return
 	}
 
-	return err
+	if c.udp != nil && c.transport == PullAuto {
+		return c.udp.waitReceived(udpProbeTimeout)
+	}
+	return nil
 }
 
-// Close 关闭客户端
-func (c *PullClient) Close() error {
-	c.disconnect()
-	return nil
+// UDP 方式时，将收到的包写入流
+func (c *PullClient) attachUDP() {
+	if c.udp != nil {
+		c.udp.setHandler(c.onPack)
+	}
+}
+
+// 比较两个 sdp 中音视频的编码格式(包括负载类型和 fmtp 参数)是否一致
+func sdpCompatible(rawSdp1, rawSdp2 string) bool {
+	formats := func(rawSdp string) (map[string]string, bool) {
+		session, err := sdp.ParseString(rawSdp)
+		if err != nil {
+			return nil, false
+		}
+		m := make(map[string]string, 2)
+		for _, media := range session.Media {
+			if len(media.Format) > 0 {
+				f := media.Format[0]
+				m[media.Type] = fmt.Sprint(f.Payload, f.Name, f.ClockRate, f.Channels, f.Params)
+			}
+		}
+		return m, true
+	}
+
+	m1, ok1 := formats(rawSdp1)
+	m2, ok2 := formats(rawSdp2)
+	return ok1 && ok2 && m1["video"] == m2["video"] && m1["audio"] == m2["audio"]
 }
 
 func (c *PullClient) requestHandshake() (err error) {
@@ -222,130 +389,235 @@ func (c *PullClient) requestSDP() (err error) {
 	}
 
 	// 解析
-	c.rawSdp = resp.Body
-	c.sdp, err = sdp.ParseString(c.rawSdp)
+	c.sdp, err = sdp.ParseString(resp.Body)
 	if err != nil {
 		return err
 	}
+	// 流使用解密后的明文 RTP
+	c.rawSdp = plainSdp(resp.Body)
 
 	for _, media := range c.sdp.Media {
+		var ch int
 		switch media.Type {
 		case "video":
+			ch = ChannelVideo
 			c.vControl = media.Attributes.Get("control")
 			c.vCodec = media.Format[0].Name
 
 		case "audio":
+			ch = ChannelAudio
 			c.aControl = media.Attributes.Get("control")
 			c.aCodec = media.Format[0].Name
+		default:
+			continue
+		}
+
+		if strings.Contains(media.Proto, "SAVP") {
+			if err = c.setupSrtp(ch, media); err != nil {
+				return err
+			}
 		}
 	}
 	return err
 }
 
+// 初始化安全媒体的解密上下文
+func (c *PullClient) setupSrtp(ch int, media *sdp.Media) error {
+	key, offer, err := srtpKeyOf(c.sdp, media)
+	if err != nil {
+		return err
+	}
+	if c.srtp[ch], err = key.decryptContext(); err != nil {
+		return err
+	}
+	if offer {
+		c.offers[ch] = key
+	}
+	return nil
+}
+
 func (c *PullClient) requestSetup() (err error) {
-	var respVS, respAS *Response
+	if c.rtpType != RTPTCPUnicast {
+		c.udp = newUDPReceiver(c.logger)
+	}
+
 	// 视频通道设置
 	if len(c.vControl) > 0 {
-		var setupURL *url.URL
-		setupURL, err = c.getSetupURL(c.vControl)
-
-		r := c.newRequest(MethodSetup, setupURL)
-		r.Header.Set(FieldTransport,
-			fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", c.rtpChannels[ChannelVideo], c.rtpChannels[ChannelVideoControl]))
-		respVS, err = c.requestWithResponse(r)
-		if err != nil {
-			return err
+		if err = c.setupChannel(c.vControl, int(ChannelVideo)); err != nil {
+			return
 		}
 	}
 
 	// 音频通道设置
 	if len(c.aControl) > 0 {
-		var setupURL *url.URL
-		setupURL, err = c.getSetupURL(c.aControl)
+		err = c.setupChannel(c.aControl, int(ChannelAudio))
+	}
+	return
+}
 
-		r := c.newRequest(MethodSetup, setupURL)
-		r.Header.Set(FieldTransport,
-			fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", c.rtpChannels[ChannelAudio], c.rtpChannels[ChannelAudioControl]))
+func (c *PullClient) setupChannel(ctrl string, ch int) (err error) {
+	setupURL, err := c.getSetupURL(ctrl)
+	if err != nil {
+		return err
+	}
 
-		respAS, err = c.requestWithResponse(r)
-		if err != nil {
+	profile := "RTP/AVP"
+	if c.srtp[ch] != nil {
+		profile = "RTP/SAVP"
+	}
+
+	var ts string
+	switch c.rtpType {
+	case RTPTCPUnicast:
+		ts = fmt.Sprintf("%s/TCP;unicast;interleaved=%d-%d", profile, c.rtpChannels[ch], c.rtpChannels[ch+1])
+	case RTPUDPUnicast:
+		var port int
+		if port, err = c.udp.listenPair(ch); err != nil {
 			return err
 		}
+		ts = fmt.Sprintf("%s;unicast;client_port=%d-%d", profile, port, port+1)
+	default:
+		ts = profile + ";multicast"
 	}
-	_ = respVS
-	_ = respAS
-	return
-}
-
-func (c *PullClient) requestPlay() (err error) {
-	r := c.newRequest(MethodPlay, c.url)
 
+	r := c.newRequest(MethodSetup, setupURL)
+	r.Header.Set(FieldTransport, ts)
+	if key := c.offers[ch]; key != nil {
+		// 服务器未提供密钥，通过 MIKEY 发送客户端的密钥
+		r.Header.Set(FieldKeyMgmt, fmt.Sprintf(`prot=mikey; uri="%s"; data="%s"`,
+			setupURL, base64.StdEncoding.EncodeToString(marshalMikey(key))))
+	}
 	resp, err := c.requestWithResponse(r)
-	if err != nil {
+	if err != nil || c.rtpType == RTPTCPUnicast {
 		return err
 	}
-	_ = resp
-	mproxy := &multicastProxy{
-		path:        c.path,
-		bufferSize:  config.NetBufferSize(),
-		multicastIP: utils.Multicast.NextIP(), // 设置组播IP
-		ttl:         config.MulticastTTL(),
-		logger:      c.logger,
+
+	// 从回复的 Transport 获取服务器端口或组播地址
+	var t RTPTransport
+	if err = t.ParseTransport(ch, resp.Header.Get(FieldTransport)); err != nil {
+		return err
+	}
+	if c.rtpType == RTPUDPUnicast {
+		if t.Type != RTPUDPUnicast {
+			return errors.New("the server does not support udp unicast")
+		}
+		ip := network.GetIP(c.conn.RemoteAddr())
+		if len(t.Source) > 0 {
+			ip = t.Source
+		}
+		c.udp.setPeer(ch, ip, t.ServerPorts)
+		return nil
 	}
 
-	for i := rtpChannelMin; i < rtpChannelCount; i++ {
-		mproxy.ports[i] = utils.Multicast.NextPort()
+	if t.Type != RTPMulticast || len(t.MulticastIP) == 0 {
+		return errors.New("the server does not support multicast")
 	}
+	return c.udp.joinGroup(ch, t.MulticastIP, t.Source, t.Ports)
+}
 
-	c.stream = media.NewStream(c.path, c.rawSdp,
-		media.Attr("addr", c.url.String()),
-		media.Multicast(mproxy))
-	go c.playStream()
+func (c *PullClient) requestPlay() (err error) {
+	r := c.newRequest(MethodPlay, c.url)
 
-	return nil
+	_, err = c.requestWithResponse(r)
+	if err == nil && c.udp != nil {
+		c.udp.start()
+	}
+	return err
 }
 
+// 接收 RTP 流，连接断开后按指数退避重连；
+// 流被关闭、客户端被关闭或重连后 sdp 不兼容时才注销流
 func (c *PullClient) playStream() {
 	defer func() {
 		if r := recover(); r != nil {
 			c.logger.Errorf("pull stream panic; %v \n %s", r, debug.Stack())
 		}
 
-		stats.RtspConns.Release() // 减少RTSP连接计数
-		media.Unregist(c.stream)  // 从媒体中心取消注册
-		c.disconnect()            // 确保网络关闭
-		c.conn = nil              // 通知GC，尽早释放资源
+		media.Unregist(c.stream) // 从媒体中心取消注册
+		c.disconnect()           // 确保网络关闭
+		c.setConn(nil)           // 通知GC，尽早释放资源
 		c.stream = nil
 		c.logger.Infof("close pull stream")
 	}()
 
 	c.logger.Infof("open pull stream")
-	media.Regist(c.stream) // 向媒体中心注册流
-	stats.RtspConns.Add()  // 增加一个 RTSP 连接计数
+
+	var backoff utils.Backoff
+	for {
+		err := c.receiveStream()
+		if err == nil || c.isStopped() {
+			return
+		}
+
+		c.stream.SetLastError(err)
+		c.disconnect()
+		for {
+			d := backoff.Next()
+			c.logger.Warnf("reconnect after %v", d)
+			select {
+			case <-c.stop:
+				return
+			case <-time.After(d):
+			}
+			if c.isStopped() {
+				return
+			}
+
+			err = c.reconnect()
+			if err == nil {
+				break
+			}
+			c.stream.SetLastError(err)
+			c.logger.Errorf("reconnect failed; %v", err)
+			if err == errSdpIncompatible {
+				return
+			}
+		}
+
+		backoff.Reset()
+		c.stream.AddReconnect()
+		c.logger.Info("reconnect success")
+	}
+}
+
+// 客户端或流已经关闭
+func (c *PullClient) isStopped() bool {
+	return atomic.LoadInt32(&c.stopped) != 0 || c.stream.IsClosed()
+}
+
+// 接收 RTP 流直到连接出错，主动关闭时返回 nil
+func (c *PullClient) receiveStream() error {
+	stats.RtspConns.Add()           // 增加一个 RTSP 连接计数
+	defer stats.RtspConns.Release() // 减少RTSP连接计数
 
 	lastHeartbeat := time.Now()
 	reader := c.conn.Reader()
 	heartbeatInterval := config.NetHeartbeatInterval()
 	timeout := config.NetTimeout()
 
-	for !c.closed {
+	for !c.isStopped() {
 		deadLine := time.Time{}
-		if timeout > 0 {
+		if c.udp != nil { // RTP 不经过 RTSP 连接，定时检查 UDP 接收和发送心跳
+			deadLine = time.Now().Add(time.Second)
+		} else if timeout > 0 {
 			deadLine = time.Now().Add(timeout)
 		}
 		if err := c.conn.SetReadDeadline(deadLine); err != nil {
 			c.logger.Error(err.Error())
-			break
+			return err
 		}
 
 		err := receive(c.logger, reader, c.rtpChannels[:], c)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && c.udp != nil {
+			err = c.udp.check(timeout)
+		}
 		if err != nil {
 			if err == io.EOF { // 如果对方断开
 				c.logger.Warn("The remote RTSP server is actively disconnected.")
-			} else if !c.closed { // 如果非主动关闭
+			} else if !c.isStopped() { // 如果非主动关闭
 				c.logger.Error(err.Error())
 			}
-			break
+			return err
 		}
 
 		if heartbeatInterval > 0 && time.Now().Sub(lastHeartbeat) > heartbeatInterval {
@@ -355,17 +627,60 @@ func (c *PullClient) playStream() {
 			err := c.request(r)
 			if err != nil {
 				c.logger.Error(err.Error())
-				break
+				return err
+			}
+			if c.udp != nil { // 保持 NAT 映射
+				c.udp.punch()
 			}
 		}
 	}
-	reader = nil
+	return nil
 }
 
 func (c *PullClient) onPack(p *RTPPack) error {
+	// 安全媒体先解密，控制通道使用对应媒体通道的上下文
+	if ctx := c.srtp[p.Channel&^1]; ctx != nil {
+		var data []byte
+		var err error
+		if p.Channel == ChannelVideo || p.Channel == ChannelAudio {
+			data, err = ctx.DecryptRTP(nil, p.Data, &p.Header)
+		} else {
+			data, err = ctx.DecryptRTCP(nil, p.Data, nil)
+		}
+		if err != nil { // 丢弃重放或认证失败的包
+			c.logger.Debugf("srtp decrypt failed; %v", err)
+			return nil
+		}
+		p.Data = data
+	}
+
+	// 安全媒体的 RR 需要加密，暂不发送
+	if c.srtp[p.Channel&^1] == nil {
+		for _, rr := range c.reporter.onReceive(p, clockRateOf(c.stream, p.Channel), time.Now()) {
+			c.sendRtcp(rr)
+		}
+	}
 	return c.stream.WriteRtpPacket(p)
 }
 
+// 向服务器发送 RTCP 包，失败时只记录日志
+func (c *PullClient) sendRtcp(p *RTPPack) {
+	var err error
+	if c.udp != nil {
+		err = c.udp.send(p)
+	} else {
+		c.lockW.Lock()
+		err = p.Write(c.conn, c.rtpChannels[:])
+		if err == nil {
+			_, err = c.conn.Flush()
+		}
+		c.lockW.Unlock()
+	}
+	if err != nil {
+		c.logger.Debugf("send rtcp failed; %v", err)
+	}
+}
+
 func (c *PullClient) onRequest(r *Request) (err error) {
 	// 只处理 Options 方法
 	switch r.Method {
@@ -400,8 +715,10 @@ func (c *PullClient) onResponse(resp *Response) (err error) {
 }
 
 func (c *PullClient) getSetupURL(ctrl string) (setupURL *url.URL, err error) {
-	if len(ctrl) >= len(rtspURLPrefix) && strings.EqualFold(ctrl[:len(rtspURLPrefix)], rtspURLPrefix) {
-		return url.Parse(ctrl)
+	for _, prefix := range []string{rtspURLPrefix, rtspsURLPrefix} {
+		if len(ctrl) >= len(prefix) && strings.EqualFold(ctrl[:len(prefix)], prefix) {
+			return url.Parse(ctrl)
+		}
 	}
 
 	setupURL = new(url.URL)
@@ -627,16 +944,33 @@ func (c *PullClient) response(resp *Response) error {
 func (c *PullClient) connect() error {
 	// 连接超时要更短
 	timeout := time.Duration(int64(config.NetTimeout()) / 3)
-	conn, err := net.DialTimeout("tcp", c.url.Host, timeout)
+	var conn net.Conn
+	var err error
+	switch {
+	case c.tunnel:
+		conn, err = dialTunnel(c.url.Host, c.url.RequestURI(), timeout)
+	case c.tlsConfig != nil:
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", c.url.Host, c.tlsConfig)
+	default:
+		conn, err = net.DialTimeout("tcp", c.url.Host, timeout)
+	}
 	if err != nil {
 		c.logger.Errorf("connet remote server fail,err = %v", err)
 		return err
 	}
 
+	// 与 Close 互斥，关闭后不再保留新连接
+	c.connLock.Lock()
+	if atomic.LoadInt32(&c.stopped) != 0 {
+		c.connLock.Unlock()
+		conn.Close()
+		return errClientClosed
+	}
 	c.closed = false // 已经连接
 	c.conn = buffered.NewConn(conn,
 		buffered.FlushRate(config.NetFlushRate()),
 		buffered.BufferSize(config.NetBufferSize()))
+	c.connLock.Unlock()
 
 	c.logger.Infof("connect remote server success")
 	return nil
@@ -653,8 +987,13 @@ func (c *PullClient) disconnect() {
 	if c.conn != nil {
 		c.conn.Close()
 	}
+	if c.udp != nil {
+		c.udp.close()
+		c.udp = nil
+	}
 
 	c.rsession = ""
+	c.reporter = rtcpReporter{}
 	atomic.StoreInt64(&c.seq, 0)
 	c.realm = ""
 	c.sdp = nil
@@ -662,4 +1001,6 @@ func (c *PullClient) disconnect() {
 	c.vControl = ""
 	c.aCodec = ""
 	c.vCodec = ""
+	c.srtp = [rtpChannelCount]*srtp.Context{}
+	c.offers = [rtpChannelCount]*srtpKey{}
 }
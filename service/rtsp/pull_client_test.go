@@ -0,0 +1,422 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package rtsp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/cnotch/ipchub/media"
+	"github.com/cnotch/ipchub/provider/route"
+	"github.com/cnotch/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+// 启动本地 rtsp 服务，返回地址
+func listenRTSP(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	onAccept := CreateAcceptHandler()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			onAccept(conn)
+		}
+	}()
+	return ln
+}
+
+func TestSdpCompatible(t *testing.T) {
+	assert.True(t, sdpCompatible(sdpRaw, sdpRaw))
+	assert.False(t, sdpCompatible(sdpRaw, sdpRaw3))
+	assert.False(t, sdpCompatible(sdpRaw, sdpRaw4))
+	assert.False(t, sdpCompatible(sdpRaw, "illegal"))
+}
+
+// 源流断开后重连，sdp 兼容时保持原来的流
+func TestPullReconnect(t *testing.T) {
+	ln := listenRTSP(t)
+	defer ln.Close()
+
+	source := media.NewStream("/live/src", sdpRaw)
+	media.Regist(source)
+	stream, err := NewPullStreamFacotry().Create("/live/rtsppull", "rtsp://"+ln.Addr().String()+"/live/src")
+	if !assert.NoError(t, err) {
+		media.Unregist(source)
+		return
+	}
+	defer media.Unregist(stream)
+	assert.True(t, stream == media.Get("/live/rtsppull"))
+
+	waitFor := func(cond func() bool) bool {
+		for i := 0; i < 100; i++ {
+			if cond() {
+				return true
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		return false
+	}
+
+	// 源流关闭后重新注册相同 sdp 的流
+	media.Unregist(source)
+	source = media.NewStream("/live/src", sdpRaw)
+	media.Regist(source)
+	assert.True(t, waitFor(func() bool { return stream.Info(false).Reconnects == 1 }))
+	assert.True(t, stream == media.Get("/live/rtsppull"))
+	assert.False(t, stream.IsClosed())
+	assert.NotEmpty(t, stream.Info(false).LastError)
+
+	// sdp 不兼容时注销流
+	media.Unregist(source)
+	source = media.NewStream("/live/src", sdpRaw4)
+	media.Regist(source)
+	defer media.Unregist(source)
+	assert.True(t, waitFor(stream.IsClosed))
+	assert.Nil(t, media.Get("/live/rtsppull"))
+	assert.Equal(t, errSdpIncompatible.Error(), stream.Info(false).LastError)
+}
+
+// 每 10 毫秒向源写入一个序号递增的视频 RTP 包，直到 done 关闭
+func writeRtpPackets(source *media.Stream, done chan struct{}) {
+	for seq := uint16(0); ; seq++ {
+		data := []byte{0x80, 96, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x41, 0x9a}
+		binary.BigEndian.PutUint16(data[2:], seq)
+		binary.BigEndian.PutUint32(data[4:], uint32(seq)*3600)
+		p := &RTPPack{Channel: ChannelVideo, Data: data}
+		p.Header.Unmarshal(data)
+		source.WriteRtpPacket(p)
+
+		select {
+		case <-done:
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestReorderBuffer(t *testing.T) {
+	var b reorderBuffer
+	var seqs []uint16
+	handler := func(p *RTPPack) error {
+		seqs = append(seqs, p.SequenceNumber)
+		return nil
+	}
+
+	// 乱序、回绕、重复、丢包、迟到和序号重置
+	for _, seq := range []uint16{65534, 0, 65535, 1, 1, 3, 40, 30, 1000, 10} {
+		p := &RTPPack{Channel: ChannelVideo}
+		p.SequenceNumber = seq
+		b.push(p, handler)
+	}
+	assert.Equal(t, []uint16{65534, 65535, 0, 1, 3, 40, 1000, 10}, seqs)
+
+	// 等待丢失的包超时后跳过
+	seqs = nil
+	p := &RTPPack{Channel: ChannelVideo}
+	p.SequenceNumber = 12
+	b.push(p, handler)
+	assert.Empty(t, seqs)
+	b.expire(time.Now(), handler)
+	assert.Empty(t, seqs)
+	b.expire(time.Now().Add(reorderTimeout), handler)
+	assert.Equal(t, []uint16{12}, seqs)
+}
+
+func TestUDPReceiverAccept(t *testing.T) {
+	r := newUDPReceiver(xlog.L())
+	r.setPeer(ChannelVideo, "127.0.0.1", [rtpChannelCount]int{6970, 6971})
+	assert.True(t, r.accept(ChannelVideo, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6970}))
+	assert.False(t, r.accept(ChannelVideo, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 7000}))
+	assert.False(t, r.accept(ChannelVideoControl, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 6971}))
+	// 没有服务器端口的通道只检查地址
+	assert.True(t, r.accept(ChannelAudio, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 7000}))
+	assert.False(t, r.accept(ChannelAudio, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 7000}))
+}
+
+type packetCounter struct {
+	lock sync.Mutex
+	seqs []uint16
+}
+
+func (c *packetCounter) Consume(p media.Pack) {
+	if pack := p.(*RTPPack); pack.Channel == ChannelVideo {
+		c.lock.Lock()
+		c.seqs = append(c.seqs, pack.SequenceNumber)
+		c.lock.Unlock()
+	}
+}
+
+func (c *packetCounter) Close() error { return nil }
+
+func (c *packetCounter) count() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.seqs)
+}
+
+// 以 UDP 方式拉流
+func TestPullUDP(t *testing.T) {
+	ln := listenRTSP(t)
+	defer ln.Close()
+
+	source := media.NewStream("/live/udpsrc", sdpRaw)
+	media.Regist(source)
+	defer media.Unregist(source)
+
+	// 持续向源写入 RTP 包
+	done := make(chan struct{})
+	defer close(done)
+	go writeRtpPackets(source, done)
+
+	url := "rtsp://" + ln.Addr().String() + "/live/udpsrc"
+	for _, transport := range []string{PullUDP, PullAuto} {
+		client, err := NewPullClient("/live/udppull", url)
+		if !assert.NoError(t, err) || !assert.NoError(t, client.SetTransport(transport)) {
+			return
+		}
+		if !assert.NoError(t, client.Open(), transport) {
+			continue
+		}
+		assert.Equal(t, RTPUDPUnicast, client.rtpType)
+
+		stream := client.stream
+		counter := &packetCounter{}
+		stream.StartConsume(counter, media.RTPPacket, "test")
+		for i := 0; i < 100 && counter.count() < 10; i++ {
+			time.Sleep(20 * time.Millisecond)
+		}
+		counter.lock.Lock()
+		assert.True(t, len(counter.seqs) >= 10, transport)
+		for i := 1; i < len(counter.seqs); i++ {
+			assert.Equal(t, counter.seqs[i-1]+1, counter.seqs[i])
+		}
+		counter.lock.Unlock()
+		media.Unregist(stream)
+	}
+
+	// 源不支持组播
+	client, _ := NewPullClient("/live/udppull", url)
+	client.SetTransport(PullMulticast)
+	assert.Error(t, client.Open())
+	assert.Error(t, client.SetTransport("http"))
+}
+
+// 在其他 go routine 中关闭正在拉流或等待重连的客户端
+func TestPullClose(t *testing.T) {
+	ln := listenRTSP(t)
+	defer ln.Close()
+
+	source := media.NewStream("/live/closesrc", sdpRaw)
+	media.Regist(source)
+	done := make(chan struct{})
+	defer close(done)
+	go writeRtpPackets(source, done)
+
+	waitClosed := func(stream *media.Stream) bool {
+		for i := 0; i < 100 && !stream.IsClosed(); i++ {
+			time.Sleep(20 * time.Millisecond)
+		}
+		return stream.IsClosed()
+	}
+
+	url := "rtsp://" + ln.Addr().String() + "/live/closesrc"
+	for _, transport := range []string{PullTCP, PullUDP} {
+		client, _ := NewPullClient("/live/closepull", url)
+		client.SetTransport(transport)
+		if !assert.NoError(t, client.Open(), transport) {
+			continue
+		}
+		stream := client.stream
+		time.Sleep(50 * time.Millisecond)
+		assert.NoError(t, client.Close())
+		assert.NoError(t, client.Close())
+		assert.True(t, waitClosed(stream), transport)
+		assert.Nil(t, media.Get("/live/closepull"))
+		assert.Equal(t, errClientClosed, client.Open())
+	}
+
+	// 源断开后在重连等待中关闭
+	client, _ := NewPullClient("/live/closepull", url)
+	if !assert.NoError(t, client.Open()) {
+		media.Unregist(source)
+		return
+	}
+	stream := client.stream
+	media.Unregist(source)
+	time.Sleep(100 * time.Millisecond)
+	client.Close()
+	assert.True(t, waitClosed(stream))
+}
+
+// 通过 HTTP 隧道拉流
+func TestPullTunnel(t *testing.T) {
+	server := httptest.NewServer(TunnelHandler(CreateAcceptHandler(), http.NotFoundHandler()))
+	defer server.Close()
+
+	source := media.NewStream("/live/tunnelsrc", sdpRaw)
+	media.Regist(source)
+	defer media.Unregist(source)
+	done := make(chan struct{})
+	defer close(done)
+	go writeRtpPackets(source, done)
+
+	remoteURL := "rtsp+http://" + server.Listener.Addr().String() + "/live/tunnelsrc"
+	assert.True(t, NewPullStreamFacotry().Can(remoteURL))
+	stream, err := NewPullStreamFacotry().Create("/live/tunnelpull", remoteURL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer media.Unregist(stream)
+
+	counter := &packetCounter{}
+	stream.StartConsume(counter, media.RTPPacket, "test")
+	for i := 0; i < 100 && counter.count() < 10; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.True(t, counter.count() >= 10)
+
+	// 非隧道请求
+	resp, err := http.Get(server.URL + "/live/tunnelsrc")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestBase64Reader(t *testing.T) {
+	// 每个请求单独编码，填充字符出现在中间，且分多次到达
+	var encoded string
+	for _, s := range []string{"OPTIONS", " rtsp://localhost/live", "\r\n\r\n"} {
+		encoded += base64.StdEncoding.EncodeToString([]byte(s)) + "\r\n"
+	}
+	r := newBase64Reader(iotest.OneByteReader(strings.NewReader(encoded)))
+	data, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "OPTIONS rtsp://localhost/live\r\n\r\n", string(data))
+
+	_, err = ioutil.ReadAll(newBase64Reader(strings.NewReader("T1B*")))
+	assert.Error(t, err)
+}
+
+// 生成 127.0.0.1 的自签名证书
+func newTestCertificate(t *testing.T) (tls.Certificate, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, der
+}
+
+// 通过 rtsps 拉流
+func TestPullRTSPS(t *testing.T) {
+	cert, der := newTestCertificate(t)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ln.Close()
+	onAccept := CreateAcceptHandler()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			onAccept(conn)
+		}
+	}()
+
+	source := media.NewStream("/live/tlssrc", sdpRaw)
+	media.Regist(source)
+	defer media.Unregist(source)
+
+	caFile, err := ioutil.TempFile("", "ca*.pem")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.Remove(caFile.Name())
+	pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	caFile.Close()
+
+	sum := sha256.Sum256(der)
+	pin := hex.EncodeToString(sum[:])
+	wrongPin := hex.EncodeToString(make([]byte, 32))
+
+	remoteURL := "rtsps://" + ln.Addr().String() + "/live/tlssrc"
+	assert.True(t, NewPullStreamFacotry().Can(remoteURL))
+	tests := []struct {
+		name    string
+		opts    *route.TLSOptions
+		wantErr bool
+	}{
+		{"verify", nil, true},
+		{"ca", &route.TLSOptions{CA: caFile.Name()}, false},
+		{"insecure", &route.TLSOptions{Insecure: true}, false},
+		{"pin", &route.TLSOptions{Insecure: true, Pins: []string{pin}}, false},
+		{"ca+wrong pin", &route.TLSOptions{CA: caFile.Name(), Pins: []string{wrongPin}}, true},
+	}
+	for _, tt := range tests {
+		client, err := NewPullClient("/live/tlspull", remoteURL)
+		if !assert.NoError(t, err) {
+			return
+		}
+		if tt.opts != nil {
+			conf, err := newTLSConfig(tt.opts)
+			if !assert.NoError(t, err, tt.name) {
+				continue
+			}
+			client.SetTLSConfig(conf)
+		}
+
+		err = client.Open()
+		if tt.wantErr {
+			assert.Error(t, err, tt.name)
+			continue
+		}
+		if assert.NoError(t, err, tt.name) {
+			assert.True(t, client.stream == media.Get("/live/tlspull"))
+			media.Unregist(client.stream)
+		}
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"strings"
 
 	"github.com/cnotch/ipchub/media"
+	"github.com/cnotch/ipchub/provider/route"
 )
 
 func init() {
@@ -24,8 +25,10 @@ func NewPullStreamFacotry() media.PullStreamFactory {
 }
 
 func (f *pullStreamFactory) Can(remoteURL string) bool {
-	if len(remoteURL) >= len(rtspURLPrefix) && strings.EqualFold(remoteURL[:len(rtspURLPrefix)], rtspURLPrefix) {
-		return true
+	for _, prefix := range []string{rtspURLPrefix, rtspsURLPrefix, tunnelURLPrefix} {
+		if len(remoteURL) >= len(prefix) && strings.EqualFold(remoteURL[:len(prefix)], prefix) {
+			return true
+		}
 	}
 	return false
 }
@@ -35,6 +38,20 @@ func (f *pullStreamFactory) Create(localPath, remoteURL string) (*media.Stream,
 	if err != nil {
 		return nil, err
 	}
+
+	// 路由指定的传输方式和证书验证选项
+	if r := route.Match(localPath); r != nil {
+		if err = client.SetTransport(r.Transport); err != nil {
+			return nil, err
+		}
+		if r.TLS != nil {
+			conf, err := newTLSConfig(r.TLS)
+			if err != nil {
+				return nil, err
+			}
+			client.SetTLSConfig(conf)
+		}
+	}
 	err = client.Open()
 	if err != nil {
 		return nil, err
@@ -0,0 +1,63 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package rtsp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/cnotch/ipchub/provider/route"
+)
+
+var errCertPinMismatch = errors.New("the server certificate does not match any pin")
+
+// 根据路由的证书验证选项创建 rtsps 拉流的 TLS 配置
+func newTLSConfig(opts *route.TLSOptions) (*tls.Config, error) {
+	conf := &tls.Config{InsecureSkipVerify: opts.Insecure}
+
+	// 自定义 CA
+	if opts.CA != "" {
+		pem, err := ioutil.ReadFile(opts.CA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in '%s'", opts.CA)
+		}
+		conf.RootCAs = pool
+	}
+
+	// 证书固定，在证书链验证之后(或跳过验证时)检查服务器证书的指纹
+	if len(opts.Pins) > 0 {
+		pins := make([][]byte, 0, len(opts.Pins))
+		for _, pin := range opts.Pins {
+			b, err := route.PinBytes(pin)
+			if err != nil {
+				return nil, err
+			}
+			pins = append(pins, b)
+		}
+
+		conf.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errCertPinMismatch
+			}
+			sum := sha256.Sum256(rawCerts[0])
+			for _, pin := range pins {
+				if bytes.Equal(pin, sum[:]) {
+					return nil
+				}
+			}
+			return errCertPinMismatch
+		}
+	}
+	return conf, nil
+}
@@ -0,0 +1,387 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package rtsp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cnotch/ipchub/config"
+	"github.com/cnotch/xlog"
+)
+
+// 拉流的传输方式
+const (
+	PullTCP       = "tcp"       // RTP over RTSP(TCP)
+	PullUDP       = "udp"       // RTP/AVP UDP 单播
+	PullMulticast = "multicast" // RTP/AVP 组播
+	PullAuto      = "auto"      // 先尝试 UDP 单播，失败时使用 TCP
+)
+
+const (
+	// 按序号重排 RTP 包的窗口大小
+	reorderWindow = 32
+	// 丢包时等待后续包的最长时间，超时后跳过丢失的包
+	reorderTimeout = time.Millisecond * 150
+	// auto 方式下等待第一个 UDP 包的时间，超时改用 TCP
+	udpProbeTimeout = time.Second * 3
+	// 分配 RTP、RTCP 端口对的最大尝试次数
+	udpPairAttempts = 16
+)
+
+var (
+	errUDPNoData  = errors.New("no rtp packet received over udp")
+	errUDPTimeout = errors.New("udp receive timeout")
+)
+
+// udpReceiver 以 UDP 单播或组播方式接收 RTP、RTCP 包
+type udpReceiver struct {
+	logger   *xlog.Logger
+	conns    [rtpChannelCount]*net.UDPConn
+	peers    [rtpChannelCount]*net.UDPAddr // 服务器的发送端口，用于 NAT 打洞和过滤收到的包
+	source   net.IP                        // 服务器或组播源的地址，不为空时只接收来自该地址的包
+	reorders [rtpChannelCount]reorderBuffer
+
+	lock     sync.Mutex
+	handler  func(*RTPPack) error // 处理器未设置时丢弃收到的包
+	err      atomic.Value         // 处理器返回的错误
+	lastRecv int64                // 最近收到包的时间(UnixNano)
+	received chan struct{}        // 收到第一个包时关闭
+	once     sync.Once
+	done     chan struct{} // 关闭时关闭
+	closed   int32
+}
+
+func newUDPReceiver(logger *xlog.Logger) *udpReceiver {
+	return &udpReceiver{
+		logger:   logger,
+		received: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// 为通道分配相邻的 RTP(偶数)、RTCP 端口，返回 RTP 端口
+func (r *udpReceiver) listenPair(ch int) (int, error) {
+	for i := 0; i < udpPairAttempts; i++ {
+		rtpConn, err := net.ListenUDP("udp", &net.UDPAddr{})
+		if err != nil {
+			return 0, err
+		}
+
+		port := rtpConn.LocalAddr().(*net.UDPAddr).Port
+		if port%2 == 0 {
+			rtcpConn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port + 1})
+			if err == nil {
+				r.conns[ch], r.conns[ch+1] = rtpConn, rtcpConn
+				rtpConn.SetReadBuffer(config.NetBufferSize())
+				return port, nil
+			}
+		}
+		rtpConn.Close()
+	}
+	return 0, errors.New("allocate rtp/rtcp port pair failed")
+}
+
+// 通道已分配的本地端口，未分配时返回 0
+func (r *udpReceiver) localPort(ch int) int {
+	if r.conns[ch] == nil {
+		return 0
+	}
+	return r.conns[ch].LocalAddr().(*net.UDPAddr).Port
+}
+
+// 设置服务器的地址和发送端口，之后只接收来自服务器的包
+func (r *udpReceiver) setPeer(ch int, ip string, ports [rtpChannelCount]int) {
+	r.setSource(ip)
+	for i := ch; i <= ch+1; i++ {
+		if ports[i] > 0 {
+			r.peers[i], _ = net.ResolveUDPAddr("udp", net.JoinHostPort(ip, fmt.Sprint(ports[i])))
+		}
+	}
+}
+
+// 设置发送端的地址，无法解析时不过滤
+func (r *udpReceiver) setSource(host string) {
+	if addr, err := net.ResolveIPAddr("ip", host); err == nil {
+		r.source = addr.IP
+	}
+}
+
+// 是否接受来自 addr 的包：已知服务器端口时地址和端口都要一致
+func (r *udpReceiver) accept(ch byte, addr *net.UDPAddr) bool {
+	if peer := r.peers[ch]; peer != nil {
+		return peer.IP.Equal(addr.IP) && peer.Port == addr.Port
+	}
+	return r.source == nil || r.source.Equal(addr.IP)
+}
+
+// 加入组播组，source 不为空时只接收组播源发送的包
+func (r *udpReceiver) joinGroup(ch int, group, source string, ports [rtpChannelCount]int) error {
+	ip := net.ParseIP(group)
+	if ip == nil || !ip.IsMulticast() {
+		return fmt.Errorf("illegal multicast address '%s'", group)
+	}
+	if source != "" {
+		r.setSource(source)
+	}
+
+	for i := ch; i <= ch+1; i++ {
+		if ports[i] <= 0 {
+			continue
+		}
+		conn, err := net.ListenMulticastUDP("udp", nil, &net.UDPAddr{IP: ip, Port: ports[i]})
+		if err != nil {
+			return err
+		}
+		conn.SetReadBuffer(config.NetBufferSize())
+		r.conns[i] = conn
+	}
+	return nil
+}
+
+// 启动接收
+func (r *udpReceiver) start() {
+	atomic.StoreInt64(&r.lastRecv, time.Now().UnixNano())
+	for i, conn := range r.conns {
+		if conn != nil {
+			go r.receive(byte(i), conn)
+		}
+	}
+	go r.expireLoop()
+	r.punch()
+}
+
+// 设置收到包的处理器
+func (r *udpReceiver) setHandler(handler func(*RTPPack) error) {
+	r.lock.Lock()
+	r.handler = handler
+	r.lock.Unlock()
+}
+
+// 等待收到第一个包
+func (r *udpReceiver) waitReceived(timeout time.Duration) error {
+	select {
+	case <-r.received:
+		return nil
+	case <-time.After(timeout):
+		return errUDPNoData
+	}
+}
+
+// 检查处理器是否出错，以及是否超时未收到包
+func (r *udpReceiver) check(timeout time.Duration) error {
+	if err, ok := r.err.Load().(error); ok {
+		return err
+	}
+	if time.Since(time.Unix(0, atomic.LoadInt64(&r.lastRecv))) > timeout {
+		return errUDPTimeout
+	}
+	return nil
+}
+
+func (r *udpReceiver) receive(ch byte, conn *net.UDPConn) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if atomic.LoadInt32(&r.closed) == 0 {
+				r.logger.Errorf("udp receive error; %v", err)
+			}
+			return
+		}
+		if !r.accept(ch, addr) {
+			continue // 丢弃其他地址发送的包
+		}
+
+		p := &RTPPack{Channel: ch, Data: append([]byte(nil), buf[:n]...)}
+		if ch == ChannelVideo || ch == ChannelAudio {
+			if p.Header.Unmarshal(p.Data) != nil {
+				continue // 可能是打洞包等无效数据
+			}
+		}
+
+		atomic.StoreInt64(&r.lastRecv, time.Now().UnixNano())
+		r.once.Do(func() { close(r.received) })
+		if err = r.onPack(p); err != nil {
+			r.err.Store(err)
+			return
+		}
+	}
+}
+
+func (r *udpReceiver) onPack(p *RTPPack) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.handler == nil {
+		return nil
+	}
+	if p.Channel == ChannelVideo || p.Channel == ChannelAudio {
+		return r.reorders[p.Channel].push(p, r.handler)
+	}
+	return r.handler(p)
+}
+
+// 定时输出等待超时的重排缓存，避免包稀疏时丢包后长时间等待
+func (r *udpReceiver) expireLoop() {
+	ticker := time.NewTicker(reorderTimeout / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case now := <-ticker.C:
+			if err := r.expire(now); err != nil {
+				r.err.Store(err)
+				return
+			}
+		}
+	}
+}
+
+func (r *udpReceiver) expire(now time.Time) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.handler == nil {
+		return nil
+	}
+	for _, ch := range []byte{ChannelVideo, ChannelAudio} {
+		if err := r.reorders[ch].expire(now, r.handler); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NAT 打洞，从接收端口向服务器的发送端口发送空的 RTP 包和 RTCP RR 包
+func (r *udpReceiver) punch() {
+	rtpPunch := []byte{0x80, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	rtcpPunch := []byte{0x80, 201, 0, 1, 0, 0, 0, 0} // 没有报告块的 RR
+	for i, peer := range r.peers {
+		if peer == nil || r.conns[i] == nil {
+			continue
+		}
+
+		punch := rtpPunch
+		if byte(i) == ChannelVideoControl || byte(i) == ChannelAudioControl {
+			punch = rtcpPunch
+		}
+		if _, err := r.conns[i].WriteToUDP(punch, peer); err != nil {
+			r.logger.Warnf("udp punch failed; %v", err)
+		}
+	}
+}
+
+// 从通道的接收端口向服务器发送包，如 RTCP RR；组播时没有服务器端口，忽略
+func (r *udpReceiver) send(p *RTPPack) error {
+	peer, conn := r.peers[p.Channel], r.conns[p.Channel]
+	if peer == nil || conn == nil {
+		return nil
+	}
+	_, err := conn.WriteToUDP(p.Data, peer)
+	return err
+}
+
+func (r *udpReceiver) close() {
+	if !atomic.CompareAndSwapInt32(&r.closed, 0, 1) {
+		return
+	}
+	close(r.done)
+	for _, conn := range r.conns {
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
+
+// reorderBuffer 按序号重排 RTP 包；丢包时最多等待 reorderWindow 个后续的包
+// 或 reorderTimeout 时长，然后跳过丢失的包
+type reorderBuffer struct {
+	started bool
+	next    uint16 // 期望的下一个序号
+	count   int
+	since   time.Time // 开始等待丢失的包的时间
+	slots   [reorderWindow]*RTPPack
+}
+
+func (b *reorderBuffer) push(p *RTPPack, handler func(*RTPPack) error) error {
+	seq := p.SequenceNumber
+	if !b.started {
+		b.started = true
+		b.next = seq
+	}
+
+	diff := int(int16(seq - b.next))
+	if diff < 0 && diff >= -reorderWindow {
+		return nil // 迟到或重复的包
+	}
+	if diff < 0 || diff >= reorderWindow {
+		// 超出窗口或序号重置，输出缓存的包并跳过丢失的包
+		if err := b.flush(handler); err != nil {
+			return err
+		}
+		b.next = seq
+	}
+
+	slot := &b.slots[seq%reorderWindow]
+	if *slot != nil {
+		return nil // 重复的包
+	}
+	*slot = p
+	b.count++
+	if err := b.output(handler); err != nil {
+		return err
+	}
+	if b.count == 0 {
+		b.since = time.Time{}
+	} else if b.since.IsZero() {
+		b.since = time.Now()
+	}
+	return nil
+}
+
+// 等待丢失的包超时后，输出全部缓存的包
+func (b *reorderBuffer) expire(now time.Time, handler func(*RTPPack) error) error {
+	if b.count == 0 || now.Sub(b.since) < reorderTimeout {
+		return nil
+	}
+	b.since = time.Time{}
+	return b.flush(handler)
+}
+
+// 输出从 next 开始连续的包
+func (b *reorderBuffer) output(handler func(*RTPPack) error) error {
+	for {
+		slot := &b.slots[b.next%reorderWindow]
+		if *slot == nil {
+			return nil
+		}
+		p := *slot
+		*slot = nil
+		b.count--
+		b.next++
+		if err := handler(p); err != nil {
+			return err
+		}
+	}
+}
+
+// 按序输出全部缓存的包
+func (b *reorderBuffer) flush(handler func(*RTPPack) error) error {
+	for b.count > 0 {
+		if err := b.output(handler); err != nil {
+			return err
+		}
+		if b.count > 0 { // 跳过丢失的包
+			b.next++
+		}
+	}
+	return nil
+}
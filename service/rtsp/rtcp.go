@@ -0,0 +1,209 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package rtsp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/cnotch/ipchub/av/format/rtp"
+	"github.com/cnotch/ipchub/config"
+	"github.com/cnotch/ipchub/media"
+	"github.com/pion/rtcp"
+)
+
+// 发送 SR、RR 的间隔
+const rtcpInterval = time.Second * 5
+
+var trackNames = [2]string{"video", "audio"}
+
+// 媒体通道的 RTP 时钟频率
+func clockRateOf(stream *media.Stream, ch byte) int {
+	if ch&^1 == ChannelAudio {
+		return stream.Audio.SampleRate
+	}
+	return stream.Video.ClockRate
+}
+
+// 生成包含 CNAME 的 RTCP 复合包
+func marshalRtcp(ssrc uint32, report rtcp.Packet) ([]byte, error) {
+	return rtcp.Marshal([]rtcp.Packet{report, &rtcp.SourceDescription{
+		Chunks: []rtcp.SourceDescriptionChunk{{
+			Source: ssrc,
+			Items:  []rtcp.SourceDescriptionItem{{Type: rtcp.SDESCNAME, Text: config.Name}},
+		}},
+	}})
+}
+
+// 播放者的一个轨道
+type rtcpTrack struct {
+	ssrc     uint32
+	packets  uint32
+	octets   uint32
+	lastSR   time.Time
+	stats    media.ReceptionStats
+	reported bool // 是否收到过 RR
+}
+
+// rtcpSender 根据流的同步时钟向播放者发送 SR，并统计播放者 RR 中的接收质量
+type rtcpSender struct {
+	stream *media.Stream
+	lock   sync.Mutex
+	tracks [2]rtcpTrack
+}
+
+func newRtcpSender(stream *media.Stream) *rtcpSender {
+	return &rtcpSender{stream: stream}
+}
+
+// 统计发送的媒体包，需要发送 SR 时返回控制通道的 SR 包；
+// 每个轨道的第一个包之后立即发送，以便中途加入的播放者尽快同步音视频
+func (r *rtcpSender) onSend(p *RTPPack, now time.Time) *RTPPack {
+	if p.Channel != ChannelVideo && p.Channel != ChannelAudio {
+		return nil
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	t := &r.tracks[p.Channel/2]
+	if t.ssrc != p.SSRC || t.packets == 0 { // 源变化时重新计数
+		*t = rtcpTrack{ssrc: p.SSRC}
+	}
+	t.packets++
+	t.octets += uint32(len(p.Payload()))
+	if now.Sub(t.lastSR) < rtcpInterval {
+		return nil
+	}
+
+	clock, ok := r.stream.SyncClock(p.Channel)
+	if !ok {
+		return nil
+	}
+	data, err := marshalRtcp(t.ssrc, &rtcp.SenderReport{
+		SSRC:        t.ssrc,
+		NTPTime:     rtp.NtpTime(now),
+		RTPTime:     clock.RTPTimeAt(now),
+		PacketCount: t.packets,
+		OctetCount:  t.octets,
+	})
+	if err != nil {
+		return nil
+	}
+	t.lastSR = now
+	return &RTPPack{Channel: p.Channel + 1, Data: data}
+}
+
+// 处理播放者发送的 RTCP 包
+func (r *rtcpSender) onReceive(p *RTPPack, now time.Time) {
+	packets, err := rtcp.Unmarshal(p.Data)
+	if err != nil {
+		return
+	}
+
+	for _, packet := range packets {
+		switch rp := packet.(type) {
+		case *rtcp.ReceiverReport:
+			r.onReports(rp.Reports, now)
+		case *rtcp.SenderReport:
+			r.onReports(rp.Reports, now)
+		}
+	}
+}
+
+func (r *rtcpSender) onReports(reports []rtcp.ReceptionReport, now time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, report := range reports {
+		for i := range r.tracks {
+			t := &r.tracks[i]
+			if t.packets == 0 || t.ssrc != report.SSRC {
+				continue
+			}
+
+			t.reported = true
+			t.stats = media.ReceptionStats{
+				Track:        trackNames[i],
+				FractionLost: float64(report.FractionLost) / 256,
+				Lost:         report.TotalLost,
+			}
+			if clockRate := clockRateOf(r.stream, byte(i*2)); clockRate > 0 {
+				t.stats.Jitter = float64(report.Jitter) * 1000 / float64(clockRate)
+			}
+			// RTT = 收到 RR 的时间 - LSR - DLSR，单位为 1/65536 秒
+			if report.LastSenderReport != 0 {
+				rtt := int32(rtp.NtpMiddle(now) - report.LastSenderReport - report.Delay)
+				if rtt >= 0 {
+					t.stats.RTT = float64(rtt) * 1000 / 65536
+				}
+			}
+		}
+	}
+}
+
+// 播放者报告的接收质量
+func (r *rtcpSender) stats() []media.ReceptionStats {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var stats []media.ReceptionStats
+	for _, t := range r.tracks {
+		if t.reported {
+			stats = append(stats, t.stats)
+		}
+	}
+	return stats
+}
+
+// rtcpReporter 统计拉流的接收情况，定时向服务器发送 RR；
+// 只在接收 routine 中调用，不需要加锁
+type rtcpReporter struct {
+	ssrc   uint32 // 本端的 SSRC
+	stats  [2]rtp.ReceiverStats
+	lastRR time.Time
+}
+
+// 统计收到的包，需要发送 RR 时返回各轨道控制通道的 RR 包
+func (r *rtcpReporter) onReceive(p *RTPPack, clockRate int, now time.Time) []*RTPPack {
+	stats := &r.stats[p.Channel/2]
+	if p.Channel&1 == 1 {
+		stats.UpdateSR(p.Data, now)
+		return nil
+	}
+
+	stats.ClockRate = clockRate
+	stats.Update(p, now)
+	if r.lastRR.IsZero() {
+		r.lastRR = now
+	}
+	if now.Sub(r.lastRR) < rtcpInterval {
+		return nil
+	}
+	r.lastRR = now
+
+	if r.ssrc == 0 {
+		var b [4]byte
+		rand.Read(b[:])
+		r.ssrc = binary.BigEndian.Uint32(b[:]) | 1
+	}
+
+	var packs []*RTPPack
+	for i := range r.stats {
+		if !r.stats[i].Started() {
+			continue
+		}
+		data, err := marshalRtcp(r.ssrc, &rtcp.ReceiverReport{
+			SSRC:    r.ssrc,
+			Reports: []rtcp.ReceptionReport{r.stats[i].Report(now)},
+		})
+		if err == nil {
+			packs = append(packs, &RTPPack{Channel: byte(i*2 + 1), Data: data})
+		}
+	}
+	return packs
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package rtsp
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cnotch/ipchub/av/format/rtp"
+	"github.com/cnotch/ipchub/media"
+	"github.com/pion/rtcp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRtcpReporter(t *testing.T) {
+	var r rtcpReporter
+	start := time.Now()
+	for seq := uint16(0); seq < 10; seq += 2 { // 丢失一半
+		p := &RTPPack{Channel: ChannelVideo}
+		p.SSRC = 1
+		p.SequenceNumber = seq
+		assert.Empty(t, r.onReceive(p, 90000, start.Add(time.Duration(seq)*time.Second/2)))
+	}
+
+	p := &RTPPack{Channel: ChannelVideo}
+	p.SSRC = 1
+	p.SequenceNumber = 10
+	packs := r.onReceive(p, 90000, start.Add(rtcpInterval+time.Second))
+	if !assert.Len(t, packs, 1) {
+		return
+	}
+	assert.Equal(t, byte(ChannelVideoControl), packs[0].Channel)
+
+	packets, err := rtcp.Unmarshal(packs[0].Data)
+	if !assert.NoError(t, err) || !assert.Len(t, packets, 2) {
+		return
+	}
+	rr := packets[0].(*rtcp.ReceiverReport)
+	assert.Equal(t, r.ssrc, rr.SSRC)
+	assert.Equal(t, uint32(1), rr.Reports[0].SSRC)
+	assert.Equal(t, uint32(5), rr.Reports[0].TotalLost)
+	assert.Equal(t, uint32(10), rr.Reports[0].LastSequenceNumber)
+}
+
+// UDP 播放时发送 SR，并统计 RR 报告的接收质量
+func TestPlayRtcp(t *testing.T) {
+	ln := listenRTSP(t)
+	defer ln.Close()
+
+	source := media.NewStream("/live/rtcpsrc", sdpRaw)
+	media.Regist(source)
+	defer media.Unregist(source)
+	done := make(chan struct{})
+	defer close(done)
+	go writeRtpPackets(source, done)
+
+	client := newTestClient(t, ln.Addr().String())
+	defer client.conn.Close()
+	base := "rtsp://" + ln.Addr().String() + "/live/rtcpsrc"
+
+	var conns [2]*net.UDPConn
+	for i := range conns {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer conn.Close()
+		conns[i] = conn
+	}
+	rtpPort := conns[0].LocalAddr().(*net.UDPAddr).Port
+	rtcpPort := conns[1].LocalAddr().(*net.UDPAddr).Port
+
+	resp := client.request(MethodDescribe, base, nil, "")
+	if resp == nil || !assert.Equal(t, StatusOK, resp.StatusCode) {
+		return
+	}
+	ts := fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d", rtpPort, rtcpPort)
+	resp = client.request(MethodSetup, base+"/streamid=0", Header{FieldTransport: {ts}}, "")
+	if resp == nil || !assert.Equal(t, StatusOK, resp.StatusCode) {
+		return
+	}
+	var transport RTPTransport
+	if !assert.NoError(t, transport.ParseTransport(int(ChannelVideo), resp.Header.Get(FieldTransport))) ||
+		!assert.True(t, transport.ServerPorts[ChannelVideoControl] > 0) {
+		return
+	}
+	resp = client.request(MethodPlay, base, nil, "")
+	if resp == nil || !assert.Equal(t, StatusOK, resp.StatusCode) {
+		return
+	}
+
+	// 第一个包之后立即收到 SR
+	buf := make([]byte, 1500)
+	conns[1].SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conns[1].ReadFromUDP(buf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	packets, err := rtcp.Unmarshal(buf[:n])
+	if !assert.NoError(t, err) {
+		return
+	}
+	sr, ok := packets[0].(*rtcp.SenderReport)
+	if !assert.True(t, ok) {
+		return
+	}
+	assert.Equal(t, uint32(1), sr.SSRC)
+	assert.True(t, sr.PacketCount >= 1)
+	assert.InDelta(t, float64(rtp.NtpTime(time.Now())>>32), float64(sr.NTPTime>>32), 2)
+
+	// 回复 RR
+	data, _ := (&rtcp.ReceiverReport{SSRC: 2, Reports: []rtcp.ReceptionReport{{
+		SSRC:             sr.SSRC,
+		FractionLost:     64,
+		TotalLost:        3,
+		Jitter:           900,
+		LastSenderReport: uint32(sr.NTPTime >> 16),
+	}}}).Marshal()
+	serverAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: transport.ServerPorts[ChannelVideoControl]}
+	conns[1].WriteToUDP(data, serverAddr)
+
+	var reception []media.ReceptionStats
+	for i := 0; i < 100 && len(reception) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		for _, c := range source.Info(true).Consumptions {
+			reception = append(reception, c.Reception...)
+		}
+	}
+	if assert.Len(t, reception, 1) {
+		assert.Equal(t, "video", reception[0].Track)
+		assert.Equal(t, 0.25, reception[0].FractionLost)
+		assert.Equal(t, uint32(3), reception[0].Lost)
+		assert.Equal(t, 10.0, reception[0].Jitter)
+		assert.True(t, reception[0].RTT >= 0 && reception[0].RTT < 1000)
+	}
+}
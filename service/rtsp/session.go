@@ -14,6 +14,7 @@ import (
 	"runtime/debug"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cnotch/ipchub/config"
@@ -37,6 +38,7 @@ const (
 	statusReady
 	statusPlaying
 	statusRecording
+	statusPaused
 )
 
 var buffers = sync.Pool{
@@ -75,11 +77,15 @@ type Session struct {
 
 	// Setup 后设置
 	transport RTPTransport
+	udp       *udpReceiver // UDP 推流时接收 RTP，UDP 播放时接收 RTCP
 
 	// 启动流媒体传输后设置
 	status   int            // session状态
+	paused   int32          // 暂停播放时为 1，丢弃要发送的包
 	stream   mediaStream    // 媒体流
 	consumer media.Consumer // 消费者
+	rtcp     *rtcpSender    // 播放时发送 SR，统计 RR
+	player   *player        // 录像回放，DESCRIBE 的 URL 带有 playback 参数时创建
 }
 
 func newSession(svr *Server, conn net.Conn) *Session {
@@ -133,7 +139,31 @@ func (s *Session) Addr() string {
 
 // Consume 消费媒体包
 func (s *Session) Consume(p Pack) {
-	s.consumer.Consume(p)
+	if atomic.LoadInt32(&s.paused) == 1 {
+		return
+	}
+	if s.rtcp == nil {
+		s.consumer.Consume(p)
+		return
+	}
+
+	// 上游的 RTCP 由本地生成的 SR 代替
+	pack := p.(*RTPPack)
+	if pack.Channel&1 == 1 {
+		return
+	}
+	s.consumer.Consume(pack)
+	if sr := s.rtcp.onSend(pack, time.Now()); sr != nil {
+		s.consumer.Consume(sr)
+	}
+}
+
+// ReceptionStats 播放者通过 RTCP RR 报告的接收质量
+func (s *Session) ReceptionStats() []media.ReceptionStats {
+	if s.rtcp == nil {
+		return nil
+	}
+	return s.rtcp.stats()
 }
 
 // Close 关闭会话
@@ -155,12 +185,22 @@ func (s *Session) process() {
 
 		stats.RtspConns.Release()
 		s.Close()
+		if s.udp != nil { // 先停止接收，避免向已关闭的流写入
+			s.udp.setHandler(nil)
+			s.udp.close()
+			s.udp = nil
+		}
+		if s.player != nil {
+			s.player.close()
+			s.player = nil
+		}
 		s.consumer.Close()
 		s.stream.Close()
 
 		// 重置到初始状态
 		s.conn = nil
 		s.status = statusInit
+		atomic.StoreInt32(&s.paused, 0)
 		s.stream = defaultStream
 		s.consumer = defaultConsumer
 		s.logger.Infof("close rtsp session")
@@ -181,6 +221,12 @@ func (s *Session) process() {
 		}
 
 		err := receive(s.logger, reader, s.transport.Channels[:], s)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && s.udp != nil {
+			// UDP 推流时控制连接可能长时间空闲，只要还在收到 RTP 包就继续
+			if err = s.udp.check(s.timeout); err == nil {
+				continue
+			}
+		}
 		if err != nil {
 			if err == io.EOF { // 如果客户端断开提醒
 				s.logger.Warn("The client actively disconnects")
@@ -194,6 +240,12 @@ func (s *Session) process() {
 
 // receiveHandler.onPack
 func (s *Session) onPack(pack *RTPPack) (err error) {
+	if s.mode == PlaySession { // 播放者只会发送 RTCP
+		if s.rtcp != nil && pack.Channel&1 == 1 {
+			s.rtcp.onReceive(pack, time.Now())
+		}
+		return nil
+	}
 	return s.stream.WritePacket(pack)
 }
 
@@ -223,6 +275,12 @@ func (s *Session) onRequest(req *Request) (err error) {
 		s.onRecord(resp, req)
 	case MethodPlay:
 		return s.onPlay(resp, req) // play 发送流媒体不在当前 routine，需要先回复
+	case MethodPause:
+		s.onPause(resp, req)
+	case MethodGetParameter:
+		s.onGetParameter(resp, req)
+	case MethodSetParameter:
+		s.onSetParameter(resp, req)
 	default:
 		// 状态不支持的方法
 		resp.StatusCode = StatusMethodNotValidInThisState
@@ -241,6 +299,11 @@ func (s *Session) onDescribe(resp *Response, req *Request) {
 		s.path = utils.CanonicalPath(req.URL.Path)
 	}
 
+	if _, ok := req.URL.Query()["playback"]; ok {
+		s.onDescribePlayback(resp)
+		return
+	}
+
 	stream := media.GetOrCreate(s.path)
 	if stream == nil {
 		resp.StatusCode = StatusNotFound
@@ -296,6 +359,11 @@ func (s *Session) onAnnounce(resp *Response, req *Request) {
 }
 
 func (s *Session) onSetup(resp *Response, req *Request) {
+	// 告知客户端会话超时时间，以便定时发送 GET_PARAMETER 等心跳
+	if s.timeout > 0 {
+		resp.Header.Set(FieldSession, fmt.Sprintf("%s;timeout=%d", s.lsession, s.timeout/time.Second))
+	}
+
 	// a=control:streamid=1
 	// a=control:rtsp://192.168.1.165/trackID=1
 	// a=control:?ctype=video
@@ -358,7 +426,7 @@ func (s *Session) onSetup(resp *Response, req *Request) {
 		return
 	}
 
-	// record 只支持 TCP 单播
+	// record 支持 TCP 和 UDP 单播
 	if s.mode == RecordSession {
 		// 检查用户权限
 		if !s.checkPermission(auth.PushRight) {
@@ -366,13 +434,24 @@ func (s *Session) onSetup(resp *Response, req *Request) {
 			return
 		}
 
-		if s.transport.Type != RTPTCPUnicast {
-			resp.StatusCode = StatusUnsupportedTransport
-			resp.Status = "when mode = record，only support tcp unicast"
-		} else {
-			if s.status < statusReady { // 初始状态切换到Ready
-				s.status = statusReady
+		switch s.transport.Type {
+		case RTPTCPUnicast:
+		case RTPUDPUnicast:
+			port, err := s.setupUDPPorts(chindex)
+			if err != nil {
+				resp.StatusCode = StatusInternalServerError
+				resp.Status = err.Error()
+				return
 			}
+			resp.Header.Set(FieldTransport, fmt.Sprintf("%s;server_port=%d-%d", ts, port, port+1))
+		default:
+			resp.StatusCode = StatusUnsupportedTransport
+			resp.Status = "when mode = record，only support tcp or udp unicast"
+			return
+		}
+
+		if s.status < statusReady { // 初始状态切换到Ready
+			s.status = statusReady
 		}
 		return
 	}
@@ -384,6 +463,10 @@ func (s *Session) onSetup(resp *Response, req *Request) {
 	}
 
 	if s.transport.Type == RTPMulticast { // 需要修改回复的transport
+		if s.player != nil { // 回放不支持组播
+			resp.StatusCode = StatusUnsupportedTransport
+			return
+		}
 		st := media.GetOrCreate(s.path)
 		if st == nil { // 没有找到源
 			resp.StatusCode = StatusNotFound
@@ -400,6 +483,14 @@ func (s *Session) onSetup(resp *Response, req *Request) {
 			ma.Port(chindex), ma.Port(chindex+1),
 			ma.SourceIP(), ma.TTL())
 		resp.Header.Set(FieldTransport, ts)
+	} else if s.transport.Type == RTPUDPUnicast { // 分配服务器端口，用于发送 RTP 和接收 RR
+		port, err := s.setupUDPPorts(chindex)
+		if err != nil {
+			resp.StatusCode = StatusInternalServerError
+			resp.Status = err.Error()
+			return
+		}
+		resp.Header.Set(FieldTransport, fmt.Sprintf("%s;server_port=%d-%d", ts, port, port+1))
 	}
 
 	if s.status < statusReady { // 初始状态切换到Ready
@@ -413,7 +504,8 @@ func (s *Session) onRecord(resp *Response, req *Request) {
 	}
 
 	// 传输模式、会话模式判断
-	if s.mode != RecordSession || s.transport.Type != RTPTCPUnicast {
+	if s.mode != RecordSession ||
+		(s.transport.Type != RTPTCPUnicast && s.transport.Type != RTPUDPUnicast) {
 		resp.StatusCode = StatusMethodNotValidInThisState
 		return
 	}
@@ -423,13 +515,25 @@ func (s *Session) onRecord(resp *Response, req *Request) {
 		return
 	}
 
-	s.asTCPPusher()
+	if s.transport.Type == RTPUDPUnicast {
+		s.asUDPPusher()
+	} else {
+		s.asTCPPusher()
+	}
 	s.status = statusRecording
 }
 
 func (s *Session) onPlay(resp *Response, req *Request) (err error) {
-	if s.status == statusPlaying {
-		return
+	if s.player != nil {
+		return s.onPlayback(resp, req)
+	}
+
+	// 恢复暂停的播放
+	if s.status == statusPlaying || s.status == statusPaused {
+		atomic.StoreInt32(&s.paused, 0)
+		s.status = statusPlaying
+		resp.Header.Set(FieldRange, req.Header.Get(FieldRange))
+		return s.response(resp)
 	}
 
 	// 传输模式、会话模式判断
@@ -465,6 +569,91 @@ func (s *Session) onPlay(resp *Response, req *Request) (err error) {
 	return
 }
 
+func (s *Session) onPause(resp *Response, req *Request) {
+	// 组播由多个会话共享，不能单独暂停
+	if s.mode != PlaySession || s.transport.Type == RTPMulticast {
+		resp.StatusCode = StatusMethodNotValidInThisState
+		return
+	}
+
+	// 回放暂停时停止读取，恢复时从暂停处继续
+	if s.player != nil {
+		s.player.pause()
+		resp.Header.Set(FieldRange, formatRange(false, s.player.position(), time.Time{}, time.Time{}))
+		s.status = statusPaused
+		return
+	}
+
+	// 暂停时保留消费者，只丢弃要发送的包
+	atomic.StoreInt32(&s.paused, 1)
+	s.status = statusPaused
+}
+
+// 空的 GET_PARAMETER 作为心跳，收到任何请求都会延长会话的超时时间
+func (s *Session) onGetParameter(resp *Response, req *Request) {
+	names, _ := parseParameters(req.Body)
+	if len(names) == 0 {
+		return
+	}
+
+	s.parameterPath(req)
+	if !s.checkPermission(auth.PullRight) {
+		resp.StatusCode = StatusForbidden
+		return
+	}
+
+	var body strings.Builder
+	for _, name := range names {
+		value, err := getParameter(s.path, name)
+		if err != nil {
+			s.parameterError(resp, err)
+			return
+		}
+		body.WriteString(name + ": " + value + "\r\n")
+	}
+	resp.Header.Set(FieldContentType, parametersContentType)
+	resp.Body = body.String()
+}
+
+func (s *Session) onSetParameter(resp *Response, req *Request) {
+	names, values := parseParameters(req.Body)
+	if len(names) == 0 {
+		return
+	}
+
+	s.parameterPath(req)
+	if !s.checkPermission(auth.PushRight) {
+		resp.StatusCode = StatusForbidden
+		return
+	}
+
+	for i, name := range names {
+		if err := setParameter(s.path, name, values[i]); err != nil {
+			s.parameterError(resp, err)
+			return
+		}
+	}
+}
+
+// 在 DESCRIBE、ANNOUNCE 之前访问参数时，使用请求的路径
+func (s *Session) parameterPath(req *Request) {
+	if s.path == "" && s.wsconn == nil {
+		s.path = utils.CanonicalPath(req.URL.Path)
+	}
+}
+
+func (s *Session) parameterError(resp *Response, err error) {
+	switch err {
+	case errParameterNotFound:
+		resp.StatusCode = StatusInvalidParameter
+	case errParameterReadOnly:
+		resp.StatusCode = StatusParameterIsReadOnly
+	default:
+		resp.StatusCode = StatusBadRequest
+		resp.Status = err.Error()
+	}
+}
+
 func (s *Session) checkPermission(right auth.AccessRight) bool {
 	if s.authMode == auth.NoneAuth {
 		return true
@@ -521,7 +710,7 @@ func (s *Session) checkAuth(r *Request) (user *auth.User, err error) {
 func (s *Session) onPreprocess(resp *Response, req *Request) (continueProcess bool, err error) {
 	// Options 方法无需验证，直接回复
 	if req.Method == MethodOptions {
-		resp.Header.Set(FieldPublic, "DESCRIBE, SETUP, TEARDOWN, PLAY, OPTIONS, ANNOUNCE, RECORD")
+		resp.Header.Set(FieldPublic, "DESCRIBE, SETUP, TEARDOWN, PLAY, PAUSE, OPTIONS, ANNOUNCE, RECORD, GET_PARAMETER, SET_PARAMETER")
 		err = s.response(resp)
 		return false, err
 	}
@@ -534,17 +723,20 @@ func (s *Session) onPreprocess(resp *Response, req *Request) (continueProcess bo
 		return false, err
 	}
 
-	// 检查状态下的方法
-	switch s.status {
-	case statusReady:
+	// 检查状态下的方法，参数读写在任何状态下都可用
+	switch {
+	case req.Method == MethodGetParameter || req.Method == MethodSetParameter:
+		continueProcess = true
+	case s.status == statusReady:
 		continueProcess = req.Method == MethodSetup ||
 			req.Method == MethodPlay || req.Method == MethodRecord
-	case statusPlaying:
-		continueProcess = req.Method == MethodPlay
-	case statusRecording:
+	case s.status == statusPlaying || s.status == statusPaused:
+		continueProcess = req.Method == MethodPlay || req.Method == MethodPause
+	case s.status == statusRecording:
 		continueProcess = req.Method == MethodRecord
 	default:
-		continueProcess = !(req.Method == MethodPlay || req.Method == MethodRecord)
+		continueProcess = !(req.Method == MethodPlay ||
+			req.Method == MethodRecord || req.Method == MethodPause)
 	}
 	if !continueProcess {
 		resp.StatusCode = StatusMethodNotValidInThisState
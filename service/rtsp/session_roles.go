@@ -43,12 +43,12 @@ type emptyConsumer struct {
 func (c emptyConsumer) Consume(p Pack) {}
 func (c emptyConsumer) Close() error   { return nil }
 
-type tcpPushStream struct {
+type pushStream struct {
 	closed bool
 	stream *media.Stream
 }
 
-func (s *tcpPushStream) Close() error {
+func (s *pushStream) Close() error {
 	if s.closed {
 		return nil
 	}
@@ -59,7 +59,7 @@ func (s *tcpPushStream) Close() error {
 	return nil
 }
 
-func (s *tcpPushStream) WritePacket(p *RTPPack) error {
+func (s *pushStream) WritePacket(p *RTPPack) error {
 	return s.stream.WriteRtpPacket(p)
 }
 
@@ -106,8 +106,10 @@ func (c *tcpConsumer) Close() error {
 		return nil
 	}
 	c.closed = true
-	c.source.StopConsume(c.cid)
-	c.source = nil
+	if c.source != nil { // 回放时没有源流
+		c.source.StopConsume(c.cid)
+		c.source = nil
+	}
 	return nil
 }
 
@@ -116,7 +118,8 @@ type udpConsumer struct {
 	closed   bool
 	source   *media.Stream
 	cid      media.CID
-	udpConn  *net.UDPConn // 用于Player的UDP单播
+	udpConn  *net.UDPConn                  // 用于Player的UDP单播
+	conns    [rtpChannelCount]*net.UDPConn // 各通道的发送连接，优先使用 SETUP 时分配的服务器端口
 	destAddr [rtpChannelCount]*net.UDPAddr
 }
 
@@ -128,7 +131,7 @@ func (c *udpConsumer) Consume(p Pack) {
 	p2 := p.(*RTPPack)
 	addr := c.destAddr[int(p2.Channel)]
 	if addr != nil {
-		_, err := c.udpConn.WriteToUDP(p2.Data, addr)
+		_, err := c.conns[int(p2.Channel)].WriteToUDP(p2.Data, addr)
 		if err != nil {
 			c.logger.Warn(err.Error())
 			return
@@ -142,9 +145,11 @@ func (c *udpConsumer) Close() error {
 	}
 	c.closed = true
 
-	c.source.StopConsume(c.cid)
+	if c.source != nil {
+		c.source.StopConsume(c.cid)
+		c.source = nil
+	}
 	c.udpConn.Close()
-	c.source = nil
 	return nil
 }
 
@@ -163,6 +168,10 @@ func (c *udpConsumer) prepareUDP(destIP string, destPorts [rtpChannelCount]int)
 		if port > 0 {
 			c.destAddr[i], _ = net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", destIP, port))
 		}
+		c.conns[i] = c.udpConn
+		if c.udp != nil && c.udp.conns[i] != nil {
+			c.conns[i] = c.udp.conns[i]
+		}
 	}
 	return nil
 }
@@ -188,7 +197,31 @@ func (c *multicastConsumer) Close() error {
 
 // 将Session作为Pusher角色
 func (s *Session) asTCPPusher() {
-	pusher := &tcpPushStream{}
+	s.asPusher("pusher")
+}
+
+// 将Session作为UDP Pusher角色，从 SETUP 时分配的端口接收 RTP 包
+func (s *Session) asUDPPusher() {
+	s.asPusher("udp-pusher")
+	s.udp.setHandler(s.stream.WritePacket)
+	s.udp.start()
+}
+
+// 为 UDP 推流或播放的通道分配服务器端口，重复 SETUP 时返回已分配的端口
+func (s *Session) setupUDPPorts(ch int) (int, error) {
+	if s.udp == nil {
+		s.udp = newUDPReceiver(s.logger)
+		s.udp.source = net.ParseIP(network.GetIP(s.conn.RemoteAddr()))
+	}
+	if port := s.udp.localPort(ch); port > 0 {
+		return port, nil
+	}
+	return s.udp.listenPair(ch)
+}
+
+// 创建并注册推送的流，替换同路径已有的流
+func (s *Session) asPusher(typ string) {
+	pusher := &pushStream{}
 
 	mproxy := &multicastProxy{
 		path:        s.path,
@@ -202,7 +235,7 @@ func (s *Session) asTCPPusher() {
 
 	s.logger = s.logger.With(xlog.Fields(
 		xlog.F("path", s.path),
-		xlog.F("type", "pusher")))
+		xlog.F("type", typ)))
 
 	for i := rtpChannelMin; i < rtpChannelCount; i++ {
 		mproxy.ports[i] = utils.Multicast.NextPort()
@@ -239,6 +272,7 @@ func (s *Session) asTCPConsumer(stream *media.Stream, resp *Response) (err error
 	}
 	s.timeout = 0 // play 只需发送不用接收，因此设置不超时
 	s.consumer = c
+	s.rtcp = newRtcpSender(stream)
 	// if s.wsconn != nil {
 	// 	c.cid = stream.StartConsumeNoGopCache(s, media.RTPPacket, "net=rtsp-websocket")
 	// } else {
@@ -274,6 +308,11 @@ func (s *Session) asUDPConsumer(stream *media.Stream, resp *Response) (err error
 
 	s.timeout = 0 // play 只需发送不用接收，因此设置不超时
 	s.consumer = c
+	s.rtcp = newRtcpSender(stream)
+	if s.udp != nil { // 接收播放者发送到服务器端口的 RR
+		s.udp.setHandler(s.onPack)
+		s.udp.start()
+	}
 
 	c.cid = stream.StartConsume(s, media.RTPPacket, "net=rtsp-udp")
 	return nil
@@ -0,0 +1,246 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package rtsp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cnotch/ipchub/media"
+	"github.com/stretchr/testify/assert"
+)
+
+// 测试用的 rtsp 客户端，按顺序发送请求并读取响应
+type testClient struct {
+	t       *testing.T
+	conn    net.Conn
+	reader  *bufio.Reader
+	session string
+	cseq    int
+}
+
+func newTestClient(t *testing.T, addr string) *testClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (c *testClient) request(method, rawurl string, header Header, body string) *Response {
+	c.cseq++
+	u, _ := url.Parse(rawurl)
+	req := &Request{Method: method, URL: u, Proto: rtspProto, Header: header, Body: body}
+	if req.Header == nil {
+		req.Header = make(Header)
+	}
+	req.Header.Set(FieldCSeq, strconv.Itoa(c.cseq))
+	if c.session != "" {
+		req.Header.Set(FieldSession, c.session)
+	}
+	if !assert.NoError(c.t, req.Write(c.conn)) {
+		return nil
+	}
+	resp, err := ReadResponse(c.reader)
+	if !assert.NoError(c.t, err) {
+		return nil
+	}
+	if resp.Header.Get(FieldSession) != "" {
+		c.session = trimSessionString(resp.Header.Get(FieldSession))
+	}
+	return resp
+}
+
+// 以 UDP 方式推流
+func TestPushUDP(t *testing.T) {
+	ln := listenRTSP(t)
+	defer ln.Close()
+
+	client := newTestClient(t, ln.Addr().String())
+	defer client.conn.Close()
+	request := client.request
+
+	rtpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer rtpConn.Close()
+	clientPort := rtpConn.LocalAddr().(*net.UDPAddr).Port
+
+	base := "rtsp://" + ln.Addr().String() + "/live/udppush"
+	resp := request(MethodAnnounce, base, Header{FieldContentType: {"application/sdp"}}, sdpRaw)
+	if resp == nil || !assert.Equal(t, StatusOK, resp.StatusCode) {
+		return
+	}
+
+	// 组播不支持推流
+	ts := "RTP/AVP;multicast;mode=record"
+	resp = request(MethodSetup, base+"/streamid=0", Header{FieldTransport: {ts}}, "")
+	if resp == nil || !assert.Equal(t, StatusUnsupportedTransport, resp.StatusCode) {
+		return
+	}
+
+	ts = fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d;mode=record", clientPort, clientPort+1)
+	resp = request(MethodSetup, base+"/streamid=0", Header{FieldTransport: {ts}}, "")
+	if resp == nil || !assert.Equal(t, StatusOK, resp.StatusCode) {
+		return
+	}
+	var transport RTPTransport
+	if !assert.NoError(t, transport.ParseTransport(int(ChannelVideo), resp.Header.Get(FieldTransport))) ||
+		!assert.True(t, transport.ServerPorts[ChannelVideo] > 0) {
+		return
+	}
+
+	resp = request(MethodRecord, base, nil, "")
+	if resp == nil || !assert.Equal(t, StatusOK, resp.StatusCode) {
+		return
+	}
+
+	stream := media.Get("/live/udppush")
+	if !assert.NotNil(t, stream) {
+		return
+	}
+	counter := &packetCounter{}
+	stream.StartConsume(counter, media.RTPPacket, "test")
+
+	// 乱序和重复的包
+	serverAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: transport.ServerPorts[ChannelVideo]}
+	for _, seq := range []uint16{0, 2, 1, 1, 3, 4, 4, 5} {
+		data := []byte{0x80, 96, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x41, 0x9a}
+		binary.BigEndian.PutUint16(data[2:], seq)
+		rtpConn.WriteToUDP(data, serverAddr)
+	}
+	for i := 0; i < 100 && counter.count() < 6; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	counter.lock.Lock()
+	assert.Equal(t, []uint16{0, 1, 2, 3, 4, 5}, counter.seqs)
+	counter.lock.Unlock()
+
+	// 断开后注销流
+	client.conn.Close()
+	for i := 0; i < 100 && media.Get("/live/udppush") != nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Nil(t, media.Get("/live/udppush"))
+}
+
+// 暂停、恢复播放和参数读写
+func TestPauseAndParameters(t *testing.T) {
+	ln := listenRTSP(t)
+	defer ln.Close()
+
+	source := media.NewStream("/live/pausesrc", sdpRaw)
+	media.Regist(source)
+	defer media.Unregist(source)
+	done := make(chan struct{})
+	defer close(done)
+	go writeRtpPackets(source, done)
+
+	var level string
+	RegistParameter("level", Parameter{
+		Get: func(path string) (string, error) { return path + "," + level, nil },
+		Set: func(path, value string) error { level = value; return nil },
+	})
+	RegistParameter("Uptime", Parameter{
+		Get: func(path string) (string, error) { return "10", nil },
+	})
+	defer UnregistParameter("level")
+	defer UnregistParameter("uptime")
+
+	client := newTestClient(t, ln.Addr().String())
+	defer client.conn.Close()
+	base := "rtsp://" + ln.Addr().String() + "/live/pausesrc"
+
+	resp := client.request(MethodOptions, base, nil, "")
+	if resp == nil {
+		return
+	}
+	for _, method := range []string{MethodPause, MethodGetParameter, MethodSetParameter} {
+		assert.Contains(t, resp.Header.Get(FieldPublic), method)
+	}
+
+	// 没有 PLAY 时不能暂停
+	resp = client.request(MethodPause, base, nil, "")
+	if resp == nil || !assert.Equal(t, StatusMethodNotValidInThisState, resp.StatusCode) {
+		return
+	}
+
+	// 参数读写
+	resp = client.request(MethodSetParameter, base, nil, "level: 3\r\n")
+	if resp == nil || !assert.Equal(t, StatusOK, resp.StatusCode) {
+		return
+	}
+	resp = client.request(MethodGetParameter, base, nil, "level\r\nuptime\r\n")
+	if resp == nil || !assert.Equal(t, StatusOK, resp.StatusCode) {
+		return
+	}
+	assert.Equal(t, "level: /live/pausesrc,3\r\nuptime: 10\r\n", resp.Body)
+	assert.Equal(t, parametersContentType, resp.Header.Get(FieldContentType))
+	resp = client.request(MethodSetParameter, base, nil, "uptime: 1\r\n")
+	assert.Equal(t, StatusParameterIsReadOnly, resp.StatusCode)
+	resp = client.request(MethodGetParameter, base, nil, "unknown\r\n")
+	assert.Equal(t, StatusInvalidParameter, resp.StatusCode)
+
+	resp = client.request(MethodDescribe, base, nil, "")
+	if resp == nil || !assert.Equal(t, StatusOK, resp.StatusCode) {
+		return
+	}
+	rtpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer rtpConn.Close()
+	clientPort := rtpConn.LocalAddr().(*net.UDPAddr).Port
+	ts := fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d", clientPort, clientPort+1)
+	resp = client.request(MethodSetup, base+"/streamid=0", Header{FieldTransport: {ts}}, "")
+	if resp == nil || !assert.Equal(t, StatusOK, resp.StatusCode) {
+		return
+	}
+	assert.Contains(t, resp.Header.Get(FieldSession), ";timeout=")
+	resp = client.request(MethodPlay, base, nil, "")
+	if resp == nil || !assert.Equal(t, StatusOK, resp.StatusCode) {
+		return
+	}
+
+	// 读取 UDP 包，返回超时时间内收到的包数
+	buf := make([]byte, 1500)
+	receive := func(d time.Duration) (n int) {
+		deadline := time.Now().Add(d)
+		for {
+			rtpConn.SetReadDeadline(deadline)
+			if _, _, err := rtpConn.ReadFromUDP(buf); err != nil {
+				return
+			}
+			n++
+		}
+	}
+	assert.True(t, receive(200*time.Millisecond) > 0)
+
+	// 暂停后不再收到包，心跳保持会话
+	resp = client.request(MethodPause, base, nil, "")
+	if resp == nil || !assert.Equal(t, StatusOK, resp.StatusCode) {
+		return
+	}
+	receive(50 * time.Millisecond) // 丢弃暂停前已发出的包
+	assert.Equal(t, 0, receive(200*time.Millisecond))
+	resp = client.request(MethodGetParameter, base, nil, "")
+	assert.Equal(t, StatusOK, resp.StatusCode)
+	resp = client.request(MethodRecord, base, nil, "")
+	assert.Equal(t, StatusMethodNotValidInThisState, resp.StatusCode)
+
+	// 恢复播放
+	resp = client.request(MethodPlay, base, nil, "")
+	if resp == nil || !assert.Equal(t, StatusOK, resp.StatusCode) {
+		return
+	}
+	assert.True(t, receive(200*time.Millisecond) > 0)
+}
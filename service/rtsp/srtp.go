@@ -0,0 +1,384 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package rtsp
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pion/srtp/v2"
+	"github.com/pixelbender/go-sdp/sdp"
+)
+
+// SRTP 加密套件(RFC 4568)
+const (
+	suiteAesCm128HmacSha1_80 = "AES_CM_128_HMAC_SHA1_80"
+	suiteAeadAes128Gcm       = "AEAD_AES_128_GCM"
+)
+
+// 重放保护的窗口大小
+const srtpReplayWindow = 64
+
+// MIKEY(RFC 3830)负载类型
+const (
+	mikeyPayloadLast  = 0
+	mikeyPayloadKEMAC = 1
+	mikeyPayloadT     = 5
+	mikeyPayloadID    = 6
+	mikeyPayloadV     = 9
+	mikeyPayloadSP    = 10
+	mikeyPayloadRAND  = 11
+)
+
+var (
+	errMikeyIllegal     = errors.New("illegal mikey message")
+	errMikeyEncrypted   = errors.New("mikey with encrypted key data is not supported")
+	errSrtpSuiteUnknown = errors.New("no supported srtp crypto suite")
+)
+
+// srtpKey SRTP 主密钥
+type srtpKey struct {
+	profile srtp.ProtectionProfile
+	key     []byte
+	salt    []byte
+}
+
+// 生成 AES_CM_128_HMAC_SHA1_80 随机主密钥
+func newSrtpKey() (*srtpKey, error) {
+	k := &srtpKey{
+		profile: srtp.ProtectionProfileAes128CmHmacSha1_80,
+		key:     make([]byte, 16),
+		salt:    make([]byte, 14),
+	}
+	if _, err := rand.Read(k.key); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(k.salt); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// 创建带重放保护的解密上下文
+func (k *srtpKey) decryptContext() (*srtp.Context, error) {
+	return srtp.CreateContext(k.key, k.salt, k.profile,
+		srtp.SRTPReplayProtection(srtpReplayWindow), srtp.SRTCPReplayProtection(srtpReplayWindow))
+}
+
+// 加密套件的主密钥和盐的长度
+func suiteKeyLen(suite string) (profile srtp.ProtectionProfile, keyLen, saltLen int, ok bool) {
+	switch suite {
+	case suiteAesCm128HmacSha1_80:
+		return srtp.ProtectionProfileAes128CmHmacSha1_80, 16, 14, true
+	case suiteAeadAes128Gcm:
+		return srtp.ProtectionProfileAeadAes128Gcm, 16, 12, true
+	}
+	return 0, 0, 0, false
+}
+
+// 解析 SDES 的 crypto 属性，如：1 AES_CM_128_HMAC_SHA1_80 inline:<base64(key||salt)>|2^31
+func parseCryptoAttribute(value string) (*srtpKey, error) {
+	fields := strings.Fields(value)
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("illegal crypto attribute '%s'", value)
+	}
+	profile, keyLen, saltLen, ok := suiteKeyLen(fields[1])
+	if !ok {
+		return nil, fmt.Errorf("crypto suite '%s' is not supported", fields[1])
+	}
+
+	// 多个密钥参数时使用第一个
+	param := strings.SplitN(fields[2], ";", 2)[0]
+	if !strings.HasPrefix(param, "inline:") {
+		return nil, fmt.Errorf("illegal crypto attribute '%s'", value)
+	}
+	inline := strings.SplitN(param[len("inline:"):], "|", 2)[0]
+	keySalt, err := base64.StdEncoding.DecodeString(inline)
+	if err != nil {
+		return nil, err
+	}
+	if len(keySalt) != keyLen+saltLen {
+		return nil, fmt.Errorf("illegal crypto key length %d", len(keySalt))
+	}
+	return &srtpKey{profile: profile, key: keySalt[:keyLen], salt: keySalt[keyLen:]}, nil
+}
+
+// 解析 key-mgmt 属性，如：mikey <base64>
+func parseKeyMgmtAttribute(value string) (*srtpKey, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 2 || !strings.EqualFold(fields[0], "mikey") {
+		return nil, fmt.Errorf("key-mgmt '%s' is not supported", value)
+	}
+	data, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return nil, err
+	}
+	return parseMikey(data)
+}
+
+// 获取安全媒体的 SRTP 密钥；
+// 服务器在 sdp 中提供(SDES 或 MIKEY)时使用服务器的密钥，
+// 否则由客户端生成，offer 为 true，需要在 SETUP 时通过 KeyMgmt 发送给服务器
+func srtpKeyOf(session *sdp.Session, media *sdp.Media) (key *srtpKey, offer bool, err error) {
+	var lastErr error
+	for _, attr := range media.Attributes {
+		if attr.Name != "crypto" {
+			continue
+		}
+		if key, lastErr = parseCryptoAttribute(attr.Value); lastErr == nil {
+			return key, false, nil
+		}
+	}
+	if lastErr != nil {
+		return nil, false, lastErr
+	}
+
+	keyMgmt := media.Attributes.Get("key-mgmt")
+	if keyMgmt == "" {
+		keyMgmt = session.Attributes.Get("key-mgmt")
+	}
+	if keyMgmt != "" {
+		key, err = parseKeyMgmtAttribute(keyMgmt)
+		return key, false, err
+	}
+
+	key, err = newSrtpKey()
+	return key, true, err
+}
+
+// 转换为明文 RTP 的 sdp，去掉密钥信息
+func plainSdp(rawSdp string) string {
+	lines := strings.Split(rawSdp, "\n")
+	plain := lines[:0]
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "a=crypto:") || strings.HasPrefix(trimmed, "a=key-mgmt:") {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "m=") {
+			line = strings.Replace(line, " RTP/SAVP", " RTP/AVP", 1)
+		}
+		plain = append(plain, line)
+	}
+	return strings.Join(plain, "\n")
+}
+
+// 生成 MIKEY 消息：预共享密钥方式，密钥数据不加密(连接已由 TLS 保护)，
+// 使用 AES_CM_128_HMAC_SHA1_80
+func marshalMikey(k *srtpKey) []byte {
+	buf := make([]byte, 0, 128)
+
+	// HDR: version, data type(PSK init), next payload, V/PRF, CSB ID,
+	// #CS, CS ID map type(SRTP-ID), CS map(policy, SSRC, ROC)
+	csbID := make([]byte, 4)
+	rand.Read(csbID)
+	buf = append(buf, 1, 0, mikeyPayloadT, 0)
+	buf = append(buf, csbID...)
+	buf = append(buf, 1, 0)
+	buf = append(buf, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+
+	// T: NTP-UTC
+	buf = append(buf, mikeyPayloadRAND, 0)
+	buf = appendUint64(buf, ntpTime(time.Now()))
+
+	// RAND
+	random := make([]byte, 16)
+	rand.Read(random)
+	buf = append(buf, mikeyPayloadSP, byte(len(random)))
+	buf = append(buf, random...)
+
+	// SP: SRTP 安全策略
+	params := []byte{
+		0, 1, 1, // 加密算法 AES-CM
+		1, 1, byte(len(k.key)), // 会话加密密钥长度
+		2, 1, 1, // 认证算法 HMAC-SHA-1
+		3, 1, 20, // 会话认证密钥长度
+		4, 1, byte(len(k.salt)), // 会话盐长度
+		5, 1, 0, // SRTP PRF AES-CM
+		7, 1, 1, // SRTP 加密
+		8, 1, 1, // SRTCP 加密
+		10, 1, 1, // SRTP 认证
+		11, 1, 10, // 认证标签长度
+	}
+	buf = append(buf, mikeyPayloadKEMAC, 0, 0)
+	buf = appendUint16(buf, uint16(len(params)))
+	buf = append(buf, params...)
+
+	// KEMAC: 不加密，不认证；Key data: TEK+SALT
+	keyData := []byte{mikeyPayloadLast, 3 << 4}
+	keyData = appendUint16(keyData, uint16(len(k.key)))
+	keyData = append(keyData, k.key...)
+	keyData = appendUint16(keyData, uint16(len(k.salt)))
+	keyData = append(keyData, k.salt...)
+	buf = append(buf, mikeyPayloadLast, 0)
+	buf = appendUint16(buf, uint16(len(keyData)))
+	buf = append(buf, keyData...)
+	buf = append(buf, 0) // MAC 算法 NULL
+	return buf
+}
+
+// 解析 MIKEY 消息，只支持不加密的密钥数据
+func parseMikey(data []byte) (*srtpKey, error) {
+	if len(data) < 10 || data[0] != 1 || data[9] != 0 { // 只支持 SRTP-ID 映射
+		return nil, errMikeyIllegal
+	}
+	next := data[2]
+	offset := 10 + int(data[8])*9
+
+	var key *srtpKey
+	encAlg, tagLen := byte(1), byte(10) // 默认 AES-CM 和 80 位认证标签
+	for next != mikeyPayloadLast {
+		if offset+2 > len(data) {
+			return nil, errMikeyIllegal
+		}
+		p := data[offset:]
+
+		var size int
+		switch next {
+		case mikeyPayloadKEMAC:
+			if len(p) < 4 {
+				return nil, errMikeyIllegal
+			}
+			if p[1] != 0 {
+				return nil, errMikeyEncrypted
+			}
+			n := int(binary.BigEndian.Uint16(p[2:]))
+			if len(p) < 4+n+1 {
+				return nil, errMikeyIllegal
+			}
+			var err error
+			if key, err = parseMikeyKeyData(p[4 : 4+n]); err != nil {
+				return nil, err
+			}
+			size = 4 + n + 1
+			if p[4+n] == 1 { // HMAC-SHA-1
+				size += 20
+			}
+		case mikeyPayloadT:
+			size = 2 + 8
+			if p[1] == 2 { // COUNTER
+				size = 2 + 4
+			}
+		case mikeyPayloadRAND:
+			size = 2 + int(p[1])
+		case mikeyPayloadSP:
+			if len(p) < 5 {
+				return nil, errMikeyIllegal
+			}
+			n := int(binary.BigEndian.Uint16(p[3:]))
+			if len(p) < 5+n {
+				return nil, errMikeyIllegal
+			}
+			for params := p[5 : 5+n]; len(params) >= 3; {
+				l := int(params[1])
+				if len(params) < 2+l {
+					return nil, errMikeyIllegal
+				}
+				if l == 1 {
+					switch params[0] {
+					case 0:
+						encAlg = params[2]
+					case 11:
+						tagLen = params[2]
+					}
+				}
+				params = params[2+l:]
+			}
+			size = 5 + n
+		case mikeyPayloadID:
+			if len(p) < 4 {
+				return nil, errMikeyIllegal
+			}
+			size = 4 + int(binary.BigEndian.Uint16(p[2:]))
+		case mikeyPayloadV:
+			size = 2
+			if p[1] == 1 {
+				size += 20
+			}
+		default:
+			return nil, fmt.Errorf("mikey payload %d is not supported", next)
+		}
+
+		if offset+size > len(data) {
+			return nil, errMikeyIllegal
+		}
+		next = p[0]
+		offset += size
+	}
+
+	if key == nil {
+		return nil, errMikeyIllegal
+	}
+
+	// 根据安全策略选择加密套件
+	var suite string
+	switch {
+	case encAlg == 1 && tagLen == 10:
+		suite = suiteAesCm128HmacSha1_80
+	case encAlg == 6:
+		suite = suiteAeadAes128Gcm
+	default:
+		return nil, errSrtpSuiteUnknown
+	}
+	profile, keyLen, saltLen, _ := suiteKeyLen(suite)
+	if len(key.key) != keyLen || len(key.salt) != saltLen {
+		return nil, errMikeyIllegal
+	}
+	key.profile = profile
+	return key, nil
+}
+
+// 解析 KEMAC 中的第一个 TEK 密钥数据
+func parseMikeyKeyData(p []byte) (*srtpKey, error) {
+	if len(p) < 4 {
+		return nil, errMikeyIllegal
+	}
+
+	keyType := p[1] >> 4
+	if keyType != 2 && keyType != 3 { // TEK 或 TEK+SALT
+		return nil, errMikeyIllegal
+	}
+	n := int(binary.BigEndian.Uint16(p[2:]))
+	if len(p) < 4+n {
+		return nil, errMikeyIllegal
+	}
+	key := &srtpKey{key: p[4 : 4+n]}
+	p = p[4+n:]
+
+	if keyType == 3 {
+		if len(p) < 2 {
+			return nil, errMikeyIllegal
+		}
+		n = int(binary.BigEndian.Uint16(p))
+		if len(p) < 2+n {
+			return nil, errMikeyIllegal
+		}
+		key.salt = p[2 : 2+n]
+	}
+	return key, nil
+}
+
+// NTP 时间戳
+func ntpTime(t time.Time) uint64 {
+	const ntpEpochOffset = 2208988800 // 1900 年到 1970 年的秒数
+	secs := uint64(t.Unix()) + ntpEpochOffset
+	frac := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return secs<<32 | frac
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var tmp [8]byte
+	binary.BigEndian.PutUint64(tmp[:], v)
+	return append(b, tmp[:]...)
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package rtsp
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cnotch/ipchub/media"
+	"github.com/cnotch/xlog"
+	pionrtp "github.com/pion/rtp"
+	"github.com/pion/srtp/v2"
+	"github.com/pixelbender/go-sdp/sdp"
+	"github.com/stretchr/testify/assert"
+)
+
+const sdpSrtp = `v=0
+o=- 0 0 IN IP4 127.0.0.1
+s=No Name
+t=0 0
+m=video 0 RTP/SAVP 96
+a=rtpmap:96 H264/90000
+a=crypto:1 AES_CM_128_HMAC_SHA1_32 inline:WVNfX19zZW1jdGwgKCkgewkyMjA7fQp9CnVubGVz|2^20
+a=crypto:2 AES_CM_128_HMAC_SHA1_80 inline:d0RmdmcmVCspeEc3QGZiNWpVLFJhQX1cfHAwJSoj|2^20|1:4
+a=control:streamid=0
+m=audio 0 RTP/SAVP 97
+a=rtpmap:97 PCMA/8000
+a=control:streamid=1
+`
+
+func TestSrtpKeyOf(t *testing.T) {
+	session, err := sdp.ParseString(sdpSrtp)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// SDES，跳过不支持的套件
+	key, offer, err := srtpKeyOf(session, session.Media[0])
+	if assert.NoError(t, err) {
+		assert.False(t, offer)
+		assert.Equal(t, srtp.ProtectionProfileAes128CmHmacSha1_80, key.profile)
+		assert.Equal(t, "wDfvg&T+)xG7@fb5", string(key.key))
+	}
+
+	// 服务器未提供，由客户端生成
+	key, offer, err = srtpKeyOf(session, session.Media[1])
+	if assert.NoError(t, err) {
+		assert.True(t, offer)
+		assert.Equal(t, 16, len(key.key))
+		assert.Equal(t, 14, len(key.salt))
+	}
+
+	_, err = parseCryptoAttribute("1 AES_CM_128_HMAC_SHA1_80 inline:d0Rm")
+	assert.Error(t, err)
+}
+
+func TestMikey(t *testing.T) {
+	key, _ := newSrtpKey()
+	data := marshalMikey(key)
+
+	parsed, err := parseMikey(data)
+	if assert.NoError(t, err) {
+		assert.Equal(t, key, parsed)
+	}
+
+	// 截断的消息
+	for i := 0; i < len(data); i++ {
+		_, err = parseMikey(data[:i])
+		assert.Error(t, err, i)
+	}
+
+	// 密钥数据加密
+	encrypted := append([]byte(nil), data...)
+	encrypted[bytes.LastIndex(data, key.key)-7] = 1
+	_, err = parseMikey(encrypted)
+	assert.Equal(t, errMikeyEncrypted, err)
+}
+
+func TestPlainSdp(t *testing.T) {
+	plain := plainSdp(strings.Replace(sdpSrtp, "\n", "\r\n", -1))
+	assert.NotContains(t, plain, "SAVP")
+	assert.NotContains(t, plain, "a=crypto")
+	assert.Contains(t, plain, "m=video 0 RTP/AVP 96\r\n")
+	assert.Contains(t, plain, "a=control:streamid=1\r\n")
+}
+
+func TestSrtpDecrypt(t *testing.T) {
+	key, _ := newSrtpKey()
+	encryptor, _ := srtp.CreateContext(key.key, key.salt, key.profile)
+	decryptor, _ := key.decryptContext()
+
+	stream := media.NewStream("/live/srtp", sdpRaw)
+	defer stream.Close()
+	client := &PullClient{stream: stream, logger: xlog.L()}
+	client.srtp[ChannelVideo] = decryptor
+
+	counter := &packetCounter{}
+	stream.StartConsume(counter, media.RTPPacket, "test")
+
+	var payloads [][]byte
+	for seq := uint16(0); seq < 3; seq++ {
+		plain, _ := (&pionrtp.Packet{
+			Header:  pionrtp.Header{Version: 2, PayloadType: 96, SequenceNumber: seq, SSRC: 1},
+			Payload: []byte{0x41, 0x9a, byte(seq)},
+		}).Marshal()
+		encrypted, err := encryptor.EncryptRTP(nil, plain, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		p := &RTPPack{Channel: ChannelVideo, Data: encrypted}
+		p.Header.Unmarshal(encrypted)
+		assert.NoError(t, client.onPack(p))
+		payloads = append(payloads, p.Payload())
+
+		// 重放的包被丢弃
+		replay := &RTPPack{Channel: ChannelVideo, Data: encrypted}
+		replay.Header.Unmarshal(encrypted)
+		assert.NoError(t, client.onPack(replay))
+	}
+
+	assert.Equal(t, [][]byte{{0x41, 0x9a, 0}, {0x41, 0x9a, 1}, {0x41, 0x9a, 2}}, payloads)
+	for i := 0; i < 50 && counter.count() < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 3, counter.count())
+}
@@ -0,0 +1,447 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package rtsp
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cnotch/ipchub/config"
+	"github.com/cnotch/ipchub/provider/security"
+	"github.com/cnotch/xlog"
+	"github.com/kelindar/tcp"
+)
+
+// RTSP over HTTP 隧道(Apple QuickTime 规范)：
+// 客户端用 GET 连接接收 RTSP 响应和 RTP 数据，用 POST 连接发送 base64 编码的 RTSP 请求，
+// 两个连接由相同的 x-sessioncookie 关联
+const (
+	tunnelContentType  = "application/x-rtsp-tunnelled"
+	tunnelCookieHeader = "x-sessioncookie"
+)
+
+// TunnelHandler 创建支持 RTSP over HTTP 隧道的 http.Handler，非隧道请求交由 next 处理；
+// 隧道建立后作为 RTSP 连接交给 onAccept
+func TunnelHandler(onAccept tcp.OnAccept, next http.Handler) http.Handler {
+	return &tunnelHandler{
+		logger:   xlog.L(),
+		onAccept: onAccept,
+		next:     next,
+		tunnels:  make(map[string]*tunnelConn),
+	}
+}
+
+type tunnelHandler struct {
+	logger   *xlog.Logger
+	onAccept tcp.OnAccept
+	next     http.Handler
+
+	lock    sync.Mutex
+	tunnels map[string]*tunnelConn // 等待或已经建立的隧道
+}
+
+func (h *tunnelHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cookie := r.Header.Get(tunnelCookieHeader)
+	switch {
+	case cookie == "":
+		h.next.ServeHTTP(w, r)
+	case r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), tunnelContentType):
+		h.onGet(cookie, w)
+	case r.Method == http.MethodPost && strings.HasPrefix(r.Header.Get("Content-Type"), tunnelContentType):
+		h.onPost(cookie, w, r)
+	default:
+		h.next.ServeHTTP(w, r)
+	}
+}
+
+// GET 连接，用于向客户端发送数据
+func (h *tunnelHandler) onGet(cookie string, w http.ResponseWriter) {
+	h.lock.Lock()
+	_, exists := h.tunnels[cookie]
+	h.lock.Unlock()
+	if exists {
+		http.Error(w, "session cookie already in use", http.StatusConflict)
+		return
+	}
+
+	conn, rw, err := hijack(w)
+	if err != nil {
+		h.logger.Errorf("rtsp tunnel: hijack GET connection failed; %v", err)
+		return
+	}
+
+	rw.WriteString("HTTP/1.0 200 OK\r\n" +
+		"Server: " + config.Name + "\r\n" +
+		"Connection: close\r\n" +
+		"Cache-Control: no-store\r\n" +
+		"Pragma: no-cache\r\n" +
+		"Content-Type: " + tunnelContentType + "\r\n\r\n")
+	if err = rw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+
+	tc := &tunnelConn{
+		Conn:    conn,
+		handler: h,
+		cookie:  cookie,
+		posts:   make(chan *tunnelPost, 1),
+		closed:  make(chan struct{}),
+	}
+
+	h.lock.Lock()
+	if _, exists = h.tunnels[cookie]; exists {
+		h.lock.Unlock()
+		conn.Close()
+		return
+	}
+	h.tunnels[cookie] = tc
+	h.lock.Unlock()
+
+	// 超时未收到 POST 连接
+	time.AfterFunc(config.NetTimeout(), func() {
+		h.lock.Lock()
+		accepted := tc.accepted
+		h.lock.Unlock()
+		if !accepted {
+			tc.Close()
+		}
+	})
+}
+
+// POST 连接，用于接收客户端的请求；客户端可以关闭 POST 连接后用相同的 cookie 重新发起
+func (h *tunnelHandler) onPost(cookie string, w http.ResponseWriter, r *http.Request) {
+	h.lock.Lock()
+	tc := h.tunnels[cookie]
+	h.lock.Unlock()
+	if tc == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	conn, rw, err := hijack(w)
+	if err != nil {
+		h.logger.Errorf("rtsp tunnel: hijack POST connection failed; %v", err)
+		return
+	}
+
+	post := &tunnelPost{conn: conn, reader: newBase64Reader(rw.Reader)}
+	select {
+	case tc.posts <- post:
+	case <-tc.closed:
+		conn.Close()
+		return
+	}
+
+	h.lock.Lock()
+	accepted := tc.accepted
+	tc.accepted = true
+	h.lock.Unlock()
+	if !accepted {
+		h.onAccept(tc)
+	}
+}
+
+func (h *tunnelHandler) remove(tc *tunnelConn) {
+	h.lock.Lock()
+	if h.tunnels[tc.cookie] == tc {
+		delete(h.tunnels, tc.cookie)
+	}
+	h.lock.Unlock()
+}
+
+func hijack(w http.ResponseWriter) (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T is not a http.Hijacker", w)
+	}
+	return hj.Hijack()
+}
+
+type tunnelPost struct {
+	conn   net.Conn
+	reader io.Reader
+}
+
+// tunnelConn 服务端隧道连接，向 GET 连接写入，从 POST 连接读取
+type tunnelConn struct {
+	net.Conn // GET 连接
+	handler  *tunnelHandler
+	cookie   string
+	accepted bool // 已收到 POST 连接，由 handler.lock 保护
+
+	posts     chan *tunnelPost
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	lock         sync.Mutex
+	post         *tunnelPost // 当前的 POST 连接
+	readDeadline time.Time
+}
+
+func (c *tunnelConn) Read(p []byte) (int, error) {
+	for {
+		post, err := c.currentPost()
+		if err != nil {
+			return 0, err
+		}
+
+		n, err := post.reader.Read(p)
+		if err == io.EOF { // POST 连接关闭，等待新的 POST 连接
+			c.lock.Lock()
+			if c.post == post {
+				c.post = nil
+			}
+			c.lock.Unlock()
+			post.conn.Close()
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+// 获取当前的 POST 连接，没有时等待直到读超时
+func (c *tunnelConn) currentPost() (*tunnelPost, error) {
+	c.lock.Lock()
+	post, deadline := c.post, c.readDeadline
+	c.lock.Unlock()
+	if post != nil {
+		return post, nil
+	}
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case post = <-c.posts:
+	case <-c.closed:
+		return nil, io.EOF
+	case <-timeout:
+		return nil, errTunnelTimeout
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	select {
+	case <-c.closed:
+		post.conn.Close()
+		return nil, io.EOF
+	default:
+	}
+	c.post = post
+	post.conn.SetReadDeadline(c.readDeadline)
+	return post, nil
+}
+
+func (c *tunnelConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.handler.remove(c)
+		close(c.closed)
+		c.Conn.Close()
+
+		c.lock.Lock()
+		if c.post != nil {
+			c.post.conn.Close()
+		}
+		c.lock.Unlock()
+
+		// 关闭还未读取的 POST 连接
+		select {
+		case post := <-c.posts:
+			post.conn.Close()
+		default:
+		}
+	})
+	return nil
+}
+
+func (c *tunnelConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *tunnelConn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.readDeadline = t
+	if c.post != nil {
+		return c.post.conn.SetReadDeadline(t)
+	}
+	return nil
+}
+
+// 等待 POST 连接超时的错误，实现 net.Error
+type tunnelTimeoutError struct{}
+
+func (tunnelTimeoutError) Error() string   { return "rtsp tunnel: wait for POST connection timeout" }
+func (tunnelTimeoutError) Timeout() bool   { return true }
+func (tunnelTimeoutError) Temporary() bool { return true }
+
+var errTunnelTimeout net.Error = tunnelTimeoutError{}
+
+// base64Reader 解码 POST 连接的数据；
+// 客户端每次发送的请求单独编码，因此填充字符可能出现在数据中间，需要按 4 个字符一组解码
+type base64Reader struct {
+	r    io.Reader
+	in   [1024]byte
+	quad [4]byte
+	n    int // quad 中的字符数
+	buf  []byte
+	out  []byte // 已解码未读取的数据
+}
+
+func newBase64Reader(r io.Reader) *base64Reader {
+	return &base64Reader{r: r}
+}
+
+func (d *base64Reader) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		n, err := d.r.Read(d.in[:])
+		if derr := d.decode(d.in[:n]); derr != nil {
+			return 0, derr
+		}
+		// 有数据时忽略错误，下次读取时底层连接会再次返回
+		if len(d.out) == 0 && err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+func (d *base64Reader) decode(src []byte) error {
+	var tmp [3]byte
+	d.buf = d.buf[:0]
+	d.out = nil
+	for _, b := range src {
+		if b == '\r' || b == '\n' || b == ' ' || b == '\t' {
+			continue
+		}
+		d.quad[d.n] = b
+		d.n++
+		if d.n < 4 {
+			continue
+		}
+
+		d.n = 0
+		n, err := base64.StdEncoding.Decode(tmp[:], d.quad[:])
+		if err != nil {
+			return err
+		}
+		d.buf = append(d.buf, tmp[:n]...)
+	}
+	d.out = d.buf
+	return nil
+}
+
+// 建立到 HTTP 服务器的隧道，uri 为 GET 和 POST 请求的路径
+func dialTunnel(host, uri string, timeout time.Duration) (net.Conn, error) {
+	cookie := security.NewID().MD5()
+	deadline := time.Now().Add(timeout)
+
+	getConn, err := net.DialTimeout("tcp", host, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	getConn.SetDeadline(deadline)
+	_, err = fmt.Fprintf(getConn, "GET %s HTTP/1.0\r\n"+
+		"User-Agent: %s\r\n"+
+		"%s: %s\r\n"+
+		"Accept: %s\r\n"+
+		"Pragma: no-cache\r\n"+
+		"Cache-Control: no-cache\r\n\r\n",
+		uri, defaultUserAgent, tunnelCookieHeader, cookie, tunnelContentType)
+	if err != nil {
+		getConn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReaderSize(getConn, config.NetBufferSize())
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		getConn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		getConn.Close()
+		return nil, fmt.Errorf("rtsp tunnel: GET status '%s'", resp.Status)
+	}
+	getConn.SetDeadline(time.Time{})
+
+	postConn, err := net.DialTimeout("tcp", host, time.Until(deadline))
+	if err != nil {
+		getConn.Close()
+		return nil, err
+	}
+
+	// 内容长度使用一个足够大的值，实际由隧道的生命周期决定
+	_, err = fmt.Fprintf(postConn, "POST %s HTTP/1.0\r\n"+
+		"User-Agent: %s\r\n"+
+		"%s: %s\r\n"+
+		"Content-Type: %s\r\n"+
+		"Pragma: no-cache\r\n"+
+		"Cache-Control: no-cache\r\n"+
+		"Content-Length: 32767\r\n"+
+		"Expires: Sun, 9 Jan 1972 00:00:00 GMT\r\n\r\n",
+		uri, defaultUserAgent, tunnelCookieHeader, cookie, tunnelContentType)
+	if err != nil {
+		getConn.Close()
+		postConn.Close()
+		return nil, err
+	}
+
+	return &tunnelClientConn{Conn: getConn, reader: reader, post: postConn}, nil
+}
+
+// tunnelClientConn 客户端隧道连接，从 GET 连接读取，向 POST 连接写入 base64 编码的数据
+type tunnelClientConn struct {
+	net.Conn // GET 连接
+	reader   *bufio.Reader
+	post     net.Conn
+}
+
+func (c *tunnelClientConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *tunnelClientConn) Write(p []byte) (int, error) {
+	buf := make([]byte, base64.StdEncoding.EncodedLen(len(p)))
+	base64.StdEncoding.Encode(buf, p)
+	if _, err := c.post.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *tunnelClientConn) Close() error {
+	c.post.Close()
+	return c.Conn.Close()
+}
+
+func (c *tunnelClientConn) SetDeadline(t time.Time) error {
+	c.post.SetWriteDeadline(t)
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *tunnelClientConn) SetWriteDeadline(t time.Time) error {
+	return c.post.SetWriteDeadline(t)
+}
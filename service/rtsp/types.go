@@ -23,7 +23,7 @@ var (
 // Request .
 type Request = rtsp.Request
 
-//Response .
+// Response .
 type Response = rtsp.Response
 
 // Header .
@@ -34,10 +34,12 @@ type RTPPack = rtp.Packet
 
 const (
 	rtpPackPrefix    = rtp.TransferPrefix
-	rtspProto        = "RTSP/1.0" // RTSP协议版本
-	rtspURLPrefix    = "rtsp://"  // RTSP地址前缀
-	basicAuthPrefix  = "Basic "   // 用户基础验证前缀
-	digestAuthPrefix = "Digest "  // 摘要认证前缀
+	rtspProto        = "RTSP/1.0"     // RTSP协议版本
+	rtspURLPrefix    = "rtsp://"      // RTSP地址前缀
+	rtspsURLPrefix   = "rtsps://"     // RTSP over TLS 地址前缀
+	tunnelURLPrefix  = "rtsp+http://" // RTSP over HTTP 隧道地址前缀
+	basicAuthPrefix  = "Basic "       // 用户基础验证前缀
+	digestAuthPrefix = "Digest "      // 摘要认证前缀
 )
 
 // 预定义 RTP 包类型
@@ -95,6 +97,7 @@ const (
 	FieldExpires           = rtsp.FieldExpires           // (e:opt.:DESCRIBE, ANNOUNCE)
 	FieldFrom              = rtsp.FieldFrom              // (R:opt.:all)
 	FieldIfModifiedSince   = rtsp.FieldIfModifiedSince   // (R:opt.:DESCRIBE, SETUP)
+	FieldKeyMgmt           = rtsp.FieldKeyMgmt           // (R:opt.:SETUP; RFC 4567)
 	FieldLastModified      = rtsp.FieldLastModified      // (e:opt.:entity)
 	FieldProxyAuthenticate = rtsp.FieldProxyAuthenticate //
 	FieldProxyRequire      = rtsp.FieldProxyRequire      // (R:req.:all)
@@ -21,7 +21,11 @@ import (
 	"github.com/cnotch/ipchub/network/socket/listener"
 	"github.com/cnotch/ipchub/provider/auth"
 	"github.com/cnotch/ipchub/provider/route"
+	"github.com/cnotch/ipchub/record"
+	"github.com/cnotch/ipchub/service/rtmp"
 	"github.com/cnotch/ipchub/service/rtsp"
+	"github.com/cnotch/ipchub/service/srt"
+	_ "github.com/cnotch/ipchub/service/ts" // 注册 mpegts 拉流工厂
 	"github.com/cnotch/ipchub/service/wsp"
 	"github.com/cnotch/scheduler"
 	"github.com/cnotch/xlog"
@@ -37,7 +41,9 @@ type Service struct {
 	tlsusing bool
 	http     *http.Server
 	rtsp     *tcp.Server
+	rtmp     *tcp.Server
 	wsp      *tcp.Server
+	srt      *srt.Server
 	tokens   *auth.TokenManager
 }
 
@@ -50,6 +56,7 @@ func NewService(ctx context.Context, l *xlog.Logger) (s *Service, err error) {
 		logger:  l,
 		http:    new(http.Server),
 		rtsp:    new(tcp.Server),
+		rtmp:    new(tcp.Server),
 		wsp:     new(tcp.Server),
 		tokens:  new(auth.TokenManager),
 	}
@@ -77,10 +84,13 @@ func NewService(ctx context.Context, l *xlog.Logger) (s *Service, err error) {
 
 	s.initApis(mux)
 	s.initHTTPStreams(mux)
-	s.http.Handler = mux
 
 	// 设置 rtsp AcceptHandler
 	s.rtsp.OnAccept = rtsp.CreateAcceptHandler()
+	// RTSP over HTTP 隧道复用 http 端口
+	s.http.Handler = rtsp.TunnelHandler(s.rtsp.OnAccept, mux)
+	// 设置 rtmp AcceptHandler
+	s.rtmp.OnAccept = rtmp.CreateAcceptHandler()
 	// 设置 wsp AcceptHandler
 	s.wsp.OnAccept = wsp.CreateAcceptHandler()
 	// 启动定时存储拉流信息
@@ -89,6 +99,12 @@ func NewService(ctx context.Context, l *xlog.Logger) (s *Service, err error) {
 		auth.Flush()
 		s.tokens.ExpCheck()
 	}, "The task of scheduled storage of routing tables and authorization information tables(5minutes")
+	// 根据路由定时启动录像，以便录制匹配通配路由的新上线流
+	scheduler.PeriodFunc(0, time.Second*10, record.SyncRoutes,
+		"The task of starting recordings for routes with the record option(10seconds)")
+	// 定时按保留策略删除最早的录像
+	scheduler.PeriodFunc(time.Minute, time.Minute, record.EnforceRetention,
+		"The task of removing recording files according to the retention policy(1minute)")
 
 	s.logger.Info("service configured")
 	return s, nil
@@ -119,6 +135,15 @@ func (s *Service) Listen() (err error) {
 		}
 	}
 
+	// srt
+	if srtconf := config.GetSRTConfig(); srtconf != nil && srtconf.ListenAddr != "" {
+		s.logger.Infof("starting the srt listener, addr = %s.", srtconf.ListenAddr)
+		if s.srt, err = srt.Listen(srtconf, s.logger); err != nil {
+			s.logger.Panic(err.Error())
+		}
+		go s.srt.Serve()
+	}
+
 	s.logger.Infof("service started(v%s).", config.Version)
 	s.logger = xlog.L()
 	// Block
@@ -147,6 +172,7 @@ func (s *Service) listen(addr *net.TCPAddr, conf *tls.Config) {
 
 	// Configure the matchers
 	l.ServeAsync(rtsp.MatchRTSP(), s.rtsp.Serve)
+	l.ServeAsync(rtmp.MatchRTMP(), s.rtmp.Serve)
 	l.ServeAsync(listener.MatchHTTP(), s.http.Serve)
 	go l.Serve()
 }
@@ -163,6 +189,12 @@ func (s *Service) Close() {
 		job.Cancel()
 	}
 
+	if s.srt != nil {
+		s.srt.Close()
+	}
+
+	// 停止录像，关闭录像文件
+	record.StopAll()
 	// 清空注册
 	media.UnregistAll()
 	// 退出前确保最新数据被存储
@@ -0,0 +1,155 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package srt
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cnotch/ipchub/av/format/mpegts"
+	"github.com/cnotch/ipchub/media"
+	"github.com/cnotch/ipchub/service/ts"
+	"github.com/cnotch/ipchub/stats"
+	"github.com/cnotch/xlog"
+	gosrt "github.com/datarhei/gosrt"
+)
+
+// 每个 SRT 载荷包含的 ts 包数
+const tsPacketsPerPayload = 7
+
+// packetWriter 缓存 ts 包，凑足一个 SRT 载荷后发送
+type packetWriter struct {
+	w   io.Writer
+	buf [tsPacketsPerPayload * 188]byte
+	n   int
+}
+
+func (pw *packetWriter) Write(p []byte) (n int, err error) {
+	n = len(p)
+	for len(p) > 0 {
+		m := copy(pw.buf[pw.n:], p)
+		pw.n += m
+		p = p[m:]
+		if pw.n == len(pw.buf) {
+			if err = pw.Flush(); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// Flush 发送缓存的 ts 包
+func (pw *packetWriter) Flush() (err error) {
+	if pw.n > 0 {
+		_, err = pw.w.Write(pw.buf[:pw.n])
+		pw.n = 0
+	}
+	return
+}
+
+// tsPlayer 播放，media.Stream -> mpegts.Frame -> SRT
+type tsPlayer struct {
+	logger  *xlog.Logger
+	conn    gosrt.Conn
+	stream  *media.Stream
+	packets packetWriter
+	w       *mpegts.Writer
+
+	l      sync.Mutex
+	cid    media.CID
+	closed int32
+}
+
+// Consume implements media.Consumer
+func (p *tsPlayer) Consume(pack media.Pack) {
+	if atomic.LoadInt32(&p.closed) != 0 {
+		return
+	}
+
+	// 每帧发送一次，避免帧数据滞留在缓存中
+	err := p.w.WriteMpegtsFrame(pack.(*mpegts.Frame))
+	if err == nil {
+		err = p.packets.Flush()
+	}
+
+	if err != nil {
+		p.logger.Errorf("srt: send ts failed; %v", err)
+		p.Close()
+	}
+}
+
+// Close implements media.Consumer
+func (p *tsPlayer) Close() error {
+	if !atomic.CompareAndSwapInt32(&p.closed, 0, 1) {
+		return nil
+	}
+
+	p.l.Lock()
+	cid := p.cid
+	p.l.Unlock()
+	if cid != 0 {
+		p.stream.StopConsume(cid)
+	}
+	// 流已关闭或发送失败，断开播放连接
+	p.conn.Close()
+	stats.SrtConns.Release()
+	p.logger.Info("srt: player closed")
+	return nil
+}
+
+// 处理播放连接
+func servePlayer(logger *xlog.Logger, conn gosrt.Conn, path string) {
+	addr := conn.RemoteAddr().String()
+	logger = logger.With(xlog.Fields(
+		xlog.F("path", path), xlog.F("addr", addr),
+		xlog.F("type", "player")))
+
+	stream := media.GetOrCreate(path)
+	if stream == nil {
+		logger.Errorf("srt: not found stream '%s'", path)
+		conn.Close()
+		return
+	}
+
+	stats.SrtConns.Add()
+	p := &tsPlayer{
+		logger: logger,
+		conn:   conn,
+		stream: stream,
+	}
+	p.packets.w = conn
+
+	var err error
+	p.w, err = mpegts.NewWriter(&p.packets, mpegts.VideoStreamType(stream.Video.Codec))
+	if err == nil {
+		err = p.packets.Flush()
+	}
+	if err != nil {
+		logger.Errorf("srt: send ts header failed; %v", err)
+		p.Close()
+		return
+	}
+
+	p.l.Lock()
+	p.cid = stream.StartConsume(p, media.TSPacket, "net=srt,"+addr)
+	cid := p.cid
+	p.l.Unlock()
+	if cid == 0 {
+		logger.Error("srt: stream has no mpegts output")
+		p.Close()
+		return
+	}
+
+	// 播放端不发送数据，读取只用于检测连接断开
+	buf := make([]byte, ts.ReadBufferSize)
+	for {
+		if _, err := conn.Read(buf); err != nil {
+			break
+		}
+	}
+	p.Close()
+}
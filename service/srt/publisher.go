@@ -0,0 +1,35 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package srt
+
+import (
+	"io"
+
+	"github.com/cnotch/ipchub/service/ts"
+	"github.com/cnotch/ipchub/stats"
+	"github.com/cnotch/xlog"
+	gosrt "github.com/datarhei/gosrt"
+)
+
+// 处理推流连接，mpegts -> codec.Frame -> media.Stream
+func servePublisher(logger *xlog.Logger, conn gosrt.Conn, path string) {
+	addr := conn.RemoteAddr().String()
+	logger = logger.With(xlog.Fields(
+		xlog.F("path", path), xlog.F("addr", addr),
+		xlog.F("type", "pusher")))
+
+	stats.SrtConns.Add()
+	defer stats.SrtConns.Release()
+
+	p := ts.NewPublisher(path, addr, logger)
+	err := p.Receive(conn)
+	p.Close()
+	conn.Close()
+
+	if err != io.EOF {
+		logger.Errorf("srt: publish stopped; %v", err)
+	}
+	logger.Info("srt: publisher closed")
+}
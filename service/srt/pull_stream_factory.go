@@ -0,0 +1,78 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package srt
+
+import (
+	"io"
+	"strings"
+
+	"github.com/cnotch/ipchub/config"
+	"github.com/cnotch/ipchub/media"
+	"github.com/cnotch/ipchub/service/ts"
+	"github.com/cnotch/ipchub/stats"
+	"github.com/cnotch/xlog"
+	gosrt "github.com/datarhei/gosrt"
+)
+
+const srtURLPrefix = "srt://"
+
+func init() {
+	// 注册拉流工厂
+	media.RegistPullStreamFactory(NewPullStreamFacotry())
+}
+
+type pullStreamFactory struct {
+}
+
+// NewPullStreamFacotry 创建 SRT 拉流工厂(caller 模式)，
+// 远端地址如 srt://host:port?streamid=live/door&passphrase=xxx&latency=200
+func NewPullStreamFacotry() media.PullStreamFactory {
+	return &pullStreamFactory{}
+}
+
+func (f *pullStreamFactory) Can(remoteURL string) bool {
+	return len(remoteURL) >= len(srtURLPrefix) &&
+		strings.EqualFold(remoteURL[:len(srtURLPrefix)], srtURLPrefix)
+}
+
+func (f *pullStreamFactory) Create(localPath, remoteURL string) (*media.Stream, error) {
+	conf := gosrt.DefaultConfig()
+	addr, err := conf.UnmarshalURL(remoteURL)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := gosrt.Dial("srt", addr, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	logger := xlog.L().With(xlog.Fields(
+		xlog.F("path", localPath), xlog.F("rurl", remoteURL),
+		xlog.F("type", "puller")))
+	p := ts.NewPublisher(localPath, conn.RemoteAddr().String(), logger)
+
+	// 等待流就绪
+	if err = p.WaitStream(conn, config.NetTimeout()); err != nil {
+		p.Close()
+		conn.Close()
+		return nil, err
+	}
+
+	stats.SrtConns.Add()
+	stream := p.Stream()
+	go func() {
+		defer stats.SrtConns.Release()
+
+		err := p.Receive(conn)
+		p.Close()
+		conn.Close()
+		if err != io.EOF {
+			logger.Errorf("srt: pull stopped; %v", err)
+		}
+		logger.Info("srt: puller closed")
+	}()
+	return stream, nil
+}
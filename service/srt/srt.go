@@ -0,0 +1,181 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package srt
+
+import (
+	"net"
+	"strings"
+
+	"github.com/cnotch/ipchub/config"
+	"github.com/cnotch/ipchub/media"
+	"github.com/cnotch/ipchub/provider/auth"
+	"github.com/cnotch/ipchub/utils"
+	"github.com/cnotch/xlog"
+	gosrt "github.com/datarhei/gosrt"
+)
+
+// srt 连接模式
+const (
+	modeRequest = "request" // 播放
+	modePublish = "publish" // 推流
+)
+
+// streamID 解析后的 SRT Stream ID
+type streamID struct {
+	path     string
+	mode     string
+	username string
+	password string
+}
+
+// 解析 SRT Stream ID，支持访问控制语法 "#!::r=live/door,m=publish,u=admin,s=password"，
+// 其中 s 作为用户密码；其他格式整体作为流路径并以播放模式处理
+func parseStreamID(sid string) (id streamID) {
+	id.mode = modeRequest
+	const prefix = "#!::"
+	if !strings.HasPrefix(sid, prefix) {
+		id.path = utils.CanonicalPath(sid)
+		return
+	}
+
+	for _, kv := range strings.Split(sid[len(prefix):], ",") {
+		i := strings.IndexByte(kv, '=')
+		if i < 0 {
+			continue
+		}
+		value := kv[i+1:]
+		switch kv[:i] {
+		case "r":
+			id.path = value
+		case "m":
+			id.mode = strings.ToLower(value)
+		case "u":
+			id.username = value
+		case "s":
+			id.password = value
+		}
+	}
+	id.path = utils.CanonicalPath(id.path)
+	return
+}
+
+// Server SRT 服务，接收推流(publish)和播放(request)连接
+type Server struct {
+	logger *xlog.Logger
+	conf   *config.SRTConfig
+	ln     gosrt.Listener
+}
+
+// Listen 在配置的 UDP 地址上侦听 SRT 连接
+func Listen(conf *config.SRTConfig, logger *xlog.Logger) (*Server, error) {
+	srtConf := gosrt.DefaultConfig()
+	srtConf.ReceiverLatency = conf.LatencyDuration()
+	srtConf.PeerLatency = conf.LatencyDuration()
+
+	ln, err := gosrt.Listen("srt", conf.ListenAddr, srtConf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Server{
+		logger: logger,
+		conf:   conf,
+		ln:     ln,
+	}, nil
+}
+
+// Addr 侦听地址
+func (s *Server) Addr() net.Addr {
+	return s.ln.Addr()
+}
+
+// Serve 接受连接，直到服务关闭
+func (s *Server) Serve() {
+	for {
+		var id streamID
+		conn, mode, err := s.ln.Accept(func(req gosrt.ConnRequest) gosrt.ConnType {
+			id = parseStreamID(req.StreamId())
+			return s.accept(req, &id)
+		})
+		if err != nil {
+			if err != gosrt.ErrListenerClosed {
+				s.logger.Errorf("srt: accept failed; %v", err)
+			}
+			return
+		}
+		if conn == nil { // 已拒绝
+			continue
+		}
+
+		if mode == gosrt.PUBLISH {
+			go servePublisher(s.logger, conn, id.path)
+		} else {
+			go servePlayer(s.logger, conn, id.path)
+		}
+	}
+}
+
+// 检查加密和权限，决定连接的模式
+func (s *Server) accept(req gosrt.ConnRequest, id *streamID) gosrt.ConnType {
+	logger := s.logger.With(xlog.Fields(
+		xlog.F("path", id.path), xlog.F("mode", id.mode),
+		xlog.F("addr", req.RemoteAddr().String())))
+
+	if s.conf.Passphrase != "" {
+		if !req.IsEncrypted() || req.SetPassphrase(s.conf.Passphrase) != nil {
+			logger.Warn("srt: passphrase mismatch")
+			return gosrt.REJECT
+		}
+	} else if req.IsEncrypted() {
+		logger.Warn("srt: encryption is not configured")
+		return gosrt.REJECT
+	}
+
+	var right auth.AccessRight
+	var mode gosrt.ConnType
+	switch id.mode {
+	case modePublish:
+		right, mode = auth.PushRight, gosrt.PUBLISH
+	case modeRequest:
+		right, mode = auth.PullRight, gosrt.SUBSCRIBE
+	default:
+		logger.Warnf("srt: unsupport mode '%s'", id.mode)
+		return gosrt.REJECT
+	}
+
+	if id.path == "/" {
+		logger.Warn("srt: stream path is empty")
+		return gosrt.REJECT
+	}
+
+	if !checkPermission(id, right) {
+		logger.Warn("srt: authorization failed")
+		return gosrt.REJECT
+	}
+
+	if mode == gosrt.SUBSCRIBE && media.GetOrCreate(id.path) == nil {
+		logger.Warn("srt: stream not found")
+		return gosrt.REJECT
+	}
+	return mode
+}
+
+func checkPermission(id *streamID, right auth.AccessRight) bool {
+	if !config.Auth() {
+		return true
+	}
+
+	user := auth.Get(id.username)
+	if user == nil || user.ValidatePassword(id.password) != nil {
+		return false
+	}
+	return user.ValidatePermission(id.path, right)
+}
+
+// Close 关闭服务，已建立的连接不受影响
+func (s *Server) Close() error {
+	s.ln.Close()
+	return nil
+}
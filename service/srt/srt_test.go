@@ -0,0 +1,183 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package srt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cnotch/ipchub/av/codec"
+	"github.com/cnotch/ipchub/av/format/mpegts"
+	"github.com/cnotch/ipchub/av/format/mpegts/mpegtstest"
+	"github.com/cnotch/ipchub/config"
+	"github.com/cnotch/ipchub/media"
+	"github.com/cnotch/ipchub/service/ts"
+	"github.com/cnotch/xlog"
+	gosrt "github.com/datarhei/gosrt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseStreamID(t *testing.T) {
+	tests := []struct {
+		sid  string
+		want streamID
+	}{
+		{"live/door", streamID{path: "/live/door", mode: modeRequest}},
+		{"/Live/Door", streamID{path: "/live/door", mode: modeRequest}},
+		{"#!::r=live/door,m=publish", streamID{path: "/live/door", mode: modePublish}},
+		{"#!::m=request,r=/live/door,u=admin,s=123", streamID{"/live/door", modeRequest, "admin", "123"}},
+		{"#!::u=admin", streamID{path: "/", mode: modeRequest, username: "admin"}},
+		{"", streamID{path: "/", mode: modeRequest}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sid, func(t *testing.T) {
+			assert.Equal(t, tt.want, parseStreamID(tt.sid))
+		})
+	}
+}
+
+type frameCollector chan *codec.Frame
+
+func (c frameCollector) WriteFrame(frame *codec.Frame) error {
+	select {
+	case c <- frame:
+	default:
+	}
+	return nil
+}
+
+// 本地 SRT 推流和播放
+func TestPublishAndPlay(t *testing.T) {
+	const path = "/live/srt"
+	server, err := Listen(&config.SRTConfig{ListenAddr: "127.0.0.1:0"}, xlog.L())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer server.Close()
+	go server.Serve()
+	addr := server.Addr().String()
+
+	// 流不存在时拒绝播放
+	conf := gosrt.DefaultConfig()
+	conf.StreamId = "live/none"
+	_, err = gosrt.Dial("srt", addr, conf)
+	assert.Error(t, err)
+
+	conf.StreamId = "#!::r=live/srt,m=publish"
+	pconn, err := gosrt.Dial("srt", addr, conf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer pconn.Close()
+
+	packets := &packetWriter{w: pconn}
+	src, err := mpegtstest.NewSource(packets)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// 周期推送帧，直到测试结束
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			if src.WriteFrames() != nil || packets.Flush() != nil {
+				return
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(40 * time.Millisecond):
+			}
+		}
+	}()
+
+	// 等待流注册
+	var stream *media.Stream
+	timeout := time.After(10 * time.Second)
+	for stream == nil {
+		select {
+		case <-timeout:
+			t.Fatal("wait for stream timeout")
+		case <-time.After(20 * time.Millisecond):
+			stream = media.Get(path)
+		}
+	}
+	assert.Equal(t, "H264", stream.Video.Codec)
+	assert.Equal(t, "AAC", stream.Audio.Codec)
+
+	conf.StreamId = "live/srt"
+	sconn, err := gosrt.Dial("srt", addr, conf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer sconn.Close()
+
+	var video codec.VideoMeta
+	var audio codec.AudioMeta
+	frames := make(frameCollector, 16)
+	demuxer := mpegts.NewDemuxer(&video, &audio, frames)
+	go func() {
+		buf := make([]byte, ts.ReadBufferSize)
+		for {
+			n, err := sconn.Read(buf)
+			if err != nil {
+				return
+			}
+			demuxer.Write(buf[:n])
+		}
+	}()
+
+	select {
+	case frame := <-frames:
+		assert.NotEmpty(t, frame.Payload)
+	case <-time.After(10 * time.Second):
+		t.Fatal("wait for played frames timeout")
+	}
+
+	// caller 模式拉流
+	pulled, err := NewPullStreamFacotry().Create("/live/srtpull", "srt://"+addr+"?streamid=live/srt")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "H264", pulled.Video.Codec)
+		assert.Equal(t, pulled, media.Get("/live/srtpull"))
+		media.Unregist(pulled)
+	}
+
+	// 推流端断开，流随之注销
+	pconn.Close()
+	timeout = time.After(10 * time.Second)
+	for media.Get(path) != nil {
+		select {
+		case <-timeout:
+			t.Fatal("wait for stream unregist timeout")
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+}
+
+func TestPassphrase(t *testing.T) {
+	server, err := Listen(&config.SRTConfig{ListenAddr: "127.0.0.1:0", Passphrase: "0123456789"}, xlog.L())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer server.Close()
+	go server.Serve()
+	addr := server.Addr().String()
+
+	conf := gosrt.DefaultConfig()
+	conf.StreamId = "#!::r=live/secret,m=publish"
+	_, err = gosrt.Dial("srt", addr, conf)
+	assert.Error(t, err)
+
+	conf.Passphrase = "9876543210"
+	_, err = gosrt.Dial("srt", addr, conf)
+	assert.Error(t, err)
+
+	conf.Passphrase = "0123456789"
+	conn, err := gosrt.Dial("srt", addr, conf)
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+}
@@ -6,14 +6,19 @@ package service
 
 import (
 	"net/http"
+	"net/url"
 	"path"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/cnotch/ipchub/config"
 	"github.com/cnotch/ipchub/network/websocket"
 	"github.com/cnotch/ipchub/provider/auth"
+	"github.com/cnotch/ipchub/service/dash"
 	"github.com/cnotch/ipchub/service/flv"
 	"github.com/cnotch/ipchub/service/hls"
+	"github.com/cnotch/ipchub/service/rtc"
 
 	"github.com/cnotch/apirouter"
 	"github.com/cnotch/ipchub/utils/scan"
@@ -55,7 +60,7 @@ func (s *Service) onWebSocketRequest(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// streams 请求处理(websocket connect,flv,mu38,ts)
+// streams 请求处理(websocket connect,flv,mu38,ts,m4s,mpd,m4v,m4a,whep,whip)
 func (s *Service) onStreamsRequest(w http.ResponseWriter, r *http.Request) {
 	// 检测 websocket 请求
 	if r.Method == "GET" &&
@@ -73,10 +78,41 @@ func (s *Service) onStreamsRequest(w http.ResponseWriter, r *http.Request) {
 	case ".flv":
 		flv.ConsumeByHTTP(s.logger, streamPath, r.RemoteAddr, w)
 	case ".m3u8":
-		token := r.URL.Query().Get("token")
-		hls.GetM3u8(s.logger, streamPath, token, r.RemoteAddr, w)
+		query := r.URL.Query()
+		token := query.Get("token")
+		if query.Get("start") != "" { // 录像回放
+			s.onVodM3u8(streamPath, token, query, w, r)
+			return
+		}
+		fmp4 := query.Get("format") == "fmp4"
+		msn, part := queryIndex(query, "_HLS_msn"), queryIndex(query, "_HLS_part")
+		hls.GetM3u8(s.logger, streamPath, token, fmp4, msn, part, r.RemoteAddr, w)
 	case ".ts":
+		if seg := r.URL.Query().Get("seg"); seg != "" { // 录像回放片段
+			nsec, err := strconv.ParseInt(seg, 10, 64)
+			if err != nil {
+				http.Error(w, "Invalid seg", http.StatusBadRequest)
+				return
+			}
+			hls.GetVodTS(s.logger, streamPath, time.Unix(0, nsec), r.RemoteAddr, w)
+			return
+		}
 		hls.GetTS(s.logger, streamPath, r.RemoteAddr, w)
+	case ".m4s":
+		hls.GetM4s(s.logger, streamPath, r.RemoteAddr, w)
+	case ".mp4":
+		hls.GetInitSegment(s.logger, streamPath, r.RemoteAddr, w)
+	case ".mpd":
+		token := r.URL.Query().Get("token")
+		dash.GetMpd(s.logger, streamPath, token, r.RemoteAddr, w)
+	case ".m4v":
+		dash.GetVideoSegment(s.logger, streamPath, r.RemoteAddr, w)
+	case ".m4a":
+		dash.GetAudioSegment(s.logger, streamPath, r.RemoteAddr, w)
+	case ".whep":
+		rtc.ServeWHEP(s.logger, streamPath, w, r)
+	case ".whip":
+		rtc.ServeWHIP(s.logger, streamPath, w, r)
 	default:
 		s.logger.Warnf("request file ext is not supported: %s.", ext)
 		http.NotFound(w, r)
@@ -90,6 +126,18 @@ func (s *Service) streamInterceptor(w http.ResponseWriter, r *http.Request) bool
 		return false
 	}
 
+	if r.Method == http.MethodOptions {
+		// CORS 预检请求不带认证信息：WHEP/WHIP 由 rtc 应答，其他直接应答，不访问流
+		if _, ext := extractStreamPathAndExt(r.URL.Path); ext == ".whep" || ext == ".whip" {
+			return true
+		}
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization")
+		w.WriteHeader(http.StatusNoContent)
+		return false
+	}
+
 	if !config.Auth() {
 		// 不启用媒体流访问验证
 		return true
@@ -102,14 +150,18 @@ func (s *Service) streamInterceptor(w http.ResponseWriter, r *http.Request) bool
 	return false
 }
 
-// 验证用户是否有权限播放指定的流
+// 验证用户是否有权限播放指定的流，WHIP 推流验证推流权限
 func permissionInterceptor(w http.ResponseWriter, r *http.Request) bool {
 	userName := r.Header.Get(usernameHeaderKey)
 	u := auth.Get(userName)
 
-	streamPath, _ := extractStreamPathAndExt(r.URL.Path)
+	streamPath, ext := extractStreamPathAndExt(r.URL.Path)
+	right := auth.PullRight
+	if ext == ".whip" {
+		right = auth.PushRight
+	}
 
-	if u == nil || !u.ValidatePermission(streamPath, auth.PullRight) {
+	if u == nil || !u.ValidatePermission(streamPath, right) {
 		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
 		return false
 	}
@@ -117,6 +169,41 @@ func permissionInterceptor(w http.ResponseWriter, r *http.Request) bool {
 	return true
 }
 
+// 获取查询参数中的非负整数，不存在或无效时返回 -1
+func queryIndex(query url.Values, key string) int {
+	v, err := strconv.Atoi(query.Get(key))
+	if err != nil || v < 0 {
+		return -1
+	}
+	return v
+}
+
+// 录像回放的播放列表，start、end 为 RFC3339 时间或 Unix 时间戳(秒)，end 默认为当前时间
+func (s *Service) onVodM3u8(streamPath, token string, query url.Values, w http.ResponseWriter, r *http.Request) {
+	start, err := queryTime(query, "start")
+	if err != nil {
+		http.Error(w, "Invalid start", http.StatusBadRequest)
+		return
+	}
+	end := time.Now()
+	if query.Get("end") != "" {
+		if end, err = queryTime(query, "end"); err != nil || !end.After(start) {
+			http.Error(w, "Invalid end", http.StatusBadRequest)
+			return
+		}
+	}
+	hls.GetVodM3u8(s.logger, streamPath, token, start, end, r.RemoteAddr, w)
+}
+
+// 获取查询参数中的时间，支持 RFC3339 格式或 Unix 时间戳(秒)
+func queryTime(query url.Values, key string) (time.Time, error) {
+	v := query.Get(key)
+	if sec, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
 // 提取请求路径中的流path和格式后缀
 func extractStreamPathAndExt(requestPath string) (streamPath, ext string) {
 	ext = path.Ext(requestPath)
@@ -0,0 +1,87 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ts
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"github.com/cnotch/ipchub/av/format/mpegts"
+	"github.com/cnotch/ipchub/media"
+	"github.com/cnotch/xlog"
+)
+
+// ReadBufferSize 读取 ts 流的缓冲大小，不小于最大的 UDP 包
+const ReadBufferSize = 64 * 1024
+
+var errWaitTimeout = errors.New("wait for mpegts stream timeout")
+
+// Publisher 推流，mpegts -> codec.Frame -> media.Stream
+//
+// 流的创建、注册和元数据变化时的替换见 media.FramePublisher。方法不是并发安全的。
+type Publisher struct {
+	*media.FramePublisher
+	demuxer *mpegts.Demuxer
+}
+
+// NewPublisher 创建 ts 推流，addr 作为流的来源地址属性
+func NewPublisher(path, addr string, logger *xlog.Logger) *Publisher {
+	// PMT 已确定节目中是否有视频，只有音频时无需等待
+	p := &Publisher{
+		FramePublisher: media.NewFramePublisher("mpegts", path, addr, 0, logger),
+	}
+	p.demuxer = mpegts.NewDemuxer(&p.Video, &p.Audio, p.FramePublisher)
+	p.SetDemuxer(p.demuxer)
+	return p
+}
+
+// Write 写入 ts 流数据
+func (p *Publisher) Write(b []byte) (int, error) {
+	return p.demuxer.Write(b)
+}
+
+// Discontinue 标记 ts 流不连续，之后的时间戳接续在已输出的帧之后
+func (p *Publisher) Discontinue() error {
+	return p.demuxer.Discontinue()
+}
+
+// WaitStream 从 r 读取 ts 流直到流就绪；超时未就绪时关闭 r 并返回错误
+func (p *Publisher) WaitStream(r io.ReadCloser, timeout time.Duration) error {
+	timer := time.AfterFunc(timeout, func() { r.Close() })
+	buf := make([]byte, ReadBufferSize)
+	for p.Stream() == nil {
+		n, err := r.Read(buf)
+		if n > 0 {
+			_, err = p.Write(buf[:n])
+		}
+		if err != nil {
+			if !timer.Stop() {
+				err = errWaitTimeout
+			}
+			return err
+		}
+	}
+	if !timer.Stop() {
+		return errWaitTimeout
+	}
+	return nil
+}
+
+// Receive 从 r 读取 ts 流，直到读取失败或流被关闭
+func (p *Publisher) Receive(r io.Reader) error {
+	buf := make([]byte, ReadBufferSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, err := p.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ts
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cnotch/ipchub/config"
+	"github.com/cnotch/ipchub/media"
+	"github.com/cnotch/xlog"
+)
+
+// UDP 接收缓冲大小，避免码率较高时丢包
+const udpReadBuffer = 2 * 1024 * 1024
+
+// 只限制等待响应头的时间，响应体是持续的 ts 流
+var httpClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		ResponseHeaderTimeout: config.NetTimeout(),
+	},
+}
+
+func init() {
+	// 注册拉流工厂
+	media.RegistPullStreamFactory(NewPullStreamFacotry())
+}
+
+type pullStreamFactory struct {
+}
+
+// NewPullStreamFacotry 创建 MPEG-TS 拉流工厂，支持组播 udp://239.0.0.1:1234?iface=eth0(iface 可选)、
+// 单播 udp://:1234(在本地端口接收) 和 http(s)://host/live/test.ts
+func NewPullStreamFacotry() media.PullStreamFactory {
+	return &pullStreamFactory{}
+}
+
+func (f *pullStreamFactory) Can(remoteURL string) bool {
+	u, err := url.Parse(remoteURL)
+	if err != nil {
+		return false
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "udp":
+		return true
+	case "http", "https":
+		return strings.HasSuffix(strings.ToLower(u.Path), ".ts")
+	}
+	return false
+}
+
+func (f *pullStreamFactory) Create(localPath, remoteURL string) (*media.Stream, error) {
+	u, err := url.Parse(remoteURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var r io.ReadCloser
+	var addr string
+	if strings.EqualFold(u.Scheme, "udp") {
+		r, addr, err = openUDP(u)
+	} else {
+		r, addr, err = openHTTP(remoteURL)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	logger := xlog.L().With(xlog.Fields(
+		xlog.F("path", localPath), xlog.F("rurl", remoteURL),
+		xlog.F("type", "puller")))
+	p := NewPublisher(localPath, addr, logger)
+
+	// 等待流就绪
+	if err = p.WaitStream(r, config.NetTimeout()); err != nil {
+		p.Close()
+		r.Close()
+		return nil, err
+	}
+
+	stream := p.Stream()
+	go func() {
+		err := p.Receive(r)
+		p.Close()
+		r.Close()
+		if err != io.EOF {
+			logger.Errorf("mpegts: pull stopped; %v", err)
+		}
+		logger.Info("mpegts: puller closed")
+	}()
+	return stream, nil
+}
+
+func openHTTP(remoteURL string) (io.ReadCloser, string, error) {
+	resp, err := httpClient.Get(remoteURL)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, "", fmt.Errorf("mpegts: http status '%s'", resp.Status)
+	}
+	return resp.Body, resp.Request.URL.Host, nil
+}
+
+func openUDP(u *url.URL) (io.ReadCloser, string, error) {
+	laddr, err := net.ResolveUDPAddr("udp", u.Host)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var conn *net.UDPConn
+	if laddr.IP != nil && laddr.IP.IsMulticast() {
+		var ifi *net.Interface
+		if name := u.Query().Get("iface"); name != "" {
+			if ifi, err = net.InterfaceByName(name); err != nil {
+				return nil, "", err
+			}
+		}
+		conn, err = net.ListenMulticastUDP("udp", ifi, laddr)
+	} else {
+		conn, err = net.ListenUDP("udp", laddr)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	conn.SetReadBuffer(udpReadBuffer)
+	return &udpReader{conn: conn}, laddr.String(), nil
+}
+
+// udpReader 读取 UDP 包中的 ts 流，超时未收到数据时返回错误
+type udpReader struct {
+	conn *net.UDPConn
+}
+
+func (r *udpReader) Read(p []byte) (int, error) {
+	r.conn.SetReadDeadline(time.Now().Add(config.NetTimeout()))
+	n, _, err := r.conn.ReadFromUDP(p)
+	if err != nil {
+		return 0, err
+	}
+	return stripRtpHeader(p[:n]), nil
+}
+
+func (r *udpReader) Close() error {
+	return r.conn.Close()
+}
+
+// 部分编码器使用 RTP 封装 ts(RTP/MP2T)，去掉 RTP 头后返回 ts 数据的长度
+func stripRtpHeader(p []byte) int {
+	const fixedHeaderSize = 12
+	if len(p) <= fixedHeaderSize || p[0]&0xc0 != 0x80 {
+		return len(p) // 不是 RTP 版本 2
+	}
+
+	size := fixedHeaderSize + int(p[0]&0x0f)*4 // CSRC
+	if p[0]&0x10 != 0 && len(p) >= size+4 {    // 扩展头
+		size += 4 + (int(p[size+2])<<8|int(p[size+3]))*4
+	}
+	if size >= len(p) || p[size] != 0x47 {
+		return len(p)
+	}
+	return copy(p, p[size:])
+}
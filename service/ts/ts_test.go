@@ -0,0 +1,136 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ts
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cnotch/ipchub/av/format/mpegts/mpegtstest"
+	"github.com/cnotch/ipchub/media"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPullStreamFactory_Can(t *testing.T) {
+	f := NewPullStreamFacotry()
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"udp://239.0.0.1:1234", true},
+		{"UDP://:1234", true},
+		{"http://localhost/live/test.ts", true},
+		{"https://localhost/live/test.TS?token=1", true},
+		{"http://localhost/live/test.flv", false},
+		{"http://localhost/live/test.m3u8", false},
+		{"rtsp://localhost/live/test.ts", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, f.Can(tt.url), tt.url)
+	}
+}
+
+func TestStripRtpHeader(t *testing.T) {
+	ts := append([]byte{0x47, 1, 2}, make([]byte, 185)...)
+	assert.Equal(t, len(ts), stripRtpHeader(append([]byte(nil), ts...)))
+
+	rtp := append([]byte{0x80, 33, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1}, ts...)
+	n := stripRtpHeader(rtp)
+	assert.Equal(t, ts, rtp[:n])
+
+	// 带 CSRC 和扩展头
+	rtp = append([]byte{0x91, 33, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1,
+		0, 0, 0, 2, // CSRC
+		0xbe, 0xde, 0, 1, 0, 0, 0, 0}, ts...) // 扩展头
+	n = stripRtpHeader(rtp)
+	assert.Equal(t, ts, rtp[:n])
+}
+
+func TestPullHTTP(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/live/test.ts" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "video/mp2t")
+		src, _ := mpegtstest.NewSource(w)
+		for {
+			src.WriteFrames()
+			w.(http.Flusher).Flush()
+			select {
+			case <-done:
+				return
+			case <-r.Context().Done():
+				return
+			case <-time.After(40 * time.Millisecond):
+			}
+		}
+	}))
+	defer server.Close()
+
+	stream, err := NewPullStreamFacotry().Create("/live/httpts", server.URL+"/live/test.ts")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "H264", stream.Video.Codec)
+	assert.Equal(t, "AAC", stream.Audio.Codec)
+	assert.Equal(t, stream, media.Get("/live/httpts"))
+	media.Unregist(stream)
+
+	_, err = NewPullStreamFacotry().Create("/live/httpts", server.URL+"/live/none.ts")
+	assert.Error(t, err)
+}
+
+func TestPullUDP(t *testing.T) {
+	// 获取一个空闲的端口
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if !assert.NoError(t, err) {
+		return
+	}
+	addr := conn.LocalAddr().String()
+	conn.Close()
+
+	// 周期发送 RTP 封装的 ts
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		sender, err := net.Dial("udp", addr)
+		if err != nil {
+			return
+		}
+		defer sender.Close()
+
+		var buf bytes.Buffer
+		src, _ := mpegtstest.NewSource(&buf)
+		var seq uint16
+		for {
+			src.WriteFrames()
+			for buf.Len() > 0 {
+				seq++
+				pkt := []byte{0x80, 33, byte(seq >> 8), byte(seq), 0, 0, 0, 0, 0, 0, 0, 1}
+				sender.Write(append(pkt, buf.Next(7*188)...))
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(40 * time.Millisecond):
+			}
+		}
+	}()
+
+	stream, err := NewPullStreamFacotry().Create("/live/udpts", "udp://"+addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "H264", stream.Video.Codec)
+	assert.Equal(t, "AAC", stream.Audio.Codec)
+	media.Unregist(stream)
+}
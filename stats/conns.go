@@ -11,8 +11,11 @@ import (
 // 全局变量
 var (
 	RtspConns = NewConns() // RTSP连接统计
+	RtmpConns = NewConns() // RTMP连接统计
 	FlvConns  = NewConns() // flv连接统计
 	WspConns  = NewConns() // WSP连接统计
+	RtcConns  = NewConns() // WebRTC连接统计
+	SrtConns  = NewConns() // SRT连接统计
 )
 
 // ConnsSample 连接计数采样
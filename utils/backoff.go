@@ -0,0 +1,52 @@
+// Copyright (c) 2019,CAOHONGJU All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package utils
+
+import (
+	"math/rand"
+	"time"
+)
+
+// 退避的默认时间
+const (
+	defaultBackoffMin = time.Second
+	defaultBackoffMax = time.Second * 30
+)
+
+// Backoff 带随机抖动的指数退避，零值使用默认的 1 秒到 30 秒
+type Backoff struct {
+	Min     time.Duration // 初始等待时间
+	Max     time.Duration // 最大等待时间
+	current time.Duration
+}
+
+// Next 返回下一次重试前的等待时间；
+// 基准时间每次加倍直到 Max，返回值在基准时间的 [1/2, 1] 之间随机
+func (b *Backoff) Next() time.Duration {
+	min, max := b.Min, b.Max
+	if min <= 0 {
+		min = defaultBackoffMin
+	}
+	if max < min {
+		max = defaultBackoffMax
+		if max < min {
+			max = min
+		}
+	}
+
+	if b.current < min {
+		b.current = min
+	} else if b.current *= 2; b.current > max {
+		b.current = max
+	}
+
+	half := b.current / 2
+	return half + time.Duration(rand.Int63n(int64(b.current-half)+1))
+}
+
+// Reset 重置为初始等待时间
+func (b *Backoff) Reset() {
+	b.current = 0
+}